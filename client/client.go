@@ -0,0 +1,278 @@
+// Package client connects to a chat server as a program rather than a
+// person: it logs in with JSON framing and then sends and receives frames.
+// Conn is one connection; package clientlib wraps it in a Session that
+// calls handlers and logs in again when the connection drops.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Options says who to log in as.
+type Options struct {
+	Name     string
+	Password string // for registered names
+	Invite   string // for invite-only servers
+	Code     string // for accounts with two-factor login on
+
+	// Token from an earlier connection's session frame, to resume its
+	// session if the server still holds it; otherwise the login is a new
+	// one
+	Resume string
+
+	// Capabilities to ask the server for, like protocol.CAPABILITY_COLOR
+	Capabilities []string
+}
+
+// ErrPasswordRequired is returned by Dial when the name is registered and
+// no password was given.
+var ErrPasswordRequired = errors.New("name is registered and needs a password")
+
+// ErrCodeRequired is returned by Dial when the account has two-factor
+// login on and no code was given. Codes only work once, so reconnecting
+// takes a new one unless the session is resumed.
+var ErrCodeRequired = errors.New("account has two-factor login on and needs a code")
+
+// LoginError is returned by Dial when the server refuses the login. Trying
+// again with the same options won't help.
+type LoginError struct {
+	Reason string
+}
+
+func (err *LoginError) Error() string {
+	return err.Reason
+}
+
+// Conn is a logged-in connection to a chat server. Receive should be called
+// from one goroutine; Send and its helpers can be called from any.
+type Conn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	pending      *protocol.Frame
+	capabilities []string
+	resumed      bool
+
+	mutex sync.Mutex // serializes writes
+}
+
+// Dial connects to addr and logs in. It fails if the server refuses the
+// login, for example because the name is taken or the password is wrong.
+func Dial(ctx context.Context, addr string, options Options) (*Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Conn{conn: conn, reader: bufio.NewReader(conn)}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := client.login(options); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return client, nil
+}
+
+// login asks for JSON framing and answers the server's prompts. The first
+// frame that isn't part of the login is kept for Receive.
+func (client *Conn) login(options Options) error {
+	if err := client.Send(protocol.Frame{Type: protocol.FRAME_HELLO, Capabilities: options.Capabilities}); err != nil {
+		return err
+	}
+
+	// Everything up to the server's hello is the text prompt it sent
+	// before it knew we wanted frames.
+	for {
+		frame, err := client.readFrame()
+		if err != nil {
+			return err
+		}
+		if frame.Type == protocol.FRAME_HELLO {
+			client.capabilities = frame.Capabilities
+			break
+		}
+	}
+
+	resume := options.Resume
+	for {
+		frame, err := client.readFrame()
+		if err != nil {
+			return err
+		}
+
+		switch frame.Type {
+		case protocol.FRAME_ERROR:
+			// The session is gone, so log in as usual
+			if client.resumed {
+				client.resumed = false
+				continue
+			}
+			return &LoginError{Reason: frame.Body}
+		case protocol.FRAME_PROMPT:
+			var answer string
+			prompt := strings.ToLower(frame.Body)
+			switch {
+			case resume != "":
+				answer, resume, client.resumed = "/resume "+resume, "", true
+			case strings.HasPrefix(prompt, "invite"):
+				answer = options.Invite
+			case strings.HasPrefix(prompt, "password"):
+				if options.Password == "" {
+					return ErrPasswordRequired
+				}
+				answer = options.Password
+			case strings.HasPrefix(prompt, "code"):
+				if options.Code == "" {
+					return ErrCodeRequired
+				}
+				answer = options.Code
+			default:
+				answer = options.Name
+			}
+			if err := client.Send(protocol.Frame{Type: protocol.FRAME_CHAT, Body: answer}); err != nil {
+				return err
+			}
+		default:
+			client.pending = &frame
+			return nil
+		}
+	}
+}
+
+// readFrame reads the next frame, skipping anything that isn't one, such
+// as telnet echo or the text prompt in front of the server's hello.
+func (client *Conn) readFrame() (protocol.Frame, error) {
+	for {
+		line, err := client.reader.ReadString('\n')
+		if err != nil {
+			return protocol.Frame{}, err
+		}
+		start := strings.IndexByte(line, '{')
+		if start < 0 {
+			continue
+		}
+		if frame, err := protocol.Parse(line[start:]); err == nil {
+			return frame, nil
+		}
+	}
+}
+
+// Receive returns the next frame from the server. Pings are answered and
+// not returned.
+func (client *Conn) Receive() (protocol.Frame, error) {
+	if client.pending != nil {
+		frame := *client.pending
+		client.pending = nil
+		return frame, nil
+	}
+	for {
+		frame, err := client.readFrame()
+		if err != nil {
+			return protocol.Frame{}, err
+		}
+		if frame.Type == protocol.FRAME_PING {
+			if err := client.Send(protocol.Frame{Type: protocol.FRAME_PONG, Body: frame.Body}); err != nil {
+				return protocol.Frame{}, err
+			}
+			continue
+		}
+		return frame, nil
+	}
+}
+
+// Resumed reports whether the login resumed the session in
+// Options.Resume.
+func (client *Conn) Resumed() bool {
+	return client.resumed
+}
+
+// HasCapability reports whether the server turned on a capability the
+// client asked for.
+func (client *Conn) HasCapability(capability string) bool {
+	return slices.Contains(client.capabilities, capability)
+}
+
+// Send writes one frame.
+func (client *Conn) Send(frame protocol.Frame) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	_, err := client.conn.Write(protocol.Encode(frame))
+	return err
+}
+
+// Say sends a chat message to the current room. A leading slash is sent
+// as text, not run as a command.
+func (client *Conn) Say(text string) error {
+	if strings.HasPrefix(text, "/") {
+		text = "/" + text
+	}
+	return client.Send(protocol.Frame{Type: protocol.FRAME_CHAT, Body: text})
+}
+
+// Typing tells the room the user is typing. The server passes on at most
+// one of these every few seconds, so it is fine to call on every keystroke.
+func (client *Conn) Typing() error {
+	return client.Send(protocol.Frame{Type: protocol.FRAME_TYPING})
+}
+
+// Edit changes a message the user sent, by the ID in its frame.
+func (client *Conn) Edit(id, text string) error {
+	return client.Send(protocol.Frame{Type: protocol.FRAME_EDIT, ID: id, Body: text})
+}
+
+// Delete removes a message the user sent.
+func (client *Conn) Delete(id string) error {
+	return client.Send(protocol.Frame{Type: protocol.FRAME_DELETE, ID: id})
+}
+
+// React adds an emoji reaction to a message, or takes it back if the user
+// already reacted with it.
+func (client *Conn) React(id, emoji string) error {
+	return client.Send(protocol.Frame{Type: protocol.FRAME_REACT, ID: id, Body: emoji})
+}
+
+// MarkRead sends a read receipt for a private message, by the ID in its
+// frame. Clients that don't call it never send receipts.
+func (client *Conn) MarkRead(id string) error {
+	return client.Send(protocol.Frame{Type: protocol.FRAME_READ, ID: id})
+}
+
+// SetPresence sets the user's presence: "online", "away", "busy" or
+// "invisible". The reason is shown with away and busy.
+func (client *Conn) SetPresence(presence, reason string) error {
+	if presence == "online" {
+		presence = "back"
+	}
+	return client.Command(strings.TrimSpace("/" + presence + " " + reason))
+}
+
+// Join moves the user to a room, such as "#go", creating it if it doesn't
+// exist.
+func (client *Conn) Join(room string) error {
+	return client.Command("/join " + room)
+}
+
+// Command runs a slash command, such as "/join #go".
+func (client *Conn) Command(line string) error {
+	return client.Send(protocol.Frame{Type: protocol.FRAME_COMMAND, Body: line})
+}
+
+// Close logs out and disconnects, so the server doesn't hold the session
+// for resuming.
+func (client *Conn) Close() error {
+	client.Command("exit")
+	return client.conn.Close()
+}
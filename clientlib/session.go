@@ -0,0 +1,293 @@
+// Package clientlib is a Go library for bots and custom UIs: Connect logs
+// in and returns a Session, which calls handlers as messages, joins and
+// leaves arrive, sends messages and joins rooms, and logs in again when
+// the connection drops. It is built on package client, which speaks the
+// wire protocol one connection at a time.
+package clientlib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/leavedtrait/chat/client"
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Reconnection backoff: the first retry waits RECONNECT_MIN, and each
+// failure doubles the wait up to RECONNECT_MAX.
+const (
+	RECONNECT_MIN = time.Second
+	RECONNECT_MAX = 30 * time.Second
+)
+
+// Options says who to log in as, as for client.Dial.
+type Options = client.Options
+
+// Errors from Connect, and from reconnecting, that a Session can't get
+// past by itself
+var (
+	ErrPasswordRequired = client.ErrPasswordRequired
+	ErrCodeRequired     = client.ErrCodeRequired
+)
+
+// ErrClosed is passed to OnDisconnect, and returned by Err and the send
+// methods, once the session has been closed.
+var ErrClosed = errors.New("session closed")
+
+// ErrDisconnected is returned by the send methods while the session is
+// reconnecting.
+var ErrDisconnected = errors.New("disconnected; reconnecting")
+
+// Handlers are what a Session calls as things happen. They run on the
+// session's goroutine one at a time, so a handler that blocks holds up
+// the rest; any of them can be nil.
+type Handlers struct {
+	// OnConnect is called after each login, reconnections included
+	OnConnect func()
+	// OnMessage gets chat, action and dm frames
+	OnMessage func(frame protocol.Frame)
+	// OnUserJoin and OnUserLeave get who joined or left and the room,
+	// which is "" for the server as a whole
+	OnUserJoin  func(name, room string)
+	OnUserLeave func(name, room string)
+	// OnDisconnect is called when the connection drops, before the
+	// session reconnects, and with ErrClosed when the session is closed
+	OnDisconnect func(err error)
+	// OnFrame gets every other frame: notices, presence, typing and so on
+	OnFrame func(frame protocol.Frame)
+}
+
+// Session is a connection that calls handlers for what arrives and logs
+// in again when it drops, for bots and custom UIs. If the server holds
+// sessions for resuming, reconnecting resumes it, and what was said in the
+// meantime arrives as usual; otherwise the session goes back to the room
+// it was last asked to join.
+type Session struct {
+	addr     string
+	options  Options
+	handlers Handlers
+	cancel   context.CancelFunc
+
+	mutex sync.Mutex
+	conn  *client.Conn // nil while reconnecting
+	room  string       // joined again after reconnecting
+	token string       // from the server's session frame, for resuming
+	err   error        // why the session ended
+
+	done chan struct{}
+}
+
+// Connect logs in to addr and starts the session, which runs until ctx is
+// cancelled or Close is called. It fails if the first login does; later
+// ones are retried until they succeed, unless the name turns out to need
+// a password.
+func Connect(ctx context.Context, addr string, options Options, handlers Handlers) (*Session, error) {
+	conn, err := client.Dial(ctx, addr, options)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	session := &Session{
+		addr:     addr,
+		options:  options,
+		handlers: handlers,
+		cancel:   cancel,
+		conn:     conn,
+		done:     make(chan struct{}),
+	}
+	context.AfterFunc(ctx, func() {
+		if conn := session.current(); conn != nil {
+			conn.Close()
+		}
+	})
+	go session.run(ctx, conn)
+	return session, nil
+}
+
+// run receives from each connection in turn until the session ends.
+func (session *Session) run(ctx context.Context, conn *client.Conn) {
+	defer close(session.done)
+	defer session.cancel()
+	for {
+		if session.handlers.OnConnect != nil {
+			session.handlers.OnConnect()
+		}
+		err := session.receive(conn)
+		conn.Close()
+		session.setConn(nil)
+		if ctx.Err() != nil {
+			err = ErrClosed
+		}
+		if session.handlers.OnDisconnect != nil {
+			session.handlers.OnDisconnect(err)
+		}
+		if ctx.Err() != nil {
+			session.end(ErrClosed)
+			return
+		}
+
+		if conn, err = session.reconnect(ctx); err != nil {
+			session.end(err)
+			return
+		}
+	}
+}
+
+// receive hands frames to the handlers until the connection fails.
+func (session *Session) receive(conn *client.Conn) error {
+	for {
+		frame, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		if frame.Type == protocol.FRAME_SESSION {
+			session.mutex.Lock()
+			session.token = frame.Body
+			session.mutex.Unlock()
+		}
+		handlers := session.handlers
+		switch {
+		case frame.Type == protocol.FRAME_CHAT || frame.Type == protocol.FRAME_ACTION || frame.Type == protocol.FRAME_DM:
+			if handlers.OnMessage != nil {
+				handlers.OnMessage(frame)
+			}
+		case frame.Event == protocol.EVENT_JOIN:
+			if handlers.OnUserJoin != nil {
+				handlers.OnUserJoin(frame.From, frame.Room)
+			}
+		case frame.Event == protocol.EVENT_LEAVE:
+			if handlers.OnUserLeave != nil {
+				handlers.OnUserLeave(frame.From, frame.Room)
+			}
+		default:
+			if handlers.OnFrame != nil {
+				handlers.OnFrame(frame)
+			}
+		}
+	}
+}
+
+// reconnect logs in again, waiting longer after each failure, and
+// resumes the session or rejoins the room. The old connection may still
+// hold the name for a moment, so refused logins are retried too.
+func (session *Session) reconnect(ctx context.Context) (*client.Conn, error) {
+	wait := RECONNECT_MIN
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ErrClosed
+		case <-time.After(wait):
+		}
+
+		options := session.options
+		session.mutex.Lock()
+		options.Resume = session.token
+		session.mutex.Unlock()
+		conn, err := client.Dial(ctx, session.addr, options)
+		if err == nil {
+			session.mutex.Lock()
+			session.conn = conn
+			session.token = ""
+			room := session.room
+			session.mutex.Unlock()
+			// Closing the session from now on closes conn too
+			if ctx.Err() != nil {
+				conn.Close()
+				return nil, ErrClosed
+			}
+			if room != "" && !conn.Resumed() {
+				conn.Join(room)
+			}
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ErrClosed
+		}
+		if errors.Is(err, ErrPasswordRequired) || errors.Is(err, ErrCodeRequired) {
+			return nil, err
+		}
+		wait = min(2*wait, RECONNECT_MAX)
+	}
+}
+
+func (session *Session) current() *client.Conn {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.conn
+}
+
+func (session *Session) setConn(conn *client.Conn) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.conn = conn
+}
+
+func (session *Session) end(err error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.err = err
+}
+
+// send runs write on the current connection.
+func (session *Session) send(write func(conn *client.Conn) error) error {
+	conn := session.current()
+	if conn == nil {
+		if err := session.Err(); err != nil {
+			return err
+		}
+		return ErrDisconnected
+	}
+	return write(conn)
+}
+
+// SendMessage sends a chat message to the current room. A leading slash
+// is sent as text, not run as a command.
+func (session *Session) SendMessage(text string) error {
+	return session.send(func(conn *client.Conn) error { return conn.Say(text) })
+}
+
+// JoinRoom moves the user to a room, and back to it after reconnecting.
+// While the session is reconnecting the room is only remembered.
+func (session *Session) JoinRoom(room string) error {
+	session.mutex.Lock()
+	session.room = room
+	session.mutex.Unlock()
+	err := session.send(func(conn *client.Conn) error { return conn.Join(room) })
+	if errors.Is(err, ErrDisconnected) {
+		return nil
+	}
+	return err
+}
+
+// Command runs a slash command, such as "/away lunch".
+func (session *Session) Command(line string) error {
+	return session.send(func(conn *client.Conn) error { return conn.Command(line) })
+}
+
+// Send writes a frame, for anything the other methods don't cover.
+func (session *Session) Send(frame protocol.Frame) error {
+	return session.send(func(conn *client.Conn) error { return conn.Send(frame) })
+}
+
+// Done is closed when the session has ended.
+func (session *Session) Done() <-chan struct{} {
+	return session.done
+}
+
+// Err returns why the session ended: ErrClosed, or the error that stopped
+// it reconnecting. It is nil while the session runs.
+func (session *Session) Err() error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.err
+}
+
+// Close ends the session and waits for its last handler to return. It
+// must not be called from a handler.
+func (session *Session) Close() error {
+	session.cancel()
+	<-session.done
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Keys the editor understands
+const (
+	KEY_CTRL_A    = 1
+	KEY_CTRL_B    = 2
+	KEY_CTRL_C    = 3
+	KEY_CTRL_D    = 4
+	KEY_CTRL_E    = 5
+	KEY_CTRL_F    = 6
+	KEY_TAB       = 9
+	KEY_CTRL_K    = 11
+	KEY_CTRL_L    = 12
+	KEY_CTRL_N    = 14
+	KEY_CTRL_P    = 16
+	KEY_CTRL_U    = 21
+	KEY_CTRL_W    = 23
+	KEY_ESCAPE    = 27
+	KEY_BACKSPACE = 8
+	KEY_DELETE    = 127
+
+	MAX_INPUT_HISTORY = 500
+)
+
+// editor is a raw-mode line editor. Everything printed goes through Print,
+// which writes above the line being typed and then redraws it, so incoming
+// messages never break up what you are typing.
+type editor struct {
+	input  *bufio.Reader
+	output io.Writer
+	prompt string
+
+	mutex   sync.Mutex
+	line    []rune
+	cursor  int
+	hidden  bool // for passwords
+	history []string
+	recall  int // position in history while browsing, len(history) when not
+	saved   []rune
+
+	// Returns the commands starting with what is typed, for Tab
+	complete func(prefix string) []string
+}
+
+func newEditor(input io.Reader, output io.Writer, prompt string) *editor {
+	return &editor{input: bufio.NewReader(input), output: output, prompt: prompt}
+}
+
+// redraw writes the prompt and line and puts the cursor in place. The
+// caller holds the mutex.
+func (editor *editor) redraw() {
+	if editor.hidden {
+		fmt.Fprintf(editor.output, "\r\x1b[K%s", editor.prompt)
+		return
+	}
+	fmt.Fprintf(editor.output, "\r\x1b[K%s%s", editor.prompt, string(editor.line))
+	if back := len(editor.line) - editor.cursor; back > 0 {
+		fmt.Fprintf(editor.output, "\x1b[%dD", back)
+	}
+}
+
+// Print shows text above the input line.
+func (editor *editor) Print(text string) {
+	editor.mutex.Lock()
+	defer editor.mutex.Unlock()
+	text = strings.ReplaceAll(strings.TrimRight(text, "\r\n"), "\n", "\r\n")
+	fmt.Fprintf(editor.output, "\r\x1b[K%s\r\n", text)
+	editor.redraw()
+}
+
+// ReadSecret reads one line without showing it.
+func (editor *editor) ReadSecret(prompt string) (string, error) {
+	editor.mutex.Lock()
+	saved := editor.prompt
+	editor.prompt, editor.hidden = prompt, true
+	editor.mutex.Unlock()
+	defer func() {
+		editor.mutex.Lock()
+		editor.prompt, editor.hidden = saved, false
+		editor.mutex.Unlock()
+	}()
+	return editor.ReadLine()
+}
+
+// ReadLine reads one edited line. It returns io.EOF on Ctrl-C, or on Ctrl-D
+// with an empty line.
+func (editor *editor) ReadLine() (string, error) {
+	editor.mutex.Lock()
+	editor.redraw()
+	editor.mutex.Unlock()
+
+	for {
+		r, _, err := editor.input.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		editor.mutex.Lock()
+		switch r {
+		case '\r', '\n':
+			line := string(editor.line)
+			editor.line, editor.cursor = nil, 0
+			if !editor.hidden {
+				editor.remember(line)
+			}
+			fmt.Fprint(editor.output, "\r\x1b[K")
+			editor.mutex.Unlock()
+			return line, nil
+		case KEY_CTRL_C:
+			editor.mutex.Unlock()
+			return "", io.EOF
+		case KEY_CTRL_D:
+			if len(editor.line) == 0 {
+				editor.mutex.Unlock()
+				return "", io.EOF
+			}
+			editor.deleteAt(editor.cursor)
+		case KEY_BACKSPACE, KEY_DELETE:
+			if editor.cursor > 0 {
+				editor.cursor--
+				editor.deleteAt(editor.cursor)
+			}
+		case KEY_CTRL_A:
+			editor.cursor = 0
+		case KEY_CTRL_E:
+			editor.cursor = len(editor.line)
+		case KEY_CTRL_B:
+			editor.move(-1)
+		case KEY_CTRL_F:
+			editor.move(1)
+		case KEY_CTRL_K:
+			editor.line = editor.line[:editor.cursor]
+		case KEY_CTRL_U:
+			editor.line = append([]rune(nil), editor.line[editor.cursor:]...)
+			editor.cursor = 0
+		case KEY_CTRL_W:
+			editor.deleteWord()
+		case KEY_CTRL_P:
+			editor.browse(-1)
+		case KEY_CTRL_N:
+			editor.browse(1)
+		case KEY_CTRL_L:
+			fmt.Fprint(editor.output, "\x1b[H\x1b[2J")
+		case KEY_TAB:
+			editor.completeCommand()
+		case KEY_ESCAPE:
+			editor.escape()
+		default:
+			if unicode.IsPrint(r) {
+				editor.insert(r)
+			}
+		}
+		editor.redraw()
+		editor.mutex.Unlock()
+	}
+}
+
+// escape handles the arrow, Home, End and Delete key sequences.
+func (editor *editor) escape() {
+	next, _, err := editor.input.ReadRune()
+	if err != nil || (next != '[' && next != 'O') {
+		return
+	}
+	key, _, err := editor.input.ReadRune()
+	if err != nil {
+		return
+	}
+	if key >= '0' && key <= '9' {
+		// "ESC [ n ~"
+		if tilde, _, err := editor.input.ReadRune(); err != nil || tilde != '~' {
+			return
+		}
+		switch key {
+		case '1', '7':
+			key = 'H'
+		case '4', '8':
+			key = 'F'
+		case '3':
+			editor.deleteAt(editor.cursor)
+			return
+		}
+	}
+
+	switch key {
+	case 'A':
+		editor.browse(-1)
+	case 'B':
+		editor.browse(1)
+	case 'C':
+		editor.move(1)
+	case 'D':
+		editor.move(-1)
+	case 'H':
+		editor.cursor = 0
+	case 'F':
+		editor.cursor = len(editor.line)
+	}
+}
+
+// completeCommand completes the command name being typed, as far as the
+// commands starting with it agree, and lists them if that is no further.
+func (editor *editor) completeCommand() {
+	typed := string(editor.line)
+	if editor.complete == nil || editor.hidden || editor.cursor != len(editor.line) ||
+		!strings.HasPrefix(typed, "/") || strings.Contains(typed, " ") {
+		return
+	}
+	matches := editor.complete(typed)
+	switch len(matches) {
+	case 0:
+		return
+	case 1:
+		editor.line = []rune(matches[0] + " ")
+	default:
+		common := matches[0]
+		for _, match := range matches[1:] {
+			for !strings.HasPrefix(match, common) {
+				common = common[:len(common)-1]
+			}
+		}
+		if common == typed {
+			fmt.Fprintf(editor.output, "\r\x1b[K%s\r\n", strings.Join(matches, "  "))
+		}
+		editor.line = []rune(common)
+	}
+	editor.cursor = len(editor.line)
+}
+
+func (editor *editor) insert(r rune) {
+	editor.line = append(editor.line, 0)
+	copy(editor.line[editor.cursor+1:], editor.line[editor.cursor:])
+	editor.line[editor.cursor] = r
+	editor.cursor++
+}
+
+func (editor *editor) deleteAt(i int) {
+	if i < len(editor.line) {
+		editor.line = append(editor.line[:i], editor.line[i+1:]...)
+	}
+}
+
+func (editor *editor) deleteWord() {
+	start := editor.cursor
+	for start > 0 && editor.line[start-1] == ' ' {
+		start--
+	}
+	for start > 0 && editor.line[start-1] != ' ' {
+		start--
+	}
+	editor.line = append(editor.line[:start], editor.line[editor.cursor:]...)
+	editor.cursor = start
+}
+
+func (editor *editor) move(delta int) {
+	editor.cursor = max(0, min(len(editor.line), editor.cursor+delta))
+}
+
+// remember adds a sent line to the history that the up and down keys
+// browse.
+func (editor *editor) remember(line string) {
+	if strings.TrimSpace(line) != "" && (len(editor.history) == 0 || editor.history[len(editor.history)-1] != line) {
+		editor.history = append(editor.history, line)
+		if len(editor.history) > MAX_INPUT_HISTORY {
+			editor.history = editor.history[1:]
+		}
+	}
+	editor.recall = len(editor.history)
+	editor.saved = nil
+}
+
+// browse moves through the history, keeping the line being typed to come
+// back to.
+func (editor *editor) browse(delta int) {
+	next := editor.recall + delta
+	if next < 0 || next > len(editor.history) {
+		return
+	}
+	if editor.recall == len(editor.history) {
+		editor.saved = editor.line
+	}
+	editor.recall = next
+	if next == len(editor.history) {
+		editor.line = editor.saved
+	} else {
+		editor.line = []rune(editor.history[next])
+	}
+	editor.cursor = len(editor.line)
+}
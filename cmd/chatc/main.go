@@ -0,0 +1,310 @@
+// Command chatc is a terminal client for the chat server. It keeps what you
+// are typing on its own line below the chat, remembers what you sent (up
+// and down arrows), and reconnects when the connection drops.
+//
+//	chatc --server chat.example.com:8888 --name alice
+//
+// Registered names are asked for their password, or take it from
+// $CHAT_PASSWORD. Lines starting with "/" are commands (/help lists them,
+// and Tab completes their names); /quit or exit leaves.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leavedtrait/chat/client"
+	"github.com/leavedtrait/chat/internal/term"
+	"github.com/leavedtrait/chat/protocol"
+)
+
+const (
+	DEFAULT_SERVER = "localhost:8888"
+	PROMPT         = "> "
+
+	// Reconnect delays, doubling from the first to the last
+	RECONNECT_MIN = time.Second
+	RECONNECT_MAX = 30 * time.Second
+)
+
+// screen is where chat is shown and lines are typed: the line editor on a
+// terminal, plain lines otherwise.
+type screen interface {
+	Print(text string)
+	ReadLine() (string, error)
+	ReadSecret(prompt string) (string, error)
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	address := flag.String("server", DEFAULT_SERVER, "chat server address")
+	name := flag.String("name", os.Getenv("USER"), "username")
+	invite := flag.String("invite", "", "invite code, for invite-only servers")
+	flag.Parse()
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "Error: no username, use --name")
+		return 2
+	}
+
+	chat := &session{
+		address: *address,
+		options: client.Options{Name: *name, Password: os.Getenv("CHAT_PASSWORD"), Invite: *invite},
+	}
+	var out screen = newLineScreen(os.Stdin, os.Stdout)
+	if restore, err := term.MakeRaw(os.Stdin); err == nil {
+		defer restore()
+		editor := newEditor(os.Stdin, os.Stdout, PROMPT)
+		editor.complete = chat.commandsStarting
+		out = editor
+	}
+	chat.screen = out
+	if err := chat.connect(); err != nil {
+		out.Print(fmt.Sprintf("Error connecting to %s: %v", *address, err))
+		return 1
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for {
+			line, err := out.ReadLine()
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	chat.loop(lines)
+	return 0
+}
+
+// session is one user's connection, which is replaced when it drops.
+type session struct {
+	address string
+	options client.Options
+	screen  screen
+
+	conn   *client.Conn
+	closed chan error
+
+	// The commands the server last said we can run, for completion
+	mutex    sync.Mutex
+	commands []protocol.CommandInfo
+}
+
+// commandsStarting returns the names of the commands starting with prefix.
+func (chat *session) commandsStarting(prefix string) []string {
+	chat.mutex.Lock()
+	defer chat.mutex.Unlock()
+	var names []string
+	for _, command := range chat.commands {
+		if strings.HasPrefix(command.Name, strings.ToLower(prefix)) {
+			names = append(names, command.Name)
+		}
+	}
+	return names
+}
+
+// connect logs in for the first time, asking for a password if the name
+// needs one and a two-factor code if the account does.
+func (chat *session) connect() error {
+	err := chat.dial()
+	if errors.Is(err, client.ErrPasswordRequired) {
+		password, readErr := chat.screen.ReadSecret("Password: ")
+		if readErr != nil {
+			return err
+		}
+		chat.options.Password = password
+		err = chat.dial()
+	}
+	if errors.Is(err, client.ErrCodeRequired) {
+		code, readErr := chat.screen.ReadSecret("Code: ")
+		if readErr != nil {
+			return err
+		}
+		chat.options.Code = code
+		err = chat.dial()
+		chat.options.Code = ""
+	}
+	return err
+}
+
+// dial connects and starts showing what arrives.
+func (chat *session) dial() error {
+	conn, err := client.Dial(context.Background(), chat.address, chat.options)
+	if err != nil {
+		return err
+	}
+	chat.conn = conn
+	chat.closed = make(chan error, 1)
+	go chat.receive(conn, chat.closed)
+	return nil
+}
+
+func (chat *session) receive(conn *client.Conn, closed chan<- error) {
+	for {
+		frame, err := conn.Receive()
+		if err != nil {
+			closed <- err
+			return
+		}
+		if frame.Type == protocol.FRAME_COMMANDS {
+			chat.mutex.Lock()
+			chat.commands = frame.Commands
+			chat.mutex.Unlock()
+			continue
+		}
+		if frame.Type == protocol.FRAME_TYPING || frame.Type == protocol.FRAME_ACK || frame.Type == protocol.FRAME_READ {
+			// Nowhere to show them that wouldn't get in the way
+			continue
+		}
+		chat.screen.Print(render(frame, chat.options.Name))
+	}
+}
+
+// loop sends typed lines until the user quits, reconnecting whenever the
+// connection is lost.
+func (chat *session) loop(lines <-chan string) {
+	delay := RECONNECT_MIN
+	var retry <-chan time.Time
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok || isQuit(line) {
+				if chat.conn != nil {
+					chat.conn.Say("exit")
+					chat.conn.Close()
+				}
+				return
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if chat.conn == nil {
+				chat.screen.Print("*** Not connected ***")
+				continue
+			}
+			chat.send(line)
+
+		case err := <-chat.closed:
+			chat.conn.Close()
+			chat.conn, chat.closed = nil, nil
+			chat.screen.Print(fmt.Sprintf("*** Connection lost (%v), reconnecting in %v ***", err, delay))
+			retry = time.After(delay)
+
+		case <-retry:
+			retry = nil
+			err := chat.dial()
+			if errors.Is(err, client.ErrPasswordRequired) || errors.Is(err, client.ErrCodeRequired) {
+				chat.screen.Print(fmt.Sprintf("*** %v ***", err))
+				return
+			}
+			if err != nil {
+				delay = min(2*delay, RECONNECT_MAX)
+				chat.screen.Print(fmt.Sprintf("*** Reconnecting failed (%v), trying again in %v ***", err, delay))
+				retry = time.After(delay)
+				continue
+			}
+			delay = RECONNECT_MIN
+			chat.screen.Print("*** Reconnected ***")
+		}
+	}
+}
+
+// send sends one typed line, as a command if it starts with a slash. A lost
+// connection shows up in receive.
+func (chat *session) send(line string) {
+	if strings.HasPrefix(line, "/") {
+		chat.conn.Command(line)
+	} else {
+		chat.conn.Say(line)
+	}
+}
+
+func isQuit(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "/quit" || line == "exit"
+}
+
+// render formats a frame the way the server shows it to telnet users.
+func render(frame protocol.Frame, self string) string {
+	clock := frame.Timestamp
+	if clock.IsZero() {
+		clock = time.Now()
+	}
+	timestamp := clock.Local().Format("15:04:05")
+
+	switch frame.Type {
+	case protocol.FRAME_CHAT:
+		return fmt.Sprintf("[%s] %s: %s", timestamp, frame.From, frame.Body)
+	case protocol.FRAME_ACTION:
+		return fmt.Sprintf("* %s %s", frame.From, frame.Body)
+	case protocol.FRAME_DM:
+		if frame.From == self {
+			return fmt.Sprintf("[%s] [PM to %s] %s", timestamp, frame.To, frame.Body)
+		}
+		return fmt.Sprintf("[%s] [PM from %s] %s", timestamp, frame.From, frame.Body)
+	case protocol.FRAME_EDIT:
+		return fmt.Sprintf("*** %s edited a message: %s ***", frame.From, frame.Body)
+	case protocol.FRAME_DELETE:
+		return fmt.Sprintf("*** %s deleted a message ***", frame.From)
+	case protocol.FRAME_PRESENCE:
+		switch {
+		case frame.Presence == "online":
+			return fmt.Sprintf("*** %s is back ***", frame.From)
+		case frame.Body != "":
+			return fmt.Sprintf("*** %s is %s: %s ***", frame.From, frame.Presence, frame.Body)
+		}
+		return fmt.Sprintf("*** %s is %s ***", frame.From, frame.Presence)
+	case protocol.FRAME_REACT:
+		return fmt.Sprintf("*** %s reacted %s (%d in all) ***", frame.From, frame.Body, frame.Reactions[frame.Body])
+	case protocol.FRAME_NOTICE:
+		return fmt.Sprintf("*** %s ***", frame.Body)
+	case protocol.FRAME_ERROR:
+		return fmt.Sprintf("*** Error: %s ***", frame.Body)
+	}
+	return frame.Body
+}
+
+// lineScreen is used when stdin isn't a terminal, for scripts and pipes.
+type lineScreen struct {
+	scanner *bufio.Scanner
+	output  io.Writer
+	mutex   sync.Mutex
+}
+
+func newLineScreen(input io.Reader, output io.Writer) *lineScreen {
+	return &lineScreen{scanner: bufio.NewScanner(input), output: output}
+}
+
+func (screen *lineScreen) Print(text string) {
+	screen.mutex.Lock()
+	defer screen.mutex.Unlock()
+	fmt.Fprintln(screen.output, strings.TrimRight(text, "\r\n"))
+}
+
+func (screen *lineScreen) ReadLine() (string, error) {
+	if !screen.scanner.Scan() {
+		if err := screen.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return screen.scanner.Text(), nil
+}
+
+func (screen *lineScreen) ReadSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	return screen.ReadLine()
+}
@@ -0,0 +1,210 @@
+// Command loadtest opens many connections to a chat server, has a few of
+// them talk in one room, and reports how long messages took to reach
+// everyone in it:
+//
+//	chatd --max-clients 11000 --message-rate 0 &
+//	loadtest --clients 10000 --senders 20 --duration 1m
+//
+// Both ends need a file limit above the number of clients (ulimit -n).
+// New users may only send one message every 5 seconds, so that is the
+// default --interval; use more senders for more traffic. Latency is
+// measured from just before a message is sent to when each client reads
+// it, so run loadtest on the same machine as the server or one with a
+// synchronized clock.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leavedtrait/chat/client"
+	"github.com/leavedtrait/chat/protocol"
+)
+
+const (
+	DEFAULT_SERVER = "localhost:8888"
+
+	// Start of every message loadtest sends, followed by the time it was
+	// sent in Unix nanoseconds
+	MARKER = "loadtest"
+)
+
+// results collects what the receivers saw.
+type results struct {
+	mutex     sync.Mutex
+	latencies []time.Duration
+}
+
+func (results *results) add(latencies []time.Duration) {
+	results.mutex.Lock()
+	defer results.mutex.Unlock()
+	results.latencies = append(results.latencies, latencies...)
+}
+
+// percentile returns the latency p percent of messages arrived within;
+// sorted must be in order.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// receive reads from a connection until it closes, timing the messages
+// loadtest sent.
+func receive(conn *client.Conn, collected *results) {
+	var latencies []time.Duration
+	defer func() { collected.add(latencies) }()
+	for {
+		frame, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		if frame.Type != protocol.FRAME_CHAT || !strings.HasPrefix(frame.Body, MARKER+" ") {
+			continue
+		}
+		sent, err := strconv.ParseInt(strings.TrimPrefix(frame.Body, MARKER+" "), 10, 64)
+		if err == nil {
+			latencies = append(latencies, time.Since(time.Unix(0, sent)))
+		}
+	}
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	address := flag.String("server", DEFAULT_SERVER, "chat server address")
+	clients := flag.Int("clients", 1000, "connections to open")
+	senders := flag.Int("senders", 10, "how many of the clients send messages")
+	interval := flag.Duration("interval", 5*time.Second, "time between each sender's messages")
+	duration := flag.Duration("duration", time.Minute, "how long to send for")
+	ramp := flag.Int("ramp", 500, "connections to open per second")
+	room := flag.String("room", "#loadtest", "room to talk in")
+	prefix := flag.String("prefix", "lt", "start of the clients' names")
+	drain := flag.Duration("drain", 5*time.Second, "how long to wait for the last messages after sending stops")
+	flag.Parse()
+	if *clients < 1 || *senders < 0 || *senders > *clients || *ramp < 1 || *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: need at least one client, no more senders than clients, and a positive ramp and interval")
+		return 2
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Connect at the ramp rate. Each client reads from the start, so the
+	// server doesn't drop it for falling behind while the others connect.
+	fmt.Printf("Connecting %d clients to %s at %d a second\n", *clients, *address, *ramp)
+	conns := make([]*client.Conn, *clients)
+	var failures sync.Mutex
+	var failed int
+	var firstError error
+	var collected results
+	var dialing, receiving sync.WaitGroup
+	ticker := time.NewTicker(time.Second / time.Duration(*ramp))
+	started := time.Now()
+	for i := range conns {
+		<-ticker.C
+		dialing.Add(1)
+		receiving.Add(1)
+		go func() {
+			defer receiving.Done()
+			conn, err := client.Dial(ctx, *address, client.Options{Name: fmt.Sprintf("%s%05d", *prefix, i)})
+			if err == nil {
+				err = conn.Command("/join " + *room)
+			}
+			if err != nil {
+				failures.Lock()
+				if failed++; firstError == nil {
+					firstError = err
+				}
+				failures.Unlock()
+				dialing.Done()
+				return
+			}
+			conns[i] = conn
+			dialing.Done()
+			receive(conn, &collected)
+		}()
+	}
+	ticker.Stop()
+	dialing.Wait()
+	connected := *clients - failed
+	fmt.Printf("Connected %d in %s", connected, time.Since(started).Round(time.Millisecond))
+	if firstError != nil {
+		fmt.Printf(", %d failed (first: %v)", failed, firstError)
+		var refused *client.LoginError
+		if errors.As(firstError, &refused) {
+			fmt.Print("; is --max-clients high enough?")
+		}
+	}
+	fmt.Println()
+	if connected == 0 {
+		return 1
+	}
+
+	// Send, with the senders spread out over the interval
+	fmt.Printf("Sending from %d clients every %s for %s\n", *senders, *interval, *duration)
+	var sent atomic.Int64
+	var sending sync.WaitGroup
+	deadline := time.Now().Add(*duration)
+	for i, n := 0, 0; i < len(conns) && n < *senders; i++ {
+		conn := conns[i]
+		if conn == nil {
+			continue
+		}
+		offset := *interval * time.Duration(n) / time.Duration(*senders)
+		n++
+		sending.Add(1)
+		go func() {
+			defer sending.Done()
+			time.Sleep(offset)
+			ticker := time.NewTicker(*interval)
+			defer ticker.Stop()
+			for time.Now().Before(deadline) {
+				if err := conn.Say(fmt.Sprintf("%s %d", MARKER, time.Now().UnixNano())); err != nil {
+					return
+				}
+				sent.Add(1)
+				<-ticker.C
+			}
+		}()
+	}
+	sending.Wait()
+	time.Sleep(*drain)
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	receiving.Wait()
+
+	// Report
+	latencies := collected.latencies
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	expected := sent.Load() * int64(connected)
+	fmt.Printf("Sent %d messages; %d of %d deliveries arrived", sent.Load(), len(latencies), expected)
+	if expected > 0 {
+		fmt.Printf(" (%.2f%% lost)", 100*float64(expected-int64(len(latencies)))/float64(expected))
+	}
+	fmt.Println()
+	if len(latencies) > 0 {
+		fmt.Printf("Latency: p50 %s, p90 %s, p99 %s, max %s\n",
+			percentile(latencies, 50).Round(time.Microsecond),
+			percentile(latencies, 90).Round(time.Microsecond),
+			percentile(latencies, 99).Round(time.Microsecond),
+			latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+	return 0
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package term
+
+import (
+	"errors"
+	"os"
+)
+
+// MakeRaw is only implemented on Linux; elsewhere callers fall back to
+// plain line mode.
+func MakeRaw(f *os.File) (func(), error) {
+	return nil, errors.New("raw terminal mode not supported on this platform")
+}
@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Room a CBOR frame has beyond the size limit of its body, for the keys
+// and the rest of its fields
+const CBOR_FRAME_OVERHEAD = 1024
+
+var ErrFrameTooLong = errors.New("frame too long")
+
+// Frames are CBOR maps with the same keys as their JSON, times included:
+// they are RFC 3339 text either way.
+var cborEncoding, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
+var cborDecoding, _ = cbor.DecOptions{MaxNestedLevels: 8, MaxArrayElements: 1024, MaxMapPairs: 1024}.DecMode()
+
+// EncodeCBOR returns a frame as one CBOR data item.
+func EncodeCBOR(frame Frame) []byte {
+	data, _ := cborEncoding.Marshal(frame)
+	return data
+}
+
+// CBORDecoder reads frames from a stream of CBOR data items.
+type CBORDecoder struct {
+	decoder *cbor.Decoder
+	source  *frameLimit
+	limit   int
+}
+
+// NewCBORDecoder reads frames from r, giving up with ErrFrameTooLong on
+// one that runs past limit bytes and CBOR_FRAME_OVERHEAD; a limit of 0
+// means none.
+func NewCBORDecoder(r io.Reader, limit int) *CBORDecoder {
+	source := &frameLimit{reader: r}
+	return &CBORDecoder{decoder: cborDecoding.NewDecoder(source), source: source, limit: limit}
+}
+
+// Decode reads the next frame. Unlike a bad JSON line, a frame that can't
+// be read leaves no telling where the next one starts, so the stream can't
+// be read any further after an error.
+func (d *CBORDecoder) Decode() (Frame, error) {
+	d.source.remaining = -1
+	if d.limit > 0 {
+		d.source.remaining = d.limit + CBOR_FRAME_OVERHEAD
+	}
+	var frame Frame
+	err := d.decoder.Decode(&frame)
+	return frame, err
+}
+
+// frameLimit stops a decoder reading more than remaining bytes (or any
+// number, if it's negative), so a frame that claims to be huge ends the
+// stream instead of being buffered.
+type frameLimit struct {
+	reader    io.Reader
+	remaining int
+}
+
+func (limit *frameLimit) Read(p []byte) (int, error) {
+	if limit.remaining < 0 {
+		return limit.reader.Read(p)
+	}
+	if limit.remaining == 0 {
+		return 0, ErrFrameTooLong
+	}
+	if len(p) > limit.remaining {
+		p = p[:limit.remaining]
+	}
+	n, err := limit.reader.Read(p)
+	limit.remaining -= n
+	return n, err
+}
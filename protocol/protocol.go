@@ -0,0 +1,200 @@
+// Package protocol defines what passes between chat servers and programs
+// that talk to them: JSON frames, keepalive lines and WebRTC signals.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JSON framing. A client that sends {"type":"hello"} as its first line gets
+// one JSON object per line each way instead of text, so it doesn't have to
+// parse what is meant for people. Prompts and login errors are framed too.
+const (
+	FRAME_HELLO    = "hello"
+	FRAME_PROMPT   = "prompt"
+	FRAME_ERROR    = "error"
+	FRAME_CHAT     = "chat"
+	FRAME_ACTION   = "action"
+	FRAME_DM       = "dm"
+	FRAME_NOTICE   = "notice"
+	FRAME_SIGNAL   = "rtc"
+	FRAME_PING     = "ping"
+	FRAME_PONG     = "pong"
+	FRAME_TEXT     = "text"
+	FRAME_COMMAND  = "command"
+	FRAME_TYPING   = "typing"
+	FRAME_EDIT     = "edit"
+	FRAME_DELETE   = "delete"
+	FRAME_ACK      = "ack"
+	FRAME_READ     = "read"
+	FRAME_REACT    = "react"
+	FRAME_PRESENCE = "presence"
+	FRAME_COMMANDS = "commands"
+	FRAME_SESSION  = "session"
+)
+
+// Encodings of frames. A client short of bandwidth can name CBOR in the
+// Body of its hello. The server's hello, still a JSON line, has in its Body
+// the encoding it picked; after a "cbor" hello every frame each way is a
+// CBOR map with the same keys as the JSON, one after another with nothing
+// between them. The client waits for that hello before it switches. The
+// server only agrees on connections that pass bytes as they are: TCP, TLS
+// and QUIC, not telnet, WebSocket, gRPC or SSH.
+const (
+	ENCODING_JSON = "json"
+	ENCODING_CBOR = "cbor"
+)
+
+// Events of notice frames about someone joining or leaving, which carry
+// who in From and the room in Room, empty for the server as a whole
+const (
+	EVENT_JOIN  = "join"
+	EVENT_LEAVE = "leave"
+)
+
+// Capabilities a client can ask for in the capabilities of its hello
+// frame; the server's hello lists the ones it has turned on. With
+// CAPABILITY_COLOR, chat, action and dm frames carry the sender's color.
+const (
+	CAPABILITY_COLOR = "color"
+)
+
+// Kinds of the parts of a message
+const (
+	PART_TEXT = "text"
+	PART_CODE = "code"
+)
+
+// Frame is one JSON message. Clients send chat, command, dm, typing, edit,
+// delete, react, read and pong frames; the server sends all the others, and
+// chat, dm, typing, edit, delete, react and read frames from other users.
+// Chat, action and dm frames carry the message's ID, which edit, delete,
+// react, ack and read frames refer to. Ref is the sender's own name for a
+// frame it sends, returned in the ack; a frame sent again with the same ref
+// is acked again rather than delivered twice. React frames from the server
+// have the message's new reaction totals; Body is the emoji From added or
+// took back. Presence frames say From is now online, away, busy or
+// offline, with any reason in Body. Color is the sender's color name, for
+// clients that asked for it. Notices that someone joined or left have
+// Event set. A commands frame comes after login, and again whenever the
+// user's role changes, listing the commands the user may run. A session
+// frame, if the server holds sessions for resuming, has the token for
+// "/resume" in Body. Chat and edit frames of a message with code blocks
+// also have it in Parts, prose and code in order, so the code can be shown
+// as it was written; Body has it indented, as text clients see it. Chat,
+// action and dm frames addressed to the user, private messages to it and
+// messages that mention its @name, have Notify set, for clients to alert
+// the user the way /bell does for text clients.
+type Frame struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id,omitempty"`
+	Ref       string    `json:"ref,omitempty"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to,omitempty"`
+	Room      string    `json:"room,omitempty"`
+	Body      string    `json:"body,omitempty"`
+	Timestamp time.Time `json:"timestamp,omitzero"`
+
+	Reactions map[string]int `json:"reactions,omitempty"`
+	Presence  string         `json:"presence,omitempty"`
+	Event     string         `json:"event,omitempty"`
+	Notify    bool           `json:"notify,omitempty"`
+
+	Capabilities []string      `json:"capabilities,omitempty"`
+	Color        string        `json:"color,omitempty"`
+	Commands     []CommandInfo `json:"commands,omitempty"`
+	Parts        []Part        `json:"parts,omitempty"`
+}
+
+// Part is one piece of a message: prose, or a fenced code block with the
+// language its fence named, if any.
+type Part struct {
+	Kind string `json:"kind"`
+	Lang string `json:"lang,omitempty"`
+	Text string `json:"text"`
+}
+
+// CommandInfo describes a slash command, for completion and help in
+// clients.
+type CommandInfo struct {
+	Name  string `json:"name"`            // with the slash, e.g. "/msg"
+	Usage string `json:"usage,omitempty"` // arguments, e.g. "<user> <text>"
+	Help  string `json:"help,omitempty"`
+	Role  string `json:"role"` // least role allowed to use it
+}
+
+// Encode returns a frame as one line.
+func Encode(frame Frame) []byte {
+	data, _ := json.Marshal(frame)
+	return append(data, '\n')
+}
+
+// Parse reads one line as a frame.
+func Parse(line string) (Frame, error) {
+	var frame Frame
+	if err := json.Unmarshal([]byte(line), &frame); err != nil {
+		return Frame{}, fmt.Errorf("bad frame: %v", err)
+	}
+	if frame.Type == "" {
+		return Frame{}, fmt.Errorf("bad frame: no type")
+	}
+	return frame, nil
+}
+
+// IsHello reports whether a line asks for JSON framing.
+func IsHello(line string) bool {
+	frame, err := Parse(line)
+	return err == nil && frame.Type == FRAME_HELLO
+}
+
+// IsTyping reports whether a line says the client's user is typing. Typing
+// frames are passed on to the rest of the room and never stored.
+func IsTyping(line string) bool {
+	frame, err := Parse(line)
+	return err == nil && frame.Type == FRAME_TYPING
+}
+
+// Keepalive pings. Text clients that see "PING <token>" should answer
+// "PONG <token>"; JSON clients get ping frames and answer with pong frames.
+const (
+	PING_LINE = "PING"
+	PONG_LINE = "PONG"
+)
+
+// IsPong reports whether a line answers a ping.
+func IsPong(line string) bool {
+	name, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+	return name == PONG_LINE
+}
+
+// WebRTC signaling. Two users set up a direct data channel (for file
+// transfers or voice) by passing offers, answers and ICE candidates through
+// the server, which relays them without looking inside. Payloads are a single
+// line, so clients base64 their SDP.
+const (
+	RTC_OFFER  = "offer"
+	RTC_ANSWER = "answer"
+	RTC_ICE    = "ice"
+	RTC_BYE    = "bye"
+
+	MAX_RTC_PAYLOAD = 16 * 1024
+
+	// Prefix of relayed signals, which clients watch for:
+	// "RTC <type> <from> <payload>"
+	RTC_PREFIX = "RTC"
+)
+
+var RTC_TYPES = map[string]bool{
+	RTC_OFFER:  true,
+	RTC_ANSWER: true,
+	RTC_ICE:    true,
+	RTC_BYE:    true,
+}
+
+// IsSignal reports whether message is a relayed signal.
+func IsSignal(message string) bool {
+	return strings.HasPrefix(message, RTC_PREFIX+" ")
+}
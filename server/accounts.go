@@ -0,0 +1,539 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Registered accounts. A registered name can only be used with its
+// password, so it keeps its owner across sessions. Passwords are stored as
+// bcrypt hashes.
+//
+// Accounts in --credentials-file are set up by the operator instead, as
+// "name:hash" lines with bcrypt hashes (htpasswd -nB or chatd passwd
+// writes them). Only these get the roles --admins and --moderators give,
+// so nobody can take a staff name by registering it first. They can't be
+// registered, and their password there beats any registered one.
+const (
+	ACCOUNTS_FILE = "accounts.json"
+
+	BCRYPT_COST         = bcrypt.DefaultCost
+	MIN_PASSWORD_LENGTH = 8
+	MAX_PASSWORD_LENGTH = 72 // bcrypt ignores the rest
+
+	// Pause after a wrong password, to slow down guessing
+	LOGIN_FAILURE_DELAY = 2 * time.Second
+)
+
+var (
+	errAccountExists = errors.New("that name is already registered")
+	errLoginFailed   = errors.New("wrong name or password")
+)
+
+// Account is a registered name, and the command aliases and SSH keys saved
+// with it. One of the operator's accounts has no Hash; its record only
+// keeps its aliases and keys.
+type Account struct {
+	Name      string            `json:"name"`
+	Hash      string            `json:"hash"`
+	CreatedAt time.Time         `json:"created_at"`
+	Aliases   map[string]string `json:"aliases,omitempty"`
+	SSHKeys   []string          `json:"ssh_keys,omitempty"`
+	Push      PushSettings      `json:"push,omitzero"`
+
+	// Email is the address the user gave, if any, and EmailVerified
+	// whether they opened the link mailed to it
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+
+	// TOTP is the base32 secret for two-factor login, if it is on
+	TOTP string `json:"totp,omitempty"`
+}
+
+// AccountStore holds the registered accounts, keyed by lowercased name,
+// and the operator's credentials.
+type AccountStore struct {
+	mutex       sync.Mutex
+	storage     Storage
+	accounts    map[string]*Account
+	credentials map[string]credential
+}
+
+// credential is an account from --credentials-file.
+type credential struct {
+	name string
+	hash []byte
+}
+
+// NewAccountStore returns an empty store that keeps accounts in memory
+// until Load gives it storage.
+func NewAccountStore() *AccountStore {
+	return &AccountStore{storage: newMemoryStorage(), accounts: make(map[string]*Account)}
+}
+
+// Load reads the accounts from storage, where changes are saved from then
+// on.
+func (store *AccountStore) Load(storage Storage) error {
+	accounts, err := storage.LoadAccounts()
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.storage, store.accounts = storage, accounts
+	return nil
+}
+
+// checkPasswordLength says what's wrong with a new password's length.
+func checkPasswordLength(password string) error {
+	if len(password) < MIN_PASSWORD_LENGTH {
+		return fmt.Errorf("passwords must be at least %d characters", MIN_PASSWORD_LENGTH)
+	}
+	if len(password) > MAX_PASSWORD_LENGTH {
+		return fmt.Errorf("passwords can be at most %d bytes", MAX_PASSWORD_LENGTH)
+	}
+	return nil
+}
+
+// hashPassword hashes a new password.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), BCRYPT_COST)
+	return string(hash), err
+}
+
+// checkPassword reports whether password matches a stored hash.
+func checkPassword(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// LoadCredentials reads the operator's accounts from path, replacing the
+// ones read before. An empty path means there are none.
+func (store *AccountStore) LoadCredentials(path string) error {
+	credentials := make(map[string]credential)
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for number := 1; scanner.Scan(); number++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			name, hash, ok := strings.Cut(line, ":")
+			if !ok || !validName(name) {
+				return fmt.Errorf("%s:%d: expected name:hash", path, number)
+			}
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, number, err)
+			}
+			credentials[strings.ToLower(name)] = credential{name: name, hash: []byte(hash)}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.credentials = credentials
+	return nil
+}
+
+// Provisioned reports whether name is one of the operator's accounts.
+func (store *AccountStore) Provisioned(name string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	_, ok := store.credentials[strings.ToLower(name)]
+	return ok
+}
+
+// Exists reports whether name is registered or one of the operator's
+// accounts.
+func (store *AccountStore) Exists(name string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := strings.ToLower(name)
+	account, registered := store.accounts[key]
+	_, provisioned := store.credentials[key]
+	return registered && account.Hash != "" || provisioned
+}
+
+// Aliases returns a copy of the command aliases saved with an account.
+func (store *AccountStore) Aliases(name string) map[string]string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if account, ok := store.accounts[strings.ToLower(name)]; ok {
+		return maps.Clone(account.Aliases)
+	}
+	return nil
+}
+
+// SaveAliases replaces the command aliases saved with an account.
+func (store *AccountStore) SaveAliases(name string, aliases map[string]string) error {
+	return store.update(name, func(account *Account) error {
+		account.Aliases = maps.Clone(aliases)
+		return nil
+	})
+}
+
+// SSHKeys returns the SSH keys saved with an account, in authorized_keys
+// form.
+func (store *AccountStore) SSHKeys(name string) []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if account, ok := store.accounts[strings.ToLower(name)]; ok {
+		return slices.Clone(account.SSHKeys)
+	}
+	return nil
+}
+
+// AddSSHKey saves an SSH key, in authorized_keys form, with an account.
+func (store *AccountStore) AddSSHKey(name, key string) error {
+	return store.update(name, func(account *Account) error {
+		if slices.Contains(account.SSHKeys, key) {
+			return nil
+		}
+		if len(account.SSHKeys) >= MAX_SSH_KEYS {
+			return fmt.Errorf("an account can have at most %d SSH keys", MAX_SSH_KEYS)
+		}
+		account.SSHKeys = append(slices.Clone(account.SSHKeys), key)
+		return nil
+	})
+}
+
+// RemoveSSHKey takes the keys matching a test off an account, reporting
+// how many there were.
+func (store *AccountStore) RemoveSSHKey(name string, matches func(key string) bool) (int, error) {
+	removed := 0
+	err := store.update(name, func(account *Account) error {
+		kept := slices.DeleteFunc(slices.Clone(account.SSHKeys), matches)
+		removed = len(account.SSHKeys) - len(kept)
+		account.SSHKeys = kept
+		return nil
+	})
+	return removed, err
+}
+
+// Push returns an account's name as registered, and its push settings.
+func (store *AccountStore) Push(name string) (string, PushSettings) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	account, ok := store.accounts[strings.ToLower(name)]
+	if !ok {
+		return name, PushSettings{}
+	}
+	settings := account.Push
+	settings.Devices = slices.Clone(settings.Devices)
+	return account.Name, settings
+}
+
+// UpdatePush changes an account's push settings.
+func (store *AccountStore) UpdatePush(name string, change func(*PushSettings) error) error {
+	return store.update(name, func(account *Account) error {
+		return change(&account.Push)
+	})
+}
+
+// AddPushDevice registers a device for an account's push notifications,
+// taking it off any other account's, as it's only one user's now.
+func (store *AccountStore) AddPushDevice(name string, device PushDevice) error {
+	sameToken := func(other PushDevice) bool { return other.Token == device.Token }
+	store.mutex.Lock()
+	var others []string
+	for key, account := range store.accounts {
+		if key != strings.ToLower(name) && slices.ContainsFunc(account.Push.Devices, sameToken) {
+			others = append(others, key)
+		}
+	}
+	store.mutex.Unlock()
+	for _, other := range others {
+		err := store.UpdatePush(other, func(settings *PushSettings) error {
+			settings.Devices = slices.DeleteFunc(slices.Clone(settings.Devices), sameToken)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.UpdatePush(name, func(settings *PushSettings) error {
+		devices := slices.DeleteFunc(slices.Clone(settings.Devices), sameToken)
+		if len(devices) >= MAX_PUSH_DEVICES {
+			return fmt.Errorf("an account can have at most %d devices", MAX_PUSH_DEVICES)
+		}
+		settings.Devices = append(devices, device)
+		return nil
+	})
+}
+
+// update changes an account's record and saves it. One of the operator's
+// accounts gets a record without a password to keep its aliases, keys and
+// devices.
+func (store *AccountStore) update(name string, change func(*Account) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := strings.ToLower(name)
+	updated := Account{Name: name, CreatedAt: time.Now()}
+	if current, ok := store.accounts[key]; ok {
+		updated = *current
+	} else if _, ok := store.credentials[key]; !ok {
+		return fmt.Errorf("no account %s", name)
+	}
+	if err := change(&updated); err != nil {
+		return err
+	}
+	if err := store.storage.SaveAccount(key, &updated); err != nil {
+		return err
+	}
+	store.accounts[key] = &updated
+	return nil
+}
+
+// Register creates an account for name.
+func (store *AccountStore) Register(name, password string) error {
+	if err := checkPasswordLength(password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := strings.ToLower(name)
+	existing, registered := store.accounts[key]
+	_, provisioned := store.credentials[key]
+	if registered && existing.Hash != "" || provisioned {
+		return errAccountExists
+	}
+	account := &Account{Name: name, Hash: hash, CreatedAt: time.Now()}
+	if registered {
+		account.Aliases, account.SSHKeys, account.Push = existing.Aliases, existing.SSHKeys, existing.Push
+		account.Email, account.EmailVerified, account.TOTP = existing.Email, existing.EmailVerified, existing.TOTP
+	}
+	if err := store.storage.SaveAccount(key, account); err != nil {
+		return err
+	}
+	store.accounts[key] = account
+	return nil
+}
+
+// Verify checks a password and returns the account's name as registered.
+func (store *AccountStore) Verify(name, password string) (string, error) {
+	store.mutex.Lock()
+	provisioned, isProvisioned := store.credentials[strings.ToLower(name)]
+	account, ok := store.accounts[strings.ToLower(name)]
+	store.mutex.Unlock()
+	if isProvisioned {
+		if bcrypt.CompareHashAndPassword(provisioned.hash, []byte(password)) != nil {
+			return "", errLoginFailed
+		}
+		return provisioned.name, nil
+	}
+	if !ok || account.Hash == "" {
+		return "", errLoginFailed
+	}
+
+	if !checkPassword(password, account.Hash) {
+		return "", errLoginFailed
+	}
+	return account.Name, nil
+}
+
+// VerifyKey checks an SSH key, in authorized_keys form, against the keys
+// saved with an account, and returns the account's name as registered.
+func (store *AccountStore) VerifyKey(name, key string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	account, ok := store.accounts[strings.ToLower(name)]
+	if key == "" || !ok || !slices.Contains(account.SSHKeys, key) {
+		return "", errLoginFailed
+	}
+	if provisioned, ok := store.credentials[strings.ToLower(name)]; ok {
+		return provisioned.name, nil
+	}
+	if account.Hash == "" {
+		return "", errLoginFailed
+	}
+	return account.Name, nil
+}
+
+// loggedInAs returns the account the client is logged in to, if any.
+func (client *Client) loggedInAs() string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.account
+}
+
+// setAccount records that the client is logged in to an account, and the
+// role that gives it, and brings back the aliases saved with it. Aliases
+// set before logging in are kept where the account has none by that name,
+// and saved with it.
+func (server *ChatServer) setAccount(client *Client, account string) {
+	aliases := server.accounts.Aliases(account)
+	if aliases == nil {
+		aliases = make(map[string]string)
+	}
+	unsaved := false
+	for name, target := range client.aliases {
+		if _, ok := aliases[name]; !ok && len(aliases) < MAX_USER_ALIASES {
+			aliases[name] = target
+			unsaved = true
+		}
+	}
+
+	client.mutex.Lock()
+	client.account = account
+	client.accountRole = server.roleOf(account)
+	client.aliases = aliases
+	client.mutex.Unlock()
+	if unsaved {
+		server.saveAliases(client)
+	}
+}
+
+// roleOf returns the role an account gets when it logs in. --admins and
+// --moderators only count for the operator's accounts, --verified-roles
+// only for accounts with a verified email address and --require-2fa only
+// for accounts with two-factor login on.
+func (server *ChatServer) roleOf(account string) string {
+	role := server.config.roleOf(account)
+	if ROLE_RANKS[role] > ROLE_RANKS[ROLE_USER] && !server.accounts.Provisioned(account) {
+		return ROLE_USER
+	}
+	return server.twoFactorRole(account, server.verifiedRole(account, role))
+}
+
+// warnUnprovisioned logs the names in --admins and --moderators that have
+// no credentials, and so get no role.
+func (server *ChatServer) warnUnprovisioned() {
+	live := server.config.live()
+	for _, name := range splitNames(live.Admins + "," + live.Moderators) {
+		if !server.accounts.Provisioned(name) {
+			slog.Warn("Staff name isn't in the credentials file, so gets no role", "name", name, "credentials_file", server.config.CredentialsFile)
+		}
+	}
+}
+
+// handleAccountCommand implements "/register <password>" and
+// "/login <user> <password> [code]", the code being for accounts with
+// two-factor login on.
+func (server *ChatServer) handleAccountCommand(client *Client, message string) {
+	command, args, _ := strings.Cut(message, " ")
+	args = strings.TrimSpace(args)
+
+	// Logging in can open up more commands
+	role := client.role()
+	defer func() {
+		if client.role() != role {
+			server.sendCommands(client)
+		}
+	}()
+
+	switch command {
+	case "/register":
+		if args == "" {
+			client.messages <- "*** Usage: /register <password> ***"
+			return
+		}
+		if server.config.roleOf(client.name()) != ROLE_USER {
+			client.messages <- fmt.Sprintf("*** %s can't be registered: the server's operator sets up its password ***", client.name())
+			return
+		}
+		if err := server.accounts.Register(client.name(), args); err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		server.setAccount(client, client.name())
+		client.logger().Info("Registered")
+		server.auditClient(AUDIT_REGISTER, client, client.name(), "")
+		client.messages <- fmt.Sprintf("*** Registered %s; next time you'll be asked for the password ***", client.name())
+		if session, ok := sshSessionOf(client.conn); ok {
+			if _, key := session.sshIdentity(); key != "" && server.accounts.AddSSHKey(client.name(), key) == nil {
+				client.messages <- fmt.Sprintf("*** Over SSH your key %s will do instead ***", sshKeyFingerprint(key))
+			}
+		}
+
+	case "/login":
+		user, password, _ := strings.Cut(args, " ")
+		if user == "" || password == "" {
+			client.messages <- "*** Usage: /login <user> <password> ***"
+			return
+		}
+		var code string
+		if server.accounts.TOTP(user) != "" {
+			if cut := strings.LastIndex(password, " "); cut >= 0 {
+				password, code = password[:cut], password[cut+1:]
+			}
+		}
+		name, err := server.accounts.Verify(user, password)
+		if err == nil && server.accounts.TOTP(name) != "" && !server.checkTOTP(name, code) {
+			if code == "" {
+				err = fmt.Errorf("%s has two-factor login on: /login %s <password> <code>", name, name)
+			} else {
+				err = errLoginFailed
+			}
+		}
+		if err != nil {
+			client.logger().Warn("Failed login", "account", user)
+			server.auditClient(AUDIT_LOGIN_FAILED, client, user, "")
+			time.Sleep(LOGIN_FAILURE_DELAY)
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		if name != client.name() {
+			if err := server.renameClient(client, name); err != nil {
+				client.messages <- fmt.Sprintf("*** %s is already logged in ***", name)
+				return
+			}
+		}
+		server.setAccount(client, name)
+		client.logger().Info("Logged in", "account", name)
+		server.auditClient(AUDIT_LOGIN, client, name, "")
+		client.messages <- fmt.Sprintf("*** Logged in as %s ***", name)
+		server.deliverMail(client, name)
+	}
+}
+
+// RunPasswdCommand implements "chatd passwd NAME", which reads a password
+// from standard input and prints the --credentials-file line for it.
+func RunPasswdCommand(args []string) int {
+	if len(args) != 1 || !validName(args[0]) {
+		fmt.Fprintln(os.Stderr, "Usage: chatd passwd NAME >> credentials")
+		return 2
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if err := checkPasswordLength(password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s:%s\n", args[0], hash)
+	return 0
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Actions ("/me waves hello") are shown in the third person, without a
+// timestamp
+const ACTION_FORMAT = "* %s %s"
+
+// handleMeCommand implements "/me <action>".
+func (server *ChatServer) handleMeCommand(client *Client, message string) {
+	_, text, _ := strings.Cut(message, " ")
+	text = strings.TrimSpace(text)
+	if text == "" {
+		client.messages <- "*** Usage: /me <action> ***"
+		return
+	}
+	if server.allowChat(client, text) {
+		server.sendAction(client, text)
+	}
+}
+
+// sendAction broadcasts an action to the client's room. It is recorded
+// like chat, marked as an action.
+func (server *ChatServer) sendAction(client *Client, text string) {
+	room := server.roomOf(client)
+	if !server.checkSpam(client, room, text) {
+		return
+	}
+	text, ok := server.filterChat(client, room, text)
+	if !ok {
+		return
+	}
+	parts := parseMessage(text)
+	server.emotes.Expand(parts)
+	action := strings.Join(strings.Fields(renderText(parts)), " ")
+
+	tag := server.newMessage(client, client.name(), room, action, true)
+	server.recordChat(client, room, tag.id, text, action, true)
+	frame := protocol.Frame{Type: protocol.FRAME_ACTION, ID: tag.id, From: client.name(), Room: room, Body: action, Timestamp: time.Now()}
+	server.sendFrom(client, room, withFrame(frame, tagMessage(tag, fmt.Sprintf(ACTION_FORMAT, client.name(), action))), PRIORITY_CHATTER)
+	server.acknowledge(client, tag.id)
+}
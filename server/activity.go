@@ -0,0 +1,253 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File the activity statistics are kept in with --storage files
+const ACTIVITY_FILE = "activity.json"
+
+// How often statistics are saved, if they have changed. Joins, leaves and
+// messages only mark them changed, so the hub never waits on the storage.
+const ACTIVITY_SAVE_INTERVAL = 30 * time.Second
+
+// Number of users shown in each half of /activity top
+const ACTIVITY_REPORT_SIZE = 5
+
+// UserActivity is what we remember about one username.
+type UserActivity struct {
+	Messages  int           `json:"messages"`
+	FirstSeen time.Time     `json:"first_seen"`
+	LastSeen  time.Time     `json:"last_seen"`
+	Online    time.Duration `json:"online"`
+}
+
+// ActivityTracker keeps per-user statistics across restarts.
+type ActivityTracker struct {
+	mutex    sync.Mutex
+	storage  Storage
+	users    map[string]*UserActivity
+	sessions map[*Client]time.Time
+	dirty    map[string]bool // users changed since the last save
+}
+
+// NewActivityTracker returns an empty tracker, which keeps statistics in
+// memory until Load gives it storage.
+func NewActivityTracker() *ActivityTracker {
+	return &ActivityTracker{
+		storage:  newMemoryStorage(),
+		users:    make(map[string]*UserActivity),
+		sessions: make(map[*Client]time.Time),
+		dirty:    make(map[string]bool),
+	}
+}
+
+// Load reads saved statistics from storage, where Save writes them from
+// then on.
+func (tracker *ActivityTracker) Load(storage Storage) error {
+	users, err := storage.LoadActivity()
+	if err != nil {
+		return err
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.storage, tracker.users = storage, users
+	return nil
+}
+
+// Save writes the statistics of the users that have changed since the
+// last save.
+func (tracker *ActivityTracker) Save() error {
+	tracker.mutex.Lock()
+	storage := tracker.storage
+	changed := make(map[string]*UserActivity, len(tracker.dirty))
+	for key := range tracker.dirty {
+		copied := *tracker.users[key]
+		changed[key] = &copied
+	}
+	clear(tracker.dirty)
+	tracker.mutex.Unlock()
+	if len(changed) == 0 {
+		return nil
+	}
+
+	err := storage.SaveActivity(changed)
+	if err != nil {
+		tracker.mutex.Lock()
+		for key := range changed {
+			tracker.dirty[key] = true
+		}
+		tracker.mutex.Unlock()
+	}
+	return err
+}
+
+// saveLoop writes the statistics when they have changed, so a crash loses
+// little.
+func (tracker *ActivityTracker) saveLoop() {
+	for range time.Tick(ACTIVITY_SAVE_INTERVAL) {
+		if err := tracker.Save(); err != nil {
+			slog.Error("Error saving activity", "err", err)
+		}
+	}
+}
+
+// user returns the entry for name, creating it, and marks it changed; the
+// caller holds the lock.
+func (tracker *ActivityTracker) user(name string) *UserActivity {
+	key := strings.ToLower(name)
+	activity, ok := tracker.users[key]
+	if !ok {
+		activity = &UserActivity{FirstSeen: time.Now()}
+		tracker.users[key] = activity
+	}
+	tracker.dirty[key] = true
+	return activity
+}
+
+// FirstSeen returns when name was first seen, or now if it never has been.
+// Unlike Get it doesn't look at open sessions, so it's cheap.
+func (tracker *ActivityTracker) FirstSeen(name string) time.Time {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if activity, ok := tracker.users[strings.ToLower(name)]; ok {
+		return activity.FirstSeen
+	}
+	return time.Now()
+}
+
+func (tracker *ActivityTracker) Joined(client *Client) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.user(client.name()).LastSeen = time.Now()
+	tracker.sessions[client] = time.Now()
+}
+
+// Left ends a client's session. Called from the hub, so it leaves saving
+// to saveLoop.
+func (tracker *ActivityTracker) Left(client *Client) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	start, ok := tracker.sessions[client]
+	if !ok {
+		return
+	}
+	delete(tracker.sessions, client)
+	activity := tracker.user(client.name())
+	activity.Online += time.Since(start)
+	activity.LastSeen = time.Now()
+}
+
+func (tracker *ActivityTracker) Message(client *Client) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.user(client.name()).Messages++
+}
+
+// snapshot returns a copy of the statistics for name, with the time of any
+// sessions still open added on; the caller holds the lock.
+func (tracker *ActivityTracker) snapshot(name string) (UserActivity, bool) {
+	activity, ok := tracker.users[strings.ToLower(name)]
+	if !ok {
+		return UserActivity{}, false
+	}
+	copied := *activity
+	for client, start := range tracker.sessions {
+		if strings.EqualFold(client.name(), name) {
+			copied.Online += time.Since(start)
+		}
+	}
+	return copied, true
+}
+
+func (tracker *ActivityTracker) Get(name string) (UserActivity, bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.snapshot(name)
+}
+
+// Ranked returns all known usernames ordered by message count, most first.
+func (tracker *ActivityTracker) Ranked() []string {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	names := make([]string, 0, len(tracker.users))
+	for name := range tracker.users {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := tracker.users[names[i]], tracker.users[names[j]]
+		if a.Messages != b.Messages {
+			return a.Messages > b.Messages
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+func formatActivity(name string, activity UserActivity) string {
+	return fmt.Sprintf("%s: %d messages, first seen %s, last seen %s, online %s",
+		name, activity.Messages,
+		activity.FirstSeen.Format("2006-01-02"),
+		activity.LastSeen.Format("2006-01-02 15:04"),
+		activity.Online.Round(time.Minute))
+}
+
+// report lists the most and least active users.
+func (tracker *ActivityTracker) report() string {
+	names := tracker.Ranked()
+	if len(names) == 0 {
+		return "*** No activity recorded yet ***"
+	}
+
+	line := func(name string) string {
+		activity, _ := tracker.Get(name)
+		return "  " + formatActivity(name, activity)
+	}
+
+	lines := []string{"--- Most active ---"}
+	for i := 0; i < len(names) && i < ACTIVITY_REPORT_SIZE; i++ {
+		lines = append(lines, line(names[i]))
+	}
+	if len(names) > ACTIVITY_REPORT_SIZE {
+		lines = append(lines, "--- Least active ---")
+		start := max(len(names)-ACTIVITY_REPORT_SIZE, ACTIVITY_REPORT_SIZE)
+		for i := len(names) - 1; i >= start; i-- {
+			lines = append(lines, line(names[i]))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// handleActivityCommand implements /activity [user|top]. The top report
+// covers everyone, so it's for admins.
+func (server *ChatServer) handleActivityCommand(client *Client, message string) {
+	fields := strings.Fields(message)
+
+	name := client.name()
+	if len(fields) > 1 {
+		name = fields[1]
+	}
+	if name == "top" {
+		if !client.atLeast(ROLE_ADMIN) {
+			client.messages <- fmt.Sprintf("*** /activity top needs the %s role ***", ROLE_ADMIN)
+			return
+		}
+		client.messages <- server.activity.report()
+		return
+	}
+
+	activity, ok := server.activity.Get(name)
+	if !ok {
+		client.messages <- fmt.Sprintf("*** No activity recorded for %s ***", name)
+		return
+	}
+	client.messages <- "*** " + formatActivity(name, activity) + " ***"
+}
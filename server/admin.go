@@ -0,0 +1,756 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Admin HTTP API, on --admin-listen. Every request must carry
+// "Authorization: Bearer <token>", with the token from --admin-token,
+// --admin-token-file or $CHAT_ADMIN_TOKEN.
+
+var errServerStopped = errors.New("the server is shutting down")
+
+// inHub runs an admin operation on run's goroutine and waits for it to
+// finish. The operation must not hold server.mutex when it returns.
+func (server *ChatServer) inHub(ctx context.Context, operation func()) error {
+	done := make(chan struct{})
+	select {
+	case server.control <- func() { defer close(done); operation() }:
+	case <-server.stopped:
+		return errServerStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// ClientInfo is how the admin API describes a connected client.
+type ClientInfo struct {
+	Name     string    `json:"name"`
+	Room     string    `json:"room"`
+	Remote   string    `json:"remote"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+func (server *ChatServer) clientInfo() []ClientInfo {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	infos := make([]ClientInfo, 0, len(server.clients))
+	for client := range server.clients {
+		infos = append(infos, ClientInfo{
+			Name:     client.name(),
+			Room:     client.room,
+			Remote:   client.conn.RemoteAddr().String(),
+			JoinedAt: client.joinedAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// findClients returns the connected clients called name, ignoring case.
+// Names are unique, so there is at most one.
+func (server *ChatServer) findClients(name string) []*Client {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	var found []*Client
+	for client := range server.clients {
+		if strings.EqualFold(client.name(), name) {
+			found = append(found, client)
+		}
+	}
+	return found
+}
+
+// kick disconnects every client called name and reports how many there
+// were. by names who did it.
+func (server *ChatServer) kick(name, by, reason string) int {
+	clients := server.findClients(name)
+	if len(clients) == 0 {
+		return 0
+	}
+
+	notice := fmt.Sprintf("*** %s was kicked by %s ***", clients[0].name(), by)
+	if reason != "" {
+		notice = fmt.Sprintf("*** %s was kicked by %s (%s) ***", clients[0].name(), by, reason)
+	}
+	slog.Info("Kicked", "user", clients[0].name(), "by", by, "reason", reason)
+	server.audit(AuditEntry{Event: AUDIT_KICK, Actor: by, Target: clients[0].name(), Detail: reason})
+	server.exportModeration(EVENT_KICK, clients[0].name(), by, reason, time.Time{})
+	for _, client := range clients {
+		// Closing the connection ends readPump, which unregisters the client
+		client.kicked.Store(true)
+		client.conn.Close()
+	}
+	server.notify("", notice)
+	return len(clients)
+}
+
+// RoomDetail is how the admin API describes one room.
+type RoomDetail struct {
+	RoomInfo
+	Users []string   `json:"users,omitempty"`
+	Ops   []string   `json:"ops,omitempty"`
+	ACL   []ACLEntry `json:"acl,omitempty"`
+}
+
+// adminRooms describes every room, whether anyone is in it or it only
+// has saved settings, sorted by name.
+func (server *ChatServer) adminRooms() []RoomInfo {
+	rooms := server.roomList()
+	active := make(map[string]bool, len(rooms))
+	for _, room := range rooms {
+		active[room.Name] = true
+	}
+	for _, settings := range server.roomStore.List() {
+		if !active[settings.Name] {
+			rooms = append(rooms, RoomInfo{
+				Name:       settings.Name,
+				CreatedAt:  settings.CreatedAt,
+				Owner:      settings.Owner,
+				Password:   settings.hasPassword(),
+				InviteOnly: settings.InviteOnly,
+				Topic:      settings.Topic,
+			})
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	if server.config.Backplane != "" {
+		for i := range rooms {
+			rooms[i].Node = server.roomHome(rooms[i].Name)
+		}
+	}
+	return rooms
+}
+
+// adminRoom describes a room and who is in it.
+func (server *ChatServer) adminRoom(name string) (RoomDetail, bool) {
+	for _, room := range server.adminRooms() {
+		if room.Name == name {
+			settings, _ := server.roomStore.Get(name)
+			return RoomDetail{RoomInfo: room, Users: server.roomMembers(name), Ops: settings.Ops, ACL: settings.ACL}, true
+		}
+	}
+	return RoomDetail{}, false
+}
+
+// setRoomTopic changes a room's topic, or clears it if text is "", and
+// tells its members.
+func (server *ChatServer) setRoomTopic(name, text, by string) error {
+	err := server.roomStore.Update(name, server.roomOwner(name), func(settings *RoomSettings) {
+		settings.Topic, settings.TopicBy, settings.TopicAt = text, by, time.Now()
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Topic changed", "room", name, "topic", text, "by", by)
+	if text == "" {
+		server.notify(name, fmt.Sprintf("*** %s cleared the topic of %s ***", by, name))
+	} else {
+		server.notify(name, fmt.Sprintf("*** %s changed the topic of %s to: %s ***", by, name, text))
+	}
+	return nil
+}
+
+// setRoomOwner gives a room to user, who need not be online. As with
+// /transfer, the previous owner stays on as an operator.
+func (server *ChatServer) setRoomOwner(name, user, by string) error {
+	owner, key := server.roomOwner(name), strings.ToLower(user)
+	err := server.roomStore.Update(name, owner, func(settings *RoomSettings) {
+		settings.Ops = slices.DeleteFunc(settings.Ops, func(op string) bool { return op == key })
+		if owner != "" && owner != key {
+			settings.Ops = append(settings.Ops, owner)
+		}
+		settings.Owner = key
+	})
+	if err != nil {
+		return err
+	}
+	server.mutex.Lock()
+	if room, ok := server.rooms[name]; ok {
+		room.owner = key
+	}
+	server.mutex.Unlock()
+	slog.Info("Room transferred", "room", name, "from", owner, "to", user, "by", by)
+	server.notify(name, fmt.Sprintf("*** %s gave %s to %s ***", by, name, user))
+	return nil
+}
+
+// closeRoom moves everyone in a room to the lobby and forgets its
+// settings, reporting whether there was such a room. The lobby can't be
+// closed.
+func (server *ChatServer) closeRoom(name, by string) (bool, error) {
+	moved := server.emptyRoom(name, fmt.Sprintf("*** %s closed %s; you are back in %s ***", by, name, LOBBY))
+	forgotten, err := server.roomStore.Delete(name)
+	if err != nil {
+		return moved > 0, err
+	}
+	if moved == 0 && !forgotten {
+		return false, nil
+	}
+	slog.Info("Room closed", "room", name, "by", by, "moved", moved)
+	return true, nil
+}
+
+// emptyRoom moves everyone in a room to the lobby, telling them why with
+// notice, and returns how many there were.
+func (server *ChatServer) emptyRoom(name, notice string) int {
+	server.mutex.Lock()
+	var moved []*Client
+	if room, ok := server.rooms[name]; ok {
+		for client := range room.members {
+			moved = append(moved, client)
+		}
+	}
+	for _, client := range moved {
+		server.enterRoom(client, LOBBY)
+		client.deliver(notice, PRIORITY_SYSTEM)
+	}
+	server.mutex.Unlock()
+
+	for _, client := range moved {
+		server.notifyMembership(LOBBY, membershipLine(protocol.EVENT_JOIN, client.name(), LOBBY))
+	}
+	if len(moved) > 0 {
+		server.sendUserList(LOBBY)
+	}
+	return len(moved)
+}
+
+// ServerStats is the admin API's summary of the server.
+type ServerStats struct {
+	StartedAt time.Time `json:"started_at"`
+	Uptime    string    `json:"uptime"`
+	Clients   int       `json:"clients"`
+	Messages  int64     `json:"messages"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Throttled string    `json:"egress_throttled"`
+	Links     []string  `json:"links,omitempty"`
+	Nodes     []string  `json:"nodes,omitempty"`
+}
+
+func (server *ChatServer) stats() ServerStats {
+	server.mutex.RLock()
+	clients := len(server.clients)
+	server.mutex.RUnlock()
+
+	stats := ServerStats{
+		StartedAt: server.startedAt,
+		Uptime:    time.Since(server.startedAt).Round(time.Second).String(),
+		Clients:   clients,
+		Messages:  server.messageCount.Load(),
+		BytesIn:   server.traffic.bytesIn.Load(),
+		BytesOut:  server.traffic.bytesOut.Load(),
+		Throttled: server.egress.Throttled().Round(time.Millisecond).String(),
+	}
+	if server.links != nil {
+		stats.Links = server.links.LinkedServers()
+	}
+	stats.Nodes = server.cluster.Nodes()
+	return stats
+}
+
+// adminConfig reports the server's settings.
+func (server *ChatServer) adminConfig() map[string]any {
+	live := server.config.live()
+	return map[string]any{
+		"listen":                 server.config.Listen,
+		"max_clients":            live.MaxClients,
+		"max_connections_per_ip": live.MaxPerAddress,
+		"backpressure":           server.config.Backpressure,
+		"bots":                   server.config.Bots.String(),
+		"max_message_bytes":      server.config.MaxMessageBytes,
+		"login_timeout":          server.config.LoginTimeout.String(),
+		"write_timeout":          server.config.WriteTimeout.String(),
+		"auto_away":              server.config.AutoAway.String(),
+		"tls":                    server.config.TLS.enabled(),
+		"tls_listen":             server.config.TLS.Listen,
+		"socket":                 server.config.Socket,
+		"proxy_protocol":         server.config.ProxyProtocol,
+		"grpc_listen":            server.config.GRPCListen,
+		"grpc_tls":               server.config.GRPCCert != "",
+		"grpc_client_ca":         server.config.GRPCClientCA,
+		"quic_listen":            server.config.QUICListen,
+		"ssh_listen":             server.config.SSHListen,
+		"audit_log":              server.config.Audit.File,
+		"audit_syslog":           server.config.Audit.Syslog,
+		"wrap_width":             WRAP_WIDTH,
+		"egress_kb_per_sec":      server.config.EgressKBPerSec,
+		"digest_hour":            server.config.Digest.Hour,
+		"link_listen":            server.config.Link.Listen,
+		"link_peers":             server.config.Link.peers(),
+		"events_file":            server.config.EventsFile,
+		"webhooks":               server.config.Webhooks.String(),
+		"inbound_listen":         server.config.InboundListen,
+		"inbound_name":           server.config.InboundName,
+		"feed_listen":            server.config.FeedListen,
+		"files_listen":           server.config.FilesListen,
+		"files_dir":              server.config.FilesDir,
+		"max_file_mb":            server.config.MaxFileMB,
+		"files_retention":        server.config.FilesRetention.String(),
+		"history_file":           HISTORY_FILE,
+		"activity_file":          ACTIVITY_FILE,
+		"emotes_file":            EMOTES_FILE,
+		"invite_only":            server.config.InviteOnly,
+		"invites_file":           INVITES_FILE,
+		"mail_file":              MAIL_FILE,
+		"node":                   server.config.Node,
+		"tenant":                 server.tenant,
+		"tenants":                server.config.Tenants.String(),
+		"storage":                describeStorage(server.config.Storage),
+		"storage_pool":           server.config.StoragePool,
+		"chat_format":            server.config.Formats.Chat,
+		"join_format":            server.config.Formats.Join,
+		"leave_format":           server.config.Formats.Leave,
+		"pm_format":              server.config.Formats.PM,
+		"accounts_file":          ACCOUNTS_FILE,
+		"bans_file":              BANS_FILE,
+		"translate_url":          server.config.Translate.URL,
+		"push_url":               server.config.Push.URL,
+		"new_user_period":        server.config.NewUserPeriod.String(),
+		"new_user_slow_mode":     server.config.NewUserSlowMode.String(),
+		"metrics_listen":         server.config.MetricsListen,
+		"admin_listen":           server.config.AdminListen,
+		"status_listen":          server.config.StatusListen,
+		"websocket_listen":       server.config.WebSocketListen,
+		"console_socket":         server.config.ConsoleSocket,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// requireToken rejects requests without the bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "missing or wrong token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminHandler serves the admin API:
+//
+//	GET    /admin/clients             connected clients
+//	DELETE /admin/clients/{name}      kick a client (?reason=...)
+//	POST   /admin/announce            send an announcement (?text=...)
+//	GET    /admin/connections         every open connection, in detail
+//	GET    /admin/stats               server statistics
+//	GET    /admin/config              server settings
+//	GET    /admin/search              search the history (?q=...&room=...&from=...&since=...&until=...&page=N&per_page=N)
+//	GET    /admin/bans                bans in force
+//	POST   /admin/bans                ban a user, IP or CIDR range (?target=...&duration=...&reason=...)
+//	DELETE /admin/bans/{target}       lift a ban
+//	GET    /admin/invites             outstanding invite codes
+//	POST   /admin/invites             create a code (?uses=N&note=...)
+//	DELETE /admin/invites/{code}      revoke a code
+//	GET    /admin/rooms               every room, active or with saved settings
+//	GET    /admin/rooms/{name}        one room, with who is in it
+//	PUT    /admin/rooms/{name}/topic  set a room's topic (?text=..., empty to clear)
+//	PUT    /admin/rooms/{name}/owner  give a room to a user (?user=...)
+//	DELETE /admin/rooms/{name}        close a room, moving its members to the lobby
+//	GET    /admin/motd                the message of the day
+//	PUT    /admin/motd                set it until the next reload (?text=..., empty to remove)
+//	GET    /admin/logs                recent log lines, as text (?lines=N&follow=true)
+//	GET    /admin/events              the event log, as JSON lines (?after=N&follow=true)
+//
+// Room names may leave out the leading #, which would otherwise need
+// escaping as %23.
+//
+// Anything that reads or changes who is online goes through run, by way
+// of inHub.
+func (server *ChatServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// hub runs operation with inHub, answering 503 if the server has
+	// stopped
+	hub := func(w http.ResponseWriter, r *http.Request, operation func()) bool {
+		if err := server.inHub(r.Context(), operation); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return false
+		}
+		return true
+	}
+
+	mux.HandleFunc("GET /admin/clients", func(w http.ResponseWriter, r *http.Request) {
+		var clients []ClientInfo
+		if hub(w, r, func() { clients = server.clientInfo() }) {
+			writeJSON(w, http.StatusOK, clients)
+		}
+	})
+
+	mux.HandleFunc("DELETE /admin/clients/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		var kicked int
+		if !hub(w, r, func() { kicked = server.kick(name, "an administrator", r.URL.Query().Get("reason")) }) {
+			return
+		}
+		if kicked == 0 {
+			writeError(w, http.StatusNotFound, "no client called "+name)
+			return
+		}
+		slog.Info("Admin API: kicked", "user", name, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("POST /admin/announce", func(w http.ResponseWriter, r *http.Request) {
+		text := strings.TrimSpace(r.URL.Query().Get("text"))
+		if text == "" {
+			writeError(w, http.StatusBadRequest, "text is required")
+			return
+		}
+		if hub(w, r, func() { server.announce(text, "the admin API") }) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	mux.HandleFunc("GET /admin/connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, server.inspectConnections())
+	})
+
+	mux.HandleFunc("GET /admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, server.stats())
+	})
+
+	mux.HandleFunc("GET /admin/search", func(w http.ResponseWriter, r *http.Request) {
+		query, err := searchQueryFrom(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, server.history.Search(query))
+	})
+
+	mux.HandleFunc("GET /admin/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, server.adminConfig())
+	})
+
+	mux.HandleFunc("GET /admin/bans", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, server.bans.List())
+	})
+
+	mux.HandleFunc("POST /admin/bans", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("target") == "" {
+			writeError(w, http.StatusBadRequest, "target is required")
+			return
+		}
+		ban := Ban{Reason: query.Get("reason"), By: "an administrator"}
+		ban.Target, ban.Address = addressTarget(query.Get("target"))
+		if value := query.Get("duration"); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration <= 0 {
+				writeError(w, http.StatusBadRequest, "durations look like 30s, 10m or 2h")
+				return
+			}
+			ban.Until = time.Now().Add(duration)
+		}
+
+		var err error
+		ok := hub(w, r, func() {
+			if err = server.bans.Add(ban); err == nil {
+				server.enforceBan(&ban, len(ROLE_RANKS))
+			}
+		})
+		if !ok {
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		slog.Info("Admin API: banned", "target", ban.Target, "until", ban.Until, "remote", r.RemoteAddr)
+		writeJSON(w, http.StatusCreated, ban)
+	})
+
+	mux.HandleFunc("DELETE /admin/bans/{target...}", func(w http.ResponseWriter, r *http.Request) {
+		target := r.PathValue("target")
+		removed, err := server.bans.Remove(target)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, target+" isn't banned")
+			return
+		}
+		slog.Info("Admin API: unbanned", "target", target, "remote", r.RemoteAddr)
+		server.audit(AuditEntry{Event: AUDIT_UNBAN, Actor: "an administrator", Remote: r.RemoteAddr, Target: target})
+		server.exportModeration(EVENT_UNBAN, target, "an administrator", "", time.Time{})
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /admin/invites", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, server.invites.List())
+	})
+
+	mux.HandleFunc("POST /admin/invites", func(w http.ResponseWriter, r *http.Request) {
+		uses := 1
+		if value := r.URL.Query().Get("uses"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "uses must be a number")
+				return
+			}
+			uses = n
+		}
+		invite, err := server.invites.Create(uses, r.URL.Query().Get("note"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("Admin API: created invite", "code", invite.Code, "remote", r.RemoteAddr)
+		writeJSON(w, http.StatusCreated, invite)
+	})
+
+	mux.HandleFunc("DELETE /admin/invites/{code}", func(w http.ResponseWriter, r *http.Request) {
+		code := r.PathValue("code")
+		ok, err := server.invites.Revoke(code)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "no invite "+code)
+			return
+		}
+		slog.Info("Admin API: revoked invite", "code", code, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// room takes the room name from the path, answering 400 if it isn't
+	// one
+	room := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		name, ok := normalizeRoomName(r.PathValue("name"))
+		if !ok {
+			writeError(w, http.StatusBadRequest, "no such room name: "+r.PathValue("name"))
+		}
+		return name, ok
+	}
+
+	mux.HandleFunc("GET /admin/rooms", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, server.adminRooms())
+	})
+
+	mux.HandleFunc("GET /admin/rooms/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := room(w, r)
+		if !ok {
+			return
+		}
+		detail, ok := server.adminRoom(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, "no room "+name)
+			return
+		}
+		writeJSON(w, http.StatusOK, detail)
+	})
+
+	mux.HandleFunc("PUT /admin/rooms/{name}/topic", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := room(w, r)
+		if !ok {
+			return
+		}
+		text := strings.TrimSpace(r.URL.Query().Get("text"))
+		if len(text) > MAX_TOPIC_LENGTH {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("topics are at most %d characters", MAX_TOPIC_LENGTH))
+			return
+		}
+		if _, ok := server.adminRoom(name); !ok {
+			writeError(w, http.StatusNotFound, "no room "+name)
+			return
+		}
+		if err := server.setRoomTopic(name, text, "an administrator"); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		slog.Info("Admin API: set topic", "room", name, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("PUT /admin/rooms/{name}/owner", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := room(w, r)
+		if !ok {
+			return
+		}
+		user := r.URL.Query().Get("user")
+		if !validName(user) {
+			writeError(w, http.StatusBadRequest, "user must be "+NAME_RULE)
+			return
+		}
+		if name == LOBBY {
+			writeError(w, http.StatusBadRequest, "the lobby has no owner")
+			return
+		}
+		if _, ok := server.adminRoom(name); !ok {
+			writeError(w, http.StatusNotFound, "no room "+name)
+			return
+		}
+		if err := server.setRoomOwner(name, user, "an administrator"); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		slog.Info("Admin API: transferred room", "room", name, "to", user, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("DELETE /admin/rooms/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := room(w, r)
+		if !ok {
+			return
+		}
+		if name == LOBBY {
+			writeError(w, http.StatusBadRequest, "the lobby can't be closed")
+			return
+		}
+		var closed bool
+		var err error
+		if !hub(w, r, func() { closed, err = server.closeRoom(name, "an administrator") }) {
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !closed {
+			writeError(w, http.StatusNotFound, "no room "+name)
+			return
+		}
+		slog.Info("Admin API: closed room", "room", name, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /admin/motd", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"motd": server.config.live().MOTD})
+	})
+
+	mux.HandleFunc("PUT /admin/motd", func(w http.ResponseWriter, r *http.Request) {
+		server.setMOTD(strings.TrimSpace(r.URL.Query().Get("text")))
+		slog.Info("Admin API: set the message of the day", "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /admin/logs", func(w http.ResponseWriter, r *http.Request) {
+		lines := LOG_TAIL_LINES
+		if value := r.URL.Query().Get("lines"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, "lines must be a number")
+				return
+			}
+			lines = n
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if r.URL.Query().Get("follow") != "true" {
+			for _, line := range server.logs.recent(lines) {
+				io.WriteString(w, line)
+			}
+			return
+		}
+
+		recent, follower := server.logs.follow(lines)
+		defer server.logs.unfollow(follower)
+		controller := http.NewResponseController(w)
+		w.WriteHeader(http.StatusOK)
+		for _, line := range recent {
+			io.WriteString(w, line)
+		}
+		if controller.Flush() != nil {
+			return
+		}
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case line, ok := <-follower:
+				if !ok {
+					return
+				}
+				io.WriteString(w, line)
+				if controller.Flush() != nil {
+					return
+				}
+			}
+		}
+	})
+
+	mux.HandleFunc("GET /admin/events", func(w http.ResponseWriter, r *http.Request) {
+		var after int64
+		if value := r.URL.Query().Get("after"); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, "after must be a number")
+				return
+			}
+			after = n
+		}
+
+		// Following starts before the replay, and skips what it replayed,
+		// so nothing appended in between is missed
+		var follower chan ChatEvent
+		if r.URL.Query().Get("follow") == "true" {
+			follower = server.events.Follow()
+			defer server.events.Unfollow(follower)
+		}
+		controller := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		err := server.events.Replay(after, func(event ChatEvent) {
+			encoder.Encode(event)
+			after = event.Seq
+		})
+		if err != nil {
+			slog.Error("Admin API: error reading the event log", "err", err, "remote", r.RemoteAddr)
+			return
+		}
+		if follower == nil || controller.Flush() != nil {
+			return
+		}
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-follower:
+				if !ok {
+					return
+				}
+				if event.Seq <= after {
+					continue
+				}
+				if encoder.Encode(event) != nil || controller.Flush() != nil {
+					return
+				}
+			}
+		}
+	})
+
+	return server.auditRequests(requireToken(server.config.AdminToken, mux))
+}
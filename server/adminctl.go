@@ -0,0 +1,448 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// RunAdminCommand implements "chat admin", a command-line client for the
+// admin API, so routine operations don't need a chat connection.
+func RunAdminCommand(args []string) int {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CHAT_CONFIG"), "server config file to take the address and token from (default $CHAT_CONFIG)")
+	baseURL := flags.String("url", "", "admin API address (default from admin_listen)")
+	token := flags.String("token", "", "admin token (default from admin_token or admin_token_file, or $CHAT_ADMIN_TOKEN)")
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintln(out, "Usage: chatd admin [flags] COMMAND")
+		fmt.Fprintln(out, "\nCommands:")
+		fmt.Fprintln(out, "  clients                          list connected clients")
+		fmt.Fprintln(out, "  conns                            inspect every open connection")
+		fmt.Fprintln(out, "  kick NAME [REASON]               disconnect a client")
+		fmt.Fprintln(out, "  announce TEXT                    send an announcement to everyone")
+		fmt.Fprintln(out, "  stats                            show server statistics")
+		fmt.Fprintln(out, "  config                           show server settings")
+		fmt.Fprintln(out, "  bans                             list bans")
+		fmt.Fprintln(out, "  ban TARGET [DURATION] [REASON]   ban a user, IP or CIDR range")
+		fmt.Fprintln(out, "  unban TARGET                     lift a ban")
+		fmt.Fprintln(out, "  invites                          list outstanding invite codes")
+		fmt.Fprintln(out, "  invite [USES] [NOTE]             create an invite code")
+		fmt.Fprintln(out, "  revoke CODE                      delete an invite code")
+		fmt.Fprintln(out, "  rooms                            list rooms")
+		fmt.Fprintln(out, "  room ROOM                        show a room and who is in it")
+		fmt.Fprintln(out, "  topic ROOM [TEXT]                set or clear a room's topic")
+		fmt.Fprintln(out, "  transfer ROOM USER               give a room to a user")
+		fmt.Fprintln(out, "  close ROOM                       close a room, moving everyone to the lobby")
+		fmt.Fprintln(out, "  motd [TEXT|off]                  show, set or remove the message of the day")
+		fmt.Fprintln(out, "  logs [-f] [-n LINES]             show the server's recent log, -f to follow it")
+		fmt.Fprintln(out, "  events [-f] [-after SEQ]         print the event log as JSON lines, -f to follow it")
+		fmt.Fprintln(out, "\nFlags:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	config, err := ReadConfigFile(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *baseURL == "" {
+		*baseURL = "http://" + config.AdminListen
+		if config.AdminListen == "" || strings.HasPrefix(config.AdminListen, ":") {
+			*baseURL = "http://localhost" + config.AdminListen
+		}
+	}
+	if *token == "" {
+		*token = config.AdminToken
+	}
+
+	admin := &adminClient{baseURL: strings.TrimRight(*baseURL, "/"), token: *token}
+	command, rest := flags.Arg(0), flags.Args()[1:]
+
+	switch {
+	case command == "clients" && len(rest) == 0:
+		err = admin.clients()
+	case command == "kick" && len(rest) >= 1:
+		err = admin.kick(rest[0], strings.Join(rest[1:], " "))
+	case command == "announce" && len(rest) >= 1:
+		err = admin.announce(strings.Join(rest, " "))
+	case command == "conns" && len(rest) == 0:
+		err = admin.dump("/admin/connections")
+	case command == "stats" && len(rest) == 0:
+		err = admin.dump("/admin/stats")
+	case command == "config" && len(rest) == 0:
+		err = admin.dump("/admin/config")
+	case command == "bans" && len(rest) == 0:
+		err = admin.bans()
+	case command == "ban" && len(rest) >= 1:
+		err = admin.ban(rest)
+	case command == "unban" && len(rest) == 1:
+		err = admin.unban(rest[0])
+	case command == "invites" && len(rest) == 0:
+		err = admin.invites()
+	case command == "invite":
+		err = admin.invite(rest)
+	case command == "revoke" && len(rest) == 1:
+		err = admin.revoke(rest[0])
+	case command == "rooms" && len(rest) == 0:
+		err = admin.rooms()
+	case command == "room" && len(rest) == 1:
+		err = admin.dump(roomPath(rest[0]))
+	case command == "topic" && len(rest) >= 1:
+		err = admin.topic(rest[0], strings.Join(rest[1:], " "))
+	case command == "transfer" && len(rest) == 2:
+		err = admin.transfer(rest[0], rest[1])
+	case command == "close" && len(rest) == 1:
+		err = admin.closeRoom(rest[0])
+	case command == "motd":
+		err = admin.motd(strings.Join(rest, " "))
+	case command == "logs":
+		err = admin.logs(rest)
+	case command == "events":
+		err = admin.events(rest)
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+type adminClient struct {
+	baseURL string
+	token   string
+}
+
+// call makes a request and decodes a JSON response into result, if given.
+func (admin *adminClient) call(method, path string, result any) error {
+	response, err := admin.do(method, path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// do makes a request, turning an error status into an error.
+func (admin *adminClient) do(method, path string) (*http.Response, error) {
+	request, err := http.NewRequest(method, admin.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+admin.token)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		var apiError struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(response.Body).Decode(&apiError) == nil && apiError.Error != "" {
+			return nil, fmt.Errorf("%s: %s", response.Status, apiError.Error)
+		}
+		return nil, fmt.Errorf("%s", response.Status)
+	}
+	return response, nil
+}
+
+func (admin *adminClient) clients() error {
+	var clients []ClientInfo
+	if err := admin.call("GET", "/admin/clients", &clients); err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tROOM\tREMOTE\tONLINE")
+	for _, client := range clients {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", client.Name, client.Room, client.Remote, time.Since(client.JoinedAt).Round(time.Second))
+	}
+	return table.Flush()
+}
+
+func (admin *adminClient) kick(name, reason string) error {
+	path := "/admin/clients/" + url.PathEscape(name)
+	if reason != "" {
+		path += "?reason=" + url.QueryEscape(reason)
+	}
+	if err := admin.call("DELETE", path, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Kicked %s\n", name)
+	return nil
+}
+
+func (admin *adminClient) announce(text string) error {
+	if err := admin.call("POST", "/admin/announce?text="+url.QueryEscape(text), nil); err != nil {
+		return err
+	}
+	fmt.Println("Announced")
+	return nil
+}
+
+func (admin *adminClient) bans() error {
+	var bans []Ban
+	if err := admin.call("GET", "/admin/bans", &bans); err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TARGET	UNTIL	BY	REASON")
+	for _, ban := range bans {
+		until := "forever"
+		if !ban.Until.IsZero() {
+			until = ban.Until.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", ban.Target, until, ban.By, ban.Reason)
+	}
+	return table.Flush()
+}
+
+// ban bans a target; args are the target, an optional duration and a
+// reason.
+func (admin *adminClient) ban(args []string) error {
+	query := url.Values{"target": {args[0]}}
+	args = args[1:]
+	if len(args) > 0 {
+		if _, err := time.ParseDuration(args[0]); err == nil {
+			query.Set("duration", args[0])
+			args = args[1:]
+		}
+	}
+	if len(args) > 0 {
+		query.Set("reason", strings.Join(args, " "))
+	}
+
+	var ban Ban
+	if err := admin.call("POST", "/admin/bans?"+query.Encode(), &ban); err != nil {
+		return err
+	}
+	fmt.Printf("Banned %s\n", ban.Target)
+	return nil
+}
+
+func (admin *adminClient) unban(target string) error {
+	if err := admin.call("DELETE", "/admin/bans/"+url.PathEscape(target), nil); err != nil {
+		return err
+	}
+	fmt.Printf("Unbanned %s\n", target)
+	return nil
+}
+
+func (admin *adminClient) invites() error {
+	var invites []Invite
+	if err := admin.call("GET", "/admin/invites", &invites); err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "CODE\tUSED\tCREATED\tNOTE")
+	for _, invite := range invites {
+		fmt.Fprintf(table, "%s\t%d/%d\t%s\t%s\n", invite.Code, invite.Uses, invite.MaxUses,
+			invite.CreatedAt.Local().Format("2006-01-02 15:04"), invite.Note)
+	}
+	return table.Flush()
+}
+
+// invite creates a code; args are an optional use count and a note.
+func (admin *adminClient) invite(args []string) error {
+	query := url.Values{}
+	if len(args) > 0 {
+		if _, err := strconv.Atoi(args[0]); err == nil {
+			query.Set("uses", args[0])
+			args = args[1:]
+		}
+	}
+	if len(args) > 0 {
+		query.Set("note", strings.Join(args, " "))
+	}
+
+	var invite Invite
+	if err := admin.call("POST", "/admin/invites?"+query.Encode(), &invite); err != nil {
+		return err
+	}
+	fmt.Printf("%s (%d uses)\n", invite.Code, invite.MaxUses)
+	return nil
+}
+
+func (admin *adminClient) revoke(code string) error {
+	if err := admin.call("DELETE", "/admin/invites/"+url.PathEscape(code), nil); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked %s\n", code)
+	return nil
+}
+
+// roomPath is the admin API path for a room, without its # so it needn't
+// be escaped.
+func roomPath(name string) string {
+	return "/admin/rooms/" + url.PathEscape(strings.TrimPrefix(name, "#"))
+}
+
+func (admin *adminClient) rooms() error {
+	var rooms []RoomInfo
+	if err := admin.call("GET", "/admin/rooms", &rooms); err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ROOM\tMEMBERS\tOWNER\tACCESS\tTOPIC")
+	for _, room := range rooms {
+		access := "open"
+		switch {
+		case room.InviteOnly:
+			access = "invite-only"
+		case room.Password:
+			access = "password"
+		}
+		fmt.Fprintf(table, "%s\t%d\t%s\t%s\t%s\n", room.Name, room.Members, room.Owner, access, room.Topic)
+	}
+	return table.Flush()
+}
+
+func (admin *adminClient) topic(room, text string) error {
+	if err := admin.call("PUT", roomPath(room)+"/topic?text="+url.QueryEscape(text), nil); err != nil {
+		return err
+	}
+	if text == "" {
+		fmt.Printf("Cleared the topic of %s\n", room)
+	} else {
+		fmt.Printf("Set the topic of %s\n", room)
+	}
+	return nil
+}
+
+func (admin *adminClient) transfer(room, user string) error {
+	if err := admin.call("PUT", roomPath(room)+"/owner?user="+url.QueryEscape(user), nil); err != nil {
+		return err
+	}
+	fmt.Printf("Gave %s to %s\n", room, user)
+	return nil
+}
+
+func (admin *adminClient) closeRoom(room string) error {
+	if err := admin.call("DELETE", roomPath(room), nil); err != nil {
+		return err
+	}
+	fmt.Printf("Closed %s\n", room)
+	return nil
+}
+
+// motd shows the message of the day, or sets it to text; "off" removes it.
+func (admin *adminClient) motd(text string) error {
+	if text == "" {
+		var result struct {
+			MOTD string `json:"motd"`
+		}
+		if err := admin.call("GET", "/admin/motd", &result); err != nil {
+			return err
+		}
+		if result.MOTD == "" {
+			fmt.Println("There is no message of the day")
+		} else {
+			fmt.Println(result.MOTD)
+		}
+		return nil
+	}
+
+	if text == "off" {
+		text = ""
+	}
+	if err := admin.call("PUT", "/admin/motd?text="+url.QueryEscape(text), nil); err != nil {
+		return err
+	}
+	if text == "" {
+		fmt.Println("Removed the message of the day")
+	} else {
+		fmt.Println("Set the message of the day")
+	}
+	return nil
+}
+
+// logs prints the server's recent log lines and, with -f, the ones that
+// follow until interrupted.
+func (admin *adminClient) logs(args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := flags.Bool("f", false, "keep printing lines as they are logged")
+	lines := flags.Int("n", 20, "recent lines to show")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{"lines": {strconv.Itoa(*lines)}}
+	if *follow {
+		query.Set("follow", "true")
+	}
+	response, err := admin.do("GET", "/admin/logs?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(os.Stdout, response.Body)
+	if *follow && errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("the server closed the connection")
+	}
+	return err
+}
+
+func (admin *adminClient) events(args []string) error {
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	follow := flags.Bool("f", false, "keep printing events as they happen")
+	after := flags.Int64("after", 0, "only events numbered after this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{"after": {strconv.FormatInt(*after, 10)}}
+	if *follow {
+		query.Set("follow", "true")
+	}
+	response, err := admin.do("GET", "/admin/events?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(os.Stdout, response.Body)
+	if *follow && errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("the server closed the connection")
+	}
+	return err
+}
+
+// dump pretty-prints a JSON endpoint.
+func (admin *adminClient) dump(path string) error {
+	var value any
+	if err := admin.call("GET", path, &value); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(os.Stdout, string(data)+"\n")
+	return err
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Server-wide command aliases. Users can add their own with /alias; theirs
+// take precedence. A logged-in user's aliases are saved with its account
+// and come back when it logs in again; anyone else's last the session.
+var COMMAND_ALIASES = map[string]string{
+	"/quit": "exit",
+	"/q":    "exit",
+}
+
+const MAX_USER_ALIASES = 32
+
+// resolveAlias expands the command word of message if it names an alias,
+// keeping any arguments. Expansion happens once, so aliases can't loop.
+func (client *Client) resolveAlias(message string) string {
+	if !strings.HasPrefix(message, "/") {
+		return message
+	}
+
+	name, args, _ := strings.Cut(message, " ")
+	name = strings.ToLower(name)
+	target, ok := client.aliases[name]
+	if !ok {
+		target, ok = COMMAND_ALIASES[name]
+	}
+	if !ok {
+		return message
+	}
+	if args != "" {
+		return target + " " + args
+	}
+	return target
+}
+
+// handleAliasCommand implements /alias and /unalias:
+//
+//	/alias                list aliases
+//	/alias /w /wrap       define an alias
+//	/unalias /w           remove it
+func (server *ChatServer) handleAliasCommand(client *Client, message string) {
+	fields := strings.Fields(message)
+
+	if fields[0] == "/unalias" {
+		if len(fields) != 2 {
+			client.messages <- "*** Usage: /unalias /name ***"
+			return
+		}
+		name := strings.ToLower(fields[1])
+		if _, ok := client.aliases[name]; !ok {
+			client.messages <- fmt.Sprintf("*** No alias %s ***", name)
+			return
+		}
+		delete(client.aliases, name)
+		client.messages <- fmt.Sprintf("*** Alias %s removed ***", name)
+		server.saveAliases(client)
+		return
+	}
+
+	if len(fields) == 1 {
+		client.messages <- client.listAliases()
+		return
+	}
+
+	if len(fields) < 3 || !strings.HasPrefix(fields[1], "/") {
+		client.messages <- "*** Usage: /alias /name command [args] ***"
+		return
+	}
+	name := strings.ToLower(fields[1])
+	if name == "/alias" || name == "/unalias" {
+		client.messages <- "*** /alias and /unalias can't be redefined ***"
+		return
+	}
+	if _, exists := client.aliases[name]; !exists && len(client.aliases) >= MAX_USER_ALIASES {
+		client.messages <- fmt.Sprintf("*** You can have at most %d aliases ***", MAX_USER_ALIASES)
+		return
+	}
+
+	if client.aliases == nil {
+		client.aliases = make(map[string]string)
+	}
+	client.aliases[name] = strings.Join(fields[2:], " ")
+	client.messages <- fmt.Sprintf("*** Alias %s -> %s ***", name, client.aliases[name])
+	server.saveAliases(client)
+}
+
+// saveAliases saves client's aliases with its account, if it's logged in.
+func (server *ChatServer) saveAliases(client *Client) {
+	account := client.loggedInAs()
+	if account == "" {
+		return
+	}
+	if err := server.accounts.SaveAliases(account, client.aliases); err != nil {
+		client.logger().Error("Error saving aliases", "account", account, "err", err)
+		client.messages <- "*** Couldn't save your aliases; they'll last until you leave ***"
+	}
+}
+
+func (client *Client) listAliases() string {
+	var lines []string
+	for name, target := range COMMAND_ALIASES {
+		if _, overridden := client.aliases[name]; !overridden {
+			lines = append(lines, fmt.Sprintf("  %s -> %s", name, target))
+		}
+	}
+	for name, target := range client.aliases {
+		lines = append(lines, fmt.Sprintf("  %s -> %s (yours)", name, target))
+	}
+	sort.Strings(lines)
+	return "--- Aliases ---\n" + strings.Join(lines, "\n")
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Announcements are system notices to everyone on the server, in every
+// room. Admins send them with /announce; scheduled ones come from
+// "announce" lines in the config file (or --announce flags), each a cron
+// schedule followed by the text:
+//
+//	announce = "0 9 * * 1-5 Stand-up in #standup in 15 minutes"
+//	announce = "@every 2h Remember to take a break"
+const ANNOUNCE_FORMAT = "*** Announcement: %s ***"
+
+// Announcement is one scheduled announcement.
+type Announcement struct {
+	Spec     string // the schedule as written
+	Text     string
+	schedule schedule
+}
+
+// schedule says when something next happens after a time.
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+// announcementList collects the --announce flags; it is a flag.Value, so
+// every "announce" line in the config file adds one.
+type announcementList []Announcement
+
+func (list *announcementList) String() string {
+	if list == nil {
+		return ""
+	}
+	lines := make([]string, len(*list))
+	for i, announcement := range *list {
+		lines[i] = announcement.Spec + " " + announcement.Text
+	}
+	return strings.Join(lines, "; ")
+}
+
+func (list *announcementList) Set(value string) error {
+	announcement, err := parseAnnouncement(value)
+	if err != nil {
+		return err
+	}
+	*list = append(*list, announcement)
+	return nil
+}
+
+// parseAnnouncement splits "<schedule> <text>", where the schedule is five
+// cron fields or "@every <duration>".
+func parseAnnouncement(value string) (Announcement, error) {
+	fields := strings.Fields(value)
+	count := 5
+	if len(fields) > 0 && fields[0] == "@every" {
+		count = 2
+	}
+	if len(fields) <= count {
+		return Announcement{}, fmt.Errorf("announcement %q needs a schedule and text", value)
+	}
+
+	spec := strings.Join(fields[:count], " ")
+	var when schedule
+	var err error
+	if count == 2 {
+		when, err = parseEvery(fields[1])
+	} else {
+		when, err = parseCron(fields[:count])
+	}
+	if err != nil {
+		return Announcement{}, fmt.Errorf("announcement schedule %q: %v", spec, err)
+	}
+	return Announcement{Spec: spec, Text: strings.Join(fields[count:], " "), schedule: when}, nil
+}
+
+// everySchedule repeats at a fixed interval.
+type everySchedule time.Duration
+
+func parseEvery(value string) (schedule, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, err
+	}
+	if interval < time.Minute {
+		return nil, fmt.Errorf("interval must be at least a minute")
+	}
+	return everySchedule(interval), nil
+}
+
+func (every everySchedule) next(after time.Time) time.Time {
+	return after.Add(time.Duration(every))
+}
+
+// cronSchedule is a standard five-field cron schedule: minute, hour, day of
+// month, month and day of week, each a set of allowed values.
+type cronSchedule struct {
+	minute, hour, day, month, weekday uint64
+	anyDay, anyWeekday                bool
+}
+
+// Limits of the cron fields, in order
+var CRON_FIELDS = [5]struct{ min, max int }{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, 0 and 7 both Sunday
+}
+
+func parseCron(fields []string) (schedule, error) {
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, CRON_FIELDS[i].min, CRON_FIELDS[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %v", i+1, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		minute:     sets[0],
+		hour:       sets[1],
+		day:        sets[2],
+		month:      sets[3],
+		weekday:    sets[4],
+		anyDay:     strings.HasPrefix(fields[2], "*"),
+		anyWeekday: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField parses "*", "n", "a-b" and comma lists of them, each
+// optionally with a "/step".
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if base, stepText, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			part, step = base, n
+		}
+
+		low, high := min, max
+		if part != "*" {
+			lowText, highText, isRange := strings.Cut(part, "-")
+			var err error
+			if low, err = strconv.Atoi(lowText); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highText); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			}
+			if low < min || high > max || low > high {
+				return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+			}
+		}
+		for value := low; value <= high; value += step {
+			set |= 1 << value
+		}
+	}
+	return set, nil
+}
+
+// next finds the first whole minute after the given time that matches.
+// Like cron, when both the day of month and the day of week are
+// restricted, either one matching is enough.
+func (cron *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if cron.month&(1<<int(t.Month())) == 0 {
+			continue
+		}
+		dayMatches := cron.day&(1<<t.Day()) != 0
+		weekdayMatches := cron.weekday&(1<<int(t.Weekday())) != 0
+		switch {
+		case cron.anyDay && cron.anyWeekday:
+		case cron.anyDay && !weekdayMatches, cron.anyWeekday && !dayMatches:
+			continue
+		case !cron.anyDay && !cron.anyWeekday && !dayMatches && !weekdayMatches:
+			continue
+		}
+		if cron.hour&(1<<t.Hour()) != 0 && cron.minute&(1<<t.Minute()) != 0 {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// announce sends an announcement to everyone; by says who sent it, for
+// the log.
+func (server *ChatServer) announce(text, by string) {
+	slog.Info("Announcement", "by", by, "text", text)
+	server.notify("", fmt.Sprintf(ANNOUNCE_FORMAT, text))
+}
+
+// startAnnouncements sends the scheduled announcements until ctx is
+// cancelled.
+func (server *ChatServer) startAnnouncements(ctx context.Context) {
+	for _, announcement := range server.config.Announcements {
+		go func() {
+			for {
+				at := announcement.schedule.next(time.Now())
+				if at.IsZero() {
+					return
+				}
+				select {
+				case <-time.After(time.Until(at)):
+					server.announce(announcement.Text, "schedule")
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handleAnnounceCommand implements "/announce <text>".
+func (server *ChatServer) handleAnnounceCommand(client *Client, message string) {
+	_, text, _ := strings.Cut(message, " ")
+	text = strings.TrimSpace(text)
+	if text == "" {
+		client.messages <- "*** Usage: /announce <text> ***"
+		return
+	}
+	server.announce(text, client.name())
+}
+
+// handleMOTDCommand implements "/motd", which shows the message of the day
+// again.
+func (server *ChatServer) handleMOTDCommand(client *Client, message string) {
+	if !server.sendMOTD(client) {
+		client.messages <- "*** There is no message of the day ***"
+	}
+}
+
+// sendMOTD sends the message of the day, if there is one.
+func (server *ChatServer) sendMOTD(client *Client) bool {
+	motd := server.config.live().MOTD
+	if motd == "" {
+		return false
+	}
+	client.messages <- "--- Message of the day ---\n" + motd
+	return true
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit log. Security-relevant events (logins and failed logins, kicks,
+// bans and unbans, moderator and admin commands, console and admin API
+// actions, and connections turned away by a ban) are appended to
+// --audit-log, one JSON AuditEntry per line. The server only ever appends
+// to the file; rotating and archiving it is left to the operator. With
+// --audit-syslog the entries are also sent to syslog, under the authpriv
+// facility, for a collector that keeps its own copy.
+const (
+	AUDIT_FILE_MODE = 0600
+	AUDIT_BUFFER    = 1024 // entries waiting for syslog before they're dropped
+
+	SYSLOG_PRIORITY = 10<<3 | 5 // authpriv.notice
+	SYSLOG_TAG      = "chatd"
+)
+
+// Audit event types
+const (
+	AUDIT_LOGIN          = "login"
+	AUDIT_LOGIN_FAILED   = "login_failed"
+	AUDIT_REGISTER       = "register"
+	AUDIT_PASSWORD_RESET = "password_reset"
+	AUDIT_2FA            = "2fa"
+	AUDIT_KICK           = "kick"
+	AUDIT_BAN            = "ban"
+	AUDIT_UNBAN          = "unban"
+	AUDIT_COMMAND        = "command"
+	AUDIT_ADMIN_API      = "admin_api"
+	AUDIT_REFUSED        = "refused"
+	AUDIT_RELOAD         = "reload"
+)
+
+// Local syslog sockets, in the order they are tried
+var SYSLOG_SOCKETS = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// AuditEntry is one line of the audit log. Actor is who acted, a user
+// name or "an administrator" for the console and admin API, and Remote
+// their address; Target is who or what they acted on.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Actor  string    `json:"actor,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// AuditOptions says where the audit log goes. It is off unless one of
+// them is set.
+type AuditOptions struct {
+	File   string
+	Syslog string // local, or udp://host:port or tcp://host:port
+}
+
+func (options *AuditOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.File, "audit-log", options.File, "file to append security events to, as JSON lines (empty for none)")
+	flags.StringVar(&options.Syslog, "audit-syslog", options.Syslog, "also send security events to syslog: local, udp://host:port or tcp://host:port (empty for none)")
+}
+
+func (options *AuditOptions) validate() error {
+	if options.Syslog == "" {
+		return nil
+	}
+	_, _, err := syslogAddress(options.Syslog)
+	return err
+}
+
+// syslogAddress reads --audit-syslog as a network and address, with an
+// empty network for the local syslog socket.
+func syslogAddress(value string) (string, string, error) {
+	if value == "local" {
+		return "", "", nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "udp" && parsed.Scheme != "tcp") || parsed.Path != "" {
+		return "", "", fmt.Errorf("use local, udp://host:port or tcp://host:port, not %q", value)
+	}
+	if _, _, err := net.SplitHostPort(parsed.Host); err != nil {
+		return "", "", fmt.Errorf("%s: %v", value, err)
+	}
+	return parsed.Scheme, parsed.Host, nil
+}
+
+// auditLog writes audit entries to the file and hands them to syslog.
+type auditLog struct {
+	mutex  sync.Mutex
+	file   *os.File         // nil if not writing a file
+	syslog *syslogForwarder // nil if not forwarding
+}
+
+// open opens the audit log, or returns nil if it is off.
+func (options *AuditOptions) open() (*auditLog, error) {
+	if options.File == "" && options.Syslog == "" {
+		return nil, nil
+	}
+	audit := &auditLog{}
+	if options.File != "" {
+		file, err := os.OpenFile(options.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, AUDIT_FILE_MODE)
+		if err != nil {
+			return nil, err
+		}
+		audit.file = file
+	}
+	if options.Syslog != "" {
+		network, address, err := syslogAddress(options.Syslog)
+		if err != nil {
+			return nil, err
+		}
+		audit.syslog = newSyslogForwarder(network, address)
+	}
+	return audit, nil
+}
+
+// record writes an entry. The file is written before record returns, so
+// an action is on record before it is reported done.
+func (audit *auditLog) record(entry AuditEntry) {
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Error encoding audit entry", "err", err)
+		return
+	}
+	if audit.file != nil {
+		audit.mutex.Lock()
+		_, err := audit.file.Write(append(line, '\n'))
+		audit.mutex.Unlock()
+		if err != nil {
+			slog.Error("Error writing audit log", "event", entry.Event, "err", err)
+		}
+	}
+	if audit.syslog != nil {
+		audit.syslog.send(line)
+	}
+}
+
+// syslogForwarder sends entries to syslog from its own goroutine, as RFC
+// 5424 messages, dropping them if it falls too far behind. It connects
+// when it has something to send and again after an error.
+type syslogForwarder struct {
+	network string // "" for the local socket
+	address string
+	entries chan []byte
+}
+
+func newSyslogForwarder(network, address string) *syslogForwarder {
+	forwarder := &syslogForwarder{network: network, address: address, entries: make(chan []byte, AUDIT_BUFFER)}
+	go forwarder.run()
+	return forwarder
+}
+
+func (forwarder *syslogForwarder) send(line []byte) {
+	select {
+	case forwarder.entries <- line:
+	default:
+		slog.Warn("Audit syslog is backed up, dropping entry")
+	}
+}
+
+func (forwarder *syslogForwarder) run() {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	var conn net.Conn
+	for line := range forwarder.entries {
+		message := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", SYSLOG_PRIORITY,
+			time.Now().UTC().Format(time.RFC3339Nano), hostname, SYSLOG_TAG, os.Getpid(), line)
+		// TCP needs the messages framed; datagrams carry one each
+		if forwarder.network == "tcp" {
+			message = fmt.Sprintf("%d %s", len(message), message)
+		}
+
+		if conn == nil {
+			var err error
+			if conn, err = forwarder.dial(); err != nil {
+				slog.Warn("Error connecting to syslog, dropping audit entry", "err", err)
+				continue
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(message)); err != nil {
+			slog.Warn("Error sending audit entry to syslog", "err", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (forwarder *syslogForwarder) dial() (net.Conn, error) {
+	if forwarder.network != "" {
+		return net.DialTimeout(forwarder.network, forwarder.address, 5*time.Second)
+	}
+	var err error
+	for _, path := range SYSLOG_SOCKETS {
+		for _, network := range []string{"unixgram", "unix"} {
+			var conn net.Conn
+			if conn, err = net.Dial(network, path); err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no local syslog socket: %v", err)
+}
+
+// audit records an entry if the audit log is on.
+func (server *ChatServer) audit(entry AuditEntry) {
+	if server.auditLog != nil {
+		server.auditLog.record(entry)
+	}
+}
+
+// auditClient records something a client did, to target.
+func (server *ChatServer) auditClient(event string, client *Client, target, detail string) {
+	server.audit(AuditEntry{
+		Event:  event,
+		Actor:  client.name(),
+		Remote: client.conn.RemoteAddr().String(),
+		Target: target,
+		Detail: detail,
+	})
+}
+
+// auditBan records a new ban.
+func (server *ChatServer) auditBan(ban *Ban) {
+	detail := "forever"
+	if !ban.Until.IsZero() {
+		detail = "until " + ban.Until.UTC().Format(time.RFC3339)
+	}
+	if ban.Reason != "" {
+		detail += ": " + ban.Reason
+	}
+	server.audit(AuditEntry{Event: AUDIT_BAN, Actor: ban.By, Target: ban.Target, Detail: detail})
+}
+
+// auditRequests records the admin API requests that change something, and
+// every request turned away for a missing or wrong token.
+func (server *ChatServer) auditRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if r.Method == http.MethodGet && recorder.status != http.StatusUnauthorized {
+			return
+		}
+		entry := AuditEntry{
+			Event:  AUDIT_ADMIN_API,
+			Actor:  "an administrator",
+			Remote: r.RemoteAddr,
+			Detail: fmt.Sprintf("%s %s: %d", r.Method, r.URL.RequestURI(), recorder.status),
+		}
+		if recorder.status == http.StatusUnauthorized {
+			entry.Event, entry.Actor = AUDIT_LOGIN_FAILED, ""
+		}
+		server.audit(entry)
+	})
+}
+
+// statusRecorder remembers the status a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the real writer, to flush a
+// stream.
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
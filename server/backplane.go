@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Cluster mode. Servers started with the same --backplane share chat,
+// actions, joins and leaves through it, so users on different nodes are in
+// the same conversation. Unlike links, nodes don't connect to each other
+// and names aren't marked with a server: the cluster is one chat server.
+// Without a backplane a server runs alone.
+const (
+	// Each node announces who is on it every CLUSTER_HEARTBEAT; nodes not
+	// heard from for CLUSTER_TIMEOUT are taken to be gone.
+	CLUSTER_HEARTBEAT = 15 * time.Second
+	CLUSTER_TIMEOUT   = 45 * time.Second
+
+	// Messages waiting to go out to the backplane before new ones are
+	// dropped
+	CLUSTER_BUFFER = 1024
+
+	// Message types listing the users on a node, saying that a node is
+	// shutting down, and carrying a room's settings
+	CLUSTER_PRESENCE = "presence"
+	CLUSTER_GONE     = "gone"
+	CLUSTER_ROOM     = "room"
+)
+
+// Backplane carries messages between the nodes of a cluster. Messages use
+// the link format, with Server naming the node that sent them.
+type Backplane interface {
+	// Publish sends a message to every node. It doesn't block; if the
+	// backplane can't keep up the message is dropped.
+	Publish(message LinkMessage)
+
+	// Messages delivers what the nodes publish, possibly including this
+	// node's own messages.
+	Messages() <-chan LinkMessage
+
+	Close() error
+}
+
+// localBackplane is the backplane of a server running alone.
+type localBackplane struct{}
+
+func (localBackplane) Publish(message LinkMessage)  {}
+func (localBackplane) Messages() <-chan LinkMessage { return nil }
+func (localBackplane) Close() error                 { return nil }
+
+// parseBackplane checks a --backplane URL, one of
+//
+//	redis://[:password@]host[:port][/channel]
+//	nats://[user:password@|token@]host[:port][/subject prefix]
+func parseBackplane(address string) (*url.URL, error) {
+	location, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if (location.Scheme != "redis" && location.Scheme != "nats") || location.Host == "" {
+		return nil, fmt.Errorf("%q isn't a redis:// or nats://host:port URL", address)
+	}
+	if prefix := strings.TrimPrefix(location.Path, "/"); location.Scheme == "nats" && prefix != "" {
+		for _, token := range strings.Split(prefix, ".") {
+			if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t") {
+				return nil, fmt.Errorf("%q isn't a NATS subject prefix", prefix)
+			}
+		}
+	}
+	return location, nil
+}
+
+// openBackplane connects to the backplane a --backplane URL names, or
+// returns the local one if there is none.
+func openBackplane(address string) (Backplane, error) {
+	if address == "" {
+		return localBackplane{}, nil
+	}
+	location, err := parseBackplane(address)
+	if err != nil {
+		return nil, err
+	}
+	host := location.Host
+	password, _ := location.User.Password()
+	path := strings.TrimPrefix(location.Path, "/")
+	if location.Scheme == "nats" {
+		if location.Port() == "" {
+			host += ":" + NATS_PORT
+		}
+		if path == "" {
+			path = NATS_PREFIX
+		}
+		// A user without a password is a token
+		user, token := location.User.Username(), ""
+		if _, set := location.User.Password(); !set {
+			user, token = "", user
+		}
+		return openNATSBackplane(host, user, password, token, path), nil
+	}
+	if location.Port() == "" {
+		host += ":" + REDIS_PORT
+	}
+	if path == "" {
+		path = REDIS_CHANNEL
+	}
+	return openRedisBackplane(host, password, path), nil
+}
+
+// defaultNodeName names a node after its host and chat port, which is
+// unique as long as nodes sharing a host listen on different ports.
+func defaultNodeName(listen string) string {
+	host, _ := os.Hostname()
+	return host + listen
+}
+
+// clusterPresence tracks the users on the other nodes.
+type clusterPresence struct {
+	mutex    sync.Mutex
+	users    map[string]map[string]int // node -> user -> sessions
+	lastSeen map[string]time.Time
+
+	// Whether a node has come or gone since membershipChanged was last
+	// called, and the nodes rooms were last given homes among
+	changed  bool
+	balanced []string
+}
+
+func newClusterPresence() *clusterPresence {
+	return &clusterPresence{
+		users:    make(map[string]map[string]int),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+// seen records that a node is alive, and returns its users.
+func (cluster *clusterPresence) seen(node string) map[string]int {
+	if _, known := cluster.lastSeen[node]; !known {
+		slog.Info("Cluster node joined", "node", node)
+		cluster.changed = true
+	}
+	cluster.lastSeen[node] = time.Now()
+	if cluster.users[node] == nil {
+		cluster.users[node] = make(map[string]int)
+	}
+	return cluster.users[node]
+}
+
+// Users lists the users on other nodes.
+func (cluster *clusterPresence) Users() []string {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	var users []string
+	for _, names := range cluster.users {
+		for name := range names {
+			users = append(users, name)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Nodes lists the other nodes.
+func (cluster *clusterPresence) Nodes() []string {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	var nodes []string
+	for node := range cluster.lastSeen {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// expire forgets nodes that have gone quiet.
+func (cluster *clusterPresence) expire() {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	for node, seen := range cluster.lastSeen {
+		if time.Since(seen) > CLUSTER_TIMEOUT {
+			slog.Warn("Cluster node timed out", "node", node)
+			delete(cluster.lastSeen, node)
+			delete(cluster.users, node)
+			cluster.changed = true
+		}
+	}
+}
+
+// membershipChanged reports whether a node has joined or gone since it
+// was last called.
+func (cluster *clusterPresence) membershipChanged() bool {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	changed := cluster.changed
+	cluster.changed = false
+	return changed
+}
+
+// relay passes a local event on to linked servers and the other nodes.
+func (server *ChatServer) relay(messageType, room, from, text string) {
+	if server.links != nil {
+		server.links.Relay(messageType, room, from, text)
+	}
+	server.backplane.Publish(LinkMessage{Type: messageType, Server: server.config.Node, Room: room, From: from, Text: text})
+}
+
+// startBackplane joins the cluster, if there is one, and handles what the
+// other nodes send until ctx is cancelled.
+func (server *ChatServer) startBackplane(ctx context.Context) error {
+	if server.config.Backplane == "" {
+		return nil
+	}
+	backplane, err := openBackplane(server.config.Backplane)
+	if err != nil {
+		return fmt.Errorf("opening backplane: %v", err)
+	}
+	if server.config.Node == "" {
+		server.config.Node = defaultNodeName(server.config.Listen)
+	}
+	server.backplane = backplane
+	server.roomStore.OnChange(server.publishRoom)
+	slog.Info("Joined cluster", "node", server.config.Node)
+
+	presence := func() {
+		backplane.Publish(LinkMessage{Type: CLUSTER_PRESENCE, Server: server.config.Node, Users: server.userNames()})
+	}
+	presence()
+	server.rebalanceRooms()
+	go func() {
+		heartbeat := time.NewTicker(CLUSTER_HEARTBEAT)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case message := <-backplane.Messages():
+				server.receiveCluster(message)
+			case <-heartbeat.C:
+				server.cluster.expire()
+				presence()
+			case <-ctx.Done():
+				backplane.Publish(LinkMessage{Type: CLUSTER_GONE, Server: server.config.Node})
+				backplane.Close()
+				return
+			}
+			if server.cluster.membershipChanged() {
+				server.rebalanceRooms()
+			}
+		}
+	}()
+	return nil
+}
+
+// receiveCluster handles a message from another node.
+func (server *ChatServer) receiveCluster(message LinkMessage) {
+	if message.Server == server.config.Node || message.Server == "" {
+		return
+	}
+	from := sanitizeText(message.From)
+	text := sanitizeText(message.Text)
+	room, ok := normalizeRoomName(message.Room)
+	if !ok {
+		room = LOBBY
+	}
+
+	cluster := server.cluster
+	switch message.Type {
+	case LINK_MESSAGE:
+		now := time.Now()
+		frame := protocol.Frame{Type: protocol.FRAME_CHAT, From: from, Room: room, Body: text, Timestamp: now}
+		server.send(room, withFrame(frame, fmt.Sprintf("[%s] %s: %s", now.Format("15:04:05"), from, text)), PRIORITY_CHATTER)
+
+	case LINK_ACTION:
+		frame := protocol.Frame{Type: protocol.FRAME_ACTION, From: from, Room: room, Body: text, Timestamp: time.Now()}
+		server.send(room, withFrame(frame, fmt.Sprintf(ACTION_FORMAT, from, text)), PRIORITY_CHATTER)
+
+	case LINK_JOIN:
+		cluster.mutex.Lock()
+		cluster.seen(message.Server)[from]++
+		cluster.mutex.Unlock()
+		server.notifyMembership("", membershipLine(protocol.EVENT_JOIN, from, ""))
+
+	case LINK_LEAVE:
+		cluster.mutex.Lock()
+		users := cluster.seen(message.Server)
+		if users[from]--; users[from] <= 0 {
+			delete(users, from)
+		}
+		cluster.mutex.Unlock()
+		server.notifyMembership("", membershipLine(protocol.EVENT_LEAVE, from, ""))
+
+	case CLUSTER_PRESENCE:
+		users := make(map[string]int)
+		for _, name := range message.Users {
+			users[sanitizeText(name)]++
+		}
+		cluster.mutex.Lock()
+		cluster.seen(message.Server)
+		cluster.users[message.Server] = users
+		cluster.mutex.Unlock()
+
+	case CLUSTER_GONE:
+		slog.Info("Cluster node left", "node", message.Server)
+		cluster.mutex.Lock()
+		delete(cluster.users, message.Server)
+		delete(cluster.lastSeen, message.Server)
+		cluster.changed = true
+		cluster.mutex.Unlock()
+
+	case CLUSTER_ROOM:
+		server.applyRoom(message.Room, message.Settings)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import "time"
+
+// Backpressure policies, chosen with --backpressure, say what send does
+// with chat for a client whose queue is full. Notices and direct messages
+// have queues of their own and aren't affected: a client that can't take
+// those is always disconnected.
+const (
+	// Drop the new message; the client misses it (the default)
+	BACKPRESSURE_DROP_NEWEST = "drop-newest"
+
+	// Drop the oldest waiting message to make room for the new one
+	BACKPRESSURE_DROP_OLDEST = "drop-oldest"
+
+	// Tell the client it fell behind and disconnect it
+	BACKPRESSURE_DISCONNECT = "disconnect"
+
+	// Wait for room, then disconnect as above. The wait is shared by one
+	// broadcast, so however many clients are slow it holds up everyone
+	// else's messages, and joins and leaves, for at most
+	// --backpressure-timeout.
+	BACKPRESSURE_BLOCK = "block"
+
+	// Time for a disconnect notice to go out before the connection closes
+	BACKPRESSURE_GRACE = time.Second
+)
+
+var BACKPRESSURE_POLICIES = map[string]bool{
+	BACKPRESSURE_DROP_NEWEST: true,
+	BACKPRESSURE_DROP_OLDEST: true,
+	BACKPRESSURE_DISCONNECT:  true,
+	BACKPRESSURE_BLOCK:       true,
+}
+
+// backpressure handles chat for a client whose queue is full, following
+// the configured policy. deadline is the end of the current broadcast's
+// wait under the block policy, set by the first client that waits. Called
+// from send, with server.mutex read-locked.
+func (server *ChatServer) backpressure(client *Client, text string, deadline *time.Time) {
+	server.metrics.backpressure.Add(1)
+	switch server.config.Backpressure {
+	case BACKPRESSURE_DROP_OLDEST:
+		select {
+		case <-client.messages:
+		default:
+		}
+		server.dropChatter(client)
+		if !client.deliver(text, PRIORITY_CHATTER) {
+			server.dropChatter(client)
+		}
+
+	case BACKPRESSURE_DISCONNECT:
+		server.disconnectLagging(client)
+
+	case BACKPRESSURE_BLOCK:
+		if deadline.IsZero() {
+			*deadline = time.Now().Add(server.config.BackpressureTimeout)
+		}
+		timer := time.NewTimer(time.Until(*deadline))
+		defer timer.Stop()
+		select {
+		case client.messages <- text:
+		case <-timer.C:
+			server.disconnectLagging(client)
+		}
+
+	default:
+		server.dropChatter(client)
+	}
+}
+
+// dropChatter counts a chat message a client missed, logging the first.
+func (server *ChatServer) dropChatter(client *Client) {
+	server.metrics.droppedMessages.Add(1)
+	if client.dropped.Add(1) == 1 {
+		client.logger().Warn("Client is falling behind, dropping messages", "policy", server.config.Backpressure)
+	}
+}
+
+// disconnectLagging tells a client that fell behind why it is being
+// disconnected and closes its connection once the notice has had time to
+// go out. Closing the connection ends its readPump, which unregisters it.
+func (server *ChatServer) disconnectLagging(client *Client) {
+	if !client.lagging.CompareAndSwap(false, true) {
+		return
+	}
+	server.metrics.droppedClients.Add(1)
+	client.logger().Warn("Client fell behind, disconnecting", "policy", server.config.Backpressure, "queued", client.queued())
+	client.deliver("*** Disconnected: you fell too far behind ***", PRIORITY_SYSTEM)
+	time.AfterFunc(BACKPRESSURE_GRACE, func() { client.conn.Close() })
+}
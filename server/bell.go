@@ -0,0 +1,71 @@
+package server
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Terminal bell, prepended to messages that should get the user's attention
+const BEL = "\a"
+
+// mentions reports whether message contains @name, ignoring case, with the
+// name not running on into a longer word.
+func mentions(message, name string) bool {
+	lower := strings.ToLower(message)
+	target := "@" + strings.ToLower(name)
+	for offset := 0; ; {
+		i := strings.Index(lower[offset:], target)
+		if i < 0 {
+			return false
+		}
+		end := offset + i + len(target)
+		next, _ := utf8.DecodeRuneInString(lower[end:])
+		if end == len(lower) || !(unicode.IsLetter(next) || unicode.IsDigit(next) || next == '_' || next == '-') {
+			return true
+		}
+		offset = end
+	}
+}
+
+// shouldNotify reports whether message is addressed to the client.
+func (client *Client) shouldNotify(message string) bool {
+	return isDirectMessage(message) || mentions(message, client.name())
+}
+
+// wantsBell reports whether the client has asked for notifications and
+// message is one.
+func (client *Client) wantsBell(message string) bool {
+	client.mutex.Lock()
+	bell := client.bell
+	client.mutex.Unlock()
+	return bell && client.shouldNotify(message)
+}
+
+// withBell prefixes a BEL to messages that mention the client, if it has
+// asked for notifications.
+func (client *Client) withBell(message string) string {
+	if client.wantsBell(message) {
+		return BEL + message
+	}
+	return message
+}
+
+// handleBellCommand implements "/bell on|off".
+func (client *Client) handleBellCommand(message string) {
+	_, arg, _ := strings.Cut(message, " ")
+	switch strings.TrimSpace(arg) {
+	case "on":
+		client.mutex.Lock()
+		client.bell = true
+		client.mutex.Unlock()
+		client.messages <- "*** Bell on: you'll hear a beep when someone mentions @" + client.name() + " ***"
+	case "off":
+		client.mutex.Lock()
+		client.bell = false
+		client.mutex.Unlock()
+		client.messages <- "*** Bell off ***"
+	default:
+		client.messages <- "*** Usage: /bell on|off ***"
+	}
+}
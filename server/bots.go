@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Bots are automated users that run inside the server: responders,
+// moderation bots, bridges. A bot is Go code implementing Bot, registered
+// under a kind with RegisterBot (usually from an init function), and
+// started by a "bot" line in the config file, or a --bot flag, naming the
+// kind and anything it takes:
+//
+//	bot = "echo"
+//	bot = "echo !say"
+//
+// A bot chats under its kind's name, which users can't take. It sees every
+// chat message, action, join and leave, in order, on a goroutine of its
+// own. What bots say isn't passed to bots, so they can't set each other off.
+const BOT_BUFFER = 256 // events waiting for a bot before new ones are dropped
+
+// Bot reacts to what happens on the server.
+type Bot interface {
+	// OnMessage is called for chat messages and actions; event.Type says
+	// which.
+	OnMessage(chat BotChat, event ChatEvent)
+	OnJoin(chat BotChat, event ChatEvent)
+	OnLeave(chat BotChat, event ChatEvent)
+}
+
+// BotChat is what a bot can do in return.
+type BotChat interface {
+	// Name is the name the bot chats under.
+	Name() string
+
+	// Say and Act send a chat message or an action to a room.
+	Say(room, text string)
+	Act(room, text string)
+
+	// Kick disconnects everyone called user and returns how many there
+	// were.
+	Kick(user, reason string) int
+}
+
+// BotFactory makes a bot from the rest of its config line.
+type BotFactory func(args string) (Bot, error)
+
+var (
+	botMutex sync.Mutex
+	botKinds = make(map[string]BotFactory)
+)
+
+// RegisterBot makes a kind of bot available to "bot" config lines. It
+// panics if the kind is already registered.
+func RegisterBot(kind string, factory BotFactory) {
+	botMutex.Lock()
+	defer botMutex.Unlock()
+	if _, ok := botKinds[kind]; ok {
+		panic("server: bot " + kind + " registered twice")
+	}
+	botKinds[kind] = factory
+}
+
+func botFactory(kind string) (BotFactory, bool) {
+	botMutex.Lock()
+	defer botMutex.Unlock()
+	factory, ok := botKinds[kind]
+	return factory, ok
+}
+
+// botKindNames lists the registered kinds of bot.
+func botKindNames() []string {
+	botMutex.Lock()
+	defer botMutex.Unlock()
+	kinds := make([]string, 0, len(botKinds))
+	for kind := range botKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// BotSpec is one bot to start: its kind and the rest of its config line.
+type BotSpec struct {
+	Kind string
+	Args string
+}
+
+// botList collects the --bot flags; it is a flag.Value, so every "bot"
+// line in the config file adds one.
+type botList []BotSpec
+
+func (list *botList) String() string {
+	if list == nil {
+		return ""
+	}
+	lines := make([]string, len(*list))
+	for i, spec := range *list {
+		lines[i] = strings.TrimSpace(spec.Kind + " " + spec.Args)
+	}
+	return strings.Join(lines, "; ")
+}
+
+func (list *botList) Set(value string) error {
+	kind, args, _ := strings.Cut(strings.TrimSpace(value), " ")
+	if _, ok := botFactory(kind); !ok {
+		return fmt.Errorf("unknown bot %q (have %s)", kind, strings.Join(botKindNames(), ", "))
+	}
+	for _, spec := range *list {
+		if spec.Kind == kind {
+			return fmt.Errorf("bot %q is already running", kind)
+		}
+	}
+	*list = append(*list, BotSpec{Kind: kind, Args: strings.TrimSpace(args)})
+	return nil
+}
+
+// botRunner passes events to one bot from its own goroutine. It is an
+// EventExporter, so bots see exactly what the exporters do.
+type botRunner struct {
+	server *ChatServer
+	name   string
+	bot    Bot
+	events chan ChatEvent
+}
+
+// startBot makes a bot, reserves its name and starts passing it events.
+func (server *ChatServer) startBot(spec BotSpec) error {
+	factory, ok := botFactory(spec.Kind)
+	if !ok {
+		return fmt.Errorf("unknown bot %q", spec.Kind)
+	}
+	bot, err := factory(spec.Args)
+	if err != nil {
+		return fmt.Errorf("starting bot %s: %v", spec.Kind, err)
+	}
+	if !validName(spec.Kind) || !server.claimName(spec.Kind) {
+		return fmt.Errorf("starting bot %s: the name can't be used", spec.Kind)
+	}
+
+	runner := &botRunner{
+		server: server,
+		name:   spec.Kind,
+		bot:    bot,
+		events: make(chan ChatEvent, BOT_BUFFER),
+	}
+	go runner.run()
+	server.exporters = append(server.exporters, runner)
+	slog.Info("Bot started", "bot", spec.Kind)
+	return nil
+}
+
+func (runner *botRunner) Export(event ChatEvent) {
+	select {
+	case runner.events <- event:
+	default:
+		slog.Warn("Bot is backed up, dropping event", "bot", runner.name, "type", event.Type)
+	}
+}
+
+func (runner *botRunner) run() {
+	for event := range runner.events {
+		runner.handle(event)
+	}
+}
+
+// handle passes one event to the bot. A bot that panics is logged and
+// carries on with the next event.
+func (runner *botRunner) handle(event ChatEvent) {
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error("Bot failed", "bot", runner.name, "type", event.Type, "err", err)
+		}
+	}()
+
+	switch event.Type {
+	case EVENT_MESSAGE, EVENT_ACTION:
+		runner.bot.OnMessage(runner, event)
+	case EVENT_JOIN:
+		runner.bot.OnJoin(runner, event)
+	case EVENT_LEAVE:
+		runner.bot.OnLeave(runner, event)
+	}
+}
+
+func (runner *botRunner) Name() string {
+	return runner.name
+}
+
+func (runner *botRunner) Say(room, text string) {
+	runner.server.postAs(runner.name, room, text, false)
+}
+
+func (runner *botRunner) Act(room, text string) {
+	runner.server.postAs(runner.name, room, text, true)
+}
+
+func (runner *botRunner) Kick(user, reason string) int {
+	return runner.server.kick(user, runner.name, reason)
+}
+
+// postAs broadcasts chat or an action from someone who isn't a connected
+// client, such as a bot or the inbound webhook, to a room (the lobby if
+// room isn't valid). It is logged, kept in the history and relayed like
+// chat, but not exported as an event.
+func (server *ChatServer) postAs(name, room, text string, action bool) {
+	text = strings.TrimSpace(sanitizeText(text))
+	if text == "" {
+		return
+	}
+	room, ok := normalizeRoomName(room)
+	if !ok {
+		room = LOBBY
+	}
+
+	kind, linkType := "Chat", LINK_MESSAGE
+	separator := " "
+	if strings.Contains(text, "\n") {
+		separator = "\n"
+	}
+	now := time.Now()
+	message := fmt.Sprintf("[%s] %s:%s%s", now.Format("15:04:05"), name, separator, text)
+	frameType := protocol.FRAME_CHAT
+	if action {
+		kind, linkType = "Action", LINK_ACTION
+		message = fmt.Sprintf(ACTION_FORMAT, name, text)
+		frameType = protocol.FRAME_ACTION
+	}
+	tag := server.newMessage(nil, name, room, text, action)
+	slog.Info(kind, "user", name, "room", room, "text", text)
+	server.messageCount.Add(1)
+	server.relay(linkType, room, name, text)
+	eventType := EVENT_MESSAGE
+	if action {
+		eventType = EVENT_ACTION
+	}
+	server.record(ChatEvent{Type: eventType, User: name, Room: room, ID: tag.id, Text: text})
+	frame := protocol.Frame{Type: frameType, ID: tag.id, From: name, Room: room, Body: text, Timestamp: now}
+	server.send(room, withFrame(frame, tagMessage(tag, message)), PRIORITY_CHATTER)
+}
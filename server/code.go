@@ -0,0 +1,103 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Fence that opens and closes a code block, as in Markdown
+const (
+	CODE_FENCE  = "```"
+	CODE_INDENT = "    "
+)
+
+// messagePart is one piece of a chat message: either prose or a fenced code
+// block carried as an attachment. Code is passed through verbatim; nothing
+// that rewrites message text may touch it.
+type messagePart struct {
+	Code bool
+	Lang string
+	Text string
+}
+
+// parseMessage splits text on ``` fences. An unterminated fence runs to the
+// end of the message.
+func parseMessage(text string) []messagePart {
+	var parts []messagePart
+	var lines []string
+	current := messagePart{}
+
+	flush := func() {
+		if len(lines) > 0 {
+			current.Text = strings.Join(lines, "\n")
+			if current.Code || strings.TrimSpace(current.Text) != "" {
+				parts = append(parts, current)
+			}
+		}
+		lines = nil
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, CODE_FENCE) {
+			lines = append(lines, line)
+			continue
+		}
+
+		if current.Code {
+			flush()
+			current = messagePart{}
+		} else {
+			flush()
+			current = messagePart{
+				Code: true,
+				Lang: strings.TrimSpace(strings.TrimPrefix(trimmed, CODE_FENCE)),
+			}
+		}
+	}
+	flush()
+	return parts
+}
+
+// hasCode reports whether any part of the message is a code block.
+func hasCode(parts []messagePart) bool {
+	for _, part := range parts {
+		if part.Code {
+			return true
+		}
+	}
+	return false
+}
+
+// frameParts gives the parts of a message for its frame, or nil if it has
+// no code, when Body says it all.
+func frameParts(parts []messagePart) []protocol.Part {
+	if !hasCode(parts) {
+		return nil
+	}
+	framed := make([]protocol.Part, len(parts))
+	for i, part := range parts {
+		framed[i] = protocol.Part{Kind: protocol.PART_TEXT, Text: part.Text}
+		if part.Code {
+			framed[i] = protocol.Part{Kind: protocol.PART_CODE, Lang: part.Lang, Text: part.Text}
+		}
+	}
+	return framed
+}
+
+// renderText turns message parts back into terminal text, indenting code
+// blocks by a fixed amount so they stand apart from the prose.
+func renderText(parts []messagePart) string {
+	var out []string
+	for _, part := range parts {
+		if !part.Code {
+			out = append(out, part.Text)
+			continue
+		}
+		for _, line := range strings.Split(part.Text, "\n") {
+			out = append(out, CODE_INDENT+strings.ReplaceAll(line, "\t", CODE_INDENT))
+		}
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"hash/fnv"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Colors. Every user has a color picked from USER_COLORS by their name, so
+// it is the same everywhere and every time. Text clients that turn on
+// /color see names in chat, actions, private messages and join and leave
+// notices in their user's color; everyone else has colors stripped from
+// what they are sent, including any the message formats add. JSON clients
+// that ask for the color capability in their hello get the sender's color
+// in chat, action and dm frames.
+var USER_COLORS = []string{
+	"red", "green", "yellow", "blue", "magenta", "cyan",
+	"bright_red", "bright_green", "bright_yellow", "bright_blue", "bright_magenta", "bright_cyan",
+}
+
+// Capabilities the server turns on for JSON clients that ask
+var CAPABILITIES = []string{protocol.CAPABILITY_COLOR}
+
+// colorPattern matches the ANSI color (SGR) sequences colorText writes.
+var colorPattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// Built-in lines, taken apart again to color the names in them
+var (
+	chatLinePattern   = regexp.MustCompile(`(?s)^\[(\d\d:\d\d:\d\d)\] ([^\n:]+):[ \n](.*)$`)
+	actionPattern     = regexp.MustCompile(`(?s)^\* (\S+) (.*)$`)
+	dmLinePattern     = regexp.MustCompile(`(?s)^\[(\d\d:\d\d:\d\d)\] \[PM (from|to) ([^\]]+)\] (.*)$`)
+	membershipPattern = regexp.MustCompile(`^\*\*\* (.+) has (joined|left) (the chat|#\S+) \*\*\*$`)
+)
+
+// Built-in lines and which of their submatches is a user's name
+var namePatterns = []struct {
+	pattern *regexp.Regexp
+	group   int
+}{
+	{dmLinePattern, 3},
+	{chatLinePattern, 2},
+	{actionPattern, 1},
+	{membershipPattern, 1},
+}
+
+// userColor returns a name's color.
+func userColor(name string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(name)))
+	return USER_COLORS[hash.Sum32()%uint32(len(USER_COLORS))]
+}
+
+// colorName returns a name in its color.
+func colorName(name string) string {
+	return colorText(userColor(name), name)
+}
+
+// colorNames colors the name in a line in one of the built-in formats.
+// Other lines are returned as they are.
+func colorNames(line string) string {
+	for _, names := range namePatterns {
+		match := names.pattern.FindStringSubmatchIndex(line)
+		if match == nil {
+			continue
+		}
+		start, end := match[2*names.group], match[2*names.group+1]
+		return line[:start] + colorName(line[start:end]) + line[end:]
+	}
+	return line
+}
+
+// stripColors removes color sequences.
+func stripColors(text string) string {
+	if !strings.Contains(text, "\x1b[") {
+		return text
+	}
+	return colorPattern.ReplaceAllString(text, "")
+}
+
+// visibleLength counts the runes of text a terminal shows, leaving out
+// color sequences.
+func visibleLength(text string) int {
+	return utf8.RuneCountInString(stripColors(text))
+}
+
+// visibleOffset returns the byte offset just after the first n visible
+// runes of text, keeping any color sequences that follow them.
+func visibleOffset(text string, n int) int {
+	offset := 0
+	for offset < len(text) {
+		if strings.HasPrefix(text[offset:], "\x1b[") {
+			if loc := colorPattern.FindStringIndex(text[offset:]); loc != nil && loc[0] == 0 {
+				offset += loc[1]
+				continue
+			}
+		}
+		if n == 0 {
+			break
+		}
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		offset += size
+		n--
+	}
+	return offset
+}
+
+// colored reports whether the client has colors on.
+func (client *Client) colored() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.color
+}
+
+// colorFrame adds the sender's color to a frame for a client that asked
+// for colors.
+func (client *Client) colorFrame(frame protocol.Frame) protocol.Frame {
+	switch frame.Type {
+	case protocol.FRAME_CHAT, protocol.FRAME_ACTION, protocol.FRAME_DM:
+		if frame.From != "" && client.colored() {
+			frame.Color = userColor(frame.From)
+		}
+	}
+	return frame
+}
+
+// acceptCapabilities returns the capabilities asked for that the server
+// has.
+func acceptCapabilities(asked []string) []string {
+	var accepted []string
+	for _, capability := range asked {
+		if slices.Contains(CAPABILITIES, capability) && !slices.Contains(accepted, capability) {
+			accepted = append(accepted, capability)
+		}
+	}
+	return accepted
+}
+
+// handleColorCommand implements "/color on|off".
+func (client *Client) handleColorCommand(message string) {
+	_, arg, _ := strings.Cut(message, " ")
+	switch strings.TrimSpace(arg) {
+	case "on":
+		client.mutex.Lock()
+		client.color = true
+		client.mutex.Unlock()
+		client.messages <- "*** Colors on: names are shown in their user's color ***"
+	case "off":
+		client.mutex.Lock()
+		client.color = false
+		client.mutex.Unlock()
+		client.messages <- "*** Colors off ***"
+	default:
+		client.messages <- "*** Usage: /color on|off ***"
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Queued for a JSON client to send it a commands frame
+const COMMANDS_LINE = "COMMANDS"
+
+// Command is one slash command. The handler gets the whole line, command
+// name included.
+type Command struct {
+	Name    string // with the slash, e.g. "/msg"
+	Usage   string // arguments, e.g. "<user> <text>"
+	Help    string
+	Role    string // least role allowed to use it
+	Handler func(client *Client, message string)
+
+	uses *atomic.Int64 // times run, for metrics
+}
+
+// CommandRegistry maps command names to their handlers and generates /help.
+type CommandRegistry struct {
+	commands map[string]*Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{commands: make(map[string]*Command)}
+}
+
+// Register adds a command, replacing any earlier one with the same name.
+// Commands without a role are open to everyone.
+func (registry *CommandRegistry) Register(command Command) {
+	if command.Role == "" {
+		command.Role = DEFAULT_ROLE
+	}
+	command.uses = new(atomic.Int64)
+	registry.commands[command.Name] = &command
+}
+
+// Dispatch runs the command on a line and reports whether the line was a
+// command, known or not. Lines starting with "//" are chat starting with
+// "/", and are left to the caller.
+func (registry *CommandRegistry) Dispatch(client *Client, message string) bool {
+	if !strings.HasPrefix(message, "/") || strings.HasPrefix(message, "//") {
+		return false
+	}
+
+	name, _, _ := strings.Cut(message, " ")
+	command, ok := registry.commands[strings.ToLower(name)]
+	if !ok {
+		client.messages <- fmt.Sprintf("*** Unknown command %s (try /help) ***", name)
+		return true
+	}
+	if !client.atLeast(command.Role) {
+		client.messages <- fmt.Sprintf("*** %s needs the %s role ***", command.Name, command.Role)
+		return true
+	}
+	command.uses.Add(1)
+	command.Handler(client, message)
+	return true
+}
+
+// Usage reports how many times each command has been run.
+func (registry *CommandRegistry) Usage() map[string]int64 {
+	usage := make(map[string]int64, len(registry.commands))
+	for name, command := range registry.commands {
+		usage[name] = command.uses.Load()
+	}
+	return usage
+}
+
+// available returns the commands open to a role, by name.
+func (registry *CommandRegistry) available(role string) []*Command {
+	var commands []*Command
+	for _, command := range registry.commands {
+		if ROLE_RANKS[role] >= ROLE_RANKS[command.Role] {
+			commands = append(commands, command)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// Help lists the commands open to a role.
+func (registry *CommandRegistry) Help(role string) string {
+	commands := registry.available(role)
+	width := 0
+	for _, command := range commands {
+		width = max(width, len(command.Name+" "+command.Usage))
+	}
+
+	lines := []string{"--- Commands ---"}
+	for _, command := range commands {
+		lines = append(lines, fmt.Sprintf("%-*s  %s", width, strings.TrimSpace(command.Name+" "+command.Usage), command.Help))
+	}
+	lines = append(lines,
+		"/paste starts a multi-line message, ended by /endpaste.",
+		"Start a message with // to send one beginning with /. Type 'exit' to quit.")
+	return strings.Join(lines, "\n")
+}
+
+// Describe lists the commands open to a role for a commands frame.
+func (registry *CommandRegistry) Describe(role string) []protocol.CommandInfo {
+	var commands []protocol.CommandInfo
+	for _, command := range registry.available(role) {
+		commands = append(commands, protocol.CommandInfo{Name: command.Name, Usage: command.Usage, Help: command.Help, Role: command.Role})
+	}
+	return commands
+}
+
+// sendCommands tells a JSON client which commands it can run, so it can
+// complete them. The list is made from the registry when it is written,
+// for the role the client has then.
+func (server *ChatServer) sendCommands(client *Client) {
+	if client.json {
+		client.deliver(COMMANDS_LINE, PRIORITY_DIRECT)
+	}
+}
+
+// builtinCommands registers the server's own commands.
+func (server *ChatServer) builtinCommands() *CommandRegistry {
+	registry := NewCommandRegistry()
+	simple := func(name, usage, help, role string, handler func(client *Client, message string)) {
+		// Moderator and admin commands go in the audit log as they're run
+		if ROLE_RANKS[role] >= ROLE_RANKS[ROLE_MODERATOR] {
+			run := handler
+			handler = func(client *Client, message string) {
+				server.auditClient(AUDIT_COMMAND, client, "", message)
+				run(client, message)
+			}
+		}
+		registry.Register(Command{Name: name, Usage: usage, Help: help, Role: role, Handler: handler})
+	}
+
+	simple("/help", "", "list commands", "", func(client *Client, message string) {
+		client.messages <- registry.Help(client.role())
+	})
+
+	// Personal settings
+	simple("/alias", "[/name command [args]]", "list or define your command aliases", "", func(client *Client, message string) {
+		server.handleAliasCommand(client, message)
+	})
+	simple("/unalias", "/name", "remove one of your aliases", "", func(client *Client, message string) {
+		server.handleAliasCommand(client, message)
+	})
+	simple("/input", "char|line", "character or line input (telnet)", "", func(client *Client, message string) {
+		client.handleInputCommand(message)
+	})
+	simple("/newline", "lf|crlf|cr", "line endings the server sends you", "", func(client *Client, message string) {
+		client.handleNewlineCommand(message)
+	})
+	simple("/bell", "on|off", "beep when someone mentions you", "", func(client *Client, message string) {
+		client.handleBellCommand(message)
+	})
+	simple("/color", "on|off", "show names in color", "", func(client *Client, message string) {
+		client.handleColorCommand(message)
+	})
+	simple("/ids", "on|off", "show message IDs, for /edit and /react", "", func(client *Client, message string) {
+		client.handleIDsCommand(message)
+	})
+	simple("/wrap", fmt.Sprintf("<%d-%d>|auto|off", MIN_WRAP_WIDTH, MAX_WRAP_WIDTH), "wrap long lines", "", func(client *Client, message string) {
+		client.handleWrapCommand(message)
+	})
+	simple("/lang", "<code>|off", "translate chat into a language", "", server.handleLangCommand)
+	simple("/translate", "<id> [code]", "translate one message, into your /lang language if no code is given", "", server.handleTranslateCommand)
+
+	// Names and accounts
+	simple("/nick", "<newname>", "change your name", "", server.handleNickCommand)
+	simple("/register", "<password>", "register your name", "", server.handleAccountCommand)
+	simple("/login", "<user> <password>", "log in to a registered name", "", server.handleAccountCommand)
+	simple("/resetpassword", "<user> [<code> <new password>]", "get a code to reset a forgotten password, then use it", "", server.handleResetPasswordCommand)
+	simple("/2fa", "[enable|confirm <code>|disable <code>]", "turn two-factor login with an authenticator app on or off", "", server.handle2FACommand)
+	simple("/email", "[<address>|off]", "show or set your email address, and verify it", "", server.handleEmailCommand)
+	simple("/sshkey", "[add [<public key>] | del <fingerprint>]", "list or change the SSH keys that log in to your account", "", server.handleSSHKeyCommand)
+
+	// Rooms and people
+	simple("/join", "<#room> [password]", "join or create a room", "", server.handleRoomCommand)
+	simple("/leave", "", "go back to the lobby", "", server.handleRoomCommand)
+	simple("/rooms", "", "list rooms", "", server.handleRoomCommand)
+	simple("/topic", "[text|off]", "show or set the room's topic", "", server.handleTopicCommand)
+	simple("/roompass", "<password>|off", "set or remove your room's password", "", server.handleRoomPasswordCommand)
+	simple("/inviteonly", "on|off", "let only invited users into your room", "", server.handleInviteOnlyCommand)
+	simple("/invite", "<user>", "let a user into your room", "", server.handleInviteCommand)
+	simple("/uninvite", "<user>", "take back an invite to your room", "", server.handleInviteCommand)
+	simple("/op", "[user]", "list your room's operators, or make a user one", "", server.handleOpCommand)
+	simple("/deop", "<user>", "stop a user being an operator of your room", "", server.handleOpCommand)
+	simple("/acl", "[<who> <permission,...>|<who> off|clear]", "show or change who may read, write, invite and moderate in your room", "", server.handleACLCommand)
+	simple("/transfer", "<user>", "give your room to another user", "", server.handleOpCommand)
+	simple("/roomkick", "<user> [reason]", "send a user out of your room (owners and operators)", "", server.handleRoomModerationCommand)
+	simple("/roommute", "<user> <duration>", "stop a user talking in your room (owners and operators)", "", server.handleRoomModerationCommand)
+	simple("/roomunmute", "<user>", "lift a room mute", "", server.handleRoomModerationCommand)
+	simple("/me", "<action>", "describe what you're doing", "", server.handleMeCommand)
+	simple("/edit", "<id> <text>", "change a message you just sent", "", server.handleEditCommand)
+	simple("/delete", "<id>", "remove a message you just sent", "", server.handleEditCommand)
+	simple("/react", "<id> <emoji>", "react to a message, or take your reaction back", "", server.handleReactCommand)
+	simple("/msg", "<user> <text>", "send a private message", "", server.handleDirectMessage)
+	simple("/reply", "<text>", "answer the last private message", "", server.handleDirectMessage)
+	simple("/search", "<words> [#room] [from:user] [since:date] [until:date] [page:n]", "search the chat history", "", server.handleSearchCommand)
+	simple("/mail", "", "list your messages waiting for offline users", "", server.handleMailCommand)
+	simple("/push", "[on | off | add <platform> <token> | del <number>]", "list or change the devices notified while you're away", "", server.handlePushCommand)
+	simple("/upload", "[user]", "get a link to share a file with the room or a user", "", server.handleUploadCommand)
+	simple("/who", "[#room]", "list who is online", "", server.handleWhoCommand)
+	simple("/whois", "<user>", "show who someone is", "", server.handleWhoisCommand)
+	simple("/away", "[reason]", "tell people you're away", "", server.handlePresenceCommand)
+	simple("/busy", "[reason]", "tell people you're busy", "", server.handlePresenceCommand)
+	simple("/invisible", "", "appear offline to everyone but admins", "", server.handlePresenceCommand)
+	simple("/back", "", "come back from away, busy or invisible", "", server.handlePresenceCommand)
+	simple("/activity", "[user|top]", "when people were last here, or (admins) the most and least active", "", server.handleActivityCommand)
+	simple("/rtc", "<type> <user> [payload]", "relay a WebRTC signal", "", server.handleSignalCommand)
+	simple("/emotes", "", "list custom emotes", "", server.handleEmoteCommand)
+	simple("/motd", "", "show the message of the day", "", server.handleMOTDCommand)
+
+	// Moderation
+	simple("/emote", "add :name: <text> | del :name:", "manage custom emotes", ROLE_MODERATOR, server.handleEmoteCommand)
+	simple("/kick", "<user> [reason]", "disconnect a user", ROLE_MODERATOR, server.handleModerationCommand)
+	simple("/ban", "<user|ip|cidr> [duration] [reason]", "ban a user, address or address range", ROLE_MODERATOR, server.handleModerationCommand)
+	simple("/unban", "<user|ip|cidr>", "lift a ban", ROLE_MODERATOR, server.handleModerationCommand)
+	simple("/mute", "<user> <duration>", "stop a user from talking for a while", ROLE_MODERATOR, server.handleModerationCommand)
+	simple("/unmute", "<user>", "lift a mute", ROLE_MODERATOR, server.handleModerationCommand)
+	simple("/shadowban", "[<user|ip|cidr> [duration] [reason]]", "hide a user's messages from everyone but them, or list who is", ROLE_ADMIN, server.handleShadowBanCommand)
+	simple("/unshadowban", "<user|ip|cidr>", "lift a shadow ban", ROLE_ADMIN, server.handleShadowBanCommand)
+	simple("/filter", "[#room] [add <warn|mask|drop|mute> <word|/regexp/> | del <word|/regexp/>]", "list or change the words filtered in a room", ROLE_ADMIN, server.handleFilterCommand)
+	simple("/announce", "<text>", "send a notice to everyone in every room", ROLE_ADMIN, server.handleAnnounceCommand)
+
+	return registry
+}
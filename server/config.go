@@ -0,0 +1,500 @@
+package server
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on the settings
+const (
+	MIN_MESSAGE_BYTES = 64
+	MAX_MESSAGE_BYTES = 1024 * 1024
+)
+
+// Config holds the server settings that can be changed without rebuilding.
+// Defaults come from the constants in server.go, then the config file, then
+// command-line flags.
+type Config struct {
+	File                string
+	Listen              string
+	Socket              string
+	ProxyProtocol       string
+	GRPCListen          string
+	GRPCCert            string
+	GRPCKey             string
+	GRPCClientCA        string
+	QUICListen          string
+	QUICCert            string
+	QUICKey             string
+	SSHListen           string
+	SSHHostKey          string
+	MaxClients          int
+	MaxPerAddress       int
+	MaxMessageBytes     int
+	MessageRate         float64
+	MessageBurst        int
+	LoginTimeout        time.Duration
+	WriteTimeout        time.Duration
+	IdleTimeout         time.Duration
+	AutoAway            time.Duration
+	PingInterval        time.Duration
+	ResumeWindow        time.Duration
+	NewUserPeriod       time.Duration
+	NewUserSlowMode     time.Duration
+	Backpressure        string
+	BackpressureTimeout time.Duration
+	MOTD                string
+	Announcements       announcementList
+	Bots                botList
+	Webhooks            webhookList
+	WebhookSecret       string
+	InboundListen       string
+	InboundToken        string
+	InboundName         string
+	FeedListen          string
+	FeedToken           string
+	FilesListen         string
+	FilesURL            string
+	FilesDir            string
+	MaxFileMB           int
+	FilesRetention      time.Duration
+	MetricsListen       string
+	AdminListen         string
+	AdminToken          string
+	AdminTokenFile      string
+	StatusListen        string
+	StatusName          string
+	StatusAddress       string
+	WebSocketListen     string
+	ConsoleSocket       string
+	InviteOnly          bool
+	EventsFile          string
+	EgressKBPerSec      int
+	Admins              string
+	Moderators          string
+	CredentialsFile     string
+	Require2FA          string
+	Backplane           string
+	Node                string
+	Storage             string
+	StoragePool         int
+	Formats             FormatOptions
+	TLS                 TLSOptions
+	Log                 LogOptions
+	Audit               AuditOptions
+	Filter              FilterOptions
+	Spam                SpamOptions
+	Link                LinkOptions
+	Digest              DigestOptions
+	Email               EmailOptions
+	Translate           TranslateOptions
+	Push                PushOptions
+	Kafka               KafkaOptions
+	Tenants             tenantList
+
+	// Guards the settings Reload changes while the server runs
+	mutex sync.RWMutex
+
+	// The command line LoadConfig read, for Rehash; nil if the settings
+	// didn't come from one
+	args []string
+
+	// Set for a tenant's settings, which may leave listen empty
+	tenant bool
+}
+
+// DefaultConfig returns the built-in settings. Programs that embed the
+// server can start from it and set fields directly.
+func DefaultConfig() *Config {
+	return &Config{
+		File:                os.Getenv("CHAT_CONFIG"),
+		AdminToken:          os.Getenv("CHAT_ADMIN_TOKEN"),
+		Listen:              PORT,
+		MaxClients:          MAX_CLIENTS,
+		MaxMessageBytes:     4096,
+		MessageRate:         2,
+		MessageBurst:        10,
+		LoginTimeout:        time.Minute,
+		WriteTimeout:        30 * time.Second,
+		IdleTimeout:         time.Hour,
+		PingInterval:        time.Minute,
+		NewUserPeriod:       10 * time.Minute,
+		NewUserSlowMode:     5 * time.Second,
+		Backpressure:        BACKPRESSURE_DROP_NEWEST,
+		InboundName:         "webhook",
+		FilesDir:            "uploads",
+		MaxFileMB:           10,
+		FilesRetention:      24 * time.Hour,
+		Storage:             STORAGE_FILES,
+		StoragePool:         10,
+		StatusName:          "Go Chat Server",
+		ConsoleSocket:       "chatd.sock",
+		SSHHostKey:          "ssh_host_ed25519_key",
+		BackpressureTimeout: time.Second,
+		TLS:                 defaultTLSOptions(),
+		Log:                 LogOptions{Level: "info", Format: "text", MaxFiles: 5},
+		Filter:              FilterOptions{Action: FILTER_MASK, MuteFor: 5 * time.Minute},
+		Spam:                SpamOptions{Checks: "repeat,caps,links", MuteFor: 5 * time.Minute},
+		Digest:              DigestOptions{From: "chat@localhost"},
+		Email:               EmailOptions{From: "chat@localhost"},
+		Kafka:               KafkaOptions{Topic: KAFKA_TOPIC},
+	}
+}
+
+// flagSet binds the settings to flags, using their current values as the
+// defaults. Config file keys are the flag names with _ for -.
+func (config *Config) flagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet("chatd", flag.ContinueOnError)
+	flags.StringVar(&config.File, "config", config.File, "config file (default $CHAT_CONFIG)")
+	flags.StringVar(&config.Listen, "listen", config.Listen, "address to accept chat connections on")
+	flags.StringVar(&config.Socket, "socket", config.Socket, "Unix socket to accept chat connections on as well, for local bots and proxies (empty for none)")
+	flags.StringVar(&config.ProxyProtocol, "proxy-protocol", config.ProxyProtocol, "comma-separated addresses or CIDR ranges of proxies whose connections start with a PROXY protocol header (empty for none)")
+	flags.StringVar(&config.GRPCListen, "grpc-listen", config.GRPCListen, "address for the gRPC API, in builds with -tags grpc (empty for none)")
+	flags.StringVar(&config.GRPCCert, "grpc-cert", config.GRPCCert, "TLS certificate file (PEM) for the gRPC API (empty for plain TCP)")
+	flags.StringVar(&config.GRPCKey, "grpc-key", config.GRPCKey, "TLS private key file (PEM) for the gRPC API")
+	flags.StringVar(&config.GRPCClientCA, "grpc-client-ca", config.GRPCClientCA, "CA certificates (PEM); gRPC clients with a certificate that chains to them may make admin calls without the token")
+	flags.StringVar(&config.QUICListen, "quic-listen", config.QUICListen, "UDP address for the experimental QUIC listener, in builds with -tags quic (empty for none)")
+	flags.StringVar(&config.QUICCert, "quic-cert", config.QUICCert, "TLS certificate file (PEM) for QUIC (default --tls-cert)")
+	flags.StringVar(&config.QUICKey, "quic-key", config.QUICKey, "TLS private key file (PEM) for QUIC (default --tls-key)")
+	flags.StringVar(&config.SSHListen, "ssh-listen", config.SSHListen, "address to accept chat over SSH on, in builds with -tags ssh (empty for none)")
+	flags.StringVar(&config.SSHHostKey, "ssh-host-key", config.SSHHostKey, "SSH host key file (PEM), made if it doesn't exist")
+	flags.IntVar(&config.MaxClients, "max-clients", config.MaxClients, "most clients online at once")
+	flags.IntVar(&config.MaxPerAddress, "max-connections-per-ip", config.MaxPerAddress, "most connections open at once from one IP address (0 for no limit)")
+	flags.IntVar(&config.MaxMessageBytes, "max-message-bytes", config.MaxMessageBytes, "longest line a client may send")
+	flags.Float64Var(&config.MessageRate, "message-rate", config.MessageRate, "messages per second a client may send (0 for no limit)")
+	flags.IntVar(&config.MessageBurst, "message-burst", config.MessageBurst, "messages a client may send at once before the rate applies")
+	flags.DurationVar(&config.LoginTimeout, "login-timeout", config.LoginTimeout, "time allowed to pick a name (0 for no limit)")
+	flags.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "time allowed for one write to a client (0 for no limit)")
+	flags.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "disconnect clients that send nothing for this long (0 for never)")
+	flags.DurationVar(&config.AutoAway, "auto-away", config.AutoAway, "mark users away after sending nothing for this long (0 for never)")
+	flags.DurationVar(&config.PingInterval, "ping-interval", config.PingInterval, "ping clients that have been silent this long (0 for no pings)")
+	flags.DurationVar(&config.ResumeWindow, "resume-window", config.ResumeWindow, "hold the name and room of a client whose connection drops for this long, for it to resume (0 to turn off)")
+	flags.DurationVar(&config.NewUserPeriod, "new-user-period", config.NewUserPeriod, "how long names first seen recently can't post links or message strangers (0 for no limits on new users)")
+	flags.DurationVar(&config.NewUserSlowMode, "new-user-slow-mode", config.NewUserSlowMode, "least time between messages from a new user (0 for no limit)")
+	flags.StringVar(&config.Backpressure, "backpressure", config.Backpressure, "what to do with chat for a client that has fallen behind: drop-newest, drop-oldest, disconnect or block")
+	flags.DurationVar(&config.BackpressureTimeout, "backpressure-timeout", config.BackpressureTimeout, "longest a message waits for slow clients with --backpressure block")
+	flags.StringVar(&config.MOTD, "motd", config.MOTD, "message of the day, shown after the welcome")
+	flags.Var(&config.Announcements, "announce", "scheduled announcement, \"<cron schedule> <text>\" or \"@every <duration> <text>\" (repeatable)")
+	flags.Var(&config.Bots, "bot", "bot to run, \"<kind> [args]\" (repeatable)")
+	flags.Var(&config.Tenants, "tenant", "community to host as well, \"<name> <config file> [TLS server names...]\" (repeatable)")
+	flags.Var(&config.Webhooks, "webhook", "URL to POST events to, optionally followed by the events, e.g. \"https://example.com/hook join,leave,ban\" (repeatable)")
+	flags.StringVar(&config.WebhookSecret, "webhook-secret", config.WebhookSecret, "key for signing webhook deliveries with HMAC-SHA256 (empty for unsigned)")
+	flags.StringVar(&config.InboundListen, "inbound-listen", config.InboundListen, "address for the inbound webhook, which posts messages to rooms (empty for none)")
+	flags.StringVar(&config.InboundToken, "inbound-token", config.InboundToken, "bearer token the inbound webhook requires")
+	flags.StringVar(&config.InboundName, "inbound-name", config.InboundName, "name messages from the inbound webhook appear under")
+	flags.StringVar(&config.FeedListen, "feed-listen", config.FeedListen, "address to stream chat on as Server-Sent Events, at /feed (empty for none)")
+	flags.StringVar(&config.FeedToken, "feed-token", config.FeedToken, "bearer token the feed requires")
+	flags.StringVar(&config.FilesListen, "files-listen", config.FilesListen, "address to accept file uploads and downloads on (empty for no file sharing)")
+	flags.StringVar(&config.FilesURL, "files-url", config.FilesURL, "public URL of --files-listen, for share links (default http://<host>:<port>)")
+	flags.StringVar(&config.FilesDir, "files-dir", config.FilesDir, "directory shared files are kept in")
+	flags.IntVar(&config.MaxFileMB, "max-file-mb", config.MaxFileMB, "largest file that can be shared, in MB")
+	flags.DurationVar(&config.FilesRetention, "files-retention", config.FilesRetention, "how long shared files are kept")
+	flags.StringVar(&config.MetricsListen, "metrics-listen", config.MetricsListen, "address to serve Prometheus metrics on, at /metrics (empty for none)")
+	flags.StringVar(&config.AdminListen, "admin-listen", config.AdminListen, "address for the admin API, at /admin/ (empty for none)")
+	flags.StringVar(&config.AdminToken, "admin-token", config.AdminToken, "bearer token the admin API and the gRPC Admin service require (default $CHAT_ADMIN_TOKEN)")
+	flags.StringVar(&config.AdminTokenFile, "admin-token-file", config.AdminTokenFile, "file to read --admin-token from instead, so it stays out of ps and the config file")
+	flags.StringVar(&config.StatusListen, "status-listen", config.StatusListen, "address for the public status page, at / and /status.json (empty for none)")
+	flags.StringVar(&config.StatusName, "status-name", config.StatusName, "server name the status page shows")
+	flags.StringVar(&config.StatusAddress, "status-address", config.StatusAddress, "host:port the status page tells users to connect to (default the page's host and the --listen port)")
+	flags.StringVar(&config.WebSocketListen, "websocket-listen", config.WebSocketListen, "address to accept browsers on over WebSocket (empty for none)")
+	flags.StringVar(&config.ConsoleSocket, "console-socket", config.ConsoleSocket, "Unix socket for the admin console, \"chatd console\" (empty for none)")
+	flags.BoolVar(&config.InviteOnly, "invite-only", config.InviteOnly, "new users need an invite code from an admin to log in")
+	flags.StringVar(&config.EventsFile, "events-file", config.EventsFile, "file to write every message, join and leave to as JSON lines, for analytics (empty for none)")
+	flags.IntVar(&config.EgressKBPerSec, "egress-kb-per-sec", config.EgressKBPerSec, "server-wide limit on what is sent to clients, in KB per second (0 for no limit)")
+	flags.StringVar(&config.Admins, "admins", config.Admins, "comma-separated accounts with the admin role")
+	flags.StringVar(&config.Moderators, "moderators", config.Moderators, "comma-separated accounts with the moderator role")
+	flags.StringVar(&config.Require2FA, "require-2fa", config.Require2FA, "comma-separated roles (user, moderator, admin) accounts only get once two-factor login is on, e.g. moderator,admin")
+	flags.StringVar(&config.CredentialsFile, "credentials-file", config.CredentialsFile, "file of name:bcrypt-hash lines for accounts the operator sets up; only these get the roles in --admins and --moderators")
+	flags.StringVar(&config.Backplane, "backplane", config.Backplane, "cluster backplane, redis://[:password@]host[:port][/channel] or nats://[user:password@|token@]host[:port][/subject prefix] (empty to run alone)")
+	flags.StringVar(&config.Node, "node", config.Node, "this server's name in the cluster (default host and listen port)")
+	flags.StringVar(&config.Storage, "storage", config.Storage, "where accounts, bans, mail, history and rooms are kept: files, memory, sqlite:<path> or a postgres:// DSN")
+	flags.IntVar(&config.StoragePool, "storage-pool", config.StoragePool, "most connections open at once to an SQL --storage")
+	config.Formats.register(flags)
+	config.TLS.register(flags)
+	config.Log.register(flags)
+	config.Audit.register(flags)
+	config.Filter.register(flags)
+	config.Spam.register(flags)
+	config.Link.register(flags)
+	config.Digest.register(flags)
+	config.Email.register(flags)
+	config.Translate.register(flags)
+	config.Push.register(flags)
+	config.Kafka.register(flags)
+	return flags
+}
+
+// LoadConfig builds the configuration from the config file and flags. The
+// flags are parsed twice: first to find the config file, then again over
+// the file's settings so flags win.
+func LoadConfig(args []string) (*Config, error) {
+	probe := DefaultConfig()
+	if err := probe.flagSet().Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := DefaultConfig()
+	if probe.File != "" {
+		if err := config.loadFile(probe.File); err != nil {
+			return nil, err
+		}
+	}
+	flags := config.flagSet()
+	flags.SetOutput(new(strings.Builder))
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := config.readAdminToken(); err != nil {
+		return nil, err
+	}
+	config.args = append([]string{}, args...)
+	return config, config.validate()
+}
+
+// ReadConfigFile returns the settings in a config file, or the defaults if
+// path is empty, for commands that work on a server's data or talk to it.
+func ReadConfigFile(path string) (*Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		if err := config.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.readAdminToken(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readAdminToken replaces AdminToken with the contents of AdminTokenFile,
+// if it is set.
+func (config *Config) readAdminToken() error {
+	if config.AdminTokenFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(config.AdminTokenFile)
+	if err != nil {
+		return fmt.Errorf("admin_token_file: %v", err)
+	}
+	config.AdminToken = strings.TrimSpace(string(data))
+	return nil
+}
+
+// loadFile reads "key = value" lines, with # comments and optionally quoted
+// values (so a simple TOML file works).
+func (config *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	flags := config.flagSet()
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value", path, number)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("%s:%d: bad string: %v", path, number, err)
+			}
+		}
+
+		name := strings.ReplaceAll(key, "_", "-")
+		if name == "config" || flags.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, number, key)
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, number, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// roleOf returns the role --admins and --moderators give an account.
+func (config *Config) roleOf(account string) string {
+	live := config.live()
+	listed := func(names string) bool {
+		for _, name := range splitNames(names) {
+			if strings.EqualFold(name, account) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case account == "":
+		return DEFAULT_ROLE
+	case listed(live.Admins):
+		return ROLE_ADMIN
+	case listed(live.Moderators):
+		return ROLE_MODERATOR
+	}
+	return ROLE_USER
+}
+
+// splitNames splits a comma-separated list of names.
+func splitNames(names string) []string {
+	var split []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			split = append(split, name)
+		}
+	}
+	return split
+}
+
+func (config *Config) validate() error {
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil && !(config.tenant && config.Listen == "") {
+		return fmt.Errorf("listen: %v", err)
+	}
+	if config.MaxClients < 1 {
+		return fmt.Errorf("max_clients must be at least 1")
+	}
+	if config.MaxPerAddress < 0 {
+		return fmt.Errorf("max_connections_per_ip can't be negative")
+	}
+	if config.MaxMessageBytes < MIN_MESSAGE_BYTES || config.MaxMessageBytes > MAX_MESSAGE_BYTES {
+		return fmt.Errorf("max_message_bytes must be %d-%d", MIN_MESSAGE_BYTES, MAX_MESSAGE_BYTES)
+	}
+	if config.MessageRate < 0 {
+		return fmt.Errorf("message_rate can't be negative")
+	}
+	if config.MessageRate > 0 && config.MessageBurst < 1 {
+		return fmt.Errorf("message_burst must be at least 1")
+	}
+	if config.LoginTimeout < 0 || config.WriteTimeout < 0 || config.IdleTimeout < 0 || config.AutoAway < 0 || config.PingInterval < 0 || config.ResumeWindow < 0 {
+		return fmt.Errorf("timeouts can't be negative")
+	}
+	if !BACKPRESSURE_POLICIES[config.Backpressure] {
+		return fmt.Errorf("unknown backpressure %q (use drop-newest, drop-oldest, disconnect or block)", config.Backpressure)
+	}
+	if config.Backpressure == BACKPRESSURE_BLOCK && config.BackpressureTimeout <= 0 {
+		return fmt.Errorf("backpressure_timeout must be positive with backpressure = block")
+	}
+	if config.InboundListen != "" && config.InboundToken == "" {
+		return fmt.Errorf("inbound_token must be set to enable the inbound webhook")
+	}
+	if config.FeedListen != "" && config.FeedToken == "" {
+		return fmt.Errorf("feed_token must be set to enable the feed")
+	}
+	if config.AdminListen != "" && config.AdminToken == "" {
+		return fmt.Errorf("admin_token or admin_token_file must be set to enable the admin API")
+	}
+	if !validName(config.InboundName) {
+		return fmt.Errorf("inbound_name must be %s", NAME_RULE)
+	}
+	if config.MaxFileMB < 1 {
+		return fmt.Errorf("max_file_mb must be at least 1")
+	}
+	if config.FilesRetention <= 0 {
+		return fmt.Errorf("files_retention must be positive")
+	}
+	if config.Backplane != "" {
+		if _, err := parseBackplane(config.Backplane); err != nil {
+			return fmt.Errorf("backplane: %v", err)
+		}
+	}
+	if config.GRPCListen != "" && serveGRPC == nil {
+		return fmt.Errorf("grpc_listen: %v", errNoGRPC)
+	}
+	if config.QUICListen != "" {
+		if serveQUIC == nil {
+			return fmt.Errorf("quic_listen: %v", errNoQUIC)
+		}
+		if _, err := config.quicTLS(); err != nil {
+			return fmt.Errorf("quic: %v", err)
+		}
+	}
+	if config.SSHListen != "" {
+		if serveSSH == nil {
+			return fmt.Errorf("ssh_listen: %v", errNoSSH)
+		}
+		if config.SSHHostKey == "" {
+			return fmt.Errorf("ssh_listen needs ssh_host_key")
+		}
+	}
+	if config.GRPCClientCA != "" && config.GRPCCert == "" {
+		return fmt.Errorf("grpc_client_ca needs grpc_cert and grpc_key")
+	}
+	if _, err := config.grpcTLS(); err != nil {
+		return fmt.Errorf("grpc tls: %v", err)
+	}
+	if _, err := parseProxies(config.ProxyProtocol); err != nil {
+		return fmt.Errorf("proxy_protocol: %v", err)
+	}
+	if err := checkStorage(config.Storage); err != nil {
+		return fmt.Errorf("storage: %v", err)
+	}
+	if config.StoragePool < 1 {
+		return fmt.Errorf("storage_pool must be at least 1")
+	}
+	if err := config.Formats.validate(); err != nil {
+		return err
+	}
+	if err := config.Log.validate(); err != nil {
+		return fmt.Errorf("log: %v", err)
+	}
+	if err := config.Audit.validate(); err != nil {
+		return fmt.Errorf("audit_syslog: %v", err)
+	}
+	if err := config.Filter.validate(); err != nil {
+		return err
+	}
+	if err := config.Spam.validate(); err != nil {
+		return err
+	}
+	if err := config.Kafka.validate(); err != nil {
+		return err
+	}
+	if config.EgressKBPerSec < 0 {
+		return fmt.Errorf("egress_kb_per_sec can't be negative")
+	}
+	if err := config.Link.validate(); err != nil {
+		return err
+	}
+	if err := config.Digest.validate(); err != nil {
+		return err
+	}
+	if err := config.Email.validate(); err != nil {
+		return err
+	}
+	for _, role := range splitNames(config.Require2FA) {
+		if _, ok := ROLE_RANKS[role]; !ok || role == ROLE_GUEST {
+			return fmt.Errorf("require_2fa: %q isn't user, moderator or admin", role)
+		}
+	}
+	if err := config.Push.validate(); err != nil {
+		return err
+	}
+	if config.TLS.Listen != "" {
+		if !config.TLS.enabled() {
+			return fmt.Errorf("tls_listen needs tls_cert and tls_key")
+		}
+		if _, _, err := net.SplitHostPort(config.TLS.Listen); err != nil {
+			return fmt.Errorf("tls_listen: %v", err)
+		}
+	}
+	if config.TLS.enabled() {
+		if _, err := config.TLS.config(); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	}
+	return nil
+}
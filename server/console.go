@@ -0,0 +1,383 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin console on a Unix socket. Access is controlled by the socket's file
+// permissions, so only the user running the server (and root) can attach.
+// It listens on --console-socket; attach with "chatd console".
+
+// Console commands and their help text
+var CONSOLE_COMMANDS = map[string]string{
+	"help":     "show this help",
+	"clients":  "list connected clients",
+	"conns":    "inspect every open connection",
+	"kick":     "kick NAME [REASON] - disconnect a client",
+	"ban":      "ban NAME|IP|CIDR [DURATION] [REASON] - ban a user or addresses",
+	"unban":    "unban NAME|IP|CIDR - lift a ban",
+	"bans":     "list bans",
+	"say":      "say TEXT - send a notice to everyone",
+	"invite":   "invite [USES] [NOTE] - create an invite code",
+	"invites":  "list outstanding invite codes",
+	"revoke":   "revoke CODE - delete an invite code",
+	"resets":   "list password reset codes waiting to be passed on",
+	"reset2fa": "reset2fa NAME - turn off two-factor login for a user who lost their device",
+	"stats":    "show server statistics",
+	"config":   "show server settings",
+	"tail":     "tail on|off - stream chat events",
+	"quit":     "detach from the console",
+}
+
+// Console commands that change something, which the audit log records
+var CONSOLE_AUDITED = []string{"kick", "ban", "unban", "say", "invite", "revoke", "reset2fa"}
+
+// Prefix of replies to "complete", which the console client uses for tab
+// completion rather than printing
+const CONSOLE_COMPLETIONS = "completions:"
+
+// ConsoleServer serves admin console sessions, streams events to those
+// that asked to tail them and shows notices, such as password reset codes,
+// to all of them.
+type ConsoleServer struct {
+	server  *ChatServer
+	mutex   sync.Mutex
+	tails   map[chan ChatEvent]bool
+	notices map[chan string]bool
+}
+
+func NewConsoleServer(server *ChatServer) *ConsoleServer {
+	return &ConsoleServer{
+		server:  server,
+		tails:   make(map[chan ChatEvent]bool),
+		notices: make(map[chan string]bool),
+	}
+}
+
+// Listen opens the console socket, replacing a stale one left by a server
+// that didn't shut down cleanly.
+func (console *ConsoleServer) Listen(path string) error {
+	listener, err := listenUnix(path, 0600)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				slog.Error("Error accepting console connection", "err", err)
+				return
+			}
+			go console.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Export implements EventExporter, fanning events out to tailing sessions.
+func (console *ConsoleServer) Export(event ChatEvent) {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+	for tail := range console.tails {
+		select {
+		case tail <- event:
+		default:
+		}
+	}
+}
+
+// Notice shows a line on every attached console.
+func (console *ConsoleServer) Notice(text string) {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+	for notices := range console.notices {
+		select {
+		case notices <- text:
+		default:
+		}
+	}
+}
+
+func (console *ConsoleServer) serve(conn net.Conn) {
+	defer conn.Close()
+	slog.Info("Admin console attached")
+	console.server.audit(AuditEntry{Event: AUDIT_LOGIN, Actor: "an administrator", Detail: "admin console"})
+
+	var writeMutex sync.Mutex
+	reply := func(format string, args ...any) {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		fmt.Fprintf(conn, format+"\n", args...)
+	}
+
+	var tail chan ChatEvent
+	stopTail := func() {
+		if tail != nil {
+			console.mutex.Lock()
+			delete(console.tails, tail)
+			console.mutex.Unlock()
+			close(tail)
+			tail = nil
+		}
+	}
+	defer stopTail()
+
+	notices := make(chan string, 16)
+	console.mutex.Lock()
+	console.notices[notices] = true
+	console.mutex.Unlock()
+	defer func() {
+		console.mutex.Lock()
+		delete(console.notices, notices)
+		console.mutex.Unlock()
+		close(notices)
+	}()
+	go func() {
+		for notice := range notices {
+			reply("*** %s", notice)
+		}
+	}()
+
+	reply("Chat server console. Type 'help' for commands.")
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		command, args, _ := strings.Cut(line, " ")
+		args = strings.TrimSpace(args)
+		if slices.Contains(CONSOLE_AUDITED, command) {
+			console.server.audit(AuditEntry{Event: AUDIT_COMMAND, Actor: "an administrator", Detail: line})
+		}
+
+		switch command {
+		case "":
+		case "help":
+			var names []string
+			for name := range CONSOLE_COMMANDS {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				reply("  %-8s %s", name, CONSOLE_COMMANDS[name])
+			}
+
+		case "clients":
+			clients := console.server.clientInfo()
+			for _, client := range clients {
+				reply("  %-20s %-16s %-22s %s", client.Name, client.Room, client.Remote, time.Since(client.JoinedAt).Round(time.Second))
+			}
+			reply("%d clients", len(clients))
+
+		case "conns":
+			conns := console.server.inspectConnections()
+			reply("  %-22s %-16s %-8s %-9s %-6s %-10s %-10s %s", "REMOTE", "USER", "IDLE", "QUEUE", "DROP", "IN", "OUT", "READ/WRITE")
+			for _, c := range conns {
+				reply("  %-22s %-16s %-8s %-9s %-6d %-10d %-10d %s/%s", c.Remote, c.User, c.Idle,
+					fmt.Sprintf("%d/%d", c.Queue, c.QueueCap), c.Dropped, c.BytesIn, c.BytesOut, c.Reader, c.Writer)
+			}
+			reply("%d connections", len(conns))
+
+		case "kick":
+			name, reason, _ := strings.Cut(args, " ")
+			if name == "" {
+				reply("usage: kick NAME [REASON]")
+			} else if console.server.kick(name, "an administrator", reason) == 0 {
+				reply("no client called %s", name)
+			} else {
+				slog.Info("Console: kicked", "user", name)
+				reply("kicked %s", name)
+			}
+
+		case "ban":
+			fields := strings.Fields(args)
+			if len(fields) == 0 {
+				reply("usage: ban NAME|IP|CIDR [DURATION] [REASON]")
+				break
+			}
+			ban := parseBan(fields, "an administrator")
+			if err := console.server.bans.Add(ban); err != nil {
+				reply("error: %v", err)
+				break
+			}
+			// The console outranks everyone
+			console.server.enforceBan(&ban, len(ROLE_RANKS))
+			slog.Info("Console: banned", "target", ban.Target, "until", ban.Until, "reason", ban.Reason)
+			reply("banned %s", ban.Target)
+
+		case "unban":
+			if removed, err := console.server.bans.Remove(args); err != nil {
+				reply("error: %v", err)
+			} else if !removed {
+				reply("%s isn't banned", args)
+			} else {
+				slog.Info("Console: unbanned", "target", args)
+				console.server.audit(AuditEntry{Event: AUDIT_UNBAN, Actor: "an administrator", Target: args})
+				console.server.exportModeration(EVENT_UNBAN, args, "an administrator", "", time.Time{})
+				reply("unbanned %s", args)
+			}
+
+		case "bans":
+			bans := console.server.bans.List()
+			for _, ban := range bans {
+				until := "forever"
+				if !ban.Until.IsZero() {
+					until = ban.Until.Local().Format("2006-01-02 15:04")
+				}
+				reply("  %-20s %-16s %-16s %s", ban.Target, until, ban.By, ban.Reason)
+			}
+			reply("%d bans", len(bans))
+
+		case "say":
+			if args == "" {
+				reply("usage: say TEXT")
+			} else {
+				console.server.notify("", fmt.Sprintf("*** Notice: %s ***", args))
+			}
+
+		case "invite":
+			uses, note := 1, ""
+			if first, rest, _ := strings.Cut(args, " "); first != "" {
+				if n, err := strconv.Atoi(first); err == nil {
+					uses, note = n, strings.TrimSpace(rest)
+				} else {
+					note = args
+				}
+			}
+			invite, err := console.server.invites.Create(uses, note)
+			if err != nil {
+				reply("error: %v", err)
+			} else {
+				slog.Info("Console: created invite", "code", invite.Code, "uses", invite.MaxUses)
+				reply("%s (%d uses)", invite.Code, invite.MaxUses)
+			}
+
+		case "invites":
+			invites := console.server.invites.List()
+			for _, invite := range invites {
+				reply("  %-12s %4d/%-4d %s  %s", invite.Code, invite.Uses, invite.MaxUses,
+					invite.CreatedAt.Local().Format("2006-01-02 15:04"), invite.Note)
+			}
+			reply("%d invites", len(invites))
+
+		case "revoke":
+			if ok, err := console.server.invites.Revoke(args); err != nil {
+				reply("error: %v", err)
+			} else if !ok {
+				reply("no invite %s", args)
+			} else {
+				slog.Info("Console: revoked invite", "code", args)
+				reply("revoked %s", args)
+			}
+
+		case "reset2fa":
+			if args == "" {
+				reply("usage: reset2fa NAME")
+			} else if console.server.accounts.TOTP(args) == "" {
+				reply("%s doesn't have two-factor login on", args)
+			} else if err := console.server.accounts.SetTOTP(args, ""); err != nil {
+				reply("error: %v", err)
+			} else {
+				slog.Info("Console: turned off two-factor login", "account", args)
+				console.server.refreshRole(args)
+				reply("turned off two-factor login for %s", args)
+			}
+
+		case "resets":
+			resets := console.server.resets.List()
+			for _, reset := range resets {
+				reply("  %-20s %-12s expires %s", reset.Account, reset.Code, reset.Expires.Local().Format("15:04"))
+			}
+			reply("%d reset codes", len(resets))
+
+		case "stats", "config":
+			var value any = console.server.stats()
+			if command == "config" {
+				value = console.server.adminConfig()
+			}
+			data, _ := json.MarshalIndent(value, "", "  ")
+			reply("%s", data)
+
+		case "tail":
+			switch args {
+			case "on":
+				if tail == nil {
+					tail = make(chan ChatEvent, 256)
+					console.mutex.Lock()
+					console.tails[tail] = true
+					console.mutex.Unlock()
+					go func(events chan ChatEvent) {
+						for event := range events {
+							reply("[%s] %s %s %s", event.Time.Local().Format("15:04:05"), event.Type, event.User, event.Text)
+						}
+					}(tail)
+				}
+				reply("tailing events")
+			case "off":
+				stopTail()
+				reply("stopped tailing")
+			default:
+				reply("usage: tail on|off")
+			}
+
+		case "complete":
+			reply("%s %s", CONSOLE_COMPLETIONS, strings.Join(console.complete(args), " "))
+
+		case "quit", "exit":
+			return
+
+		default:
+			reply("unknown command %q, try 'help'", command)
+		}
+	}
+}
+
+// complete returns the candidates for the last word of a partial line:
+// command names first, then client names for kick.
+func (console *ConsoleServer) complete(line string) []string {
+	words := strings.Fields(line)
+	if len(words) == 0 || strings.HasSuffix(line, " ") {
+		words = append(words, "")
+	}
+	prefix := strings.ToLower(words[len(words)-1])
+
+	var candidates []string
+	switch {
+	case len(words) == 1:
+		for name := range CONSOLE_COMMANDS {
+			candidates = append(candidates, name)
+		}
+	case len(words) == 2 && words[0] == "kick":
+		for _, client := range console.server.clientInfo() {
+			candidates = append(candidates, client.Name)
+		}
+	case len(words) == 2 && words[0] == "unban":
+		for _, ban := range console.server.bans.List() {
+			candidates = append(candidates, ban.Target)
+		}
+	case len(words) == 2 && words[0] == "tail":
+		candidates = []string{"on", "off"}
+	case len(words) == 2 && words[0] == "revoke":
+		for _, invite := range console.server.invites.List() {
+			candidates = append(candidates, invite.Code)
+		}
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(strings.ToLower(candidate), prefix) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
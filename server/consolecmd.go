@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/leavedtrait/chat/internal/term"
+)
+
+const CONSOLE_PROMPT = "chat> "
+
+// RunConsoleCommand implements "chat console", which attaches to a running
+// server's admin console. On a terminal it offers line editing and tab
+// completion; otherwise it just copies lines back and forth, for scripts.
+func RunConsoleCommand(args []string) int {
+	flags := flag.NewFlagSet("console", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CHAT_CONFIG"), "server config file to take the socket from (default $CHAT_CONFIG)")
+	socket := flags.String("socket", "", "console socket of the running server (default from console_socket)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *socket == "" {
+		config := DefaultConfig()
+		if *configFile != "" {
+			if err := config.loadFile(*configFile); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		*socket = config.ConsoleSocket
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error attaching to console:", err)
+		return 1
+	}
+	defer conn.Close()
+
+	restore, err := term.MakeRaw(os.Stdin)
+	if err != nil {
+		// Not a terminal
+		go io.Copy(conn, os.Stdin)
+		io.Copy(os.Stdout, conn)
+		return 0
+	}
+	defer restore()
+
+	editor := &consoleEditor{conn: conn, completions: make(chan []string, 1)}
+	go editor.readServer()
+	editor.run()
+	fmt.Print("\r\n")
+	return 0
+}
+
+// consoleEditor is a minimal raw-mode line editor. Server output is printed
+// above the line being typed, which is then redrawn.
+type consoleEditor struct {
+	conn        net.Conn
+	completions chan []string
+
+	mutex sync.Mutex
+	line  []rune
+	done  bool
+}
+
+func (editor *consoleEditor) redraw() {
+	fmt.Printf("\r\x1b[K%s%s", CONSOLE_PROMPT, string(editor.line))
+}
+
+func (editor *consoleEditor) readServer() {
+	scanner := bufio.NewScanner(editor.conn)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if rest, ok := strings.CutPrefix(text, CONSOLE_COMPLETIONS); ok {
+			editor.completions <- strings.Fields(rest)
+			continue
+		}
+
+		editor.mutex.Lock()
+		fmt.Printf("\r\x1b[K%s\r\n", text)
+		editor.redraw()
+		editor.mutex.Unlock()
+	}
+
+	editor.mutex.Lock()
+	editor.done = true
+	fmt.Print("\r\x1b[KConsole closed by server\r\n")
+	editor.mutex.Unlock()
+	os.Stdin.Close()
+}
+
+func (editor *consoleEditor) run() {
+	input := bufio.NewReader(os.Stdin)
+	editor.mutex.Lock()
+	editor.redraw()
+	editor.mutex.Unlock()
+
+	for {
+		r, _, err := input.ReadRune()
+		if err != nil {
+			return
+		}
+
+		editor.mutex.Lock()
+		if editor.done {
+			editor.mutex.Unlock()
+			return
+		}
+		switch r {
+		case '\r', '\n':
+			line := string(editor.line)
+			editor.line = nil
+			fmt.Print("\r\n")
+			editor.mutex.Unlock()
+			fmt.Fprintln(editor.conn, line)
+			if t := strings.TrimSpace(line); t == "quit" || t == "exit" {
+				return
+			}
+			continue
+		case 3, 4: // Ctrl-C, Ctrl-D
+			editor.mutex.Unlock()
+			return
+		case KEY_BACKSPACE, KEY_DELETE:
+			if len(editor.line) > 0 {
+				editor.line = editor.line[:len(editor.line)-1]
+			}
+		case KEY_CTRL_U:
+			editor.line = nil
+		case '\t':
+			line := string(editor.line)
+			editor.mutex.Unlock()
+			fmt.Fprintln(editor.conn, "complete "+line)
+			matches := <-editor.completions
+			editor.mutex.Lock()
+			editor.complete(matches)
+		default:
+			if r >= ' ' {
+				editor.line = append(editor.line, r)
+			}
+		}
+		editor.redraw()
+		editor.mutex.Unlock()
+	}
+}
+
+// complete applies completion candidates to the last word of the line:
+// one candidate replaces it, several extend it to their common prefix and
+// are listed.
+func (editor *consoleEditor) complete(matches []string) {
+	if len(matches) == 0 {
+		return
+	}
+
+	line := string(editor.line)
+	start := strings.LastIndex(line, " ") + 1
+	if len(matches) == 1 {
+		editor.line = []rune(line[:start] + matches[0] + " ")
+		return
+	}
+
+	prefix := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) > len(line)-start {
+		editor.line = []rune(line[:start] + prefix)
+	}
+	fmt.Printf("\r\x1b[K%s\r\n", strings.Join(matches, "  "))
+}
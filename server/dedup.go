@@ -0,0 +1,83 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retransmits. A JSON client whose connection drops before the ack for a
+// message arrives can't tell whether the server got it, so it sends it
+// again once it has reconnected. If it sends it with the same ref, the
+// server knows it for DEDUP_WINDOW after the first time: it isn't sent on
+// again, and the client gets the first one's ack instead. Refs are kept by
+// user name so they outlast the connection; clients should make them
+// unique, like a UUID or a counter after a random prefix.
+const (
+	DEDUP_WINDOW   = 10 * time.Minute
+	DEDUP_MAX_REFS = 100000 // refs remembered at most, across all users
+	MAX_REF_LENGTH = 64     // longer refs are acked but not remembered
+)
+
+// sentRef is the message a ref was first acked with.
+type sentRef struct {
+	id string
+	at time.Time
+}
+
+// dedupCache remembers the refs of recently acked messages.
+type dedupCache struct {
+	mutex sync.Mutex
+	refs  map[string]sentRef // by refKey
+	order []string           // refKeys, oldest first
+}
+
+func newDedupCache() *dedupCache {
+	return &dedupCache{refs: make(map[string]sentRef)}
+}
+
+func refKey(name, ref string) string {
+	return strings.ToLower(name) + " " + ref
+}
+
+// add remembers that the user's message with ref was accepted as id.
+func (cache *dedupCache) add(name, ref, id string) {
+	if ref == "" || len(ref) > MAX_REF_LENGTH {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.expire()
+	key := refKey(name, ref)
+	if _, ok := cache.refs[key]; ok {
+		return
+	}
+	cache.refs[key] = sentRef{id: id, at: time.Now()}
+	cache.order = append(cache.order, key)
+}
+
+// lookup returns the ID the user's message with ref was accepted as, if it
+// was within the window.
+func (cache *dedupCache) lookup(name, ref string) (string, bool) {
+	if ref == "" {
+		return "", false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.expire()
+	sent, ok := cache.refs[refKey(name, ref)]
+	return sent.id, ok
+}
+
+// expire forgets refs that are out of the window, or over the limit.
+func (cache *dedupCache) expire() {
+	cutoff := time.Now().Add(-DEDUP_WINDOW)
+	for len(cache.order) > 0 {
+		oldest := cache.order[0]
+		if len(cache.order) <= DEDUP_MAX_REFS && cache.refs[oldest].at.After(cutoff) {
+			return
+		}
+		delete(cache.refs, oldest)
+		cache.order = cache.order[1:]
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Daily digest. It is posted to the chat at --digest-hour (local time, -1
+// to turn it off) and, if --digest-smtp and --digest-to are set, mailed.
+// It names the DIGEST_TOP_USERS most active users.
+const DIGEST_TOP_USERS = 3
+
+// DigestOptions configures the daily digest.
+type DigestOptions struct {
+	Hour int
+	SMTP string
+	From string
+	To   string
+}
+
+func (options *DigestOptions) register(flags *flag.FlagSet) {
+	flags.IntVar(&options.Hour, "digest-hour", options.Hour, "hour of the day (0-23, local time) to post the daily digest at, or -1 for none")
+	flags.StringVar(&options.SMTP, "digest-smtp", options.SMTP, "SMTP server to mail the digest through, e.g. localhost:25 (empty to not mail it)")
+	flags.StringVar(&options.From, "digest-from", options.From, "sender of digest mail")
+	flags.StringVar(&options.To, "digest-to", options.To, "comma-separated addresses to mail the digest to")
+}
+
+func (options *DigestOptions) validate() error {
+	if options.Hour < -1 || options.Hour > 23 {
+		return fmt.Errorf("digest_hour must be 0-23, or -1 for no digest")
+	}
+	return nil
+}
+
+// DailyDigest counts the day's messages per user.
+type DailyDigest struct {
+	mutex    sync.Mutex
+	since    time.Time
+	messages int
+	users    map[string]int
+}
+
+func NewDailyDigest() *DailyDigest {
+	return &DailyDigest{
+		since: time.Now(),
+		users: make(map[string]int),
+	}
+}
+
+func (digest *DailyDigest) Record(name string) {
+	digest.mutex.Lock()
+	defer digest.mutex.Unlock()
+	digest.messages++
+	digest.users[name]++
+}
+
+// Take returns the summary of the period so far and starts a new one.
+func (digest *DailyDigest) Take() string {
+	digest.mutex.Lock()
+	since, messages, users := digest.since, digest.messages, digest.users
+	digest.since = time.Now()
+	digest.messages = 0
+	digest.users = make(map[string]int)
+	digest.mutex.Unlock()
+
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if users[names[i]] != users[names[j]] {
+			return users[names[i]] > users[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	var top []string
+	for i := 0; i < len(names) && i < DIGEST_TOP_USERS; i++ {
+		top = append(top, fmt.Sprintf("%s (%d)", names[i], users[names[i]]))
+	}
+	if len(top) == 0 {
+		top = append(top, "nobody")
+	}
+
+	return fmt.Sprintf("=== Daily digest since %s ===\nMessages: %d from %d users\nMost active: %s",
+		since.Format("2006-01-02 15:04"), messages, len(users), strings.Join(top, ", "))
+}
+
+// nextDigestTime returns the next time the clock reads hour:00.
+func nextDigestTime(now time.Time, hour int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// digestLoop posts the digest once a day.
+func (server *ChatServer) digestLoop() {
+	options := server.config.Digest
+	if options.Hour < 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Until(nextDigestTime(time.Now(), options.Hour)))
+
+		summary := server.digest.Take()
+		slog.Info("Daily digest", "summary", summary)
+		server.notify("", summary)
+
+		if options.SMTP != "" && options.To != "" {
+			if err := options.mail(summary); err != nil {
+				slog.Error("Error mailing digest", "err", err)
+			}
+		}
+	}
+}
+
+func (options DigestOptions) mail(summary string) error {
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Chat digest for %s\r\n\r\n%s\r\n",
+		options.From, options.To, time.Now().Format("2006-01-02"),
+		strings.ReplaceAll(summary, "\n", "\r\n"))
+	return smtp.SendMail(options.SMTP, nil, options.From, strings.Split(options.To, ","), []byte(body))
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Direct messages carry these prefixes after the timestamp
+const (
+	PM_FROM = "[PM from %s]"
+	PM_TO   = "[PM to %s]"
+)
+
+// isDirectMessage reports whether message is a private message to the
+// client reading it.
+func isDirectMessage(message string) bool {
+	_, rest, ok := strings.Cut(message, "] ")
+	return ok && strings.HasPrefix(rest, "[PM from ")
+}
+
+// handleDirectMessage implements "/msg <user> <text>" and "/reply <text>",
+// which sends to whoever last sent the client a private message.
+func (server *ChatServer) handleDirectMessage(client *Client, message string) {
+	command, rest, _ := strings.Cut(message, " ")
+
+	var target, text string
+	if command == "/reply" {
+		client.mutex.Lock()
+		target = client.replyTo
+		client.mutex.Unlock()
+		if target == "" {
+			client.messages <- "*** Nobody has sent you a private message yet ***"
+			return
+		}
+		text = strings.TrimSpace(rest)
+	} else {
+		target, text, _ = strings.Cut(strings.TrimSpace(rest), " ")
+		text = strings.TrimSpace(text)
+	}
+
+	if target == "" || text == "" {
+		client.messages <- "*** Usage: /msg <user> <text> or /reply <text> ***"
+		return
+	}
+	if strings.EqualFold(target, client.name()) {
+		client.messages <- "*** You can't message yourself ***"
+		return
+	}
+	if !server.allowDirect(client, target) {
+		return
+	}
+
+	peers := server.findClients(target)
+	if len(peers) == 0 && !server.accounts.Exists(target) {
+		client.messages <- fmt.Sprintf("*** %s is not online ***", target)
+		return
+	}
+
+	now := time.Now()
+	timestamp := now.Format("15:04:05")
+	id := newMessageID()
+	// Shadow-banned users are only shown their own side
+	if server.shadowed(client) {
+		client.logger().Info("Private message", "to", target, "shadow_banned", true)
+		if len(peers) == 0 {
+			client.messages <- fmt.Sprintf("*** %s is offline; they'll get your message when they next log in ***", target)
+			return
+		}
+		sent := fmt.Sprintf("[%s] "+PM_TO+" %s", timestamp, peers[0].name(), text)
+		frame := protocol.Frame{Type: protocol.FRAME_DM, ID: id, From: client.name(), To: peers[0].name(), Body: text, Timestamp: now}
+		client.messages <- withFrame(frame, tagMessage(messageTag{kind: TAG_MESSAGE, id: id, from: client.name()}, sent))
+		server.acknowledge(client, id)
+		return
+	}
+	if len(peers) == 0 {
+		server.sendMail(client, target, text)
+		return
+	}
+	server.receipts.add(id, client, peers[0].name())
+	delivered := false
+	name := client.name()
+	for _, peer := range peers {
+		received := fmt.Sprintf("[%s] "+PM_FROM+" %s", timestamp, name, text)
+		frame := protocol.Frame{Type: protocol.FRAME_DM, ID: id, From: name, To: peer.name(), Body: text, Timestamp: now}
+		if peer.deliver(withFrame(frame, tagMessage(messageTag{kind: TAG_DIRECT, id: id, from: name}, received)), PRIORITY_DIRECT) {
+			delivered = true
+			peer.mutex.Lock()
+			peer.replyTo = name
+			peer.mutex.Unlock()
+		}
+	}
+	if !delivered {
+		client.messages <- fmt.Sprintf("*** %s is too far behind to take messages right now ***", peers[0].name())
+		return
+	}
+	sent := fmt.Sprintf("[%s] "+PM_TO+" %s", timestamp, peers[0].name(), text)
+	frame := protocol.Frame{Type: protocol.FRAME_DM, ID: id, From: name, To: peers[0].name(), Body: text, Timestamp: now}
+	client.messages <- withFrame(frame, tagMessage(messageTag{kind: TAG_MESSAGE, id: id, from: client.name()}, sent))
+	server.acknowledge(client, id)
+}
@@ -0,0 +1,34 @@
+package server
+
+import "strings"
+
+// echoBot is the sample bot. It repeats whatever follows its trigger,
+// "!echo" unless the config line gives another:
+//
+//	bot = "echo !say"
+type echoBot struct {
+	trigger string
+}
+
+func init() {
+	RegisterBot("echo", func(args string) (Bot, error) {
+		trigger := "!echo"
+		if args != "" {
+			trigger = strings.Fields(args)[0]
+		}
+		return &echoBot{trigger: trigger}, nil
+	})
+}
+
+func (bot *echoBot) OnMessage(chat BotChat, event ChatEvent) {
+	if event.Type != EVENT_MESSAGE {
+		return
+	}
+	command, text, _ := strings.Cut(event.Text, " ")
+	if command == bot.trigger && strings.TrimSpace(text) != "" {
+		chat.Say(event.Room, text)
+	}
+}
+
+func (bot *echoBot) OnJoin(chat BotChat, event ChatEvent)  {}
+func (bot *echoBot) OnLeave(chat BotChat, event ChatEvent) {}
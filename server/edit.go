@@ -0,0 +1,268 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Message IDs, editing and deletion. Every chat message and action gets an
+// ID when it is broadcast, which JSON clients see in the frame. For
+// EDIT_WINDOW afterwards its sender can change it with an edit frame (or
+// "/edit <id> <text>") and remove it with a delete frame (or "/delete
+// <id>"). The room's JSON clients get edit and delete frames so they can
+// update what they show; text clients get a line saying what changed.
+// Changes are appended to the history, which applies them when it is read.
+const (
+	EDIT_WINDOW       = 15 * time.Minute
+	MESSAGE_ID_LENGTH = 8
+	RECENT_MESSAGES   = 1024 // messages remembered for editing
+
+	// History entries that change an earlier message
+	CHANGE_EDIT   = "edit"
+	CHANGE_DELETE = "delete"
+
+	// Messages with IDs are queued with a tag in front, between
+	// MESSAGE_MARK characters, which sanitizeText keeps out of anything
+	// clients send: MARK <kind> <id> <from> MARK <text>. The kind is
+	// TAG_MESSAGE, CHANGE_EDIT or CHANGE_DELETE; for changes the text is
+	// the new text, or nothing.
+	MESSAGE_MARK = "\x1f"
+	TAG_MESSAGE  = "message"
+)
+
+// messageTag says which message a queued line is, or changes.
+type messageTag struct {
+	kind string
+	id   string
+	from string
+}
+
+// tagMessage puts a tag in front of text for queueing.
+func tagMessage(tag messageTag, text string) string {
+	return MESSAGE_MARK + tag.kind + " " + tag.id + " " + tag.from + MESSAGE_MARK + text
+}
+
+// untagMessage splits a queued line into its tag and text, if it has one.
+func untagMessage(message string) (messageTag, string, bool) {
+	rest, ok := strings.CutPrefix(message, MESSAGE_MARK)
+	if !ok {
+		return messageTag{}, message, false
+	}
+	header, text, ok := strings.Cut(rest, MESSAGE_MARK)
+	if !ok {
+		return messageTag{}, message, false
+	}
+	fields := strings.SplitN(header, " ", 3)
+	if len(fields) != 3 {
+		return messageTag{}, message, false
+	}
+	return messageTag{kind: fields[0], id: fields[1], from: fields[2]}, text, true
+}
+
+// displayText turns a queued line into what a text client is shown.
+func (client *Client) displayText(message string) string {
+	tag, text, ok := untagMessage(message)
+	if !ok {
+		return message
+	}
+	switch tag.kind {
+	case CHANGE_EDIT:
+		return fmt.Sprintf("*** %s edited a message: %s ***", tag.from, text)
+	case CHANGE_DELETE:
+		return fmt.Sprintf("*** %s deleted a message ***", tag.from)
+	case CHANGE_REACT:
+		return reactionText(tag, text)
+	case TAG_PRESENCE:
+		return presenceText(tag, text)
+	}
+
+	client.mutex.Lock()
+	showIDs := client.showIDs
+	client.mutex.Unlock()
+	if showIDs {
+		return fmt.Sprintf("(%s) %s", tag.id, text)
+	}
+	return text
+}
+
+// newMessageID makes a random message ID.
+func newMessageID() string {
+	return rand.Text()[:MESSAGE_ID_LENGTH]
+}
+
+// postedMessage is a recently broadcast message.
+type postedMessage struct {
+	id      string
+	room    string
+	from    string
+	text    string // as shown, after any edit
+	action  bool
+	sentAt  time.Time
+	deleted bool
+
+	// Who reacted with what
+	reactions reactions
+
+	// Who may change it: the client that sent it, or anyone logged in to
+	// the account it was sent from. Neither is set for messages from bots
+	// and webhooks.
+	owner   *Client
+	account string
+}
+
+// recentMessages remembers the last RECENT_MESSAGES messages by ID.
+type recentMessages struct {
+	mutex sync.Mutex
+	byID  map[string]*postedMessage
+	order []string
+}
+
+func newRecentMessages() *recentMessages {
+	return &recentMessages{byID: make(map[string]*postedMessage)}
+}
+
+// add gives a message an ID and remembers it.
+func (recent *recentMessages) add(message *postedMessage) string {
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+	for {
+		message.id = newMessageID()
+		if _, taken := recent.byID[message.id]; !taken {
+			break
+		}
+	}
+	message.sentAt = time.Now()
+	recent.byID[message.id] = message
+	recent.order = append(recent.order, message.id)
+	if len(recent.order) > RECENT_MESSAGES {
+		delete(recent.byID, recent.order[0])
+		recent.order = recent.order[1:]
+	}
+	return message.id
+}
+
+// change finds a message client may still edit or delete and calls apply
+// with it, holding the lock. It returns why not if it can't.
+func (recent *recentMessages) change(client *Client, id string, apply func(message *postedMessage)) error {
+	account := client.loggedInAs()
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+	message, ok := recent.byID[strings.ToUpper(id)]
+	switch {
+	case !ok || message.deleted:
+		return fmt.Errorf("there is no message %s", id)
+	case message.owner != client && (account == "" || !strings.EqualFold(account, message.account)):
+		return fmt.Errorf("message %s isn't yours", id)
+	case time.Since(message.sentAt) > EDIT_WINDOW:
+		return fmt.Errorf("messages can only be changed for %s", EDIT_WINDOW)
+	}
+	apply(message)
+	return nil
+}
+
+// edited records a message's new text.
+func (recent *recentMessages) edited(id, text string) {
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+	if message, ok := recent.byID[id]; ok {
+		message.text = text
+	}
+}
+
+// get returns a copy of a recent message that hasn't been deleted.
+func (recent *recentMessages) get(id string) (postedMessage, bool) {
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+	message, ok := recent.byID[strings.ToUpper(id)]
+	if !ok || message.deleted {
+		return postedMessage{}, false
+	}
+	return *message, true
+}
+
+// handleEditCommand implements "/edit <id> <text>" and "/delete <id>".
+func (server *ChatServer) handleEditCommand(client *Client, message string) {
+	command, args, _ := strings.Cut(message, " ")
+	id, text, _ := strings.Cut(strings.TrimSpace(args), " ")
+	text = strings.TrimSpace(text)
+	if command == "/edit" && (id == "" || text == "") {
+		client.messages <- "*** Usage: /edit <id> <text> ***"
+		return
+	}
+	if command == "/delete" && id == "" {
+		client.messages <- "*** Usage: /delete <id> ***"
+		return
+	}
+	if command == "/edit" && !server.allowChat(client, text) {
+		return
+	}
+
+	var changed postedMessage
+	err := server.recent.change(client, id, func(message *postedMessage) {
+		if command == "/delete" {
+			message.deleted = true
+		}
+		changed = *message
+	})
+	if err != nil {
+		client.messages <- fmt.Sprintf("*** %v ***", err)
+		return
+	}
+	if command == "/edit" {
+		var ok bool
+		if text, ok = server.filterChat(client, changed.room, text); !ok {
+			return
+		}
+	}
+
+	// Like chat, history keeps what was typed and the room is shown it
+	// rendered
+	change, shown := CHANGE_EDIT, ""
+	var parts []messagePart
+	if command == "/delete" {
+		change, text = CHANGE_DELETE, ""
+	} else {
+		parts = parseMessage(text)
+		server.emotes.Expand(parts)
+		shown = renderText(parts)
+		if changed.action {
+			shown, parts = strings.Join(strings.Fields(shown), " "), nil
+		}
+	}
+
+	if change == CHANGE_EDIT {
+		server.recent.edited(changed.id, shown)
+	}
+	client.logger().Info("Message changed", "change", change, "id", changed.id, "room", changed.room, "text", shown)
+	if !server.shadowed(client) {
+		eventType := EVENT_EDIT
+		if change == CHANGE_DELETE {
+			eventType = EVENT_DELETE
+		}
+		event := server.record(ChatEvent{Type: eventType, User: client.name(), Room: changed.room, ID: changed.id, Text: text})
+		event.Text = shown
+		server.export(event)
+	}
+	line := tagMessage(messageTag{kind: change, id: changed.id, from: changed.from}, shown)
+	if change == CHANGE_EDIT {
+		frame := protocol.Frame{Type: protocol.FRAME_EDIT, ID: changed.id, From: changed.from, Room: changed.room, Body: shown, Parts: frameParts(parts)}
+		line = withFrame(frame, line)
+	}
+	server.sendFrom(client, changed.room, line, PRIORITY_CHATTER)
+}
+
+// newMessage gives a message that is about to be broadcast an ID and
+// returns its tag. owner is the client sending it, or nil for messages
+// nobody may change; text is what the room is shown.
+func (server *ChatServer) newMessage(owner *Client, from, room, text string, action bool) messageTag {
+	message := &postedMessage{room: room, from: from, text: text, action: action, owner: owner}
+	if owner != nil {
+		message.account = owner.loggedInAs()
+	}
+	return messageTag{kind: TAG_MESSAGE, id: server.recent.add(message), from: from}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Writes are sent in chunks of this size. Every chunk queues for its own
+// slot, so a client being sent a large message doesn't hold up the rest.
+const EGRESS_CHUNK = 4096
+
+// EgressLimiter spaces out writes from all connections to a fixed rate,
+// --egress-kb-per-sec, so a burst of large broadcasts can't saturate a
+// small uplink.
+// Slots are handed out in the order they are asked for, which shares the
+// bandwidth fairly between clients.
+type EgressLimiter struct {
+	mutex     sync.Mutex
+	rate      float64 // bytes per second
+	next      time.Time
+	throttled atomic.Int64 // nanoseconds writers spent waiting
+}
+
+func NewEgressLimiter(kbPerSec int) *EgressLimiter {
+	if kbPerSec <= 0 {
+		return nil
+	}
+	return &EgressLimiter{rate: float64(kbPerSec * 1024)}
+}
+
+// wait blocks until n bytes may be sent.
+func (limiter *EgressLimiter) wait(n int) {
+	limiter.mutex.Lock()
+	now := time.Now()
+	start := limiter.next
+	if start.Before(now) {
+		start = now
+	}
+	limiter.next = start.Add(time.Duration(float64(n) / limiter.rate * float64(time.Second)))
+	limiter.mutex.Unlock()
+
+	if delay := start.Sub(now); delay > 0 {
+		limiter.throttled.Add(int64(delay))
+		time.Sleep(delay)
+	}
+}
+
+// Throttled returns the total time writers have spent waiting.
+func (limiter *EgressLimiter) Throttled() time.Duration {
+	if limiter == nil {
+		return 0
+	}
+	return time.Duration(limiter.throttled.Load())
+}
+
+// writeLimited writes p through the limiter in chunks.
+func (limiter *EgressLimiter) writeLimited(write func([]byte) (int, error), p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), EGRESS_CHUNK)]
+		limiter.wait(len(chunk))
+		n, err := write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
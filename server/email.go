@@ -0,0 +1,426 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Email addresses. A registered user can give an address with /email and
+// is mailed, through --email-smtp, a link to /verify on --email-listen;
+// opening it and confirming verifies the address. Links are signed with
+// --email-secret and only work for EMAIL_LINK_LIFETIME, for the address
+// they were sent to. Without a secret the server makes a key when it
+// starts, so links die with a restart; servers in a cluster need the same
+// secret.
+//
+// Rooms in --verified-rooms only let in users with a verified address
+// (admins always get in), and the roles in --verified-roles only count
+// once an account's address is verified: until then it has the role
+// below, so "user" keeps unverified accounts to what guests can do.
+const (
+	EMAIL_LINK_LIFETIME = 24 * time.Hour
+	EMAIL_RESEND_DELAY  = time.Minute // between mails of a kind to one account
+	MAX_EMAIL_LENGTH    = 254
+
+	// Kinds of mail
+	EMAIL_VERIFY = "verify"
+	EMAIL_RESET  = "reset"
+)
+
+var errEmailLink = errors.New("this link is invalid or has expired")
+
+// EmailOptions says how to send mail to users and where the links in it
+// lead.
+type EmailOptions struct {
+	SMTP          string
+	From          string
+	Listen        string
+	URL           string
+	Secret        string
+	VerifiedRooms string
+	VerifiedRoles string
+}
+
+func (options *EmailOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.SMTP, "email-smtp", options.SMTP, "SMTP server to mail users through, e.g. localhost:25 (empty for no mail)")
+	flags.StringVar(&options.From, "email-from", options.From, "sender of mail to users")
+	flags.StringVar(&options.Listen, "email-listen", options.Listen, "address to serve email verification links on, at /verify (empty for no verification)")
+	flags.StringVar(&options.URL, "email-url", options.URL, "public URL of --email-listen, for the links (default http://<host>:<port>)")
+	flags.StringVar(&options.Secret, "email-secret", options.Secret, "key for signing verification links (default one made at startup, so links die with a restart)")
+	flags.StringVar(&options.VerifiedRooms, "verified-rooms", options.VerifiedRooms, "comma-separated rooms only users with a verified email address can join")
+	flags.StringVar(&options.VerifiedRoles, "verified-roles", options.VerifiedRoles, "comma-separated roles (user, moderator, admin) accounts only get once their email address is verified")
+}
+
+func (options *EmailOptions) validate() error {
+	for _, room := range splitNames(options.VerifiedRooms) {
+		name, ok := normalizeRoomName(room)
+		if !ok || name == LOBBY {
+			return fmt.Errorf("verified_rooms: %q can't be kept to verified users", room)
+		}
+	}
+	for _, role := range splitNames(options.VerifiedRoles) {
+		if _, ok := ROLE_RANKS[role]; !ok || role == ROLE_GUEST {
+			return fmt.Errorf("verified_roles: %q isn't user, moderator or admin", role)
+		}
+	}
+	if (options.VerifiedRooms != "" || options.VerifiedRoles != "") && !options.verifies() {
+		return fmt.Errorf("verified_rooms and verified_roles need email_smtp and email_listen")
+	}
+	if options.Listen != "" {
+		if _, _, err := net.SplitHostPort(options.Listen); err != nil {
+			return fmt.Errorf("email_listen: %v", err)
+		}
+	}
+	return nil
+}
+
+// verifies reports whether addresses can be verified.
+func (options *EmailOptions) verifies() bool {
+	return options.SMTP != "" && options.Listen != ""
+}
+
+// verifiedRoom reports whether a room is kept to verified users.
+func (options *EmailOptions) verifiedRoom(name string) bool {
+	return slices.ContainsFunc(splitNames(options.VerifiedRooms), func(room string) bool {
+		normalized, _ := normalizeRoomName(room)
+		return normalized == name
+	})
+}
+
+// verifiedRole reports whether a role is kept to verified accounts.
+func (options *EmailOptions) verifiedRole(role string) bool {
+	return slices.Contains(splitNames(options.VerifiedRoles), role)
+}
+
+// baseURL is where the links in mail lead.
+func (options *EmailOptions) baseURL() string {
+	if options.URL != "" {
+		return strings.TrimSuffix(options.URL, "/")
+	}
+	host, port, _ := net.SplitHostPort(options.Listen)
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// send mails text to one address.
+func (options *EmailOptions) send(to, subject, text string) error {
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n\r\n%s\r\n",
+		options.From, to, subject, time.Now().Format(time.RFC1123Z),
+		strings.ReplaceAll(text, "\n", "\r\n"))
+	return smtp.SendMail(options.SMTP, nil, options.From, []string{to}, []byte(body))
+}
+
+// emailSender signs links and keeps accounts from being mailed too often.
+type emailSender struct {
+	key   []byte
+	mutex sync.Mutex
+	sent  map[string]time.Time // by kind and lowercased account
+}
+
+func newEmailSender(secret string) *emailSender {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &emailSender{key: key, sent: make(map[string]time.Time)}
+}
+
+// allow reports whether an account may be sent a kind of mail now, and if
+// so counts it as sent.
+func (sender *emailSender) allow(kind, account string) bool {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	key := kind + " " + strings.ToLower(account)
+	if time.Since(sender.sent[key]) < EMAIL_RESEND_DELAY {
+		return false
+	}
+	sender.sent[key] = time.Now()
+	return true
+}
+
+// sign makes a link token for verifying an account's address.
+func (sender *emailSender) sign(account, address string, expires time.Time) string {
+	payload := account + "\n" + address + "\n" + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, sender.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// open checks a link token, returning the account and address it is for.
+func (sender *emailSender) open(token string) (string, string, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if !ok || err != nil {
+		return "", "", errEmailLink
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	mac := hmac.New(sha256.New, sender.key)
+	mac.Write(payload)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return "", "", errEmailLink
+	}
+	fields := strings.Split(string(payload), "\n")
+	if len(fields) != 3 {
+		return "", "", errEmailLink
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		return "", "", errEmailLink
+	}
+	return fields[0], fields[1], nil
+}
+
+// parseEmail checks an address a user gave, which must be just the
+// address.
+func parseEmail(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address || len(address) > MAX_EMAIL_LENGTH {
+		return "", fmt.Errorf("%q isn't an email address", address)
+	}
+	return parsed.Address, nil
+}
+
+// Email returns an account's address and whether it is verified.
+func (store *AccountStore) Email(name string) (string, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if account, ok := store.accounts[strings.ToLower(name)]; ok {
+		return account.Email, account.EmailVerified
+	}
+	return "", false
+}
+
+// SetEmail gives an account an unverified address, or none.
+func (store *AccountStore) SetEmail(name, address string) error {
+	return store.update(name, func(account *Account) error {
+		account.Email, account.EmailVerified = address, false
+		return nil
+	})
+}
+
+// VerifyEmail marks an account's address verified, if it is still the
+// one that was mailed.
+func (store *AccountStore) VerifyEmail(name, address string) error {
+	return store.update(name, func(account *Account) error {
+		if !strings.EqualFold(account.Email, address) {
+			return errEmailLink
+		}
+		account.EmailVerified = true
+		return nil
+	})
+}
+
+// emailVerified reports whether the client is logged in to an account
+// with a verified address.
+func (server *ChatServer) emailVerified(client *Client) bool {
+	account := client.loggedInAs()
+	if account == "" {
+		return false
+	}
+	_, verified := server.accounts.Email(account)
+	return verified
+}
+
+// verifiedRole returns the role an account gets, taking it down a rank at
+// a time while it is one of --verified-roles and the account's address
+// isn't verified.
+func (server *ChatServer) verifiedRole(account, role string) string {
+	options := &server.config.Email
+	if options.VerifiedRoles == "" {
+		return role
+	}
+	if _, verified := server.accounts.Email(account); verified {
+		return role
+	}
+	for role != ROLE_GUEST && options.verifiedRole(role) {
+		role = roleBelow(role)
+	}
+	return role
+}
+
+// refreshRole gives the clients logged in to an account the role it has
+// now, sending them the commands that opens or closes.
+func (server *ChatServer) refreshRole(account string) {
+	for _, client := range server.findClients(account) {
+		if !strings.EqualFold(client.loggedInAs(), account) {
+			continue
+		}
+		role := server.roleOf(account)
+		client.mutex.Lock()
+		changed := client.accountRole != role
+		client.accountRole = role
+		client.mutex.Unlock()
+		if changed {
+			client.logger().Info("Role changed", "role", role)
+			server.sendCommands(client)
+		}
+	}
+}
+
+// handleEmailCommand implements "/email" to show the client's address,
+// "/email <address>" to set it and be mailed a link to verify it and
+// "/email off" to remove it.
+func (server *ChatServer) handleEmailCommand(client *Client, message string) {
+	_, arg, _ := strings.Cut(message, " ")
+	arg = strings.TrimSpace(arg)
+	account := client.loggedInAs()
+	if account == "" {
+		client.messages <- "*** Only registered users can give an email address: /register first ***"
+		return
+	}
+	current, verified := server.accounts.Email(account)
+
+	switch {
+	case arg == "":
+		switch {
+		case current == "":
+			client.messages <- "*** You haven't given an email address: /email <address> ***"
+		case verified:
+			client.messages <- fmt.Sprintf("*** Your email address is %s (verified) ***", current)
+		default:
+			client.messages <- fmt.Sprintf("*** Your email address is %s (not verified: /email %s sends the link again) ***", current, current)
+		}
+		return
+
+	case arg == "off":
+		if err := server.accounts.SetEmail(account, ""); err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		client.logger().Info("Email address removed")
+		client.messages <- "*** Removed your email address ***"
+		server.refreshRole(account)
+		return
+	}
+
+	if !server.config.Email.verifies() {
+		client.messages <- "*** This server doesn't verify email addresses ***"
+		return
+	}
+	address, err := parseEmail(arg)
+	if err != nil {
+		client.messages <- fmt.Sprintf("*** %v ***", err)
+		return
+	}
+	if strings.EqualFold(address, current) && verified {
+		client.messages <- fmt.Sprintf("*** %s is already verified ***", address)
+		return
+	}
+	if !server.email.allow(EMAIL_VERIFY, account) {
+		client.messages <- "*** Wait a little before asking for another mail ***"
+		return
+	}
+	if !strings.EqualFold(address, current) {
+		if err := server.accounts.SetEmail(account, address); err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		server.refreshRole(account)
+	}
+
+	options := &server.config.Email
+	link := options.baseURL() + "/verify?token=" + url.QueryEscape(server.email.sign(account, address, time.Now().Add(EMAIL_LINK_LIFETIME)))
+	text := fmt.Sprintf("Someone, hopefully you, gave this address for %s on %s.\n\nTo verify it, open this link within %d hours:\n\n%s\n\nIf it wasn't you, ignore this mail.",
+		account, server.config.StatusName, int(EMAIL_LINK_LIFETIME.Hours()), link)
+	if err := options.send(address, "Verify your email address", text); err != nil {
+		client.logger().Error("Error sending verification mail", "err", err)
+		client.messages <- fmt.Sprintf("*** Couldn't send mail to %s; try again later ***", address)
+		return
+	}
+	client.logger().Info("Verification mail sent")
+	client.messages <- fmt.Sprintf("*** Mailed a link to %s; open it to verify the address ***", address)
+}
+
+var verifyTemplate = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+{{if .Error}}<p>{{.Error}}.</p>
+{{else if .Done}}<p>{{.Address}} is verified for {{.Account}}. You can close this page.</p>
+{{else}}<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<p>Verify {{.Address}} for {{.Account}}?</p>
+<button type="submit">Verify</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// verifyHandler serves the links in verification mail:
+//
+//	GET  /verify?token=T  asks to confirm
+//	POST /verify          verifies the address (form field token)
+//
+// Verifying takes a POST so that mail scanners opening the link don't.
+func (server *ChatServer) verifyHandler() http.Handler {
+	mux := http.NewServeMux()
+	page := func(w http.ResponseWriter, r *http.Request, done bool) {
+		token := r.FormValue("token")
+		account, address, err := server.email.open(token)
+		if err == nil && done {
+			err = server.accounts.VerifyEmail(account, address)
+		}
+		data := struct {
+			Name, Account, Address, Token, Error string
+			Done                                 bool
+		}{Name: server.config.StatusName, Account: account, Address: address, Token: token, Done: done}
+		status := http.StatusOK
+		switch {
+		case errors.Is(err, errEmailLink):
+			data.Error, status = "This link is invalid or has expired", http.StatusBadRequest
+		case err != nil:
+			slog.Error("Error verifying email address", "account", account, "err", err)
+			data.Error, status = "Something went wrong; try again later", http.StatusInternalServerError
+		case done:
+			slog.Info("Email address verified", "account", account, "remote", r.RemoteAddr)
+			server.refreshRole(account)
+			for _, client := range server.findClients(account) {
+				if strings.EqualFold(client.loggedInAs(), account) {
+					client.deliver(fmt.Sprintf("*** Verified your email address %s ***", address), PRIORITY_SYSTEM)
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := verifyTemplate.Execute(w, data); err != nil {
+			slog.Error("Error rendering verification page", "err", err)
+		}
+	}
+
+	mux.HandleFunc("GET /verify", func(w http.ResponseWriter, r *http.Request) {
+		page(w, r, false)
+	})
+	mux.HandleFunc("POST /verify", func(w http.ResponseWriter, r *http.Request) {
+		page(w, r, true)
+	})
+	return mux
+}
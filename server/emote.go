@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// File emotes are kept in with --storage files
+const EMOTES_FILE = "emotes.json"
+
+const MAX_EMOTE_LENGTH = 200
+
+var emoteNamePattern = regexp.MustCompile(`^:[a-z0-9_+-]{1,32}:$`)
+
+// EmoteRegistry maps :shortcodes: to the text (usually an emoji or a URL)
+// they expand to in chat messages.
+type EmoteRegistry struct {
+	mutex   sync.RWMutex
+	storage Storage
+	emotes  map[string]string
+}
+
+// NewEmoteRegistry returns an empty registry, which keeps emotes in memory
+// until Load gives it storage.
+func NewEmoteRegistry() *EmoteRegistry {
+	return &EmoteRegistry{storage: newMemoryStorage(), emotes: make(map[string]string)}
+}
+
+// Load reads the emotes from storage, where changes are saved from then on.
+func (registry *EmoteRegistry) Load(storage Storage) error {
+	emotes, err := storage.LoadEmotes()
+	if err != nil {
+		return err
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.storage, registry.emotes = storage, emotes
+	return nil
+}
+
+func (registry *EmoteRegistry) Add(name, value string) error {
+	if !emoteNamePattern.MatchString(name) {
+		return fmt.Errorf("emote names look like :name: (a-z, 0-9, _ + -)")
+	}
+	if value == "" || len(value) > MAX_EMOTE_LENGTH {
+		return fmt.Errorf("emote text must be 1-%d bytes", MAX_EMOTE_LENGTH)
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if err := registry.storage.SaveEmote(name, value); err != nil {
+		return err
+	}
+	registry.emotes[name] = value
+	return nil
+}
+
+func (registry *EmoteRegistry) Remove(name string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, ok := registry.emotes[name]; !ok {
+		return fmt.Errorf("no emote %s", name)
+	}
+	if err := registry.storage.DeleteEmote(name); err != nil {
+		return err
+	}
+	delete(registry.emotes, name)
+	return nil
+}
+
+// List returns "name value" lines sorted by name.
+func (registry *EmoteRegistry) List() []string {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	var lines []string
+	for name, value := range registry.emotes {
+		lines = append(lines, fmt.Sprintf("%s  %s", name, value))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// Expand replaces known :shortcodes: in the prose parts of a message. Code
+// blocks are left alone.
+func (registry *EmoteRegistry) Expand(parts []messagePart) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	if len(registry.emotes) == 0 {
+		return
+	}
+
+	var pairs []string
+	for name, value := range registry.emotes {
+		pairs = append(pairs, name, value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	for i, part := range parts {
+		if !part.Code {
+			parts[i].Text = replacer.Replace(part.Text)
+		}
+	}
+}
+
+// handleEmoteCommand implements /emote add|del, for moderators, and
+// /emotes.
+func (server *ChatServer) handleEmoteCommand(client *Client, message string) {
+	fields := strings.Fields(message)
+
+	if fields[0] == "/emotes" {
+		lines := server.emotes.List()
+		if len(lines) == 0 {
+			client.messages <- "*** No custom emotes yet. Add one with /emote add :name: <text> ***"
+			return
+		}
+		client.messages <- "--- Custom emotes ---\n" + strings.Join(lines, "\n")
+		return
+	}
+
+	var err error
+	switch {
+	case len(fields) >= 4 && fields[1] == "add":
+		name := strings.ToLower(fields[2])
+		if err = server.emotes.Add(name, strings.Join(fields[3:], " ")); err == nil {
+			server.send("", fmt.Sprintf("*** %s added emote %s ***", client.name(), name), PRIORITY_CHATTER)
+		}
+	case len(fields) == 3 && fields[1] == "del":
+		name := strings.ToLower(fields[2])
+		if err = server.emotes.Remove(name); err == nil {
+			server.send("", fmt.Sprintf("*** %s removed emote %s ***", client.name(), name), PRIORITY_CHATTER)
+		}
+	default:
+		client.messages <- "*** Usage: /emote add :name: <url-or-unicode> | /emote del :name: ***"
+		return
+	}
+	if err != nil {
+		client.messages <- fmt.Sprintf("*** %v ***", err)
+	}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Event log. What happens on the server is appended to the storage's
+// event log, numbered from 1 in Seq, and never changed: messages and
+// actions, their edits, deletions and reactions, bans, unbans, kicks and
+// mutes, and rooms created, changed and closed. Joins and leaves are only
+// exported. The history and its search index are read models, rebuilt
+// from the log when the server opens and brought up to date as events are
+// appended, so the log is the one source of truth for replaying, bridging
+// and auditing. GET /admin/events?after=N (chatd admin events) replays it
+// from any point, and with follow=true goes on with events as they
+// happen; a follower that falls EVENT_LOG_BUFFER behind is cut off, and
+// can pick up from the last Seq it saw.
+//
+// Messages are kept as they were typed, as the history always has been,
+// and without the sender's address.
+const (
+	EVENT_LOG_BUFFER  = 256
+	EVENT_REPLAY_PAGE = 10000 // events read from storage at a time
+)
+
+// Events kept in the event log
+var EVENT_LOGGED = map[string]bool{
+	EVENT_MESSAGE:     true,
+	EVENT_ACTION:      true,
+	EVENT_EDIT:        true,
+	EVENT_DELETE:      true,
+	EVENT_REACT:       true,
+	EVENT_BAN:         true,
+	EVENT_UNBAN:       true,
+	EVENT_KICK:        true,
+	EVENT_MUTE:        true,
+	EVENT_ROOM:        true,
+	EVENT_ROOM_CLOSED: true,
+}
+
+// eventLog is where a Storage keeps the event log.
+type eventLog interface {
+	// AppendEvent stores an event, numbering it one after the last.
+	AppendEvent(event *ChatEvent) error
+
+	// ReadEvents calls each with the events numbered after after, oldest
+	// first: the first limit of them, or all if limit is 0.
+	ReadEvents(after int64, limit int, each func(ChatEvent)) error
+}
+
+// EventLog appends events to the storage's event log, keeps the history
+// in step with it and passes new events on to followers.
+type EventLog struct {
+	mutex     sync.Mutex
+	log       eventLog
+	history   *HistoryLog
+	followers map[chan ChatEvent]bool
+}
+
+func NewEventLog(log eventLog, history *HistoryLog) *EventLog {
+	return &EventLog{log: log, history: history, followers: make(map[chan ChatEvent]bool)}
+}
+
+// Append numbers and stores an event and applies it to the history. Events
+// are appended one at a time, so followers get them in order.
+func (events *EventLog) Append(event *ChatEvent) error {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	if err := events.log.AppendEvent(event); err != nil {
+		return err
+	}
+	events.history.Apply(*event)
+	for follower := range events.followers {
+		select {
+		case follower <- *event:
+		default:
+			delete(events.followers, follower)
+			close(follower)
+		}
+	}
+	return nil
+}
+
+// Replay calls each with the stored events after after. They are read
+// EVENT_REPLAY_PAGE at a time, so a slow each doesn't hold up the storage.
+func (events *EventLog) Replay(after int64, each func(ChatEvent)) error {
+	for {
+		var page []ChatEvent
+		err := events.log.ReadEvents(after, EVENT_REPLAY_PAGE, func(event ChatEvent) {
+			page = append(page, event)
+		})
+		if err != nil {
+			return err
+		}
+		for _, event := range page {
+			each(event)
+			after = event.Seq
+		}
+		if len(page) < EVENT_REPLAY_PAGE {
+			return nil
+		}
+	}
+}
+
+// Follow returns a channel that gets every event appended from now on,
+// until Unfollow or until it falls EVENT_LOG_BUFFER behind, when it is
+// closed.
+func (events *EventLog) Follow() chan ChatEvent {
+	follower := make(chan ChatEvent, EVENT_LOG_BUFFER)
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.followers[follower] = true
+	return follower
+}
+
+func (events *EventLog) Unfollow(follower chan ChatEvent) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	if events.followers[follower] {
+		delete(events.followers, follower)
+		close(follower)
+	}
+}
+
+// record stamps an event and, if it is one the event log keeps, appends
+// it there, returning it with its Seq. Export the result to send it on.
+func (server *ChatServer) record(event ChatEvent) ChatEvent {
+	event.stamp()
+	if server.events == nil || !EVENT_LOGGED[event.Type] {
+		return event
+	}
+	if err := server.events.Append(&event); err != nil {
+		slog.Error("Error writing the event log", "type", event.Type, "err", err)
+	}
+	return event
+}
+
+// recordRoom records and exports a change to a room's settings; it is the
+// room store's OnChange.
+func (server *ChatServer) recordRoom(name string, settings *RoomSettings) {
+	event := ChatEvent{Type: EVENT_ROOM_CLOSED, Room: name}
+	if settings != nil {
+		shown := *settings
+		shown.Hash = ""
+		event.Type, event.User, event.Settings = EVENT_ROOM, settings.Owner, &shown
+	}
+	server.export(server.record(event))
+}
+
+// historyEntry returns the history entry an event stands for, if it is a
+// message or a change to one.
+func historyEntry(event ChatEvent) (HistoryEntry, bool) {
+	entry := HistoryEntry{Time: event.Time, Room: event.Room, From: event.User, Text: event.Text, ID: event.ID}
+	switch event.Type {
+	case EVENT_MESSAGE:
+	case EVENT_ACTION:
+		entry.Action = true
+	case EVENT_EDIT:
+		entry.Change = CHANGE_EDIT
+	case EVENT_DELETE:
+		entry.Change = CHANGE_DELETE
+	case EVENT_REACT:
+		entry.Change = CHANGE_REACT
+	default:
+		return HistoryEntry{}, false
+	}
+	return entry, true
+}
+
+// entryEvent returns the event a history entry stands for, for imported
+// logs and history written before there was an event log.
+func entryEvent(entry HistoryEntry) ChatEvent {
+	event := ChatEvent{Version: EVENTS_VERSION, Type: EVENT_MESSAGE, Time: entry.Time, User: entry.From, Text: entry.Text, Room: entry.Room, ID: entry.ID}
+	switch {
+	case entry.Change == CHANGE_EDIT:
+		event.Type = EVENT_EDIT
+	case entry.Change == CHANGE_DELETE:
+		event.Type = EVENT_DELETE
+	case entry.Change == CHANGE_REACT:
+		event.Type = EVENT_REACT
+	case entry.Action:
+		event.Type = EVENT_ACTION
+	}
+	return event
+}
+
+// eventFile is an event log file, one JSON event per line, numbered by
+// line. Lines from before the event log are history entries, read as the
+// events they stand for.
+type eventFile struct {
+	mutex sync.Mutex
+	file  *os.File
+	lines int64
+}
+
+func openEventFile(path string) (*eventFile, error) {
+	lines, err := scanEventFile(path, 0, 0, func(ChatEvent) {})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventFile{file: file, lines: lines}, nil
+}
+
+func (log *eventFile) AppendEvent(event *ChatEvent) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	event.Seq = log.lines + 1
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := log.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	log.lines++
+	return nil
+}
+
+func (log *eventFile) ReadEvents(after int64, limit int, each func(ChatEvent)) error {
+	_, err := scanEventFile(log.file.Name(), after, limit, each)
+	return err
+}
+
+// scanEventFile reads a file from the start, calling each with the first
+// limit events numbered after after (all of them if limit is 0) and
+// skipping lines that aren't events or entries, and returns how many
+// lines it read.
+func scanEventFile(path string, after int64, limit int, each func(ChatEvent)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var seq int64
+	read := 0
+	for (limit == 0 || read < limit) && scanner.Scan() {
+		seq++
+		if seq <= after {
+			continue
+		}
+		var event ChatEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		if event.Type == "" {
+			var entry HistoryEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.From == "" {
+				continue
+			}
+			event = entryEvent(entry)
+		}
+		event.Seq = seq
+		each(event)
+		read++
+	}
+	return seq, scanner.Err()
+}
+
+func (log *eventFile) Close() error {
+	return log.file.Close()
+}
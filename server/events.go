@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event export. Every message, join, leave and moderation action is
+// written in a versioned schema, for analytics and compliance pipelines:
+// as a JSON line to --events-file, and produced to Kafka with
+// --kafka-brokers. Events that are kept in the event log (see
+// eventlog.go) carry their number there in Seq.
+//
+// Exporters that write from a goroutine of their own keep up to
+// EVENTS_BUFFER events waiting. When that is full, an event waits up to
+// EVENTS_BLOCK for room before it is dropped; drops are counted in
+// chat_events_dropped_total and logged at most once every
+// EVENTS_DROP_LOG_INTERVAL.
+const (
+	EVENTS_VERSION           = 1
+	EVENTS_BUFFER            = 1024
+	EVENTS_BLOCK             = time.Second
+	EVENTS_DROP_LOG_INTERVAL = 10 * time.Second
+)
+
+// Event types
+const (
+	EVENT_MESSAGE = "message"
+	EVENT_ACTION  = "action"
+	EVENT_JOIN    = "join"
+	EVENT_LEAVE   = "leave"
+	EVENT_BAN     = "ban"
+	EVENT_UNBAN   = "unban"
+	EVENT_KICK    = "kick"
+	EVENT_MUTE    = "mute"
+
+	// Changes to earlier messages, by ID; a reaction's text is the emoji
+	EVENT_EDIT   = "edit"
+	EVENT_DELETE = "delete"
+	EVENT_REACT  = "react"
+
+	// A room created or its settings changed, and a room's settings
+	// removed
+	EVENT_ROOM        = "room"
+	EVENT_ROOM_CLOSED = "room_closed"
+)
+
+// Events that can be asked for by name, by webhooks and Kafka topics
+var EVENT_TYPES = map[string]bool{
+	EVENT_MESSAGE: true,
+	EVENT_ACTION:  true,
+	EVENT_JOIN:    true,
+	EVENT_LEAVE:   true,
+	EVENT_BAN:     true,
+	EVENT_UNBAN:   true,
+	EVENT_KICK:    true,
+	EVENT_MUTE:    true,
+
+	EVENT_EDIT:        true,
+	EVENT_DELETE:      true,
+	EVENT_REACT:       true,
+	EVENT_ROOM:        true,
+	EVENT_ROOM_CLOSED: true,
+}
+
+// eventTypeNames lists the event types, for messages.
+func eventTypeNames() string {
+	names := make([]string, 0, len(EVENT_TYPES))
+	for name := range EVENT_TYPES {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ChatEvent is the exported event schema. Fields are only ever added, and
+// Version is bumped if the meaning of an existing one changes. For bans,
+// unbans, kicks and mutes, User is the name or address acted on, By who
+// did it and Text the reason; bans and mutes that end have Until. Messages
+// and the edits, deletions and reactions to them have ID, and room events
+// the room's Settings, without its password.
+type ChatEvent struct {
+	Version int       `json:"version"`
+	Seq     int64     `json:"seq,omitempty"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Text    string    `json:"text,omitempty"`
+	Remote  string    `json:"remote,omitempty"`
+	Room    string    `json:"room,omitempty"`
+	By      string    `json:"by,omitempty"`
+	Until   time.Time `json:"until,omitzero"`
+
+	ID       string        `json:"id,omitempty"`
+	Settings *RoomSettings `json:"settings,omitempty"`
+}
+
+// EventExporter receives every event. Export must not block for long.
+type EventExporter interface {
+	Export(event ChatEvent)
+}
+
+// eventQueue holds events for an exporter that writes them from its own
+// goroutine, which reads events.
+type eventQueue struct {
+	name    string // the exporter, for the log
+	events  chan ChatEvent
+	dropped atomic.Int64
+
+	mutex    sync.Mutex
+	reported int64 // drops already logged
+	warned   time.Time
+}
+
+func newEventQueue(name string) *eventQueue {
+	return &eventQueue{name: name, events: make(chan ChatEvent, EVENTS_BUFFER)}
+}
+
+// Export queues an event, waiting up to EVENTS_BLOCK if the queue is full.
+func (queue *eventQueue) Export(event ChatEvent) {
+	select {
+	case queue.events <- event:
+		return
+	default:
+	}
+	timer := time.NewTimer(EVENTS_BLOCK)
+	defer timer.Stop()
+	select {
+	case queue.events <- event:
+	case <-timer.C:
+		queue.drop(event)
+	}
+}
+
+// drop counts an event that couldn't be queued, logging the drops since
+// the last warning if it has been long enough.
+func (queue *eventQueue) drop(event ChatEvent) {
+	total := queue.dropped.Add(1)
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if time.Since(queue.warned) < EVENTS_DROP_LOG_INTERVAL {
+		return
+	}
+	slog.Warn("Event export is backed up, dropping events", "exporter", queue.name, "type", event.Type, "dropped", total-queue.reported, "total", total)
+	queue.reported, queue.warned = total, time.Now()
+}
+
+// Dropped returns how many events have been dropped.
+func (queue *eventQueue) Dropped() int64 {
+	return queue.dropped.Load()
+}
+
+// fileExporter appends events to a file from its own goroutine.
+type fileExporter struct {
+	*eventQueue
+}
+
+func NewFileExporter(path string) (EventExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter := &fileExporter{eventQueue: newEventQueue("file")}
+	go func() {
+		encoder := json.NewEncoder(file)
+		for event := range exporter.events {
+			if err := encoder.Encode(event); err != nil {
+				slog.Error("Error exporting event", "err", err)
+			}
+		}
+	}()
+	return exporter, nil
+}
+
+// droppedEvents adds up the events the exporters have dropped.
+func (server *ChatServer) droppedEvents() int64 {
+	var dropped int64
+	for _, exporter := range server.exporters {
+		if queue, ok := exporter.(interface{ Dropped() int64 }); ok {
+			dropped += queue.Dropped()
+		}
+	}
+	return dropped
+}
+
+// exportEvent stamps an event about a client and hands it to every
+// exporter.
+func (server *ChatServer) exportEvent(eventType string, client *Client, text string) {
+	if len(server.exporters) == 0 {
+		return
+	}
+	server.export(ChatEvent{
+		Type:   eventType,
+		User:   client.name(),
+		Text:   text,
+		Remote: client.conn.RemoteAddr().String(),
+		Room:   server.roomOf(client),
+	})
+}
+
+// exportBan records and exports a new ban.
+func (server *ChatServer) exportBan(ban *Ban) {
+	server.exportModeration(EVENT_BAN, ban.Target, ban.By, ban.Reason, ban.Until)
+}
+
+// exportModeration records and exports a ban, unban, kick or mute of
+// target by by.
+func (server *ChatServer) exportModeration(eventType, target, by, reason string, until time.Time) {
+	server.export(server.record(ChatEvent{
+		Type:  eventType,
+		User:  target,
+		Text:  reason,
+		By:    by,
+		Until: until,
+	}))
+}
+
+func (server *ChatServer) export(event ChatEvent) {
+	event.stamp()
+	for _, exporter := range server.exporters {
+		exporter.Export(event)
+	}
+}
+
+// stamp sets an event's version, and its time if it has none.
+func (event *ChatEvent) stamp() {
+	event.Version = EVENTS_VERSION
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+}
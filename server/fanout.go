@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Capacity. Each client costs a goroutine reading its connection (the one
+// that accepted it), one writing and, with pings on, one for keepalives;
+// everything else is shared. A message goes to a room by queueing it for
+// each member, and writePump sends whatever has queued up for its client
+// in one write. In rooms bigger than CROWD_SIZE, joins, leaves and user
+// lists aren't announced: with thousands of members they would be most
+// of the traffic. See cmd/loadtest for measuring a server.
+const (
+	CROWD_SIZE = 200
+
+	// Most writePump gathers from a client's queues into one write
+	WRITE_BATCH_BYTES = 16 * 1024
+)
+
+// writeBuffers holds buffers for writePump between writes, so idle clients
+// don't each keep one.
+var writeBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// putWriteBuffer returns a buffer to the pool, unless one huge message
+// made it too big to be worth keeping.
+func putWriteBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > 4*WRITE_BATCH_BYTES {
+		return
+	}
+	buffer.Reset()
+	writeBuffers.Put(buffer)
+}
+
+// crowded reports whether a room, or the whole server if room is empty,
+// has too many members to announce who comes and goes. Everyone passes
+// through the lobby on the way in, so it counts as crowded when the server
+// is, however few are in it at the moment.
+func (server *ChatServer) crowded(room string) bool {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	if room == "" || room == LOBBY {
+		return len(server.clients) > CROWD_SIZE
+	}
+	members := 0
+	if r, ok := server.rooms[room]; ok {
+		members = len(r.members)
+	}
+	return members > CROWD_SIZE
+}
+
+// membershipLine is the notice that name joined or left a room, or the
+// chat if room is empty, with its frame.
+func membershipLine(event, name, room string) string {
+	verb, where := "joined", "the chat"
+	if event == protocol.EVENT_LEAVE {
+		verb = "left"
+	}
+	if room != "" {
+		where = room
+	}
+	text := fmt.Sprintf("%s has %s %s", name, verb, where)
+	frame := protocol.Frame{Type: protocol.FRAME_NOTICE, Event: event, From: name, Room: room, Body: text}
+	return withFrame(frame, "*** "+text+" ***")
+}
+
+// notifyMembership sends a notice about someone joining or leaving, unless
+// the room is crowded. Like renames and user lists it goes as chatter, so
+// when many come and go at once a client that falls behind misses some of
+// these rather than losing its connection.
+func (server *ChatServer) notifyMembership(room, text string) {
+	if !server.crowded(room) {
+		server.send(room, text, PRIORITY_CHATTER)
+	}
+}
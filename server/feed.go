@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Live feed. With --feed-listen set, GET /feed streams chat as Server-Sent
+// Events, read-only, for dashboards and status pages to embed: every
+// message, action, join and leave is an event named for its type, with the
+// ChatEvent as JSON for data, less the user's address. ?room=#name,
+// repeatable, limits the feed to those rooms. Invite-only rooms and ones
+// with a password never appear in it. Readers need --feed-token, as a
+// bearer token or, since a browser's EventSource can't send headers, as
+// ?token=.
+const (
+	FEED_BUFFER    = 256 // events a reader may fall behind by before it is dropped
+	FEED_KEEPALIVE = 30 * time.Second
+)
+
+// Event types the feed carries
+var FEED_EVENTS = []string{EVENT_MESSAGE, EVENT_ACTION, EVENT_JOIN, EVENT_LEAVE}
+
+// feedHub fans events out to the feed's readers.
+type feedHub struct {
+	mutex   sync.Mutex
+	readers map[chan ChatEvent]bool
+}
+
+func newFeedHub() *feedHub {
+	return &feedHub{readers: make(map[chan ChatEvent]bool)}
+}
+
+// Export implements EventExporter. A reader that has fallen too far
+// behind is dropped rather than sent a feed with holes in it; EventSource
+// reconnects by itself.
+func (feed *feedHub) Export(event ChatEvent) {
+	if !slices.Contains(FEED_EVENTS, event.Type) {
+		return
+	}
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	for reader := range feed.readers {
+		select {
+		case reader <- event:
+		default:
+			delete(feed.readers, reader)
+			close(reader)
+		}
+	}
+}
+
+func (feed *feedHub) subscribe() chan ChatEvent {
+	reader := make(chan ChatEvent, FEED_BUFFER)
+	feed.mutex.Lock()
+	feed.readers[reader] = true
+	feed.mutex.Unlock()
+	return reader
+}
+
+func (feed *feedHub) unsubscribe(reader chan ChatEvent) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	if feed.readers[reader] {
+		delete(feed.readers, reader)
+		close(reader)
+	}
+}
+
+// inFeed reports whether a room's events may go in the feed.
+func (server *ChatServer) inFeed(room string) bool {
+	settings, ok := server.roomStore.Get(room)
+	return !ok || !(settings.InviteOnly || settings.hasPassword())
+}
+
+// feedHandler serves the feed.
+func (server *ChatServer) feedHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /feed", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "streaming isn't supported")
+			return
+		}
+		var rooms []string
+		for _, value := range r.URL.Query()["room"] {
+			room, ok := normalizeRoomName(value)
+			if !ok {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("%q isn't a room name", value))
+				return
+			}
+			rooms = append(rooms, room)
+		}
+
+		reader := server.feed.subscribe()
+		defer server.feed.unsubscribe(reader)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepalive := time.NewTicker(FEED_KEEPALIVE)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				// A comment, so proxies don't close an idle stream
+				fmt.Fprint(w, ": keepalive\n\n")
+			case event, ok := <-reader:
+				if !ok {
+					return
+				}
+				if (len(rooms) > 0 && !slices.Contains(rooms, event.Room)) || !server.inFeed(event.Room) {
+					continue
+				}
+				// Addresses are for the operators, not whoever watches
+				event.Remote = ""
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			}
+			flusher.Flush()
+		}
+	})
+
+	// EventSource can't send headers, so the token may come in the query
+	guarded := requireToken(server.config.FeedToken, mux)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		guarded.ServeHTTP(w, r)
+	})
+}
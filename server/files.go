@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// File sharing. "/upload" gives the client a single-use link to POST a
+// file to, and once it arrives a share link goes to the client's room (or,
+// with "/upload <user>", privately to that user):
+//
+//	curl -F file=@report.pdf http://chat.example.com:8091/files/upload/<token>
+//
+// Files are kept in --files-dir, next to a JSON description of each, and
+// removed after --files-retention. Off unless --files-listen is set; the
+// listener may be shared with the admin API, status page or metrics.
+//
+//	POST /files/upload/{token}    upload the "file" field of a multipart form
+//	GET  /files/{id}/{name}       download a shared file
+const (
+	UPLOAD_WINDOW   = 10 * time.Minute // how long an upload link works
+	FILES_SWEEP     = time.Hour        // how often expired files are removed
+	FILE_ID_LENGTH  = 16
+	SNIFF_BYTES     = 512 // bytes http.DetectContentType looks at
+	MAX_FILE_NAME   = 128
+	UPLOAD_OVERHEAD = 64 * 1024 // room for multipart headers in a request
+)
+
+var errFileTooLarge = errors.New("file is too large")
+
+// SharedFile describes a stored file.
+type SharedFile struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	From       string    `json:"from"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// uploadGrant is what an upload link allows: a file from a user, for a
+// room or another user.
+type uploadGrant struct {
+	from    string
+	room    string
+	to      string
+	expires time.Time
+}
+
+// FileStore keeps shared files on disk and the upload links handed out.
+type FileStore struct {
+	dir       string
+	maxBytes  int64
+	retention time.Duration
+
+	mutex  sync.Mutex
+	grants map[string]uploadGrant
+}
+
+func NewFileStore(dir string, maxBytes int64, retention time.Duration) *FileStore {
+	return &FileStore{
+		dir:       dir,
+		maxBytes:  maxBytes,
+		retention: retention,
+		grants:    make(map[string]uploadGrant),
+	}
+}
+
+// Grant returns a token for one upload.
+func (store *FileStore) Grant(grant uploadGrant) string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	for token, old := range store.grants {
+		if now.After(old.expires) {
+			delete(store.grants, token)
+		}
+	}
+	token := rand.Text()
+	grant.expires = now.Add(UPLOAD_WINDOW)
+	store.grants[token] = grant
+	return token
+}
+
+// Redeem uses up an upload token.
+func (store *FileStore) Redeem(token string) (uploadGrant, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	grant, ok := store.grants[token]
+	delete(store.grants, token)
+	return grant, ok && time.Now().Before(grant.expires)
+}
+
+func (store *FileStore) path(id string) string {
+	return filepath.Join(store.dir, id)
+}
+
+// Save stores a file, sniffing its type from the first bytes.
+func (store *FileStore) Save(name, from string, content io.Reader) (SharedFile, error) {
+	if err := os.MkdirAll(store.dir, 0700); err != nil {
+		return SharedFile{}, err
+	}
+	file := SharedFile{
+		ID:         rand.Text()[:FILE_ID_LENGTH],
+		Name:       cleanFileName(name),
+		From:       from,
+		UploadedAt: time.Now(),
+	}
+
+	output, err := os.OpenFile(store.path(file.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return SharedFile{}, err
+	}
+	head := make([]byte, SNIFF_BYTES)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		output.Close()
+		os.Remove(store.path(file.ID))
+		return SharedFile{}, err
+	}
+	file.Type = http.DetectContentType(head[:n])
+
+	// Copy one byte more than allowed to tell a full-sized file from a
+	// larger one
+	body := io.MultiReader(bytes.NewReader(head[:n]), content)
+	file.Size, err = io.Copy(output, io.LimitReader(body, store.maxBytes+1))
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && file.Size > store.maxBytes {
+		err = errFileTooLarge
+	}
+	if err == nil {
+		var data []byte
+		data, _ = json.Marshal(file)
+		err = os.WriteFile(store.path(file.ID)+".json", data, 0600)
+	}
+	if err != nil {
+		os.Remove(store.path(file.ID))
+		return SharedFile{}, err
+	}
+	return file, nil
+}
+
+// Open returns a stored file and its description.
+func (store *FileStore) Open(id string) (*os.File, SharedFile, error) {
+	var file SharedFile
+	if len(id) != FILE_ID_LENGTH || strings.ContainsAny(id, `/\.`) {
+		return nil, file, os.ErrNotExist
+	}
+	data, err := os.ReadFile(store.path(id) + ".json")
+	if err != nil {
+		return nil, file, err
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, file, err
+	}
+	content, err := os.Open(store.path(id))
+	return content, file, err
+}
+
+// Expire removes files older than the retention period.
+func (store *FileStore) Expire() {
+	descriptions, _ := filepath.Glob(filepath.Join(store.dir, "*.json"))
+	for _, description := range descriptions {
+		data, err := os.ReadFile(description)
+		if err != nil {
+			continue
+		}
+		var file SharedFile
+		if json.Unmarshal(data, &file) != nil || time.Since(file.UploadedAt) < store.retention {
+			continue
+		}
+		os.Remove(strings.TrimSuffix(description, ".json"))
+		os.Remove(description)
+		slog.Info("Shared file expired", "id", file.ID, "name", file.Name)
+	}
+}
+
+// cleanFileName keeps the last element of a name a client gave, as
+// printable text of a sensible length.
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.TrimSpace(sanitizeText(strings.ReplaceAll(name, "\n", " ")))
+	if len(name) > MAX_FILE_NAME {
+		name = name[:MAX_FILE_NAME]
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "file"
+	}
+	return name
+}
+
+// formatSize writes a byte count for people.
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// filesURL is where the file listener can be reached from outside.
+func (server *ChatServer) filesURL() string {
+	if server.config.FilesURL != "" {
+		return strings.TrimSuffix(server.config.FilesURL, "/")
+	}
+	host, port, _ := net.SplitHostPort(server.config.FilesListen)
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// startFiles opens the file store and removes expired files every
+// FILES_SWEEP until the server stops.
+func (server *ChatServer) startFiles(done <-chan struct{}) {
+	server.files = NewFileStore(server.config.FilesDir, int64(server.config.MaxFileMB)<<20, server.config.FilesRetention)
+	go func() {
+		for {
+			server.files.Expire()
+			select {
+			case <-time.After(FILES_SWEEP):
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// handleUploadCommand implements "/upload [user]".
+func (server *ChatServer) handleUploadCommand(client *Client, message string) {
+	if server.files == nil {
+		client.messages <- "*** File sharing is off ***"
+		return
+	}
+	grant := uploadGrant{from: client.name(), room: server.roomOf(client)}
+	if _, target, _ := strings.Cut(message, " "); strings.TrimSpace(target) != "" {
+		grant.to = strings.TrimSpace(target)
+		if strings.EqualFold(grant.to, client.name()) {
+			client.messages <- "*** You can't send a file to yourself ***"
+			return
+		}
+		if !server.allowDirect(client, grant.to) {
+			return
+		}
+	} else if !server.allowChat(client, "") {
+		return
+	}
+
+	token := server.files.Grant(grant)
+	link := server.filesURL() + "/files/upload/" + token
+	client.messages <- fmt.Sprintf("*** Within %s, upload up to %d MB with: curl -F file=@<path> %s ***", UPLOAD_WINDOW, server.config.MaxFileMB, link)
+}
+
+// shareFile tells the room, or the user, a grant was for about a new file.
+func (server *ChatServer) shareFile(grant uploadGrant, file SharedFile) (string, error) {
+	link := fmt.Sprintf("%s/files/%s/%s", server.filesURL(), file.ID, url.PathEscape(file.Name))
+	description := fmt.Sprintf("shared %s (%s, %s): %s", file.Name, formatSize(file.Size), file.Type, link)
+	if grant.to == "" {
+		server.postAs(grant.from, grant.room, description, true)
+		return link, nil
+	}
+
+	peers := server.findClients(grant.to)
+	if len(peers) == 0 {
+		return link, fmt.Errorf("%s is not online", grant.to)
+	}
+	now := time.Now()
+	timestamp := now.Format("15:04:05")
+	frame := protocol.Frame{Type: protocol.FRAME_DM, From: grant.from, To: peers[0].name(), Body: description, Timestamp: now}
+	for _, peer := range peers {
+		peer.deliver(withFrame(frame, fmt.Sprintf("[%s] "+PM_FROM+" %s", timestamp, grant.from, description)), PRIORITY_DIRECT)
+	}
+	for _, sender := range server.findClients(grant.from) {
+		sender.deliver(withFrame(frame, fmt.Sprintf("[%s] "+PM_TO+" %s", timestamp, peers[0].name(), description)), PRIORITY_DIRECT)
+	}
+	return link, nil
+}
+
+// filesHandler serves uploads and downloads.
+func (server *ChatServer) filesHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /files/upload/{token}", func(w http.ResponseWriter, r *http.Request) {
+		grant, ok := server.files.Redeem(r.PathValue("token"))
+		if !ok {
+			writeError(w, http.StatusForbidden, "unknown or expired upload link; ask for another with /upload")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, server.files.maxBytes+UPLOAD_OVERHEAD)
+		reader, err := r.MultipartReader()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "expected a multipart form with a file field")
+			return
+		}
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "no file field in the form")
+				return
+			}
+			if part.FormName() != "file" {
+				continue
+			}
+
+			file, err := server.files.Save(part.FileName(), grant.from, part)
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.Is(err, errFileTooLarge), errors.As(err, &tooLarge):
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("files can be at most %d MB", server.config.MaxFileMB))
+				return
+			case err != nil:
+				slog.Error("Error saving shared file", "err", err)
+				writeError(w, http.StatusInternalServerError, "couldn't save the file")
+				return
+			}
+			slog.Info("File shared", "user", grant.from, "id", file.ID, "name", file.Name, "type", file.Type, "size", file.Size, "remote", r.RemoteAddr)
+
+			link, err := server.shareFile(grant, file)
+			if err != nil {
+				writeJSON(w, http.StatusOK, map[string]string{"url": link, "warning": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"url": link})
+			return
+		}
+	})
+	mux.HandleFunc("GET /files/{id}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		content, file, err := server.files.Open(r.PathValue("id"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer content.Close()
+
+		// Only images are shown in the browser; anything else, HTML in
+		// particular, is downloaded
+		disposition := "attachment"
+		if strings.HasPrefix(file.Type, "image/") {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", file.Type)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename*=UTF-8''%s", disposition, url.PathEscape(file.Name)))
+		http.ServeContent(w, r, "", file.UploadedAt, content)
+	})
+	return mux
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Content filter. Chat, actions and edits in a room are checked against
+// the room's filter rules and the words in --filter-file, which apply in
+// every room; private messages aren't. A rule is a word, matched whole
+// and in any case, or a /regexp/, with an action: warn lets the message
+// through and warns the sender, mask stars out what matched, drop stops
+// the message and mute stops it and mutes the sender for --filter-mute.
+// When several rules match the strictest action wins, and whatever mask
+// rules matched is starred out. Admins list a room's rules with "/filter
+// [#room]" and change them with "/filter [#room] add <action> <word or
+// /regexp/>" and "/filter [#room] del <word or /regexp/>"; they are saved
+// with the room's settings.
+const (
+	FILTER_WARN = "warn"
+	FILTER_MASK = "mask"
+	FILTER_DROP = "drop"
+	FILTER_MUTE = "mute"
+
+	MAX_ROOM_FILTERS = 100
+)
+
+// Filter actions, most lenient first
+var FILTER_ACTIONS = []string{FILTER_WARN, FILTER_MASK, FILTER_DROP, FILTER_MUTE}
+
+// FilterRule is a word or /regexp/ and what to do with messages that
+// contain it.
+type FilterRule struct {
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+}
+
+// FilterOptions configures the words filtered in every room.
+type FilterOptions struct {
+	File    string
+	Action  string
+	MuteFor time.Duration
+}
+
+func (options *FilterOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.File, "filter-file", options.File, "file of words or /regexps/ to filter in every room, one per line (empty for none)")
+	flags.StringVar(&options.Action, "filter-action", options.Action, "what --filter-file words do: warn, mask, drop or mute")
+	flags.DurationVar(&options.MuteFor, "filter-mute", options.MuteFor, "how long the mute filter action mutes for")
+}
+
+func (options *FilterOptions) validate() error {
+	if !slices.Contains(FILTER_ACTIONS, options.Action) {
+		return fmt.Errorf("unknown filter_action %q (use warn, mask, drop or mute)", options.Action)
+	}
+	if options.MuteFor <= 0 {
+		return fmt.Errorf("filter_mute must be positive")
+	}
+	return nil
+}
+
+// load reads the rules in --filter-file. Blank lines and lines starting
+// with # are skipped.
+func (options *FilterOptions) load() ([]FilterRule, error) {
+	if options.File == "" {
+		return nil, nil
+	}
+	file, err := os.Open(options.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []FilterRule
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if _, err := compileFilter(pattern); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", options.File, number, err)
+		}
+		rules = append(rules, FilterRule{Pattern: pattern, Action: options.Action})
+	}
+	return rules, scanner.Err()
+}
+
+// compileFilter turns a rule's pattern into a case-insensitive regexp. A
+// word only matches whole, where it starts or ends with a letter or digit.
+func compileFilter(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+	}
+	wordy := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	expression := regexp.QuoteMeta(pattern)
+	if first, _ := utf8.DecodeRuneInString(pattern); wordy(first) {
+		expression = `\b` + expression
+	}
+	if last, _ := utf8.DecodeLastRuneInString(pattern); wordy(last) {
+		expression += `\b`
+	}
+	return regexp.Compile("(?i)" + expression)
+}
+
+// contentFilter holds the rules for every room and the compiled patterns.
+type contentFilter struct {
+	global []FilterRule
+
+	mutex    sync.Mutex
+	compiled map[string]*regexp.Regexp
+}
+
+func newContentFilter(global []FilterRule) *contentFilter {
+	return &contentFilter{global: global, compiled: make(map[string]*regexp.Regexp)}
+}
+
+// pattern returns a rule's compiled pattern, or nil if it doesn't compile.
+func (filter *contentFilter) pattern(rule FilterRule) *regexp.Regexp {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	expression, ok := filter.compiled[rule.Pattern]
+	if !ok {
+		expression, _ = compileFilter(rule.Pattern)
+		filter.compiled[rule.Pattern] = expression
+	}
+	return expression
+}
+
+// apply checks text against the global rules and a room's, returning it
+// with what mask rules matched starred out, and the strictest action of
+// the rules that matched, or "" if none did.
+func (filter *contentFilter) apply(rules []FilterRule, text string) (string, string) {
+	action := ""
+	for _, rule := range slices.Concat(filter.global, rules) {
+		expression := filter.pattern(rule)
+		if expression == nil || !expression.MatchString(text) {
+			continue
+		}
+		if rule.Action == FILTER_MASK {
+			text = expression.ReplaceAllStringFunc(text, func(match string) string {
+				return strings.Repeat("*", utf8.RuneCountInString(match))
+			})
+		}
+		if slices.Index(FILTER_ACTIONS, rule.Action) > slices.Index(FILTER_ACTIONS, action) {
+			action = rule.Action
+		}
+	}
+	return text, action
+}
+
+// filterChat runs a message client is sending to room through the filter,
+// returning the text to send and whether to send it. The client is told
+// if the filter did anything but mask it.
+func (server *ChatServer) filterChat(client *Client, room, text string) (string, bool) {
+	settings, _ := server.roomStore.Get(room)
+	text, action := server.filter.apply(settings.Filters, text)
+	if action != "" {
+		client.logger().Info("Filtered message", "room", room, "action", action)
+	}
+	switch action {
+	case FILTER_WARN:
+		client.messages <- "*** Please mind your language ***"
+	case FILTER_DROP:
+		client.messages <- "*** Your message wasn't sent: it has words that aren't allowed here ***"
+		return "", false
+	case FILTER_MUTE:
+		duration := server.config.Filter.MuteFor
+		server.mute(client.name(), "the server", "filtered words", duration)
+		client.messages <- fmt.Sprintf("*** Your message wasn't sent and you are muted for %s: it has words that aren't allowed here ***", duration)
+		return "", false
+	}
+	return text, true
+}
+
+// handleFilterCommand implements "/filter [#room] [add <action> <pattern>
+// | del <pattern>]". The command registry keeps it to admins.
+func (server *ChatServer) handleFilterCommand(client *Client, message string) {
+	const usage = "*** Usage: /filter [#room] [add <warn|mask|drop|mute> <word or /regexp/> | del <word or /regexp/>] ***"
+	_, args, _ := strings.Cut(message, " ")
+	fields := strings.Fields(args)
+	room := server.roomOf(client)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "#") {
+		name, ok := normalizeRoomName(fields[0])
+		if !ok {
+			client.messages <- fmt.Sprintf("*** %s isn't a room name ***", fields[0])
+			return
+		}
+		room, fields = name, fields[1:]
+	}
+	settings, _ := server.roomStore.Get(room)
+
+	switch {
+	case len(fields) == 0:
+		lines := []string{fmt.Sprintf("--- Filter for %s ---", room)}
+		for _, rule := range settings.Filters {
+			lines = append(lines, fmt.Sprintf("  %-4s %s", rule.Action, rule.Pattern))
+		}
+		if len(settings.Filters) == 0 {
+			lines = append(lines, "  (no rules of its own)")
+		}
+		if count := len(server.filter.global); count > 0 {
+			lines = append(lines, fmt.Sprintf("  and %d from --filter-file, which %s in every room", count, server.config.Filter.Action))
+		}
+		client.messages <- strings.Join(lines, "\n")
+
+	case fields[0] == "add" && len(fields) >= 3:
+		action, pattern := fields[1], strings.Join(fields[2:], " ")
+		if !slices.Contains(FILTER_ACTIONS, action) {
+			client.messages <- usage
+			return
+		}
+		if _, err := compileFilter(pattern); err != nil {
+			client.messages <- fmt.Sprintf("*** Bad pattern: %v ***", err)
+			return
+		}
+		replaced := slices.ContainsFunc(settings.Filters, func(rule FilterRule) bool { return rule.Pattern == pattern })
+		if !replaced && len(settings.Filters) >= MAX_ROOM_FILTERS {
+			client.messages <- fmt.Sprintf("*** A room can have at most %d filter rules ***", MAX_ROOM_FILTERS)
+			return
+		}
+		if !server.updateRoom(client, room, func(settings *RoomSettings) {
+			settings.Filters = slices.DeleteFunc(settings.Filters, func(rule FilterRule) bool { return rule.Pattern == pattern })
+			settings.Filters = append(settings.Filters, FilterRule{Pattern: pattern, Action: action})
+		}) {
+			return
+		}
+		client.logger().Info("Filter rule added", "room", room, "pattern", pattern, "action", action)
+		client.messages <- fmt.Sprintf("*** %s now filters %s (%s) ***", room, pattern, action)
+
+	case fields[0] == "del" && len(fields) >= 2:
+		pattern := strings.Join(fields[1:], " ")
+		if !slices.ContainsFunc(settings.Filters, func(rule FilterRule) bool { return rule.Pattern == pattern }) {
+			client.messages <- fmt.Sprintf("*** %s doesn't filter %s ***", room, pattern)
+			return
+		}
+		if !server.updateRoom(client, room, func(settings *RoomSettings) {
+			settings.Filters = slices.DeleteFunc(settings.Filters, func(rule FilterRule) bool { return rule.Pattern == pattern })
+		}) {
+			return
+		}
+		client.logger().Info("Filter rule removed", "room", room, "pattern", pattern)
+		client.messages <- fmt.Sprintf("*** %s no longer filters %s ***", room, pattern)
+
+	default:
+		client.messages <- usage
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// A client sending faster than the message rate has its lines dropped with
+// a warning. Each run of dropped lines is a strike; a client with too many
+// strikes is kicked and its address banned for a while.
+const (
+	FLOOD_STRIKES      = 3
+	FLOOD_STRIKE_RESET = time.Minute // strikes are forgotten after this long
+	FLOOD_BAN          = 10 * time.Minute
+)
+
+// floodState is a token bucket of messages plus the client's strikes,
+// owned by readPump.
+type floodState struct {
+	tokens     float64
+	last       time.Time
+	throttled  bool
+	strikes    int
+	lastStrike time.Time
+}
+
+// checkFlood charges one message to the client. It reports whether the
+// message should be dropped, and whether the client has been kicked.
+func (server *ChatServer) checkFlood(client *Client) (drop, kicked bool) {
+	live := server.config.live()
+	rate, burst := live.MessageRate, float64(live.MessageBurst)
+	if rate <= 0 {
+		return false, false
+	}
+
+	flood := &client.flood
+	now := time.Now()
+	if flood.last.IsZero() {
+		flood.tokens = burst
+	} else {
+		flood.tokens = min(burst, flood.tokens+now.Sub(flood.last).Seconds()*rate)
+	}
+	flood.last = now
+
+	if flood.tokens >= 1 {
+		flood.tokens--
+		flood.throttled = false
+		return false, false
+	}
+	if flood.throttled {
+		return true, false
+	}
+
+	// A new run of dropped messages
+	flood.throttled = true
+	if now.Sub(flood.lastStrike) > FLOOD_STRIKE_RESET {
+		flood.strikes = 0
+	}
+	flood.strikes++
+	flood.lastStrike = now
+	if flood.strikes > FLOOD_STRIKES {
+		server.kickForFlooding(client)
+		return true, true
+	}
+	client.deliver(fmt.Sprintf("*** You're sending too fast; messages are being dropped (warning %d of %d) ***", flood.strikes, FLOOD_STRIKES), PRIORITY_SYSTEM)
+	return true, false
+}
+
+func (server *ChatServer) kickForFlooding(client *Client) {
+	ban := Ban{
+		Target:  remoteHost(client.conn),
+		Address: true,
+		Until:   time.Now().Add(FLOOD_BAN),
+		Reason:  "flooding",
+		By:      "the server",
+	}
+	server.bans.Add(ban)
+	server.exportBan(&ban)
+	server.auditBan(&ban)
+	client.deliver(fmt.Sprintf("*** Disconnected for flooding; you can come back in %s ***", FLOOD_BAN), PRIORITY_SYSTEM)
+
+	notice := fmt.Sprintf("*** %s was kicked for flooding ***", client.name())
+	client.logger().Warn("Kicked for flooding", "banned", remoteHost(client.conn), "for", FLOOD_BAN)
+	server.audit(AuditEntry{Event: AUDIT_KICK, Actor: "the server", Remote: client.conn.RemoteAddr().String(), Target: client.name(), Detail: "flooding"})
+	server.exportModeration(EVENT_KICK, client.name(), "the server", "flooding", time.Time{})
+	server.notify("", notice)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Message formats. Admins can change how text clients are shown chat,
+// join and leave notices and private messages with Go text/template
+// formats (--chat-format, --join-format, --leave-format, --pm-format).
+// Messages are still queued in the built-in format, which the bell reads,
+// and only turned into the configured one as they are written, from the
+// frame they were queued with. An empty format keeps the built-in one. Templates can
+// use the color function, e.g. {{color "cyan" .Text}}, and usercolor for
+// a name in its user's color, e.g. {{usercolor .From}}. Clients without
+// /color on have the colors taken out.
+var FORMAT_COLORS = map[string]string{
+	"bold":           "1",
+	"red":            "31",
+	"green":          "32",
+	"yellow":         "33",
+	"blue":           "34",
+	"magenta":        "35",
+	"cyan":           "36",
+	"white":          "37",
+	"bright_red":     "91",
+	"bright_green":   "92",
+	"bright_yellow":  "93",
+	"bright_blue":    "94",
+	"bright_magenta": "95",
+	"bright_cyan":    "96",
+}
+
+// ChatLine is what a chat format is given: {{.Time}}, {{.Room}}, {{.From}}
+// and {{.Text}}.
+type ChatLine struct {
+	Time time.Time
+	Room string
+	From string
+	Text string
+}
+
+// MembershipLine is what join and leave formats are given. Room is empty
+// when the user joined or left the chat rather than a room.
+type MembershipLine struct {
+	Time time.Time
+	Name string
+	Room string
+}
+
+// PrivateLine is what a private message format is given. Sent is true on
+// the sender's copy.
+type PrivateLine struct {
+	Time time.Time
+	From string
+	To   string
+	Text string
+	Sent bool
+}
+
+// FormatOptions holds the message format templates.
+type FormatOptions struct {
+	Chat  string
+	Join  string
+	Leave string
+	PM    string
+}
+
+func (options *FormatOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.Chat, "chat-format", options.Chat, "text/template for chat messages, with .Time, .Room, .From and .Text (empty for the built-in format)")
+	flags.StringVar(&options.Join, "join-format", options.Join, "text/template for join notices, with .Time, .Name and .Room (empty for the chat)")
+	flags.StringVar(&options.Leave, "leave-format", options.Leave, "text/template for leave notices, with .Time, .Name and .Room (empty for the chat)")
+	flags.StringVar(&options.PM, "pm-format", options.PM, "text/template for private messages, with .Time, .From, .To, .Text and .Sent")
+}
+
+func (options *FormatOptions) validate() error {
+	_, err := options.compile()
+	return err
+}
+
+// messageFormats are the compiled templates; a nil one keeps the built-in
+// format.
+type messageFormats struct {
+	chat  *template.Template
+	join  *template.Template
+	leave *template.Template
+	pm    *template.Template
+}
+
+// compile parses the templates.
+func (options *FormatOptions) compile() (*messageFormats, error) {
+	var formats messageFormats
+	for _, format := range []struct {
+		name     string
+		text     string
+		template **template.Template
+	}{
+		{"chat_format", options.Chat, &formats.chat},
+		{"join_format", options.Join, &formats.join},
+		{"leave_format", options.Leave, &formats.leave},
+		{"pm_format", options.PM, &formats.pm},
+	} {
+		if format.text == "" {
+			continue
+		}
+		parsed, err := template.New(format.name).Funcs(template.FuncMap{"color": colorText, "usercolor": colorName}).Parse(format.text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", format.name, err)
+		}
+		*format.template = parsed
+	}
+	return &formats, nil
+}
+
+// colorText wraps text in the ANSI escapes for a FORMAT_COLORS color, or
+// leaves it alone if there is no such color.
+func colorText(color, text string) string {
+	code, ok := FORMAT_COLORS[color]
+	if !ok {
+		return text
+	}
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+// apply rewrites a line in the built-in format for client using the
+// configured format for its kind, which the frame it was queued with
+// says. Lines without one, and lines a template fails on, are returned as
+// they are.
+func (formats *messageFormats) apply(client *Client, frame protocol.Frame, line string) string {
+	if formats == nil {
+		return line
+	}
+
+	var format *template.Template
+	var data any
+	switch {
+	case frame.Type == protocol.FRAME_DM:
+		private := PrivateLine{Time: frame.Timestamp, From: frame.From, To: frame.To, Text: frame.Body}
+		private.Sent = strings.EqualFold(frame.From, client.name())
+		format, data = formats.pm, private
+	case frame.Type == protocol.FRAME_CHAT:
+		format, data = formats.chat, ChatLine{Time: frame.Timestamp, Room: frame.Room, From: frame.From, Text: frame.Body}
+	case frame.Event == protocol.EVENT_JOIN:
+		format, data = formats.join, MembershipLine{Time: time.Now(), Name: frame.From, Room: frame.Room}
+	case frame.Event == protocol.EVENT_LEAVE:
+		format, data = formats.leave, MembershipLine{Time: time.Now(), Name: frame.From, Room: frame.Room}
+	}
+	if format == nil {
+		return line
+	}
+
+	var output strings.Builder
+	if err := format.Execute(&output, data); err != nil {
+		client.logger().Debug("Message format failed", "format", format.Name(), "err", err)
+		return line
+	}
+	return output.String()
+}
+
+// textFor turns a queued line into what a text client is shown, in the
+// configured formats and the client's colors, ringing the bell for it if
+// the client asked.
+func (server *ChatServer) textFor(client *Client, queued string) string {
+	message := unframed(queued)
+	render := func(line string) string {
+		if server.formats != nil {
+			frame, _, _ := splitFrame(queued)
+			line = server.formats.apply(client, frame, line)
+		}
+		if client.colored() {
+			return colorNames(line)
+		}
+		return stripColors(line)
+	}
+
+	rendered := message
+	tag, text, tagged := untagMessage(message)
+	switch {
+	case !tagged:
+		rendered = render(message)
+	case tag.kind == TAG_MESSAGE || tag.kind == TAG_DIRECT:
+		rendered = tagMessage(tag, render(text))
+	}
+	if client.wantsBell(client.displayText(message)) {
+		return BEL + client.displayText(rendered)
+	}
+	return client.displayText(rendered)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Lines that JSON clients get as frames of their own type (chat, actions,
+// private messages, joins and leaves) are queued with the frame in front,
+// made from what the line was: FRAME_MARK <frame as JSON> FRAME_MARK
+// <line>. Text clients are sent the line and JSON clients the frame, so
+// nothing is parsed back out of the text. sanitizeText keeps FRAME_MARK out
+// of anything clients send, and JSON escapes it inside the frame.
+const FRAME_MARK = "\x1e"
+
+// withFrame puts the frame for line in front of it, for queueing.
+func withFrame(frame protocol.Frame, line string) string {
+	data, _ := json.Marshal(frame)
+	return FRAME_MARK + string(data) + FRAME_MARK + line
+}
+
+// splitFrame splits a queued line into the frame it was queued with, if it
+// has one, and the line.
+func splitFrame(message string) (protocol.Frame, string, bool) {
+	rest, ok := strings.CutPrefix(message, FRAME_MARK)
+	if !ok {
+		return protocol.Frame{}, message, false
+	}
+	data, line, ok := strings.Cut(rest, FRAME_MARK)
+	if !ok {
+		return protocol.Frame{}, message, false
+	}
+	var frame protocol.Frame
+	if err := json.Unmarshal([]byte(data), &frame); err != nil {
+		return protocol.Frame{}, line, false
+	}
+	return frame, line, true
+}
+
+// unframed returns a queued line without its frame.
+func unframed(message string) string {
+	if rest, ok := strings.CutPrefix(message, FRAME_MARK); ok {
+		if _, line, ok := strings.Cut(rest, FRAME_MARK); ok {
+			return line
+		}
+	}
+	return message
+}
+
+// frameFor describes a message queued for client as a frame. Chat,
+// actions, private messages, joins and leaves were queued with theirs;
+// everything else is a change to a message, a notice or one of the
+// server's own lines.
+func (server *ChatServer) frameFor(client *Client, message string) protocol.Frame {
+	if frame, line, ok := splitFrame(message); ok {
+		switch frame.Type {
+		case protocol.FRAME_CHAT, protocol.FRAME_ACTION, protocol.FRAME_DM:
+			frame.Notify = client.shouldNotify(client.displayText(line))
+		}
+		return frame
+	}
+	if tag, text, ok := untagMessage(message); ok {
+		switch tag.kind {
+		case CHANGE_EDIT:
+			return protocol.Frame{Type: protocol.FRAME_EDIT, ID: tag.id, From: tag.from, Room: server.roomOf(client), Body: text}
+		case CHANGE_DELETE:
+			return protocol.Frame{Type: protocol.FRAME_DELETE, ID: tag.id, From: tag.from, Room: server.roomOf(client)}
+		case TAG_PRESENCE:
+			return protocol.Frame{Type: protocol.FRAME_PRESENCE, From: tag.from, Presence: tag.id, Body: text}
+		case CHANGE_REACT:
+			var update reactionUpdate
+			json.Unmarshal([]byte(text), &update)
+			frame := protocol.Frame{Type: protocol.FRAME_REACT, ID: tag.id, From: tag.from, Room: server.roomOf(client), Body: update.Emoji}
+			frame.Reactions = make(map[string]int)
+			for _, count := range update.Counts {
+				frame.Reactions[count.Emoji] = count.Count
+			}
+			return frame
+		}
+		frame := server.frameFor(client, text)
+		frame.ID = tag.id
+		return frame
+	}
+
+	switch {
+	case protocol.IsSignal(message):
+		fields := strings.SplitN(message, " ", 3)
+		return protocol.Frame{Type: protocol.FRAME_SIGNAL, From: fields[2], Body: message}
+	case message == COMMANDS_LINE:
+		return protocol.Frame{Type: protocol.FRAME_COMMANDS, Commands: server.commands.Describe(client.role())}
+	case strings.HasPrefix(message, SESSION_LINE+" "):
+		return protocol.Frame{Type: protocol.FRAME_SESSION, Body: strings.TrimPrefix(message, SESSION_LINE+" ")}
+	case strings.HasPrefix(message, RECEIPT_LINE+" "):
+		return receiptFrame(message)
+	case strings.HasPrefix(message, TYPING_LINE+" "):
+		return protocol.Frame{Type: protocol.FRAME_TYPING, From: strings.TrimPrefix(message, TYPING_LINE+" "), Room: server.roomOf(client)}
+	case strings.HasPrefix(message, protocol.PING_LINE+" "):
+		return protocol.Frame{Type: protocol.FRAME_PING, Body: strings.TrimPrefix(message, protocol.PING_LINE+" ")}
+	case strings.HasPrefix(message, "*** ") && strings.HasSuffix(message, " ***"):
+		return protocol.Frame{Type: protocol.FRAME_NOTICE, Body: strings.TrimSuffix(strings.TrimPrefix(message, "*** "), " ***")}
+	}
+	return protocol.Frame{Type: protocol.FRAME_TEXT, Body: message}
+}
+
+// decodeFrame turns a frame from a JSON client into the line a text client
+// would have typed. Read frames have no such line and are returned for the
+// caller to handle.
+func decodeFrame(line string) (protocol.Frame, string, error) {
+	frame, err := protocol.Parse(line)
+	if err != nil {
+		return frame, "", err
+	}
+
+	switch frame.Type {
+	case protocol.FRAME_CHAT, protocol.FRAME_COMMAND:
+		return frame, frame.Body, nil
+	case protocol.FRAME_DM:
+		if frame.To == "" {
+			return frame, "/reply " + frame.Body, nil
+		}
+		return frame, fmt.Sprintf("/msg %s %s", frame.To, frame.Body), nil
+	case protocol.FRAME_EDIT:
+		return frame, fmt.Sprintf("/edit %s %s", frame.ID, frame.Body), nil
+	case protocol.FRAME_DELETE:
+		return frame, "/delete " + frame.ID, nil
+	case protocol.FRAME_REACT:
+		return frame, fmt.Sprintf("/react %s %s", frame.ID, frame.Body), nil
+	case protocol.FRAME_READ:
+		return frame, "", nil
+	case protocol.FRAME_PONG:
+		return frame, strings.TrimSpace(protocol.PONG_LINE + " " + frame.Body), nil
+	}
+	return frame, "", fmt.Errorf("unknown frame type %q", frame.Type)
+}
+
+// frameEncoding picks the encoding of a client's frames: the one it asked
+// for in its hello if the server has it and conn carries it, and otherwise
+// JSON.
+func frameEncoding(asked string, conn net.Conn) string {
+	if asked == protocol.ENCODING_CBOR && carriesBinary(conn) {
+		return protocol.ENCODING_CBOR
+	}
+	return protocol.ENCODING_JSON
+}
+
+// carriesBinary reports whether binary frames can pass over conn as they
+// are: over TCP or TLS from a client that hasn't spoken telnet, or over a
+// QUIC stream. WebSocket messages and gRPC streams carry JSON, and an SSH
+// session may be a terminal.
+func carriesBinary(conn net.Conn) bool {
+	if tc, ok := conn.(*telnetConn); ok {
+		return !tc.speaksTelnet()
+	}
+	if meter, ok := conn.(*meteredConn); ok {
+		conn = meter.Conn
+	}
+	_, ok := conn.(binaryConn)
+	return ok
+}
+
+// binaryConn is a connection, other than a telnetConn, that passes bytes
+// through untouched.
+type binaryConn interface {
+	net.Conn
+	passesBinary()
+}
+
+// loginSession talks to a connection before it has a name, in whichever
+// framing the client asked for with its first line.
+type loginSession struct {
+	conn    net.Conn
+	input   *lineReader
+	json    bool
+	binary  bool // frames in CBOR rather than JSON
+	started bool
+	prompt  string
+
+	// What a JSON client asked for in its hello, that the server has
+	capabilities []string
+}
+
+// ask prompts for the next line.
+func (login *loginSession) ask(prompt string) {
+	login.prompt = prompt
+	if login.json {
+		login.send(protocol.Frame{Type: protocol.FRAME_PROMPT, Body: strings.TrimSpace(prompt)})
+	} else {
+		login.conn.Write([]byte(prompt))
+	}
+}
+
+// refuse tells the client why a line wasn't accepted.
+func (login *loginSession) refuse(reason string) {
+	if login.json {
+		login.send(protocol.Frame{Type: protocol.FRAME_ERROR, Body: reason})
+	} else {
+		login.conn.Write([]byte(reason + "\n"))
+	}
+}
+
+// send writes a frame in the client's encoding.
+func (login *loginSession) send(frame protocol.Frame) {
+	if login.binary {
+		login.conn.Write(protocol.EncodeCBOR(frame))
+	} else {
+		login.conn.Write(protocol.Encode(frame))
+	}
+}
+
+// read returns the answer to the last prompt, switching to JSON framing if
+// the first line is a hello.
+func (login *loginSession) read(secret bool) (string, error) {
+	for {
+		var line string
+		var err error
+		if secret {
+			line, err = login.input.ReadSecret()
+		} else {
+			line, err = login.input.ReadLine()
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if !login.started {
+			login.started = true
+			if frame, err := protocol.Parse(line); err == nil && frame.Type == protocol.FRAME_HELLO {
+				login.json = true
+				login.capabilities = acceptCapabilities(frame.Capabilities)
+				encoding := frameEncoding(frame.Body, login.conn)
+				login.conn.Write(protocol.Encode(protocol.Frame{Type: protocol.FRAME_HELLO, Body: encoding, Capabilities: login.capabilities}))
+				if encoding == protocol.ENCODING_CBOR {
+					login.binary = true
+					login.input.useCBOR()
+				}
+				login.ask(login.prompt)
+				continue
+			}
+		}
+		if !login.json {
+			return line, nil
+		}
+
+		frame, err := protocol.Parse(line)
+		if err != nil {
+			login.refuse(err.Error())
+			login.ask(login.prompt)
+			continue
+		}
+		return frame.Body, nil
+	}
+}
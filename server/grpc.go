@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+)
+
+// gRPC API, for backend services. Built in with -tags grpc and served on
+// --grpc-listen, over TLS with --grpc-cert and --grpc-key. The chat.Chat
+// service's Stream method is a bidirectional stream of protocol.Frame
+// messages that is handled like any other JSON client: send a hello frame,
+// answer the prompts, then chat.
+//
+// chat.AdminService is for orchestration tools: ListClients, Stats, Kick,
+// Ban, Unban, Announce, SetLimit (--max-clients and
+// --max-connections-per-ip, until the next reload) and Rehash (reload the
+// configuration, as SIGHUP does). chat.Admin is the older name, with
+// Clients for ListClients and without SetLimit and Rehash. Admin calls
+// need the admin token, as "authorization: Bearer <token>" metadata, or a
+// client certificate that chains to --grpc-client-ca; the admin services
+// are left out unless one of those is set up. Messages are JSON rather
+// than protocol buffers, so clients call with the "json" content subtype.
+const GRPC_CONTENT_SUBTYPE = "json"
+
+// serveGRPC serves the gRPC API on listener until ctx is cancelled. It is
+// nil unless the server was built with -tags grpc.
+var serveGRPC func(ctx context.Context, server *ChatServer, listener net.Listener) error
+
+var errNoGRPC = errors.New("chatd was built without gRPC; rebuild with -tags grpc")
+
+// startGRPC listens on --grpc-listen and serves the gRPC API.
+func (server *ChatServer) startGRPC(ctx context.Context) error {
+	if serveGRPC == nil {
+		return errNoGRPC
+	}
+	listener, err := net.Listen("tcp", server.config.GRPCListen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := serveGRPC(ctx, server, server.proxied(listener)); err != nil {
+			slog.Error("gRPC API stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// grpcTLS returns the gRPC API's TLS settings, or nil for plain TCP. With
+// --grpc-client-ca, clients may present a certificate, which must chain to
+// it.
+func (config *Config) grpcTLS() (*tls.Config, error) {
+	if config.GRPCCert == "" && config.GRPCKey == "" {
+		return nil, nil
+	}
+	options := TLSOptions{CertFile: config.GRPCCert, KeyFile: config.GRPCKey, ClientCA: config.GRPCClientCA, ClientAuth: "none"}
+	if config.GRPCClientCA != "" {
+		options.ClientAuth = "request"
+	}
+	return options.config()
+}
@@ -0,0 +1,398 @@
+//go:build grpc
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+	serveGRPC = func(ctx context.Context, server *ChatServer, listener net.Listener) error {
+		service := &grpcService{server: server, ctx: ctx}
+		options := []grpc.ServerOption{grpc.UnaryInterceptor(service.authorize)}
+		tlsConfig, err := server.config.grpcTLS()
+		if err != nil {
+			return err
+		}
+		if tlsConfig != nil {
+			options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer := grpc.NewServer(options...)
+		grpcServer.RegisterService(&chatServiceDesc, service)
+		if server.config.AdminToken != "" || server.config.GRPCClientCA != "" {
+			grpcServer.RegisterService(&legacyAdminServiceDesc, service)
+			grpcServer.RegisterService(&adminServiceDesc, service)
+		}
+		context.AfterFunc(ctx, grpcServer.Stop)
+		slog.Info("gRPC API listening", "addr", listener.Addr().String())
+		return grpcServer.Serve(listener)
+	}
+}
+
+// jsonCodec carries messages as JSON, so the API needs no generated code.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return GRPC_CONTENT_SUBTYPE }
+
+// Admin request and response messages
+type (
+	GRPCEmpty struct{}
+
+	GRPCClients struct {
+		Clients []ClientInfo `json:"clients"`
+	}
+
+	GRPCKickRequest struct {
+		Name   string `json:"name"`
+		Reason string `json:"reason,omitempty"`
+	}
+
+	GRPCBanRequest struct {
+		Target   string `json:"target"`
+		Duration string `json:"duration,omitempty"` // like "2h"; empty for forever
+		Reason   string `json:"reason,omitempty"`
+	}
+
+	GRPCUnbanRequest struct {
+		Target string `json:"target"`
+	}
+
+	GRPCAnnounceRequest struct {
+		Text string `json:"text"`
+	}
+
+	// Limits left out stay as they are
+	GRPCSetLimitRequest struct {
+		MaxClients    *int `json:"max_clients,omitempty"`
+		MaxPerAddress *int `json:"max_connections_per_ip,omitempty"`
+	}
+
+	GRPCLimits struct {
+		MaxClients    int `json:"max_clients"`
+		MaxPerAddress int `json:"max_connections_per_ip"`
+	}
+)
+
+type grpcService struct {
+	server *ChatServer
+	ctx    context.Context // the server's, for the clients on streams
+}
+
+var chatServiceDesc = grpc.ServiceDesc{
+	ServiceName: "chat.Chat",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Stream",
+		Handler:       func(srv any, stream grpc.ServerStream) error { return srv.(*grpcService).stream(stream) },
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+}
+
+var legacyAdminServiceDesc = grpc.ServiceDesc{
+	ServiceName: "chat.Admin",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("Clients", (*grpcService).clients),
+		unary("Stats", (*grpcService).stats),
+		unary("Kick", (*grpcService).kick),
+		unary("Ban", (*grpcService).ban),
+		unary("Unban", (*grpcService).unban),
+		unary("Announce", (*grpcService).announce),
+	},
+}
+
+var adminServiceDesc = grpc.ServiceDesc{
+	ServiceName: "chat.AdminService",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("ListClients", (*grpcService).clients),
+		unary("Stats", (*grpcService).stats),
+		unary("Kick", (*grpcService).kick),
+		unary("Ban", (*grpcService).ban),
+		unary("Unban", (*grpcService).unban),
+		unary("Announce", (*grpcService).announce),
+		unary("SetLimit", (*grpcService).setLimit),
+		unary("Rehash", (*grpcService).rehash),
+	},
+}
+
+// Admin methods that only look, and so aren't audited
+var grpcReadOnly = []string{"Clients", "ListClients", "Stats"}
+
+// unary describes an admin method that takes a Request.
+func unary[Request any](name string, handle func(service *grpcService, ctx context.Context, request *Request) (any, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, decode func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			request := new(Request)
+			if err := decode(request); err != nil {
+				return nil, err
+			}
+			service := srv.(*grpcService)
+			method, _ := grpc.Method(ctx)
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: method}
+			return interceptor(ctx, request, info, func(ctx context.Context, request any) (any, error) {
+				return handle(service, ctx, request.(*Request))
+			})
+		},
+	}
+}
+
+// authorize checks admin calls for the admin token or a client
+// certificate and records them in the audit log, like the admin API does.
+func (service *grpcService) authorize(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	remote := grpcRemote(ctx).String()
+	actor := grpcCertificateName(ctx)
+	if actor == "" {
+		given := ""
+		if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+			given, _ = strings.CutPrefix(values[0], "Bearer ")
+		}
+		token := service.server.config.AdminToken
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			service.server.audit(AuditEntry{Event: AUDIT_LOGIN_FAILED, Remote: remote, Detail: "gRPC " + info.FullMethod})
+			return nil, status.Error(codes.Unauthenticated, "missing or wrong token")
+		}
+		actor = "an administrator"
+	}
+
+	response, err := handler(ctx, request)
+	if !slices.Contains(grpcReadOnly, path.Base(info.FullMethod)) {
+		detail, _ := json.Marshal(request)
+		service.server.audit(AuditEntry{
+			Event:  AUDIT_ADMIN_API,
+			Actor:  actor,
+			Remote: remote,
+			Detail: fmt.Sprintf("gRPC %s %s: %s", info.FullMethod, detail, status.Code(err)),
+		})
+	}
+	return response, err
+}
+
+// inHub runs an admin operation on the hub's goroutine.
+func (service *grpcService) inHub(ctx context.Context, operation func()) error {
+	if err := service.server.inHub(ctx, operation); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return nil
+}
+
+func (service *grpcService) clients(ctx context.Context, request *GRPCEmpty) (any, error) {
+	var clients []ClientInfo
+	if err := service.inHub(ctx, func() { clients = service.server.clientInfo() }); err != nil {
+		return nil, err
+	}
+	return &GRPCClients{Clients: clients}, nil
+}
+
+func (service *grpcService) stats(ctx context.Context, request *GRPCEmpty) (any, error) {
+	stats := service.server.stats()
+	return &stats, nil
+}
+
+func (service *grpcService) kick(ctx context.Context, request *GRPCKickRequest) (any, error) {
+	var kicked int
+	if err := service.inHub(ctx, func() { kicked = service.server.kick(request.Name, "an administrator", request.Reason) }); err != nil {
+		return nil, err
+	}
+	if kicked == 0 {
+		return nil, status.Error(codes.NotFound, "no client called "+request.Name)
+	}
+	slog.Info("gRPC API: kicked", "user", request.Name, "remote", grpcRemote(ctx).String())
+	return &GRPCEmpty{}, nil
+}
+
+func (service *grpcService) ban(ctx context.Context, request *GRPCBanRequest) (any, error) {
+	if request.Target == "" {
+		return nil, status.Error(codes.InvalidArgument, "target is required")
+	}
+	ban := Ban{Reason: request.Reason, By: "an administrator"}
+	ban.Target, ban.Address = addressTarget(request.Target)
+	if request.Duration != "" {
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil || duration <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "durations look like 30s, 10m or 2h")
+		}
+		ban.Until = time.Now().Add(duration)
+	}
+
+	var err error
+	if hubErr := service.inHub(ctx, func() {
+		if err = service.server.bans.Add(ban); err == nil {
+			service.server.enforceBan(&ban, len(ROLE_RANKS))
+		}
+	}); hubErr != nil {
+		return nil, hubErr
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	slog.Info("gRPC API: banned", "target", ban.Target, "until", ban.Until, "remote", grpcRemote(ctx).String())
+	return &ban, nil
+}
+
+func (service *grpcService) unban(ctx context.Context, request *GRPCUnbanRequest) (any, error) {
+	removed, err := service.server.bans.Remove(request.Target)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !removed {
+		return nil, status.Error(codes.NotFound, request.Target+" isn't banned")
+	}
+	slog.Info("gRPC API: unbanned", "target", request.Target, "remote", grpcRemote(ctx).String())
+	service.server.audit(AuditEntry{Event: AUDIT_UNBAN, Actor: "an administrator", Remote: grpcRemote(ctx).String(), Target: request.Target})
+	service.server.exportModeration(EVENT_UNBAN, request.Target, "an administrator", "", time.Time{})
+	return &GRPCEmpty{}, nil
+}
+
+func (service *grpcService) announce(ctx context.Context, request *GRPCAnnounceRequest) (any, error) {
+	text := strings.TrimSpace(request.Text)
+	if text == "" {
+		return nil, status.Error(codes.InvalidArgument, "text is required")
+	}
+	if err := service.inHub(ctx, func() { service.server.announce(text, "the gRPC API") }); err != nil {
+		return nil, err
+	}
+	return &GRPCEmpty{}, nil
+}
+
+func (service *grpcService) setLimit(ctx context.Context, request *GRPCSetLimitRequest) (any, error) {
+	maxClients, maxPerAddress := -1, -1
+	if request.MaxClients != nil {
+		maxClients = *request.MaxClients
+	}
+	if request.MaxPerAddress != nil {
+		maxPerAddress = *request.MaxPerAddress
+	}
+	if maxClients < -1 || maxPerAddress < -1 {
+		return nil, status.Error(codes.InvalidArgument, "limits can't be negative")
+	}
+	live, err := service.server.setLimits(maxClients, maxPerAddress)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &GRPCLimits{MaxClients: live.MaxClients, MaxPerAddress: live.MaxPerAddress}, nil
+}
+
+func (service *grpcService) rehash(ctx context.Context, request *GRPCEmpty) (any, error) {
+	if err := service.server.Rehash(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &GRPCEmpty{}, nil
+}
+
+// stream connects a Stream call to the hub as a JSON client. The client's
+// frames are written into one end of a pipe and the server's lines read
+// from it, while handleClient serves the other end like a TCP connection.
+func (service *grpcService) stream(stream grpc.ServerStream) error {
+	server := service.server
+	remote := grpcRemote(stream.Context())
+	if host, _, err := net.SplitHostPort(remote.String()); err == nil {
+		if reason := server.refusal(host); reason != "" {
+			slog.Info("Refused connection", "remote", remote.String(), "reason", reason)
+			return status.Error(codes.PermissionDenied, reason)
+		}
+	}
+
+	serverEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	slog.Debug("New gRPC stream", "remote", remote.String())
+	go server.handleClient(service.ctx, server.trackConn(&grpcConn{serverEnd, remote}))
+
+	// Frames from the client
+	go func() {
+		defer clientEnd.Close()
+		for {
+			var frame protocol.Frame
+			if err := stream.RecvMsg(&frame); err != nil {
+				return
+			}
+			if _, err := clientEnd.Write(protocol.Encode(frame)); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Frames to the client, skipping the text prompt written before the
+	// client's hello asked for frames
+	reader := bufio.NewReader(clientEnd)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// The server closed the connection
+			return nil
+		}
+		start := strings.IndexByte(line, '{')
+		if start < 0 {
+			continue
+		}
+		frame, err := protocol.Parse(line[start:])
+		if err != nil {
+			continue
+		}
+		if err := stream.SendMsg(&frame); err != nil {
+			return err
+		}
+	}
+}
+
+// grpcConn is the server's end of a stream's pipe, with the caller's
+// address.
+type grpcConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (conn *grpcConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// grpcCertificateName returns the common name on the caller's client
+// certificate, if it gave one that chains to --grpc-client-ca.
+func grpcCertificateName(ctx context.Context) string {
+	caller, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := caller.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return ""
+	}
+	certificate := info.State.VerifiedChains[0][0]
+	if certificate.Subject.CommonName == "" {
+		return "a client certificate"
+	}
+	return certificate.Subject.CommonName
+}
+
+// grpcRemote returns the caller's address.
+func grpcRemote(ctx context.Context) net.Addr {
+	if caller, ok := peer.FromContext(ctx); ok && caller.Addr != nil {
+		return caller.Addr
+	}
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File the event log is kept in with --storage files, one JSON event per
+// line; from before there was an event log, it holds history entries
+const HISTORY_FILE = "history.jsonl"
+
+type HistoryEntry struct {
+	Time time.Time `json:"time"`
+	Room string    `json:"room,omitempty"`
+	From string    `json:"from"`
+	Text string    `json:"text"`
+
+	// Action is set for "/me" messages
+	Action bool `json:"action,omitempty"`
+
+	// ID identifies the message. An entry with Change set is an edit,
+	// deletion or reaction (with the emoji as its text) to the earlier
+	// message with the same ID rather than a message of its own.
+	ID     string `json:"id,omitempty"`
+	Change string `json:"change,omitempty"`
+
+	// Reaction totals, filled in when the history is read
+	Reactions map[string]int `json:"reactions,omitempty"`
+}
+
+// room returns the entry's room; entries written before there were rooms
+// belong to the lobby.
+func (entry HistoryEntry) room() string {
+	if entry.Room == "" {
+		return LOBBY
+	}
+	return entry.Room
+}
+
+// HistoryLog is every chat message, as the event log has it, with a
+// search index once BuildIndex has been called.
+type HistoryLog struct {
+	mutex sync.Mutex
+	log   eventLog
+	index *historyIndex
+}
+
+func NewHistoryLog(log eventLog) *HistoryLog {
+	return &HistoryLog{log: log}
+}
+
+// historySource is how the commands that work on the history without a
+// server find it: in the server's storage, as --config and --storage say,
+// or in a history file given with --file.
+type historySource struct {
+	Config  string
+	Storage string
+	File    string
+}
+
+func (source *historySource) register(flags *flag.FlagSet) {
+	flags.StringVar(&source.Config, "config", os.Getenv("CHAT_CONFIG"), "server config file to take --storage from (default $CHAT_CONFIG)")
+	flags.StringVar(&source.Storage, "storage", "", "storage the history is in, as the server's --storage (default the config's, or files)")
+	flags.StringVar(&source.File, "file", "", "history file to use instead of the storage")
+}
+
+// open opens the history, returning it and a description of where it is.
+func (source *historySource) open() (historyStore, string, error) {
+	if source.File != "" {
+		history, err := openEventFile(source.File)
+		return history, source.File, err
+	}
+	config, err := ReadConfigFile(source.Config)
+	if err != nil {
+		return nil, "", err
+	}
+	if source.Storage != "" {
+		config.Storage = source.Storage
+	}
+	if config.Storage == STORAGE_MEMORY {
+		return nil, "", fmt.Errorf("%s storage keeps no history to work on", STORAGE_MEMORY)
+	}
+	storage, err := openStorage(config.Storage, config.StoragePool)
+	return storage, describeStorage(config.Storage), err
+}
+
+// historyStore is an event log the commands can close when they're done.
+type historyStore interface {
+	eventLog
+	Close() error
+}
+
+// Apply brings the history up to date with an event that has been
+// appended to the event log.
+func (history *HistoryLog) Apply(event ChatEvent) {
+	entry, ok := historyEntry(event)
+	if !ok {
+		return
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if history.index != nil {
+		history.index.add(entry)
+	}
+}
+
+// readHistory reads the history entries from an event log.
+func readHistory(log eventLog) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	err := log.ReadEvents(0, 0, func(event ChatEvent) {
+		if entry, ok := historyEntry(event); ok {
+			entries = append(entries, entry)
+		}
+	})
+	return entries, err
+}
+
+// applyChanges folds edits, deletions and reactions into the messages they
+// change, leaving one entry per surviving message. Edited messages keep
+// their original time and are marked with Change.
+func applyChanges(entries []HistoryEntry) []HistoryEntry {
+	index := make(map[string]int)
+	reacted := make(map[int]*reactions)
+	var messages []HistoryEntry
+	for _, entry := range entries {
+		i, known := index[entry.ID]
+		switch {
+		case entry.Change == "":
+			if entry.ID != "" {
+				index[entry.ID] = len(messages)
+			}
+			messages = append(messages, entry)
+		case !known:
+		case entry.Change == CHANGE_DELETE:
+			messages[i].ID = ""
+			messages[i].Change = CHANGE_DELETE
+			delete(index, entry.ID)
+		case entry.Change == CHANGE_REACT:
+			if reacted[i] == nil {
+				reacted[i] = &reactions{}
+			}
+			reacted[i].toggle(entry.From, entry.Text)
+		default:
+			messages[i].Text = entry.Text
+			messages[i].Change = CHANGE_EDIT
+		}
+	}
+
+	for i, list := range reacted {
+		for _, count := range list.counts() {
+			if messages[i].Reactions == nil {
+				messages[i].Reactions = make(map[string]int)
+			}
+			messages[i].Reactions[count.Emoji] = count.Count
+		}
+	}
+
+	kept := messages[:0]
+	for _, message := range messages {
+		if message.Change != CHANGE_DELETE {
+			kept = append(kept, message)
+		}
+	}
+	return kept
+}
+
+// parseDate accepts a date or a date and time.
+func parseDate(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse date %q (use YYYY-MM-DD)", value)
+}
+
+// RunHistoryCommand implements "chat history", which searches the history
+// in the server's storage directly so it works whether or not the server
+// is running.
+func RunHistoryCommand(args []string) int {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	var source historySource
+	source.register(flags)
+	since := flags.String("since", "", "only messages on or after this date (YYYY-MM-DD)")
+	until := flags.String("until", "", "only messages before this date (YYYY-MM-DD)")
+	from := flags.String("from", "", "only messages from this user")
+	room := flags.String("room", "", "only messages in this room (entries from before rooms count as "+LOBBY+")")
+	grep := flags.String("grep", "", "only messages containing this text (case-insensitive)")
+	limit := flags.Int("limit", 0, "print at most the last N matches")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var sinceTime, untilTime time.Time
+	var err error
+	roomName, ok := normalizeRoomName(*room)
+	if *room != "" && !ok {
+		fmt.Fprintf(os.Stderr, "invalid room name %q\n", *room)
+		return 2
+	}
+	if *since != "" {
+		if sinceTime, err = parseDate(*since); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if *until != "" {
+		if untilTime, err = parseDate(*until); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	if source.File != "" {
+		if _, err := os.Stat(source.File); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	history, _, err := source.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer history.Close()
+
+	entries, err := readHistory(history)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var matches []HistoryEntry
+	for _, entry := range applyChanges(entries) {
+		if !sinceTime.IsZero() && entry.Time.Before(sinceTime) {
+			continue
+		}
+		if !untilTime.IsZero() && !entry.Time.Before(untilTime) {
+			continue
+		}
+		if *from != "" && !strings.EqualFold(entry.From, *from) {
+			continue
+		}
+		if *room != "" && entry.room() != roomName {
+			continue
+		}
+		if *grep != "" && !strings.Contains(strings.ToLower(entry.Text), strings.ToLower(*grep)) {
+			continue
+		}
+		matches = append(matches, entry)
+	}
+
+	// Imported logs are appended after live messages, so sort by time
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Time.Before(matches[j].Time)
+	})
+	if *limit > 0 && len(matches) > *limit {
+		matches = matches[len(matches)-*limit:]
+	}
+	for _, entry := range matches {
+		when := entry.Time.Local().Format("2006-01-02 15:04:05")
+		notes := ""
+		if entry.Change == CHANGE_EDIT {
+			notes = " (edited)"
+		}
+		if len(entry.Reactions) > 0 {
+			notes += " [" + formatReactions(sortedReactions(entry.Reactions)) + "]"
+		}
+		if entry.Action {
+			fmt.Printf("[%s] %s "+ACTION_FORMAT+"%s\n", when, entry.room(), entry.From, entry.Text, notes)
+			continue
+		}
+		fmt.Printf("[%s] %s %s: %s%s\n", when, entry.room(), entry.From, entry.Text, notes)
+	}
+	return 0
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// [12:34:56] <nick> text, or 12:34 <nick> text (znc, irssi)
+	ircLinePattern = regexp.MustCompile(`^\[?(\d{1,2}:\d{2}(?::\d{2})?)\]?\s+<[ @+%&~]?([^>]+)>\s?(.*)$`)
+	// irssi: --- Log opened Mon Jan 01 12:00:00 2024 / --- Day changed Tue Jan 02 2024
+	ircDayPattern = regexp.MustCompile(`^--- (?:Log opened|Day changed) \w{3} (\w{3} \d{2}) (?:\d{2}:\d{2}:\d{2} )?(\d{4})`)
+	// A date anywhere in a file name, as znc and most loggers use
+	fileDatePattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+)
+
+// importer parses one log format into history entries.
+type importer func(r io.Reader, name string, day time.Time, emit func(HistoryEntry)) error
+
+var IMPORT_FORMATS = map[string]importer{
+	"irc":     importIRC,
+	"znc":     importIRC,
+	"weechat": importWeeChat,
+	"jsonl":   importJSONL,
+}
+
+// importIRC reads irssi/znc style logs. Lines only carry a time of day, so
+// the date comes from --date, the file name, or irssi's day markers.
+func importIRC(r io.Reader, name string, day time.Time, emit func(HistoryEntry)) error {
+	if day.IsZero() {
+		if match := fileDatePattern.FindString(filepath.Base(name)); match != "" {
+			day, _ = time.ParseInLocation("2006-01-02", match, time.Local)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := ircDayPattern.FindStringSubmatch(line); match != nil {
+			if t, err := time.ParseInLocation("Jan 02 2006", match[1]+" "+match[2], time.Local); err == nil {
+				day = t
+			}
+			continue
+		}
+
+		match := ircLinePattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if day.IsZero() {
+			return fmt.Errorf("%s: no date for messages; pass --date", name)
+		}
+		clock := match[1]
+		if strings.Count(clock, ":") == 1 {
+			clock += ":00"
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", day.Format("2006-01-02")+" "+clock, time.Local)
+		if err != nil {
+			continue
+		}
+		emit(HistoryEntry{Time: t, From: match[2], Text: match[3]})
+	}
+	return scanner.Err()
+}
+
+// importWeeChat reads WeeChat logs: "2024-01-01 12:34:56<TAB>nick<TAB>text".
+// Join, part and other status lines use a marker instead of a nick and are
+// skipped.
+func importWeeChat(r io.Reader, name string, day time.Time, emit func(HistoryEntry)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		nick := strings.TrimLeft(fields[1], "@+%&~")
+		if nick == "" || nick == "-->" || nick == "<--" || nick == "--" || nick == "*" || nick == "=!=" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", fields[0], time.Local)
+		if err != nil {
+			continue
+		}
+		emit(HistoryEntry{Time: t, From: nick, Text: fields[2]})
+	}
+	return scanner.Err()
+}
+
+// importJSONL reads our own formats: the event log's, taking its messages
+// and the changes to them, and the history's from before the event log,
+// {"time", "from", "text"}.
+func importJSONL(r io.Reader, name string, day time.Time, emit func(HistoryEntry)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var line json.RawMessage
+		err := decoder.Decode(&line)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		var event ChatEvent
+		var entry HistoryEntry
+		if json.Unmarshal(line, &event) == nil && event.Type != "" {
+			entry, _ = historyEntry(event)
+		} else if json.Unmarshal(line, &entry) != nil {
+			continue
+		}
+		if entry.From != "" && !entry.Time.IsZero() {
+			emit(entry)
+		}
+	}
+}
+
+// RunImportCommand implements "chat import", which appends messages from
+// other chat logs to the history in the server's storage.
+func RunImportCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "irc", "log format: irc, znc, weechat or jsonl")
+	var source historySource
+	source.register(flags)
+	date := flags.String("date", "", "date of the messages, for irc/znc logs without one (YYYY-MM-DD)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: chatd import [flags] LOGFILE...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	parse, ok := IMPORT_FORMATS[*format]
+	if !ok || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	var day time.Time
+	if *date != "" {
+		var err error
+		if day, err = parseDate(*date); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	store, where, err := source.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close()
+
+	total := 0
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		count := 0
+		err = parse(f, name, day, func(entry HistoryEntry) {
+			event := entryEvent(entry)
+			if store.AppendEvent(&event) == nil {
+				count++
+			}
+		})
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%s: imported %d messages\n", name, count)
+		total += count
+	}
+	fmt.Printf("Imported %d messages into %s\n", total, where)
+	return 0
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Inbound webhook. CI systems and scripts POST messages into a room, where
+// they appear as chat from --inbound-name:
+//
+//	curl -H "Authorization: Bearer $TOKEN" -d "Build 123 passed" \
+//		http://chat.example.com:8090/hooks/rooms/builds
+//
+// The body is the message, or {"text": "..."} when the content type is
+// JSON. It is off unless --inbound-listen and --inbound-token are set; the
+// listener may be shared with the admin API, status page or metrics.
+//
+//	POST /hooks/rooms/{room}    post a message to a room
+func (server *ChatServer) inboundHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /hooks/rooms/{room}", func(w http.ResponseWriter, r *http.Request) {
+		room, ok := normalizeRoomName(r.PathValue("room"))
+		if !ok {
+			writeError(w, http.StatusBadRequest, "bad room name")
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(server.config.MaxMessageBytes)))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, "message too long")
+			return
+		}
+
+		text := string(body)
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			var payload struct {
+				Text string `json:"text"`
+			}
+			if err := json.Unmarshal(body, &payload); err != nil {
+				writeError(w, http.StatusBadRequest, "bad JSON: "+err.Error())
+				return
+			}
+			text = payload.Text
+		}
+		if !utf8.ValidString(text) {
+			writeError(w, http.StatusBadRequest, "message must be UTF-8 text")
+			return
+		}
+		if strings.TrimSpace(text) == "" {
+			writeError(w, http.StatusBadRequest, "empty message")
+			return
+		}
+
+		slog.Info("Inbound webhook", "room", room, "remote", r.RemoteAddr)
+		server.postAs(server.config.InboundName, room, text, false)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return requireToken(server.config.InboundToken, mux)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// meteredConn counts the bytes that cross a connection and tells the server
+// when it closes, so the inspector can see every connection, including ones
+// still at the username prompt.
+type meteredConn struct {
+	net.Conn
+	openedAt  time.Time
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	totals    *trafficTotals
+	quota     *quotaBucket
+	egress    *EgressLimiter
+	closeOnce sync.Once
+	onClose   func()
+}
+
+// trafficTotals counts bytes across all connections.
+type trafficTotals struct {
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// Read counts input and enforces the connection's bandwidth quota: a client
+// over quota is slowed to the quota rate, and disconnected if it won't
+// slow down.
+func (m *meteredConn) Read(p []byte) (int, error) {
+	n, err := m.Conn.Read(p)
+	m.bytesIn.Add(int64(n))
+	m.totals.bytesIn.Add(int64(n))
+	if quotaErr := m.quota.throttle(n); quotaErr != nil {
+		m.Conn.Write([]byte("\r\n*** Disconnected: bandwidth quota exceeded ***\r\n"))
+		m.Close()
+		return 0, quotaErr
+	}
+	return n, err
+}
+
+func (m *meteredConn) Write(p []byte) (int, error) {
+	var n int
+	var err error
+	if m.egress != nil {
+		n, err = m.egress.writeLimited(m.Conn.Write, p)
+	} else {
+		n, err = m.Conn.Write(p)
+	}
+	m.bytesOut.Add(int64(n))
+	m.totals.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (m *meteredConn) Close() error {
+	m.closeOnce.Do(m.onClose)
+	return m.Conn.Close()
+}
+
+// meterOf finds the meteredConn under any wrappers.
+func meterOf(conn net.Conn) *meteredConn {
+	for {
+		switch c := conn.(type) {
+		case *meteredConn:
+			return c
+		case *telnetConn:
+			conn = c.Conn
+		case *wsConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// trackConn wraps a new connection for metering and adds it to the
+// server's connection table until it is closed.
+func (server *ChatServer) trackConn(conn net.Conn) *meteredConn {
+	meter := &meteredConn{
+		Conn:     conn,
+		openedAt: time.Now(),
+		totals:   &server.traffic,
+		quota:    newQuotaBucket(BANDWIDTH_QUOTAS[DEFAULT_ROLE]),
+		egress:   server.egress,
+	}
+	server.metrics.connections.Add(1)
+	meter.onClose = func() {
+		server.connMutex.Lock()
+		delete(server.connections, meter)
+		server.connMutex.Unlock()
+	}
+
+	server.connMutex.Lock()
+	server.connections[meter] = nil
+	server.connMutex.Unlock()
+	return meter
+}
+
+// connectionsFrom counts the open connections from an address.
+func (server *ChatServer) connectionsFrom(host string) int {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+	count := 0
+	for meter := range server.connections {
+		if remoteHost(meter) == host {
+			count++
+		}
+	}
+	return count
+}
+
+// attachClient records which client a tracked connection belongs to.
+func (server *ChatServer) attachClient(client *Client) {
+	meter := meterOf(client.conn)
+	if meter == nil {
+		return
+	}
+	client.meter = meter
+	if role := client.role(); role != DEFAULT_ROLE {
+		meter.quota = newQuotaBucket(BANDWIDTH_QUOTAS[role])
+	}
+
+	server.connMutex.Lock()
+	if _, open := server.connections[meter]; open {
+		server.connections[meter] = client
+	}
+	server.connMutex.Unlock()
+}
+
+// What a client's pump goroutines are doing, for the inspector
+const (
+	PUMP_STARTING = iota
+	PUMP_READING  // readPump waiting for input
+	PUMP_HANDLING // readPump processing a line
+	PUMP_WAITING  // writePump waiting for messages
+	PUMP_WRITING  // writePump blocked writing to the socket
+	PUMP_EXITED
+)
+
+var PUMP_STATES = []string{"starting", "reading", "handling", "waiting", "writing", "exited"}
+
+// touch records input from the client.
+func (client *Client) touch() {
+	client.lastActive.Store(time.Now().UnixNano())
+}
+
+// idle returns how long since the client last sent anything.
+func (client *Client) idle() time.Duration {
+	last := client.lastActive.Load()
+	if last == 0 {
+		return time.Since(client.joinedAt)
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// ConnectionInfo is one row of the connection inspector.
+type ConnectionInfo struct {
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"`
+	OpenedAt  time.Time `json:"opened_at"`
+	Idle      string    `json:"idle"`
+	Queue     int       `json:"queue"`
+	QueueCap  int       `json:"queue_cap"`
+	Dropped   int64     `json:"dropped"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Throttled string    `json:"throttled"`
+	Reader    string    `json:"reader"`
+	Writer    string    `json:"writer"`
+}
+
+// inspectConnections describes every open connection, oldest first.
+func (server *ChatServer) inspectConnections() []ConnectionInfo {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+
+	infos := make([]ConnectionInfo, 0, len(server.connections))
+	for meter, client := range server.connections {
+		info := ConnectionInfo{
+			Remote:    meter.RemoteAddr().String(),
+			OpenedAt:  meter.openedAt,
+			Idle:      time.Since(meter.openedAt).Round(time.Second).String(),
+			BytesIn:   meter.bytesIn.Load(),
+			BytesOut:  meter.bytesOut.Load(),
+			Throttled: meter.quota.throttledFor().Round(time.Millisecond).String(),
+			Reader:    "login",
+			Writer:    "login",
+		}
+		if client != nil {
+			info.User = client.name()
+			info.Idle = client.idle().Round(time.Second).String()
+			info.Queue = client.queued()
+			info.QueueCap = cap(client.urgent) + cap(client.direct) + cap(client.messages)
+			info.Dropped = client.dropped.Load()
+			info.Reader = PUMP_STATES[client.readState.Load()]
+			info.Writer = PUMP_STATES[client.writeState.Load()]
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].OpenedAt.Before(infos[j].OpenedAt) })
+	return infos
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invite-only access. With --invite-only, new connections must give a code
+// an administrator generated before they can pick a name.
+const (
+	// File the codes are kept in with --storage files
+	INVITES_FILE = "invites.json"
+
+	// Codes are this many base32 characters (5 bits each)
+	INVITE_CODE_LENGTH = 10
+	MAX_INVITE_USES    = 1000
+)
+
+var errInvalidInvite = errors.New("invalid or used up invite code")
+
+// Invite is one code and how much of it is left.
+type Invite struct {
+	Code      string    `json:"code"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	CreatedAt time.Time `json:"created_at"`
+	Note      string    `json:"note,omitempty"`
+}
+
+// InviteRegistry holds the outstanding invite codes. Codes are removed once
+// used up.
+type InviteRegistry struct {
+	mutex   sync.Mutex
+	storage Storage
+	invites map[string]*Invite
+}
+
+// NewInviteRegistry returns an empty registry, which keeps codes in memory
+// until Load gives it storage.
+func NewInviteRegistry() *InviteRegistry {
+	return &InviteRegistry{storage: newMemoryStorage(), invites: make(map[string]*Invite)}
+}
+
+// Load reads the codes from storage, where changes are saved from then on.
+func (registry *InviteRegistry) Load(storage Storage) error {
+	invites, err := storage.LoadInvites()
+	if err != nil {
+		return err
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.storage, registry.invites = storage, invites
+	return nil
+}
+
+// normalizeInviteCode makes codes forgiving to type: case and dashes don't
+// matter.
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// Create generates a code good for maxUses logins.
+func (registry *InviteRegistry) Create(maxUses int, note string) (*Invite, error) {
+	if maxUses < 1 || maxUses > MAX_INVITE_USES {
+		return nil, fmt.Errorf("uses must be 1-%d", MAX_INVITE_USES)
+	}
+
+	invite := &Invite{
+		Code:      rand.Text()[:INVITE_CODE_LENGTH],
+		MaxUses:   maxUses,
+		CreatedAt: time.Now(),
+		Note:      note,
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if err := registry.storage.SaveInvite(invite); err != nil {
+		return nil, err
+	}
+	registry.invites[invite.Code] = invite
+	copied := *invite
+	return &copied, nil
+}
+
+// Valid reports whether code can still be used.
+func (registry *InviteRegistry) Valid(code string) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	_, ok := registry.invites[normalizeInviteCode(code)]
+	return ok
+}
+
+// Redeem uses up one login from a code.
+func (registry *InviteRegistry) Redeem(code string) error {
+	code = normalizeInviteCode(code)
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	invite, ok := registry.invites[code]
+	if !ok {
+		return errInvalidInvite
+	}
+	used := *invite
+	used.Uses++
+	if used.Uses >= used.MaxUses {
+		if err := registry.storage.DeleteInvite(code); err != nil {
+			return err
+		}
+		delete(registry.invites, code)
+		return nil
+	}
+	if err := registry.storage.SaveInvite(&used); err != nil {
+		return err
+	}
+	registry.invites[code] = &used
+	return nil
+}
+
+// Revoke deletes a code, reporting whether it existed.
+func (registry *InviteRegistry) Revoke(code string) (bool, error) {
+	code = normalizeInviteCode(code)
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, ok := registry.invites[code]; !ok {
+		return false, nil
+	}
+	if err := registry.storage.DeleteInvite(code); err != nil {
+		return true, err
+	}
+	delete(registry.invites, code)
+	return true, nil
+}
+
+// List returns copies of the outstanding codes, oldest first.
+func (registry *InviteRegistry) List() []Invite {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	invites := make([]Invite, 0, len(registry.invites))
+	for _, invite := range registry.invites {
+		invites = append(invites, *invite)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt.Before(invites[j].CreatedAt) })
+	return invites
+}
@@ -0,0 +1,574 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kafka export. With --kafka-brokers set, events are produced to Kafka as
+// JSON, to --kafka-topic or the topic --kafka-topics names for their type,
+// keyed by room (or user, for events outside rooms) so each room's events
+// stay in order on one partition. The producer speaks the Kafka protocol
+// itself (Metadata v4 and Produce v3, which brokers from 0.11 on
+// understand), sends to each partition's leader and waits for it to
+// acknowledge. A batch that fails is retried until it goes through, so an
+// event can arrive twice but isn't lost while it waits; events that find
+// the queue full are dropped as for the other exporters.
+const (
+	KAFKA_TOPIC         = "chat-events"
+	KAFKA_CLIENT_ID     = "chatd"
+	KAFKA_BATCH         = 500 // most events produced at once
+	KAFKA_TIMEOUT       = 10 * time.Second
+	KAFKA_RETRY         = time.Second
+	KAFKA_MAX_RETRY     = time.Minute
+	KAFKA_MAX_RESPONSE  = 16 * 1024 * 1024
+	KAFKA_API_PRODUCE   = 0
+	KAFKA_API_METADATA  = 3
+	KAFKA_ACKS_LEADER   = 1
+	KAFKA_RECORD_FORMAT = 2 // "magic" of record batches
+)
+
+// KafkaOptions says where to produce events to.
+type KafkaOptions struct {
+	Brokers string
+	Topic   string
+	Topics  string
+}
+
+func (options *KafkaOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.Brokers, "kafka-brokers", options.Brokers, "comma-separated Kafka brokers to produce events to, e.g. kafka1:9092,kafka2:9092 (empty for none)")
+	flags.StringVar(&options.Topic, "kafka-topic", options.Topic, "Kafka topic for events")
+	flags.StringVar(&options.Topics, "kafka-topics", options.Topics, "comma-separated type=topic pairs sending some events elsewhere, e.g. ban=chat-moderation,kick=chat-moderation")
+}
+
+func (options *KafkaOptions) validate() error {
+	if options.Brokers == "" {
+		return nil
+	}
+	for _, broker := range options.brokers() {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			return fmt.Errorf("kafka_brokers: %v", err)
+		}
+	}
+	if options.Topic == "" {
+		return fmt.Errorf("kafka_topic can't be empty")
+	}
+	if _, err := options.topics(); err != nil {
+		return fmt.Errorf("kafka_topics: %v", err)
+	}
+	return nil
+}
+
+func (options *KafkaOptions) brokers() []string {
+	var brokers []string
+	for _, broker := range strings.Split(options.Brokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	return brokers
+}
+
+// topics returns the topic for each event type --kafka-topics names.
+func (options *KafkaOptions) topics() (map[string]string, error) {
+	topics := make(map[string]string)
+	for _, pair := range strings.Split(options.Topics, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		eventType, topic, ok := strings.Cut(pair, "=")
+		if !ok || topic == "" {
+			return nil, fmt.Errorf("%q should be type=topic", pair)
+		}
+		if !EVENT_TYPES[eventType] {
+			return nil, fmt.Errorf("unknown event %q (use %s)", eventType, eventTypeNames())
+		}
+		topics[eventType] = topic
+	}
+	return topics, nil
+}
+
+// kafkaPartition is one partition of a topic.
+type kafkaPartition struct {
+	topic string
+	index int32
+}
+
+// kafkaExporter produces events from its own goroutine. Only that
+// goroutine touches the connections and metadata.
+type kafkaExporter struct {
+	*eventQueue
+	brokers []string
+	topic   string
+	topics  map[string]string
+
+	correlation int32
+	conns       map[int32]*kafkaConn     // by broker node ID
+	addresses   map[int32]string         // broker addresses by node ID
+	partitions  map[string]int32         // partition counts by topic
+	leaders     map[kafkaPartition]int32 // leader node IDs
+}
+
+// NewKafkaExporter starts producing events to the brokers options names.
+func NewKafkaExporter(options KafkaOptions) (EventExporter, error) {
+	topics, err := options.topics()
+	if err != nil {
+		return nil, err
+	}
+	exporter := &kafkaExporter{
+		eventQueue: newEventQueue("kafka"),
+		brokers:    options.brokers(),
+		topic:      options.Topic,
+		topics:     topics,
+	}
+	exporter.forget()
+	go exporter.run()
+	return exporter, nil
+}
+
+func (exporter *kafkaExporter) run() {
+	for event := range exporter.events {
+		batch := []ChatEvent{event}
+	collect:
+		for len(batch) < KAFKA_BATCH {
+			select {
+			case event := <-exporter.events:
+				batch = append(batch, event)
+			default:
+				break collect
+			}
+		}
+
+		wait := KAFKA_RETRY
+		for {
+			err := exporter.produce(batch)
+			if err == nil {
+				break
+			}
+			slog.Warn("Error producing events to Kafka", "events", len(batch), "err", err, "retry_in", wait)
+			exporter.forget()
+			time.Sleep(wait)
+			wait = min(wait*2, KAFKA_MAX_RETRY)
+		}
+	}
+}
+
+// forget closes the connections and drops the metadata, to start afresh
+// after an error.
+func (exporter *kafkaExporter) forget() {
+	for _, conn := range exporter.conns {
+		conn.Close()
+	}
+	exporter.conns = make(map[int32]*kafkaConn)
+	exporter.addresses = make(map[int32]string)
+	exporter.partitions = make(map[string]int32)
+	exporter.leaders = make(map[kafkaPartition]int32)
+}
+
+// topicFor returns the topic an event goes to.
+func (exporter *kafkaExporter) topicFor(event ChatEvent) string {
+	if topic, ok := exporter.topics[event.Type]; ok {
+		return topic
+	}
+	return exporter.topic
+}
+
+// kafkaRecord is one event on its way to a partition.
+type kafkaRecord struct {
+	key, value []byte
+	time       time.Time
+}
+
+// produce sends a batch of events, one Produce request to each leader,
+// and reports the first error.
+func (exporter *kafkaExporter) produce(batch []ChatEvent) error {
+	var missing []string
+	for _, event := range batch {
+		topic := exporter.topicFor(event)
+		if _, ok := exporter.partitions[topic]; !ok && !slices.Contains(missing, topic) {
+			missing = append(missing, topic)
+		}
+	}
+	if len(missing) > 0 {
+		if err := exporter.refresh(missing); err != nil {
+			return fmt.Errorf("metadata: %v", err)
+		}
+	}
+
+	byLeader := make(map[int32]map[kafkaPartition][]kafkaRecord)
+	for _, event := range batch {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		key := event.Room
+		if key == "" {
+			key = event.User
+		}
+		topic := exporter.topicFor(event)
+		if exporter.partitions[topic] == 0 {
+			return fmt.Errorf("%s has no partitions", topic)
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(key))
+		partition := kafkaPartition{topic: topic, index: int32(hash.Sum32() % uint32(exporter.partitions[topic]))}
+		leader, ok := exporter.leaders[partition]
+		if !ok {
+			return fmt.Errorf("%s partition %d has no leader", topic, partition.index)
+		}
+		if byLeader[leader] == nil {
+			byLeader[leader] = make(map[kafkaPartition][]kafkaRecord)
+		}
+		byLeader[leader][partition] = append(byLeader[leader][partition], kafkaRecord{key: []byte(key), value: value, time: event.Time})
+	}
+
+	for leader, records := range byLeader {
+		conn, err := exporter.connect(leader)
+		if err != nil {
+			return err
+		}
+		if err := exporter.send(conn, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connect returns the connection to a broker, dialing it if need be.
+func (exporter *kafkaExporter) connect(node int32) (*kafkaConn, error) {
+	if conn, ok := exporter.conns[node]; ok {
+		return conn, nil
+	}
+	address, ok := exporter.addresses[node]
+	if !ok {
+		return nil, fmt.Errorf("unknown broker %d", node)
+	}
+	conn, err := dialKafka(address)
+	if err != nil {
+		return nil, err
+	}
+	exporter.conns[node] = conn
+	return conn, nil
+}
+
+// refresh asks the first broker that answers for the brokers and the
+// partitions of topics and their leaders. Brokers that allow it create
+// topics that don't exist yet.
+func (exporter *kafkaExporter) refresh(topics []string) error {
+	var request kafkaWriter
+	request.int32(int32(len(topics)))
+	for _, topic := range topics {
+		request.string(topic)
+	}
+	request.int8(1) // allow_auto_topic_creation
+
+	var lastErr error
+	for _, broker := range exporter.brokers {
+		conn, err := dialKafka(broker)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		exporter.correlation++
+		response, err := conn.roundTrip(KAFKA_API_METADATA, 4, exporter.correlation, request.Bytes())
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return exporter.readMetadata(response)
+	}
+	return lastErr
+}
+
+// readMetadata reads a Metadata v4 response.
+func (exporter *kafkaExporter) readMetadata(response []byte) error {
+	reader := kafkaReader{data: response}
+	reader.int32() // throttle_time_ms
+	for range reader.count() {
+		node := reader.int32()
+		host := reader.string()
+		port := reader.int32()
+		reader.string() // rack
+		exporter.addresses[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	reader.string() // cluster_id
+	reader.int32()  // controller_id
+
+	var problems []string
+	for range reader.count() {
+		code := reader.int16()
+		topic := reader.string()
+		reader.int8() // is_internal
+		partitions := reader.count()
+		if code != 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s", topic, kafkaError(code)))
+		}
+		for range partitions {
+			reader.int16() // error_code; a leader is all we need
+			index := reader.int32()
+			leader := reader.int32()
+			for range reader.count() {
+				reader.int32() // replica_nodes
+			}
+			for range reader.count() {
+				reader.int32() // isr_nodes
+			}
+			if leader >= 0 {
+				exporter.leaders[kafkaPartition{topic: topic, index: index}] = leader
+			}
+		}
+		if code == 0 && partitions > 0 {
+			exporter.partitions[topic] = int32(partitions)
+		}
+	}
+	if reader.err != nil {
+		return reader.err
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// send makes a Produce v3 request of the records and checks every
+// partition took them.
+func (exporter *kafkaExporter) send(conn *kafkaConn, records map[kafkaPartition][]kafkaRecord) error {
+	byTopic := make(map[string][]kafkaPartition)
+	for partition := range records {
+		byTopic[partition.topic] = append(byTopic[partition.topic], partition)
+	}
+
+	var request kafkaWriter
+	request.int16(-1) // transactional_id: none
+	request.int16(KAFKA_ACKS_LEADER)
+	request.int32(int32(KAFKA_TIMEOUT / time.Millisecond))
+	request.int32(int32(len(byTopic)))
+	for topic, partitions := range byTopic {
+		request.string(topic)
+		request.int32(int32(len(partitions)))
+		for _, partition := range partitions {
+			request.int32(partition.index)
+			batch := recordBatch(records[partition])
+			request.int32(int32(len(batch)))
+			request.Write(batch)
+		}
+	}
+
+	exporter.correlation++
+	response, err := conn.roundTrip(KAFKA_API_PRODUCE, 3, exporter.correlation, request.Bytes())
+	if err != nil {
+		return err
+	}
+	reader := kafkaReader{data: response}
+	var problems []string
+	for range reader.count() {
+		topic := reader.string()
+		for range reader.count() {
+			index := reader.int32()
+			code := reader.int16()
+			reader.int64() // base_offset
+			reader.int64() // log_append_time_ms
+			if code != 0 {
+				problems = append(problems, fmt.Sprintf("%s partition %d: %s", topic, index, kafkaError(code)))
+			}
+		}
+	}
+	if reader.err != nil {
+		return reader.err
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// recordBatch encodes records as a version 2 record batch.
+func recordBatch(records []kafkaRecord) []byte {
+	base, last := records[0].time, records[0].time
+	var body kafkaWriter
+	for i, record := range records {
+		if record.time.After(last) {
+			last = record.time
+		}
+		var fields []byte
+		fields = append(fields, 0) // attributes
+		fields = binary.AppendVarint(fields, record.time.Sub(base).Milliseconds())
+		fields = binary.AppendVarint(fields, int64(i))
+		fields = binary.AppendVarint(fields, int64(len(record.key)))
+		fields = append(fields, record.key...)
+		fields = binary.AppendVarint(fields, int64(len(record.value)))
+		fields = append(fields, record.value...)
+		fields = binary.AppendVarint(fields, 0) // headers
+		body.Write(binary.AppendVarint(nil, int64(len(fields))))
+		body.Write(fields)
+	}
+
+	// The CRC covers everything from the attributes on
+	var checked kafkaWriter
+	checked.int16(0) // attributes: no compression
+	checked.int32(int32(len(records) - 1))
+	checked.int64(base.UnixMilli())
+	checked.int64(last.UnixMilli())
+	checked.int64(-1) // producer_id
+	checked.int16(-1) // producer_epoch
+	checked.int32(-1) // base_sequence
+	checked.int32(int32(len(records)))
+	checked.Write(body.Bytes())
+
+	var batch kafkaWriter
+	batch.int64(0) // base_offset, set by the broker
+	batch.int32(int32(4 + 1 + 4 + checked.Len()))
+	batch.int32(0) // partition_leader_epoch
+	batch.int8(KAFKA_RECORD_FORMAT)
+	batch.int32(int32(crc32.Checksum(checked.Bytes(), crc32.MakeTable(crc32.Castagnoli))))
+	batch.Write(checked.Bytes())
+	return batch.Bytes()
+}
+
+// kafkaConn is a connection to one broker.
+type kafkaConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func dialKafka(address string) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", address, KAFKA_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// roundTrip sends a request and returns the body of its response.
+func (conn *kafkaConn) roundTrip(api, version int16, correlation int32, body []byte) ([]byte, error) {
+	var request kafkaWriter
+	request.int32(0) // size, filled in below
+	request.int16(api)
+	request.int16(version)
+	request.int32(correlation)
+	request.string(KAFKA_CLIENT_ID)
+	request.Write(body)
+	data := request.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+
+	conn.SetDeadline(time.Now().Add(KAFKA_TIMEOUT + 5*time.Second))
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > KAFKA_MAX_RESPONSE {
+		return nil, fmt.Errorf("bad response size %d", size)
+	}
+	if got := int32(binary.BigEndian.Uint32(header[4:])); got != correlation {
+		return nil, fmt.Errorf("response %d to request %d", got, correlation)
+	}
+	response := make([]byte, size-4)
+	if _, err := io.ReadFull(conn.reader, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// kafkaWriter encodes the big-endian fields of Kafka requests.
+type kafkaWriter struct {
+	bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8)   { w.WriteByte(byte(v)) }
+func (w *kafkaWriter) int16(v int16) { w.Write(binary.BigEndian.AppendUint16(nil, uint16(v))) }
+func (w *kafkaWriter) int32(v int32) { w.Write(binary.BigEndian.AppendUint32(nil, uint32(v))) }
+func (w *kafkaWriter) int64(v int64) { w.Write(binary.BigEndian.AppendUint64(nil, uint64(v))) }
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.WriteString(s)
+}
+
+// kafkaReader decodes responses, keeping the first error; after one,
+// everything reads as zero.
+type kafkaReader struct {
+	data []byte
+	err  error
+}
+
+func (r *kafkaReader) take(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errors.New("short response")
+		return make([]byte, max(n, 0))
+	}
+	taken := r.data[:n]
+	r.data = r.data[n:]
+	return taken
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.take(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.take(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.take(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.take(8))) }
+
+// string reads a string; null reads as "".
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+
+// count reads the length of an array; null reads as 0.
+func (r *kafkaReader) count() int {
+	n := r.int32()
+	if n < 0 || r.err != nil {
+		return 0
+	}
+	if int(n) > len(r.data) {
+		r.err = errors.New("short response")
+		return 0
+	}
+	return int(n)
+}
+
+// Error codes a producer is likely to see
+var KAFKA_ERRORS = map[int16]string{
+	1:  "offset out of range",
+	2:  "corrupt message",
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	10: "message too large",
+	17: "invalid topic",
+	19: "not enough replicas",
+	29: "topic authorization failed",
+	35: "unsupported version",
+	87: "invalid record",
+}
+
+func kafkaError(code int16) string {
+	if text, ok := KAFKA_ERRORS[code]; ok {
+		return text
+	}
+	return "error " + strconv.Itoa(int(code))
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Keepalive pings go to clients that have been silent for a ping interval:
+// a WebSocket ping frame, a telnet NOP, or for plain line clients the line
+// "PING <token>". Clients that answer "PONG <token>" are expected to keep
+// answering, and are disconnected if they miss one. Anyone who sends
+// nothing but pongs for the idle timeout is disconnected as inactive.
+
+// keepaliveState is shared by readPump, which sees pongs, and the
+// keepalive loop.
+type keepaliveState struct {
+	answersPings atomic.Bool
+	done         chan struct{} // closed when readPump exits
+}
+
+// ping sends one keepalive in whatever form the client's transport won't
+// show to a person.
+func (client *Client) ping(token string) {
+	switch conn := client.conn.(type) {
+	case *wsConn:
+		conn.writeFrame(WS_PING, []byte(token))
+		return
+	case *telnetConn:
+		if conn.speaksTelnet() {
+			conn.send([]byte{TELNET_IAC, TELNET_NOP})
+			return
+		}
+	}
+	client.deliver(protocol.PING_LINE+" "+token, PRIORITY_SYSTEM)
+}
+
+// keepalive pings the client whenever a ping interval passes without
+// hearing from it, until readPump exits or the server stops.
+func (server *ChatServer) keepalive(ctx context.Context, client *Client) {
+	interval := server.config.PingInterval
+	if interval <= 0 || client.meter == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	heard := client.meter.bytesIn.Load()
+	pinged := false
+	for sequence := 1; ; sequence++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-client.keepalive.done:
+			return
+		case <-ticker.C:
+		}
+
+		if in := client.meter.bytesIn.Load(); in != heard {
+			heard = in
+			pinged = false
+			continue
+		}
+		if pinged && client.keepalive.answersPings.Load() {
+			client.logger().Info("Ping timeout")
+			client.conn.Close()
+			return
+		}
+		client.ping(fmt.Sprint(sequence))
+		pinged = true
+	}
+}
+
+// readDeadline is when readPump gives up on a client that has sent nothing
+// but pongs for the idle timeout.
+func (server *ChatServer) readDeadline(client *Client) time.Time {
+	timeout := server.config.live().IdleTimeout
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout - client.idle())
+}
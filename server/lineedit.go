@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Control characters handled by the line editor
+const (
+	KEY_BACKSPACE = 0x08
+	KEY_DELETE    = 0x7f
+	KEY_CTRL_U    = 0x15
+)
+
+// Input modes. In line mode the client edits locally and sends whole lines;
+// in char mode it sends keystrokes and the server echoes and edits.
+const (
+	INPUT_LINE = "line"
+	INPUT_CHAR = "char"
+)
+
+// Output line endings a client can ask for
+var NEWLINES = map[string]string{
+	"lf":   "\n",
+	"crlf": "\r\n",
+	"cr":   "\r",
+}
+
+// Byte order mark, which some Windows clients prefix to pasted text
+const BOM = "\uFEFF"
+
+var errLineTooLong = errors.New("line too long")
+
+// lineReader assembles input into lines, applying backspace and Ctrl-U as it
+// goes, so clients that send one character at a time still produce whole
+// messages. Line-mode clients pass through it unchanged. Lines longer than
+// limit bytes are read to the end and discarded.
+type lineReader struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	line     []byte
+	lastCR   bool
+	limit    int
+	overflow bool
+	hidden   bool
+
+	// Set once the client has switched to CBOR frames
+	frames *protocol.CBORDecoder
+}
+
+func newLineReader(conn net.Conn, limit int) *lineReader {
+	return &lineReader{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		limit:  limit,
+	}
+}
+
+// echoing reports whether we have told the client we will echo its input,
+// or it's an SSH terminal, which always needs us to.
+func (lr *lineReader) echoing() bool {
+	if session, ok := sshSessionOf(lr.conn); ok {
+		return session.terminal()
+	}
+	tc, ok := lr.conn.(*telnetConn)
+	return ok && tc.localEnabled(TELOPT_ECHO)
+}
+
+// echo sends input back when we are echoing for the client. While a secret
+// is typed only the end of the line is echoed.
+func (lr *lineReader) echo(b []byte) {
+	if lr.echoing() && (!lr.hidden || string(b) == "\r\n") {
+		lr.conn.Write(b)
+	}
+}
+
+// ReadLine returns the next line without its terminator. CR, LF, CRLF and
+// the telnet CR NUL all end a line. A line over the limit is returned as
+// errLineTooLong, and the reader can carry on with the next one.
+func (lr *lineReader) ReadLine() (string, error) {
+	if lr.frames != nil {
+		return lr.readFrame()
+	}
+	for {
+		b, err := lr.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		if lr.lastCR {
+			lr.lastCR = false
+			if b == '\n' || b == 0 {
+				continue
+			}
+		}
+
+		switch b {
+		case '\r', '\n':
+			lr.lastCR = b == '\r'
+			line := strings.ReplaceAll(string(lr.line), BOM, "")
+			lr.line = lr.line[:0]
+			lr.echo([]byte("\r\n"))
+			if lr.overflow {
+				lr.overflow = false
+				return "", errLineTooLong
+			}
+			return line, nil
+
+		case KEY_BACKSPACE, KEY_DELETE:
+			if len(lr.line) > 0 {
+				_, size := utf8.DecodeLastRune(lr.line)
+				lr.line = lr.line[:len(lr.line)-size]
+				lr.echo([]byte("\b \b"))
+			}
+
+		case KEY_CTRL_U:
+			if n := utf8.RuneCount(lr.line); n > 0 {
+				lr.echo(bytes.Repeat([]byte("\b \b"), n))
+				lr.line = lr.line[:0]
+			}
+
+		default:
+			if lr.limit > 0 && len(lr.line) >= lr.limit {
+				lr.overflow = true
+				continue
+			}
+			lr.line = append(lr.line, b)
+			lr.echo([]byte{b})
+		}
+	}
+}
+
+// useCBOR switches the reader to CBOR frames, which ReadLine then returns
+// as the JSON lines they stand for, so the rest of the server only reads
+// one kind of frame.
+func (lr *lineReader) useCBOR() {
+	if tc, ok := lr.conn.(*telnetConn); ok {
+		tc.passBinary()
+	}
+	// Drop the LF of a hello that ended with CRLF
+	if lr.lastCR && lr.reader.Buffered() > 0 {
+		if next, _ := lr.reader.Peek(1); next[0] == '\n' || next[0] == 0 {
+			lr.reader.ReadByte()
+		}
+	}
+	lr.lastCR = false
+	lr.frames = protocol.NewCBORDecoder(lr.reader, lr.limit)
+}
+
+// readFrame reads a CBOR frame as a JSON line. A frame whose line is over
+// the limit is errLineTooLong, like a JSON line.
+func (lr *lineReader) readFrame() (string, error) {
+	frame, err := lr.frames.Decode()
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSuffix(string(protocol.Encode(frame)), "\n")
+	if lr.limit > 0 && len(line) > lr.limit {
+		return "", errLineTooLong
+	}
+	return line, nil
+}
+
+// ReadSecret reads a line without echoing it. Telnet clients are asked to
+// stop echoing locally while it is typed.
+func (lr *lineReader) ReadSecret() (string, error) {
+	tc, isTelnet := lr.conn.(*telnetConn)
+	if isTelnet {
+		tc.requestEcho(true)
+	}
+	lr.hidden = true
+	line, err := lr.ReadLine()
+	lr.hidden = false
+	if isTelnet {
+		tc.requestEcho(false)
+	}
+	return line, err
+}
+
+// handleInputCommand implements "/input char|line".
+func (client *Client) handleInputCommand(message string) {
+	_, mode, _ := strings.Cut(message, " ")
+	if !client.setInputMode(strings.TrimSpace(mode)) {
+		client.messages <- "*** Usage: /input char|line (telnet clients only) ***"
+	}
+}
+
+// handleNewlineCommand implements "/newline lf|crlf|cr".
+func (client *Client) handleNewlineCommand(message string) {
+	_, ending, _ := strings.Cut(message, " ")
+	ending = strings.ToLower(strings.TrimSpace(ending))
+	newline, ok := NEWLINES[ending]
+	if !ok {
+		client.messages <- "*** Usage: /newline lf|crlf|cr ***"
+		return
+	}
+	client.mutex.Lock()
+	client.newline = newline
+	client.mutex.Unlock()
+	client.messages <- fmt.Sprintf("*** Line endings set to %s ***", ending)
+}
+
+// setInputMode switches a telnet client between local line editing and
+// server-side character mode. Other clients keep sending whole lines, which
+// the line reader handles either way.
+func (client *Client) setInputMode(mode string) bool {
+	tc, ok := client.conn.(*telnetConn)
+	if !ok || !tc.speaksTelnet() {
+		return false
+	}
+
+	switch mode {
+	case INPUT_CHAR:
+		tc.requestRemote(TELOPT_LINEMODE, false)
+		tc.requestLocal(TELOPT_SGA, true)
+		tc.requestEcho(true)
+		// Have the terminal mark pastes so they arrive as one message
+		tc.Write([]byte(BRACKETED_PASTE_ON))
+	case INPUT_LINE:
+		tc.Write([]byte(BRACKETED_PASTE_OFF))
+		tc.requestEcho(false)
+		tc.requestLocal(TELOPT_SGA, false)
+		tc.requestLineMode()
+	default:
+		return false
+	}
+	return true
+}
+
+// defaultNewline picks CRLF for telnet clients, as the NVT requires, and a
+// bare LF for everyone else.
+func defaultNewline(conn net.Conn) string {
+	if tc, ok := conn.(*telnetConn); ok && tc.speaksTelnet() {
+		return NEWLINES["crlf"]
+	}
+	if session, ok := sshSessionOf(conn); ok && session.terminal() {
+		return NEWLINES["crlf"]
+	}
+	return NEWLINES["lf"]
+}
+
+// encodeOutput terminates a message, wraps long lines and converts any line
+// breaks inside it to the client's preferred line ending.
+func (client *Client) encodeOutput(message string) []byte {
+	client.mutex.Lock()
+	newline := client.newline
+	client.mutex.Unlock()
+
+	message = strings.ReplaceAll(message, "\r\n", "\n")
+	message = strings.ReplaceAll(message, "\r", "\n")
+	if !protocol.IsSignal(message) {
+		// Signals are parsed by the client, so they must arrive intact
+		message = wrapText(message, client.effectiveWrapWidth())
+	}
+	if newline != "\n" {
+		message = strings.ReplaceAll(message, "\n", newline)
+	}
+	return []byte(message + newline)
+}
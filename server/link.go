@@ -0,0 +1,454 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Server-to-server links. Linked servers relay chat messages and joins and
+// leaves to each other. Links are not forwarded, so every server links
+// directly to every other one; servers that set --link-advertise gossip
+// their address over the links, so a new node only needs one --link-peers
+// entry to find the rest of the cluster. Linking is off unless
+// --link-secret is set.
+//
+// The secret never goes over the link. Each side's hello carries a random
+// nonce, and each proves it knows the secret with an auth message holding
+// the HMAC-SHA256, under the secret, of the other's nonce and which end of
+// the link it is, so one side's proof can't be played back as the
+// other's.
+const (
+	LINK_RETRY = 10 * time.Second
+
+	// Failure detection: peers that send nothing for LINK_TIMEOUT are
+	// considered dead. Idle links carry a ping every LINK_HEARTBEAT.
+	LINK_HEARTBEAT = 15 * time.Second
+	LINK_TIMEOUT   = 45 * time.Second
+
+	// Peers learned by gossip are forgotten after this many failed dials
+	LINK_DISCOVERY_ATTEMPTS = 3
+)
+
+// LinkOptions configures links to other servers.
+type LinkOptions struct {
+	Listen    string
+	Advertise string
+	Secret    string
+	Name      string
+	Peers     string
+}
+
+func (options *LinkOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.Listen, "link-listen", options.Listen, "address to accept links from other servers on (empty to only dial out)")
+	flags.StringVar(&options.Advertise, "link-advertise", options.Advertise, "address other servers can reach --link-listen at, told to the rest of the cluster")
+	flags.StringVar(&options.Secret, "link-secret", options.Secret, "secret shared by all linked servers; enables linking")
+	flags.StringVar(&options.Name, "link-name", options.Name, "this server's name on the links (default the hostname)")
+	flags.StringVar(&options.Peers, "link-peers", options.Peers, "comma-separated servers to link to at startup, e.g. chat2.example.com:8890")
+}
+
+func (options *LinkOptions) validate() error {
+	if options.Secret == "" && (options.Listen != "" || options.Peers != "") {
+		return fmt.Errorf("link_secret must be set to link servers")
+	}
+	return nil
+}
+
+// peers lists the servers to link to at startup.
+func (options *LinkOptions) peers() []string {
+	var peers []string
+	for _, peer := range strings.Split(options.Peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// Link message types
+const (
+	LINK_HELLO   = "hello"
+	LINK_MESSAGE = "message"
+	LINK_ACTION  = "action"
+	LINK_JOIN    = "join"
+	LINK_LEAVE   = "leave"
+	LINK_PING    = "ping"
+	LINK_GOSSIP  = "peers"
+	LINK_AUTH    = "auth"
+)
+
+// Ends of a link, as signed in its auth messages
+const (
+	LINK_DIALER   = "dialer"
+	LINK_LISTENER = "listener"
+)
+
+// LinkMessage is one JSON line on a server link.
+type LinkMessage struct {
+	Type   string `json:"type"`
+	Server string `json:"server"`
+	From   string `json:"from,omitempty"`
+	Text   string `json:"text,omitempty"`
+	Room   string `json:"room,omitempty"`
+
+	// Handshake: the sender's nonce (hello), and its proof of the secret
+	// over the receiver's nonce (auth)
+	Nonce string `json:"nonce,omitempty"`
+	Proof string `json:"proof,omitempty"`
+
+	// Advertised link address (hello), and known servers by name (peers)
+	Address string            `json:"address,omitempty"`
+	Peers   map[string]string `json:"peers,omitempty"`
+
+	// Users on a cluster node (presence)
+	Users []string `json:"users,omitempty"`
+
+	// A room's settings from its cluster node (room), or none if it was
+	// closed
+	Settings *RoomSettings `json:"settings,omitempty"`
+}
+
+type serverLink struct {
+	conn    net.Conn
+	name    string
+	address string
+	out     chan LinkMessage
+	done    chan struct{} // closed when the writer stops
+}
+
+// LinkManager owns this server's links and the users seen on each peer.
+type LinkManager struct {
+	server  *ChatServer
+	name    string
+	mutex   sync.Mutex
+	links   map[*serverLink]bool
+	users   map[string]map[string]int // peer server -> user -> sessions
+	dialing map[string]bool           // addresses we keep a link to
+}
+
+func NewLinkManager(server *ChatServer) *LinkManager {
+	name := server.config.Link.Name
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	return &LinkManager{
+		server:  server,
+		name:    name,
+		links:   make(map[*serverLink]bool),
+		users:   make(map[string]map[string]int),
+		dialing: make(map[string]bool),
+	}
+}
+
+// Listen accepts links from other servers.
+func (manager *LinkManager) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				slog.Error("Error accepting link", "err", err)
+				continue
+			}
+			go manager.serve(conn, false)
+		}
+	}()
+	return nil
+}
+
+// Connect keeps a link to addr up, redialing when it drops. With attempts
+// above zero it gives up after that many failures in a row.
+func (manager *LinkManager) Connect(addr string, attempts int) {
+	manager.mutex.Lock()
+	manager.dialing[addr] = true
+	manager.mutex.Unlock()
+
+	failures := 0
+	for attempts <= 0 || failures < attempts {
+		conn, err := net.DialTimeout("tcp", addr, LINK_RETRY)
+		if err != nil {
+			slog.Warn("Error linking", "addr", addr, "err", err)
+			failures++
+		} else if manager.serve(conn, true) {
+			failures = 0
+		} else {
+			failures++
+		}
+		time.Sleep(LINK_RETRY)
+	}
+
+	slog.Warn("Giving up on link", "addr", addr)
+	manager.mutex.Lock()
+	delete(manager.dialing, addr)
+	manager.mutex.Unlock()
+}
+
+// linkProof is the auth proof of the end of a link called end, over the
+// other end's nonce.
+func linkProof(secret, end, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(end + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serve runs the handshake and then relays messages until the link drops.
+// dialed says which end of the link this server is. It reports whether
+// the link came up.
+func (manager *LinkManager) serve(conn net.Conn, dialed bool) bool {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	remote := conn.RemoteAddr().String()
+
+	options := manager.server.config.Link
+	end, peerEnd := LINK_LISTENER, LINK_DIALER
+	if dialed {
+		end, peerEnd = LINK_DIALER, LINK_LISTENER
+	}
+	nonce := rand.Text()
+	hello := LinkMessage{Type: LINK_HELLO, Server: manager.name, Address: options.Advertise, Nonce: nonce}
+	if err := encoder.Encode(hello); err != nil {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(LINK_RETRY))
+	hello = LinkMessage{}
+	if err := decoder.Decode(&hello); err != nil || hello.Type != LINK_HELLO || hello.Nonce == "" {
+		slog.Warn("Bad link handshake", "remote", remote)
+		return false
+	}
+	auth := LinkMessage{Type: LINK_AUTH, Server: manager.name, Proof: linkProof(options.Secret, end, hello.Nonce)}
+	if err := encoder.Encode(auth); err != nil {
+		return false
+	}
+	auth = LinkMessage{}
+	if err := decoder.Decode(&auth); err != nil || auth.Type != LINK_AUTH {
+		slog.Warn("Bad link handshake", "remote", remote)
+		return false
+	}
+	want := linkProof(options.Secret, peerEnd, nonce)
+	if !hmac.Equal([]byte(auth.Proof), []byte(want)) {
+		slog.Warn("Link rejected: wrong secret", "remote", remote)
+		return false
+	}
+	if hello.Server == "" || hello.Server == manager.name {
+		slog.Warn("Link rejected: bad server name", "remote", remote, "server", hello.Server)
+		return false
+	}
+
+	link := &serverLink{conn: conn, name: hello.Server, address: hello.Address, out: make(chan LinkMessage, 256), done: make(chan struct{})}
+	manager.mutex.Lock()
+	if _, linked := manager.users[link.name]; linked {
+		manager.mutex.Unlock()
+		slog.Warn("Link rejected: already linked", "remote", remote, "server", link.name)
+		return false
+	}
+	manager.links[link] = true
+	manager.users[link.name] = make(map[string]int)
+	manager.mutex.Unlock()
+
+	notice := fmt.Sprintf("*** Linked to server %s ***", link.name)
+	slog.Info("Linked", "server", link.name)
+	manager.server.notify("", notice)
+
+	go func() {
+		defer close(link.done)
+		heartbeat := time.NewTicker(LINK_HEARTBEAT)
+		defer heartbeat.Stop()
+		for {
+			message := LinkMessage{Type: LINK_PING, Server: manager.name}
+			select {
+			case next, ok := <-link.out:
+				if !ok {
+					return
+				}
+				message = next
+			case <-heartbeat.C:
+			}
+			conn.SetWriteDeadline(time.Now().Add(LINK_TIMEOUT))
+			if err := encoder.Encode(message); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	// Tell the peer who is here already, and let every peer know about the
+	// new server. If the writer has given up, the read below fails too.
+	for _, name := range manager.server.userNames() {
+		select {
+		case link.out <- LinkMessage{Type: LINK_JOIN, Server: manager.name, From: name}:
+		case <-link.done:
+		}
+	}
+	manager.send(LinkMessage{Type: LINK_GOSSIP, Server: manager.name, Peers: manager.peerAddresses()})
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(LINK_TIMEOUT))
+		var message LinkMessage
+		if err := decoder.Decode(&message); err != nil {
+			slog.Warn("Link failed", "server", link.name, "err", err)
+			break
+		}
+		manager.receive(link, message)
+	}
+
+	manager.mutex.Lock()
+	delete(manager.links, link)
+	delete(manager.users, link.name)
+	close(link.out)
+	manager.mutex.Unlock()
+
+	notice = fmt.Sprintf("*** Lost link to server %s ***", link.name)
+	slog.Info("Lost link", "server", link.name)
+	manager.server.notify("", notice)
+	manager.server.sendUserList(LOBBY)
+	return true
+}
+
+// peerAddresses returns the advertised addresses of this server and every
+// server linked to it.
+func (manager *LinkManager) peerAddresses() map[string]string {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	peers := make(map[string]string)
+	if advertise := manager.server.config.Link.Advertise; advertise != "" {
+		peers[manager.name] = advertise
+	}
+	for link := range manager.links {
+		if link.address != "" {
+			peers[link.name] = link.address
+		}
+	}
+	return peers
+}
+
+// discover links to servers we heard about but aren't linked to. Of each
+// pair of servers, only the one with the smaller name dials, so the two
+// don't race to link to each other.
+func (manager *LinkManager) discover(peers map[string]string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for name, addr := range peers {
+		if name <= manager.name || manager.dialing[addr] {
+			continue
+		}
+		if _, linked := manager.users[name]; linked {
+			continue
+		}
+		slog.Info("Discovered server", "server", name, "addr", addr)
+		manager.dialing[addr] = true
+		go manager.Connect(addr, LINK_DISCOVERY_ATTEMPTS)
+	}
+}
+
+func (manager *LinkManager) receive(link *serverLink, message LinkMessage) {
+	// Only trust the peer to speak for itself
+	remote := sanitizeText(message.From) + "@" + link.name
+	message.Text = sanitizeText(message.Text)
+
+	switch message.Type {
+	case LINK_MESSAGE:
+		now := time.Now()
+		formattedMsg := fmt.Sprintf("[%s] %s: %s", now.Format("15:04:05"), remote, message.Text)
+		slog.Info("Chat", "server", link.name, "room", message.Room, "user", remote, "text", message.Text)
+		// Peers that predate rooms send everything to the lobby
+		room, ok := normalizeRoomName(message.Room)
+		if !ok {
+			room = LOBBY
+		}
+		frame := protocol.Frame{Type: protocol.FRAME_CHAT, From: remote, Room: room, Body: message.Text, Timestamp: now}
+		manager.server.send(room, withFrame(frame, formattedMsg), PRIORITY_CHATTER)
+
+	case LINK_ACTION:
+		slog.Info("Action", "server", link.name, "room", message.Room, "user", remote, "text", message.Text)
+		room, ok := normalizeRoomName(message.Room)
+		if !ok {
+			room = LOBBY
+		}
+		frame := protocol.Frame{Type: protocol.FRAME_ACTION, From: remote, Room: room, Body: message.Text, Timestamp: time.Now()}
+		manager.server.send(room, withFrame(frame, fmt.Sprintf(ACTION_FORMAT, remote, message.Text)), PRIORITY_CHATTER)
+
+	case LINK_JOIN:
+		manager.mutex.Lock()
+		manager.users[link.name][message.From]++
+		manager.mutex.Unlock()
+		manager.server.notifyMembership("", membershipLine(protocol.EVENT_JOIN, remote, ""))
+
+	case LINK_GOSSIP:
+		manager.discover(message.Peers)
+
+	case LINK_LEAVE:
+		manager.mutex.Lock()
+		if manager.users[link.name][message.From]--; manager.users[link.name][message.From] <= 0 {
+			delete(manager.users[link.name], message.From)
+		}
+		manager.mutex.Unlock()
+		manager.server.notifyMembership("", membershipLine(protocol.EVENT_LEAVE, remote, ""))
+	}
+}
+
+// Relay sends a local event to every linked server. Links that can't keep
+// up lose the message rather than holding up the chat.
+func (manager *LinkManager) Relay(messageType, room, from, text string) {
+	manager.send(LinkMessage{Type: messageType, Server: manager.name, Room: room, From: from, Text: text})
+}
+
+func (manager *LinkManager) send(message LinkMessage) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	for link := range manager.links {
+		select {
+		case link.out <- message:
+		default:
+			slog.Warn("Link is backed up, dropping message", "server", link.name, "type", message.Type)
+		}
+	}
+}
+
+// RemoteUsers lists users on linked servers as name@server.
+func (manager *LinkManager) RemoteUsers() []string {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	var users []string
+	for server, names := range manager.users {
+		for name := range names {
+			users = append(users, name+"@"+server)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// LinkedServers lists the names of the servers we are linked to.
+func (manager *LinkManager) LinkedServers() []string {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	var names []string
+	for link := range manager.links {
+		names = append(names, link.name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// Chat listeners. The server accepts chat connections on every listener it
+// is given at once: plain TCP on --listen, TLS (on --listen, or beside it on
+// --tls-listen) and a Unix socket on --socket, for local bots and reverse
+// proxies. Browsers come in over WebSocket on --websocket-listen. Everyone on a
+// Unix socket is on this machine, so its connections skip address bans and
+// the per-address limit; the socket's permissions say who may connect.
+const SOCKET_MODE = 0660
+
+// chatListener is a listener and what to call it at startup.
+type chatListener struct {
+	net.Listener
+	scheme string
+}
+
+// listenUnix listens on a Unix socket at path, replacing one left behind
+// by a server that is no longer running.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is in use by another server", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// listen opens the configured chat listeners, using the sockets systemd
+// passed in where there are any.
+func (server *ChatServer) listen() ([]chatListener, error) {
+	inherited, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	var listeners []chatListener
+	fail := func(err error) ([]chatListener, error) {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		inherited.close()
+		return nil, err
+	}
+	// open takes the socket systemd passed in for a listener, or opens it
+	open := func(scheme string, match func(name, network string) bool, listen func() (net.Listener, error)) (net.Listener, string, error) {
+		if listener := inherited.take(match); listener != nil {
+			return listener, scheme + ", from systemd", nil
+		}
+		listener, err := listen()
+		return listener, scheme, err
+	}
+
+	var tlsConfig *tls.Config
+	if server.config.TLS.enabled() {
+		config, err := server.config.TLS.config()
+		if err != nil {
+			return fail(fmt.Errorf("setting up TLS: %v", err))
+		}
+		tlsConfig = config
+		if server.tenants != nil {
+			tlsConfig.GetCertificate = server.tenantCertificate
+		}
+	}
+
+	// TLS replaces plain TCP on --listen unless it has an address of its own
+	scheme := "plain TCP"
+	if tlsConfig != nil && server.config.TLS.Listen == "" {
+		scheme = "TLS"
+	}
+	listener, scheme, err := open(scheme, func(name, network string) bool {
+		return network == "tcp" && name != SOCKET_NAME_TLS
+	}, func() (net.Listener, error) {
+		return net.Listen("tcp", server.config.Listen)
+	})
+	if err != nil {
+		return fail(fmt.Errorf("starting server: %v", err))
+	}
+	listener = server.proxied(listener)
+	if tlsConfig != nil && server.config.TLS.Listen == "" {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	listeners = append(listeners, chatListener{listener, scheme})
+
+	if tlsConfig != nil && server.config.TLS.Listen != "" {
+		listener, scheme, err := open("TLS", func(name, network string) bool {
+			return network == "tcp" && name == SOCKET_NAME_TLS
+		}, func() (net.Listener, error) {
+			return net.Listen("tcp", server.config.TLS.Listen)
+		})
+		if err != nil {
+			return fail(fmt.Errorf("starting TLS listener: %v", err))
+		}
+		listeners = append(listeners, chatListener{tls.NewListener(server.proxied(listener), tlsConfig), scheme})
+	}
+
+	// A Unix socket from systemd is used even without --socket
+	if listener := inherited.take(func(name, network string) bool { return network == "unix" }); listener != nil {
+		listeners = append(listeners, chatListener{listener, "Unix socket, from systemd"})
+	} else if server.config.Socket != "" {
+		listener, err := listenUnix(server.config.Socket, SOCKET_MODE)
+		if err != nil {
+			return fail(fmt.Errorf("opening chat socket: %v", err))
+		}
+		listeners = append(listeners, chatListener{listener, "Unix socket"})
+	}
+
+	if len(inherited) > 0 {
+		return fail(fmt.Errorf("systemd passed in %d socket(s) with no use here; name a TLS socket %q and set tls_cert and tls_key", len(inherited), SOCKET_NAME_TLS))
+	}
+	return listeners, nil
+}
+
+// accept hands the connections from one listener to handleClient until
+// ctx is cancelled or the listener is closed.
+func (server *ChatServer) accept(ctx context.Context, listener net.Listener) {
+	local := listener.Addr().Network() == "unix"
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Error accepting connection", "err", err)
+			continue
+		}
+
+		// A TLS client's server name may pick a tenant, which means
+		// finishing the handshake, on the client's goroutine
+		if tlsConn, ok := conn.(*tls.Conn); ok && server.tenants != nil {
+			go func() {
+				if target := server.route(tlsConn); target != nil && target.admit(conn) {
+					target.handleClient(ctx, newTelnetConn(target.trackConn(conn)))
+				}
+			}()
+			continue
+		}
+
+		// Banned addresses and ones over their connection limit are turned
+		// away before a goroutine is spent on them. Behind a proxy the
+		// address is in the PROXY header, which is read on the client's
+		// goroutine so that one slow connection can't hold up the rest.
+		if local {
+			go server.handleClient(ctx, newTelnetConn(server.trackConn(conn)))
+		} else if server.config.ProxyProtocol != "" {
+			go func() {
+				if server.admit(conn) {
+					server.handleClient(ctx, newTelnetConn(server.trackConn(conn)))
+				}
+			}()
+		} else if server.admit(conn) {
+			go server.handleClient(ctx, newTelnetConn(server.trackConn(conn)))
+		}
+	}
+}
+
+// admit turns the connection away if its address is banned or has too
+// many connections open, and reports whether it may go ahead.
+func (server *ChatServer) admit(conn net.Conn) bool {
+	// A proxy that sent no usable header has already been logged
+	if proxy, ok := conn.(*proxyConn); ok && proxy.header() != nil {
+		conn.Close()
+		return false
+	}
+	if reason := server.refusal(remoteHost(conn)); reason != "" {
+		slog.Info("Refused connection", "remote", conn.RemoteAddr().String(), "reason", reason)
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(reason + "\r\n"))
+		conn.Close()
+		return false
+	}
+	slog.Debug("New connection", "remote", conn.RemoteAddr().String())
+	return true
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Log levels for --log-level
+var LOG_LEVELS = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// LogOptions configures the server's log: how much it says, in what
+// format, and where it goes. Logs go to stderr unless a file is given,
+// which is rotated when it reaches the maximum size.
+type LogOptions struct {
+	Level    string
+	Format   string // text or json
+	File     string
+	MaxSize  int // megabytes, 0 for no rotation
+	MaxFiles int // rotated files kept
+}
+
+func (options *LogOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.Level, "log-level", options.Level, "least important messages to log: debug, info, warn or error")
+	flags.StringVar(&options.Format, "log-format", options.Format, "log format: text or json")
+	flags.StringVar(&options.File, "log-file", options.File, "file to log to instead of stderr")
+	flags.IntVar(&options.MaxSize, "log-max-size", options.MaxSize, "rotate the log file at this many megabytes (0 for never)")
+	flags.IntVar(&options.MaxFiles, "log-max-files", options.MaxFiles, "rotated log files to keep")
+}
+
+func (options *LogOptions) validate() error {
+	if _, ok := LOG_LEVELS[options.Level]; !ok {
+		return fmt.Errorf("unknown level %q (use debug, info, warn or error)", options.Level)
+	}
+	if options.Format != "text" && options.Format != "json" {
+		return fmt.Errorf("unknown format %q (use text or json)", options.Format)
+	}
+	if options.MaxSize < 0 || options.MaxFiles < 0 {
+		return fmt.Errorf("log_max_size and log_max_files can't be negative")
+	}
+	return nil
+}
+
+// logger opens the log destination and builds a logger for it, which
+// writes by way of tail.
+func (options *LogOptions) logger(tail *logTail) (*slog.Logger, error) {
+	var output io.Writer = os.Stderr
+	if options.File != "" {
+		file, err := openRotatingFile(options.File, int64(options.MaxSize)<<20, options.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		output = file
+	}
+	tail.output = output
+	output = tail
+
+	handlerOptions := &slog.HandlerOptions{Level: LOG_LEVELS[options.Level]}
+	if options.Format == "json" {
+		return slog.New(slog.NewJSONHandler(output, handlerOptions)), nil
+	}
+	return slog.New(slog.NewTextHandler(output, handlerOptions)), nil
+}
+
+// Log tailing. The server keeps its last LOG_TAIL_LINES log lines, which
+// GET /admin/logs returns, and with ?follow=true streams new ones as they
+// are written, for "chatd admin logs -f".
+const (
+	LOG_TAIL_LINES  = 500
+	LOG_TAIL_BUFFER = 256 // lines a follower may fall behind by before it is dropped
+)
+
+// logTail passes log lines on to the log's real destination, keeping the
+// most recent ones and copying them to followers.
+type logTail struct {
+	output io.Writer
+
+	mutex     sync.Mutex
+	lines     []string // a ring of the last LOG_TAIL_LINES
+	next      int
+	followers map[chan string]bool
+}
+
+func newLogTail() *logTail {
+	return &logTail{output: os.Stderr, followers: make(map[chan string]bool)}
+}
+
+// Write takes one log record, as slog's handlers write them.
+func (tail *logTail) Write(p []byte) (int, error) {
+	line := string(p)
+	tail.mutex.Lock()
+	if len(tail.lines) < LOG_TAIL_LINES {
+		tail.lines = append(tail.lines, line)
+	} else {
+		tail.lines[tail.next] = line
+		tail.next = (tail.next + 1) % LOG_TAIL_LINES
+	}
+	// A follower that has fallen too far behind is dropped rather than
+	// sent a log with holes in it
+	for follower := range tail.followers {
+		select {
+		case follower <- line:
+		default:
+			delete(tail.followers, follower)
+			close(follower)
+		}
+	}
+	tail.mutex.Unlock()
+	return tail.output.Write(p)
+}
+
+// recent returns up to the last n lines, oldest first.
+func (tail *logTail) recent(n int) []string {
+	tail.mutex.Lock()
+	defer tail.mutex.Unlock()
+	return tail.last(n)
+}
+
+// last returns up to the last n lines; the caller holds the mutex.
+func (tail *logTail) last(n int) []string {
+	lines := append(slices.Clone(tail.lines[tail.next:]), tail.lines[:tail.next]...)
+	return lines[max(len(lines)-n, 0):]
+}
+
+// follow returns the last n lines and a channel of the lines written
+// after them, until unfollow.
+func (tail *logTail) follow(n int) ([]string, chan string) {
+	follower := make(chan string, LOG_TAIL_BUFFER)
+	tail.mutex.Lock()
+	defer tail.mutex.Unlock()
+	tail.followers[follower] = true
+	return tail.last(n), follower
+}
+
+func (tail *logTail) unfollow(follower chan string) {
+	tail.mutex.Lock()
+	defer tail.mutex.Unlock()
+	if tail.followers[follower] {
+		delete(tail.followers, follower)
+		close(follower)
+	}
+}
+
+// logger returns a logger that tags records with the client's address and
+// name.
+func (client *Client) logger() *slog.Logger {
+	return slog.With("remote", client.conn.RemoteAddr().String(), "user", client.name())
+}
+
+// rotatingFile is a log file that is moved aside to path.1 when it reaches
+// its maximum size, with older files shifted to path.2 and so on.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	rotating := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+func (rotating *rotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file, rotating.size = file, info.Size()
+	return nil
+}
+
+func (rotating *rotatingFile) Write(p []byte) (int, error) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	if rotating.maxSize > 0 && rotating.size > 0 && rotating.size+int64(len(p)) > rotating.maxSize {
+		if err := rotating.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rotating %s: %v\n", rotating.path, err)
+		}
+	}
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. The caller
+// holds the mutex.
+func (rotating *rotatingFile) rotate() error {
+	rotating.file.Close()
+	if rotating.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", rotating.path, rotating.maxFiles))
+		for i := rotating.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rotating.path, i), fmt.Sprintf("%s.%d", rotating.path, i+1))
+		}
+		os.Rename(rotating.path, rotating.path+".1")
+	} else {
+		os.Remove(rotating.path)
+	}
+	return rotating.open()
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Mail for registered users who are offline. A /msg to an account nobody is
+// using is kept in storage (MAIL_FILE by default) and delivered when its
+// owner next logs in; /mail shows senders what is still waiting.
+const (
+	MAIL_FILE    = "mail.json"
+	MAILBOX_SIZE = 50 // messages waiting for one account
+)
+
+var errMailboxFull = errors.New("mailbox is full")
+
+// Mail is one message waiting for its recipient.
+type Mail struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Text   string    `json:"text"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// MailStore holds the waiting mail by account, saved so it survives a
+// restart.
+type MailStore struct {
+	mutex   sync.Mutex
+	storage Storage
+	boxes   map[string][]Mail
+}
+
+func NewMailStore() *MailStore {
+	return &MailStore{storage: newMemoryStorage(), boxes: make(map[string][]Mail)}
+}
+
+// Load reads the mail from storage, where changes are saved from then on.
+func (store *MailStore) Load(storage Storage) error {
+	boxes, err := storage.LoadMail()
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.storage, store.boxes = storage, boxes
+	return nil
+}
+
+// Send puts mail in its recipient's mailbox, unless the mailbox is full.
+func (store *MailStore) Send(mail Mail) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := strings.ToLower(mail.To)
+	if len(store.boxes[key]) >= MAILBOX_SIZE {
+		return errMailboxFull
+	}
+	mail.SentAt = time.Now()
+	if err := store.storage.AddMail(key, mail); err != nil {
+		return err
+	}
+	store.boxes[key] = append(store.boxes[key], mail)
+	return nil
+}
+
+// Take empties an account's mailbox, returning what was in it, oldest
+// first.
+func (store *MailStore) Take(account string) ([]Mail, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := strings.ToLower(account)
+	mail, ok := store.boxes[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(store.boxes, key)
+	return mail, store.storage.DeleteMail(key)
+}
+
+// SentBy returns the mail from a user that is still waiting, oldest first.
+func (store *MailStore) SentBy(name string) []Mail {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var sent []Mail
+	for _, box := range store.boxes {
+		for _, mail := range box {
+			if strings.EqualFold(mail.From, name) {
+				sent = append(sent, mail)
+			}
+		}
+	}
+	sort.Slice(sent, func(i, j int) bool { return sent[i].SentAt.Before(sent[j].SentAt) })
+	return sent
+}
+
+// sendMail leaves a private message for a registered user who is offline.
+func (server *ChatServer) sendMail(client *Client, to, text string) {
+	err := server.mail.Send(Mail{From: client.name(), To: to, Text: text})
+	switch {
+	case errors.Is(err, errMailboxFull):
+		client.messages <- fmt.Sprintf("*** %s is offline and their mailbox is full ***", to)
+	case err != nil:
+		client.messages <- fmt.Sprintf("*** Error saving the message: %v ***", err)
+	default:
+		client.logger().Info("Mail sent", "to", to)
+		server.pushAway(PUSH_DM, to, client.name(), "", text)
+		client.messages <- fmt.Sprintf("*** %s is offline; they'll get your message when they next log in ***", to)
+	}
+}
+
+// deliverMail gives a client that has just logged in to an account the
+// mail that was waiting for it, as private messages.
+func (server *ChatServer) deliverMail(client *Client, account string) {
+	mail, err := server.mail.Take(account)
+	if err != nil {
+		client.logger().Error("Error saving mail", "err", err)
+	}
+	if len(mail) == 0 {
+		return
+	}
+
+	client.messages <- fmt.Sprintf("*** %d messages arrived while you were away ***", len(mail))
+	timestamp := time.Now().Format("15:04:05")
+	for _, message := range mail {
+		sent := message.SentAt.Local().Format("Jan 2 15:04")
+		frame := protocol.Frame{Type: protocol.FRAME_DM, From: message.From, To: client.name(), Body: message.Text, Timestamp: message.SentAt}
+		client.messages <- withFrame(frame, fmt.Sprintf("[%s] "+PM_FROM+" (%s) %s", timestamp, message.From, sent, message.Text))
+	}
+	client.mutex.Lock()
+	client.replyTo = mail[len(mail)-1].From
+	client.mutex.Unlock()
+	client.logger().Info("Mail delivered", "count", len(mail))
+}
+
+// handleMailCommand implements "/mail", which lists the mail the client
+// has sent that hasn't been delivered yet.
+func (server *ChatServer) handleMailCommand(client *Client, message string) {
+	sent := server.mail.SentBy(client.name())
+	if len(sent) == 0 {
+		client.messages <- "*** None of your mail is waiting to be delivered ***"
+		return
+	}
+	lines := []string{"--- Waiting to be delivered ---"}
+	for _, mail := range sent {
+		lines = append(lines, fmt.Sprintf("  %s to %s: %s", mail.SentAt.Local().Format("Jan 2 15:04"), mail.To, mail.Text))
+	}
+	client.messages <- strings.Join(lines, "\n")
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// Prometheus metrics at /metrics, in the text exposition format, on
+// --metrics-listen. The address may be shared with the status page or the
+// admin API, in which case one listener serves them all.
+
+// serverMetrics counts what happens across the server. Gauges, such as
+// clients online, are read from the server when scraped.
+type serverMetrics struct {
+	connections     atomic.Int64 // connections accepted
+	linesIn         atomic.Int64 // lines read from clients
+	delivered       atomic.Int64 // messages written to clients
+	droppedMessages atomic.Int64 // chat not delivered to clients that fell behind
+	droppedClients  atomic.Int64 // clients removed because their queue was full
+	backpressure    atomic.Int64 // chat sent to clients whose queue was full
+}
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m metricsWriter) counter(name, help string, value int64) {
+	m.header(name, "counter", help)
+	fmt.Fprintf(m.w, "%s %d\n", name, value)
+}
+
+func (m metricsWriter) gauge(name, help string, value int64) {
+	m.header(name, "gauge", help)
+	fmt.Fprintf(m.w, "%s %d\n", name, value)
+}
+
+// metricsHandler serves GET /metrics.
+func (server *ChatServer) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		server.writeMetrics(metricsWriter{w})
+	})
+	return mux
+}
+
+func (server *ChatServer) writeMetrics(m metricsWriter) {
+	server.mutex.RLock()
+	clients, rooms := len(server.clients), len(server.rooms)
+	server.mutex.RUnlock()
+	server.connMutex.Lock()
+	connections := len(server.connections)
+	server.connMutex.Unlock()
+
+	m.gauge("chat_clients", "Clients logged in.", int64(clients))
+	m.gauge("chat_connections", "Open connections, including ones not logged in yet.", int64(connections))
+	m.gauge("chat_rooms", "Rooms with at least one member.", int64(rooms))
+	m.counter("chat_connections_total", "Connections accepted.", server.metrics.connections.Load())
+	m.counter("chat_lines_received_total", "Lines read from clients, commands included.", server.metrics.linesIn.Load())
+	m.counter("chat_messages_total", "Chat messages broadcast.", server.messageCount.Load())
+	m.counter("chat_messages_delivered_total", "Messages written to clients.", server.metrics.delivered.Load())
+	m.counter("chat_messages_dropped_total", "Chat messages not delivered because the client fell behind.", server.metrics.droppedMessages.Load())
+	m.counter("chat_backpressure_total", "Chat messages sent to clients whose queue was full, whatever the backpressure policy did with them.", server.metrics.backpressure.Load())
+	m.counter("chat_clients_dropped_total", "Clients disconnected because their queue was full.", server.metrics.droppedClients.Load())
+	m.counter("chat_events_dropped_total", "Events not exported because an exporter fell behind.", server.droppedEvents())
+	m.counter("chat_bytes_received_total", "Bytes read from all connections.", server.traffic.bytesIn.Load())
+	m.counter("chat_bytes_sent_total", "Bytes written to all connections.", server.traffic.bytesOut.Load())
+
+	usage := server.commands.Usage()
+	names := make([]string, 0, len(usage))
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m.header("chat_commands_total", "counter", "Slash commands run, by command.")
+	for _, name := range names {
+		fmt.Fprintf(m.w, "chat_commands_total{command=%q} %d\n", name, usage[name])
+	}
+}
@@ -0,0 +1,420 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles, from least to most privileged. Guests haven't logged in; accounts
+// named in --moderators or --admins get those roles when they log in.
+const (
+	ROLE_GUEST     = "guest"
+	ROLE_USER      = "user"
+	ROLE_MODERATOR = "moderator"
+	ROLE_ADMIN     = "admin"
+)
+
+var ROLE_RANKS = map[string]int{
+	ROLE_GUEST:     0,
+	ROLE_USER:      1,
+	ROLE_MODERATOR: 2,
+	ROLE_ADMIN:     3,
+}
+
+// roleBelow returns the role a rank below role, or guest.
+func roleBelow(role string) string {
+	for below, rank := range ROLE_RANKS {
+		if rank == ROLE_RANKS[role]-1 {
+			return below
+		}
+	}
+	return ROLE_GUEST
+}
+
+// File the ban list is saved to, in the working directory
+const BANS_FILE = "bans.json"
+
+// atLeast reports whether the client's role is role or above.
+func (client *Client) atLeast(role string) bool {
+	return ROLE_RANKS[client.role()] >= ROLE_RANKS[role]
+}
+
+// Ban keeps a username, an IP address or a CIDR range of addresses out,
+// until a time or for good.
+type Ban struct {
+	Target    string    `json:"target"`
+	Address   bool      `json:"address,omitempty"`
+	Until     time.Time `json:"until,omitzero"`
+	Reason    string    `json:"reason,omitempty"`
+	By        string    `json:"by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// describe says how long the ban has left and why, for the banned client.
+func (ban *Ban) describe() string {
+	text := "You are banned"
+	if !ban.Until.IsZero() {
+		text += fmt.Sprintf(" for another %s", time.Until(ban.Until).Round(time.Second))
+	}
+	if ban.Reason != "" {
+		text += fmt.Sprintf(" (%s)", ban.Reason)
+	}
+	return text + "."
+}
+
+// addressTarget reports whether a ban target is an IP address or a CIDR
+// range rather than a username, and returns it in canonical form.
+func addressTarget(target string) (string, bool) {
+	if ip := net.ParseIP(target); ip != nil {
+		return ip.String(), true
+	}
+	if _, network, err := net.ParseCIDR(target); err == nil {
+		return network.String(), true
+	}
+	return target, false
+}
+
+// covers reports whether an address ban applies to host.
+func (ban *Ban) covers(host string) bool {
+	if ban.Target == host {
+		return true
+	}
+	_, network, err := net.ParseCIDR(ban.Target)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && network.Contains(ip)
+}
+
+// expired reports whether the ban has run out.
+func (ban *Ban) expired() bool {
+	return !ban.Until.IsZero() && time.Now().After(ban.Until)
+}
+
+func banKey(target string, address bool) string {
+	if address {
+		return "ip:" + target
+	}
+	return "name:" + strings.ToLower(target)
+}
+
+// BanList holds the bans, saved so they survive a restart.
+type BanList struct {
+	mutex   sync.Mutex
+	storage Storage
+	bans    map[string]*Ban
+}
+
+func NewBanList() *BanList {
+	return &BanList{storage: newMemoryStorage(), bans: make(map[string]*Ban)}
+}
+
+// Load reads the bans from storage, where changes are saved from then on.
+func (list *BanList) Load(storage Storage) error {
+	bans, err := storage.LoadBans()
+	if err != nil {
+		return err
+	}
+
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.storage, list.bans = storage, bans
+	return nil
+}
+
+// Add bans a target, replacing any earlier ban on it.
+func (list *BanList) Add(ban Ban) error {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	ban.CreatedAt = time.Now()
+	key := banKey(ban.Target, ban.Address)
+	list.bans[key] = &ban
+	return list.storage.SaveBan(key, &ban)
+}
+
+// Remove lifts a ban on a username or address, reporting whether there
+// was one.
+func (list *BanList) Remove(target string) (bool, error) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	key := banKey(addressTarget(target))
+	if _, ok := list.bans[key]; !ok {
+		return false, nil
+	}
+	delete(list.bans, key)
+	return true, list.storage.DeleteBan(key)
+}
+
+// check returns the ban on a target, if there is one still in force.
+func (list *BanList) check(target string, address bool) *Ban {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	key := banKey(target, address)
+	ban, ok := list.bans[key]
+	if !ok {
+		return nil
+	}
+	if ban.expired() {
+		delete(list.bans, key)
+		list.storage.DeleteBan(key)
+		return nil
+	}
+	return ban
+}
+
+func (list *BanList) CheckName(name string) *Ban {
+	return list.check(name, false)
+}
+
+// CheckAddress returns the ban on an IP address or on a range that
+// contains it, if there is one still in force.
+func (list *BanList) CheckAddress(host string) *Ban {
+	if ban := list.check(host, true); ban != nil {
+		return ban
+	}
+
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	var found *Ban
+	for key, ban := range list.bans {
+		if !ban.Address || !strings.Contains(ban.Target, "/") || !ban.covers(host) {
+			continue
+		}
+		if ban.expired() {
+			delete(list.bans, key)
+			list.storage.DeleteBan(key)
+			continue
+		}
+		found = ban
+	}
+	return found
+}
+
+// List returns the bans, newest first.
+func (list *BanList) List() []Ban {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	bans := make([]Ban, 0, len(list.bans))
+	for _, ban := range list.bans {
+		bans = append(bans, *ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].CreatedAt.After(bans[j].CreatedAt) })
+	return bans
+}
+
+// remoteHost returns the IP address a connection comes from.
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// refusal says why a new connection from host isn't let in: the address
+// is banned, or already has as many connections open as one address may.
+// It returns "" for connections that may go ahead.
+func (server *ChatServer) refusal(host string) string {
+	if ban := server.bans.CheckAddress(host); ban != nil {
+		server.audit(AuditEntry{Event: AUDIT_REFUSED, Remote: host, Target: ban.Target, Detail: "banned address"})
+		return ban.describe()
+	}
+	if limit := server.config.live().MaxPerAddress; limit > 0 && server.connectionsFrom(host) >= limit {
+		return fmt.Sprintf("Too many connections from %s.", host)
+	}
+	return ""
+}
+
+// canModerate reports whether client outranks the user called name,
+// whether or not they are online, and tells the client if not.
+func (server *ChatServer) canModerate(client *Client, name string) bool {
+	role := DEFAULT_ROLE
+	if peers := server.findClients(name); len(peers) > 0 {
+		role = peers[0].role()
+	} else if server.accounts.Exists(name) {
+		role = server.roleOf(name)
+	}
+	if ROLE_RANKS[role] >= ROLE_RANKS[client.role()] {
+		client.messages <- fmt.Sprintf("*** You can't moderate %s ***", name)
+		return false
+	}
+	return true
+}
+
+// clientsAt returns the clients an address ban covers: those connected from
+// the address, or from inside the range.
+func (server *ChatServer) clientsAt(ban *Ban) []*Client {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	var found []*Client
+	for client := range server.clients {
+		if ban.covers(remoteHost(client.conn)) {
+			found = append(found, client)
+		}
+	}
+	return found
+}
+
+// parseBan reads "<target> [duration] [reason]".
+func parseBan(fields []string, by string) Ban {
+	ban := Ban{By: by}
+	ban.Target, ban.Address = addressTarget(fields[0])
+	rest := fields[1:]
+	if len(rest) > 0 {
+		if duration, err := time.ParseDuration(rest[0]); err == nil && duration > 0 {
+			ban.Until = time.Now().Add(duration)
+			rest = rest[1:]
+		}
+	}
+	ban.Reason = strings.Join(rest, " ")
+	return ban
+}
+
+// enforceBan exports and audits a new ban and kicks whoever it covers,
+// except clients whose role ranks at or above rank.
+func (server *ChatServer) enforceBan(ban *Ban, rank int) {
+	server.exportBan(ban)
+	server.auditBan(ban)
+	if !ban.Address {
+		server.kick(ban.Target, ban.By, ban.Reason)
+		return
+	}
+	for _, peer := range server.clientsAt(ban) {
+		if ROLE_RANKS[peer.role()] < rank {
+			server.kick(peer.name(), ban.By, ban.Reason)
+		}
+	}
+}
+
+// mutedFor returns how much longer the client is muted, or 0. Mutes are
+// kept by name so reconnecting doesn't lift them.
+func (server *ChatServer) mutedFor(client *Client) time.Duration {
+	server.mutex.RLock()
+	until := server.mutes[strings.ToLower(client.name())]
+	server.mutex.RUnlock()
+	return max(0, time.Until(until))
+}
+
+// mute keeps name from sending anything for duration, and exports the
+// mute.
+func (server *ChatServer) mute(name, by, reason string, duration time.Duration) {
+	until := time.Now().Add(duration)
+	server.mutex.Lock()
+	server.mutes[strings.ToLower(name)] = until
+	server.mutex.Unlock()
+	server.exportModeration(EVENT_MUTE, name, by, reason, until)
+}
+
+// allowMuted tells a muted client it can't send anything.
+func (server *ChatServer) allowMuted(client *Client) bool {
+	if remaining := server.mutedFor(client); remaining > 0 {
+		client.messages <- fmt.Sprintf("*** You are muted for another %s ***", remaining.Round(time.Second))
+		return false
+	}
+	return true
+}
+
+// handleModerationCommand implements /kick, /ban, /unban, /mute and
+// /unmute. The command registry keeps them to moderators.
+func (server *ChatServer) handleModerationCommand(client *Client, message string) {
+	command, args, _ := strings.Cut(message, " ")
+	fields := strings.Fields(args)
+
+	// target finds an online user the client is allowed to act on
+	target := func(name string) *Client {
+		peers := server.findClients(name)
+		if len(peers) == 0 {
+			client.messages <- fmt.Sprintf("*** %s is not online ***", name)
+			return nil
+		}
+		if !server.canModerate(client, peers[0].name()) {
+			return nil
+		}
+		return peers[0]
+	}
+
+	switch command {
+	case "/kick":
+		if len(fields) < 1 {
+			client.messages <- "*** Usage: /kick <user> [reason] ***"
+			return
+		}
+		if peer := target(fields[0]); peer != nil {
+			server.kick(peer.name(), client.name(), strings.Join(fields[1:], " "))
+		}
+
+	case "/ban":
+		if len(fields) < 1 {
+			client.messages <- "*** Usage: /ban <user|ip|cidr> [duration] [reason] ***"
+			return
+		}
+		ban := parseBan(fields, client.name())
+		if !ban.Address && !server.canModerate(client, ban.Target) {
+			return
+		}
+		if err := server.bans.Add(ban); err != nil {
+			client.messages <- fmt.Sprintf("*** Error saving the ban: %v ***", err)
+			return
+		}
+		client.logger().Info("Banned", "target", ban.Target, "until", ban.Until, "reason", ban.Reason)
+		client.messages <- fmt.Sprintf("*** Banned %s ***", ban.Target)
+
+		server.enforceBan(&ban, ROLE_RANKS[client.role()])
+
+	case "/unban":
+		if len(fields) != 1 {
+			client.messages <- "*** Usage: /unban <user|ip|cidr> ***"
+			return
+		}
+		removed, err := server.bans.Remove(fields[0])
+		switch {
+		case err != nil:
+			client.messages <- fmt.Sprintf("*** Error saving the ban list: %v ***", err)
+		case !removed:
+			client.messages <- fmt.Sprintf("*** %s isn't banned ***", fields[0])
+		default:
+			client.logger().Info("Unbanned", "target", fields[0])
+			server.auditClient(AUDIT_UNBAN, client, fields[0], "")
+			server.exportModeration(EVENT_UNBAN, fields[0], client.name(), "", time.Time{})
+			client.messages <- fmt.Sprintf("*** Unbanned %s ***", fields[0])
+		}
+
+	case "/mute":
+		if len(fields) != 2 {
+			client.messages <- "*** Usage: /mute <user> <duration> ***"
+			return
+		}
+		duration, err := time.ParseDuration(fields[1])
+		if err != nil || duration <= 0 {
+			client.messages <- "*** Durations look like 30s, 10m or 2h ***"
+			return
+		}
+		peer := target(fields[0])
+		if peer == nil {
+			return
+		}
+		server.mute(peer.name(), client.name(), "", duration)
+		notice := fmt.Sprintf("*** %s was muted for %s by %s ***", peer.name(), duration, client.name())
+		client.logger().Info("Muted", "target", peer.name(), "for", duration)
+		server.notify("", notice)
+
+	case "/unmute":
+		if len(fields) != 1 {
+			client.messages <- "*** Usage: /unmute <user> ***"
+			return
+		}
+		key := strings.ToLower(fields[0])
+		server.mutex.Lock()
+		_, muted := server.mutes[key]
+		delete(server.mutes, key)
+		server.mutex.Unlock()
+		if !muted {
+			client.messages <- fmt.Sprintf("*** %s isn't muted ***", fields[0])
+			return
+		}
+		client.logger().Info("Unmuted", "target", fields[0])
+		client.messages <- fmt.Sprintf("*** Unmuted %s ***", fields[0])
+	}
+}
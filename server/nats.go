@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATS backplane defaults. Chat and actions go out on a subject per room,
+// <prefix>.room.<name without #>, so a bridge can follow one room;
+// presence, joins and leaves and room settings on <prefix>.cluster. Every
+// node needs every message, so nodes subscribe to both plainly rather than
+// in a queue group, which would hand each message to only one of them.
+const (
+	NATS_PORT          = "4222"
+	NATS_PREFIX        = "chat"
+	NATS_DIAL_TIMEOUT  = 5 * time.Second
+	NATS_PING_INTERVAL = time.Minute // the connection is dropped after two without an answer
+)
+
+// natsBackplane shares messages through a NATS server, speaking its text
+// protocol over one connection, which it reconnects when it drops.
+type natsBackplane struct {
+	address  string
+	user     string
+	password string
+	token    string
+	prefix   string
+
+	out      chan LinkMessage
+	messages chan LinkMessage
+	done     chan struct{}
+	finished chan struct{}
+
+	closeOnce sync.Once
+}
+
+func openNATSBackplane(address, user, password, token, prefix string) *natsBackplane {
+	nats := &natsBackplane{
+		address:  address,
+		user:     user,
+		password: password,
+		token:    token,
+		prefix:   prefix,
+		out:      make(chan LinkMessage, CLUSTER_BUFFER),
+		messages: make(chan LinkMessage, CLUSTER_BUFFER),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go nats.loop()
+	return nats
+}
+
+func (nats *natsBackplane) Publish(message LinkMessage) {
+	select {
+	case nats.out <- message:
+	default:
+		slog.Warn("Backplane is backed up, dropping message", "type", message.Type)
+	}
+}
+
+func (nats *natsBackplane) Messages() <-chan LinkMessage {
+	return nats.messages
+}
+
+// Close stops the loop once what is waiting to be published has gone.
+func (nats *natsBackplane) Close() error {
+	nats.closeOnce.Do(func() { close(nats.done) })
+	<-nats.finished
+	return nil
+}
+
+// subject is where a message is published: its room's subject for chat
+// and actions, the cluster's for the rest.
+func (nats *natsBackplane) subject(message LinkMessage) string {
+	if message.Type == LINK_MESSAGE || message.Type == LINK_ACTION {
+		if room, ok := normalizeRoomName(message.Room); ok {
+			return nats.prefix + ".room." + strings.TrimPrefix(room, "#")
+		}
+	}
+	return nats.prefix + ".cluster"
+}
+
+// loop keeps a session going, starting another after LINK_RETRY when one
+// fails, until Close.
+func (nats *natsBackplane) loop() {
+	defer close(nats.finished)
+	for {
+		err := nats.session()
+		select {
+		case <-nats.done:
+			return
+		default:
+		}
+		slog.Warn("Lost the backplane, retrying", "addr", nats.address, "err", err, "in", LINK_RETRY)
+		select {
+		case <-time.After(LINK_RETRY):
+		case <-nats.done:
+			return
+		}
+	}
+}
+
+// natsInfo is what the server says about itself on connecting.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// session connects, subscribes, and then publishes what is queued and
+// hands on what arrives until the connection fails or Close is called.
+func (nats *natsBackplane) session() error {
+	conn, err := net.DialTimeout("tcp", nats.address, NATS_DIAL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	// The server speaks first, with INFO; CONNECT, then a PING answered
+	// with PONG, shows that it took our credentials
+	conn.SetDeadline(time.Now().Add(NATS_DIAL_TIMEOUT))
+	line, err := readNATSLine(reader)
+	if err != nil {
+		return err
+	}
+	data, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		return fmt.Errorf("nats: expected INFO, got %q", line)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		return fmt.Errorf("nats: bad INFO: %v", err)
+	}
+	if info.TLSRequired {
+		return errors.New("nats: the server requires TLS, which the backplane doesn't speak")
+	}
+	connect, _ := json.Marshal(map[string]any{
+		"verbose": false, "pedantic": false, "lang": "go", "version": "chatd", "protocol": 1,
+		"no_echo": true, "user": nats.user, "pass": nats.password, "auth_token": nats.token,
+	})
+	fmt.Fprintf(writer, "CONNECT %s\r\nPING\r\n", connect)
+	fmt.Fprintf(writer, "SUB %s.cluster 1\r\nSUB %s.room.* 2\r\n", nats.prefix, nats.prefix)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	for {
+		line, err := readNATSLine(reader)
+		if err != nil {
+			return err
+		}
+		if line == "PONG" {
+			break
+		}
+		if message, ok := strings.CutPrefix(line, "-ERR "); ok {
+			return fmt.Errorf("nats: %s", message)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	slog.Info("Subscribed to the backplane", "addr", nats.address, "prefix", nats.prefix)
+
+	// The reader answers the server's PINGs through writes, which the
+	// write mutex keeps whole
+	var writeMutex sync.Mutex
+	write := func(format string, args ...any) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(NATS_DIAL_TIMEOUT))
+		fmt.Fprintf(writer, format, args...)
+		return writer.Flush()
+	}
+	failed := make(chan error, 1)
+	go func() {
+		failed <- nats.receive(conn, reader, func() error { return write("PONG\r\n") })
+	}()
+
+	publish := func(message LinkMessage) error {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return nil
+		}
+		if info.MaxPayload > 0 && len(data) > info.MaxPayload {
+			slog.Warn("Message is too big for the backplane, dropping it", "type", message.Type, "bytes", len(data))
+			return nil
+		}
+		return write("PUB %s %d\r\n%s\r\n", nats.subject(message), len(data), data)
+	}
+
+	ping := time.NewTicker(NATS_PING_INTERVAL)
+	defer ping.Stop()
+	for {
+		select {
+		case message := <-nats.out:
+			if err := publish(message); err != nil {
+				return err
+			}
+		case <-ping.C:
+			if err := write("PING\r\n"); err != nil {
+				return err
+			}
+		case err := <-failed:
+			return err
+		case <-nats.done:
+			for {
+				select {
+				case message := <-nats.out:
+					if err := publish(message); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// receive reads what the server sends, handing on messages and answering
+// PINGs with pong, until the connection fails.
+func (nats *natsBackplane) receive(conn net.Conn, reader *bufio.Reader, pong func() error) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * NATS_PING_INTERVAL))
+		line, err := readNATSLine(reader)
+		if err != nil {
+			return err
+		}
+		verb, rest, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "PING":
+			if err := pong(); err != nil {
+				return err
+			}
+		case "-ERR":
+			return fmt.Errorf("nats: %s", rest)
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <size>, then the payload
+			fields := strings.Fields(rest)
+			if len(fields) < 3 {
+				return fmt.Errorf("nats: bad MSG %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return fmt.Errorf("nats: bad MSG %q", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return err
+			}
+			var message LinkMessage
+			if err := json.Unmarshal(payload[:size], &message); err != nil {
+				slog.Warn("Bad message on the backplane", "subject", fields[0], "err", err)
+				continue
+			}
+			select {
+			case nats.messages <- message:
+			default:
+				slog.Warn("Backplane messages are backed up, dropping one", "type", message.Type)
+			}
+		}
+		// PONG, +OK and INFO updates need nothing
+	}
+}
+
+// readNATSLine reads one protocol line without its CRLF.
+func readNATSLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
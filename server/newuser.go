@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Restrictions on names first seen recently, to blunt drive-by spam. For
+// --new-user-period after a name first joins it can't post links, can only
+// message or signal people who messaged it first, and may only send one
+// message per --new-user-slow-mode. They lift by themselves as the name
+// ages, and don't apply to users logged in to an account. 0 disables them.
+var linkPattern = regexp.MustCompile(`(?i)\b[a-z][a-z0-9+.-]*://|\bwww\.`)
+
+// newUserFor returns how much longer the client counts as new, or 0. It
+// goes by the name the client logged in with, so taking an older name with
+// /nick doesn't lift the restrictions.
+func (server *ChatServer) newUserFor(client *Client) time.Duration {
+	period := server.config.NewUserPeriod
+	if period <= 0 || client.loggedInAs() != "" {
+		return 0
+	}
+	return max(0, period-time.Since(client.firstSeen))
+}
+
+// allowChat checks a chat message against mutes, in the room too, the
+// room's ACL and the new-user restrictions, telling the client why if it is refused.
+func (server *ChatServer) allowChat(client *Client, text string) bool {
+	if !server.allowMuted(client) {
+		return false
+	}
+	if remaining := server.roomMutedFor(client); remaining > 0 {
+		client.messages <- fmt.Sprintf("*** You are muted in this room for another %s ***", remaining.Round(time.Second))
+		return false
+	}
+	if room := server.roomOf(client); !server.roomAllows(client, room, ACL_WRITE) {
+		client.messages <- fmt.Sprintf("*** You can only read in %s ***", room)
+		return false
+	}
+	remaining := server.newUserFor(client)
+	if remaining == 0 {
+		return true
+	}
+
+	if linkPattern.MatchString(text) {
+		client.messages <- fmt.Sprintf("*** New users can't post links for another %s ***", remaining.Round(time.Second))
+		return false
+	}
+	if slowMode := server.config.NewUserSlowMode; time.Since(client.lastChat) < slowMode {
+		client.messages <- fmt.Sprintf("*** Slow down: new users can send one message every %s ***", slowMode)
+		return false
+	}
+	client.lastChat = time.Now()
+	return true
+}
+
+// allowDirect reports whether the client may send something privately to
+// target, telling it why not. Muted users can't, and new users can only
+// answer people who sent them a private message.
+func (server *ChatServer) allowDirect(client *Client, target string) bool {
+	if !server.allowMuted(client) {
+		return false
+	}
+	remaining := server.newUserFor(client)
+	if remaining == 0 {
+		return true
+	}
+
+	client.mutex.Lock()
+	replyTo := client.replyTo
+	client.mutex.Unlock()
+	if strings.EqualFold(target, replyTo) {
+		return true
+	}
+	client.messages <- fmt.Sprintf("*** New users can only reply to private messages for another %s ***", remaining.Round(time.Second))
+	return false
+}
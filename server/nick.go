@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Usernames are unique, ignoring case.
+const (
+	MIN_NAME_LENGTH = 2
+	MAX_NAME_LENGTH = 32
+)
+
+var errNameTaken = errors.New("that name is in use")
+
+// Usernames are letters, digits, _ and -. Anything more lets a name pass
+// for server text ("[PM from admin]") or, with a space, slip past the
+// commands that take a name as their first word; @ marks users of linked
+// servers, so no local user can pose as one.
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// NAME_RULE says what validName accepts, for telling users.
+var NAME_RULE = fmt.Sprintf("%d-%d of A-Z, a-z, 0-9, _ and -", MIN_NAME_LENGTH, MAX_NAME_LENGTH)
+
+// validName checks a username's length and characters.
+func validName(name string) bool {
+	return len(name) >= MIN_NAME_LENGTH && len(name) <= MAX_NAME_LENGTH && namePattern.MatchString(name)
+}
+
+// claimName reserves name for a client that is logging in. It is released
+// when the client leaves, or by releaseName if it never gets that far.
+func (server *ChatServer) claimName(name string) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	key := strings.ToLower(name)
+	if server.names[key] {
+		return false
+	}
+	server.names[key] = true
+	return true
+}
+
+func (server *ChatServer) releaseName(name string) {
+	server.mutex.Lock()
+	delete(server.names, strings.ToLower(name))
+	server.mutex.Unlock()
+}
+
+// name returns the client's username, which /nick can change while other
+// goroutines read it.
+func (client *Client) name() string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.username
+}
+
+// renameClient changes a client's name and tells everyone. The new name is
+// claimed in the same step, so two clients can't rename to the same name.
+func (server *ChatServer) renameClient(client *Client, name string) error {
+	server.mutex.Lock()
+	old := client.name()
+	if !strings.EqualFold(old, name) {
+		if server.names[strings.ToLower(name)] {
+			server.mutex.Unlock()
+			return errNameTaken
+		}
+		delete(server.names, strings.ToLower(old))
+		server.names[strings.ToLower(name)] = true
+	}
+	client.mutex.Lock()
+	client.username = name
+	client.mutex.Unlock()
+	room := client.room
+	server.mutex.Unlock()
+	server.shadowBans.rename(old, name)
+
+	server.relay(LINK_LEAVE, "", old, "")
+	server.relay(LINK_JOIN, "", name, "")
+	notice := fmt.Sprintf("*** %s is now known as %s ***", old, name)
+	client.logger().Info("Renamed", "from", old)
+	server.send("", notice, PRIORITY_CHATTER)
+	server.sendUserList(room)
+	return nil
+}
+
+// handleNickCommand implements "/nick <newname>". Registered names can only
+// be taken with /login.
+func (server *ChatServer) handleNickCommand(client *Client, message string) {
+	_, name, _ := strings.Cut(message, " ")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		client.messages <- "*** Usage: /nick <newname> ***"
+		return
+	}
+	if !validName(name) {
+		client.messages <- "*** Names must be " + NAME_RULE + " ***"
+		return
+	}
+	if name == client.name() {
+		return
+	}
+	if server.accounts.Exists(name) && !strings.EqualFold(name, client.loggedInAs()) {
+		client.messages <- fmt.Sprintf("*** %s is registered; use /login to take it ***", name)
+		return
+	}
+	if err := server.renameClient(client, name); err != nil {
+		client.messages <- fmt.Sprintf("*** %s is in use; pick another ***", name)
+	}
+}
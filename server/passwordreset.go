@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Password resets. "/resetpassword <user>" makes a code for a registered
+// account, good for RESET_CODE_LIFETIME and RESET_ATTEMPTS wrong tries.
+// It is mailed to the account's verified email address if it has one and
+// --email-smtp is set, and otherwise shown on the admin console, where
+// "resets" lists the codes waiting, for an administrator to pass on.
+// "/resetpassword <user> <code> <new password>" then sets the password.
+// Asking says the same whether or not the account exists. Codes are only
+// kept in memory, so a restart cancels them. The operator's accounts are
+// reset in --credentials-file instead.
+const (
+	RESET_CODE_LIFETIME = 30 * time.Minute
+	RESET_CODE_LENGTH   = 10 // base32 characters, as for invite codes
+	RESET_ATTEMPTS      = 5
+)
+
+// passwordReset is a code waiting to be redeemed for an account.
+type passwordReset struct {
+	Account string
+	Code    string
+	Expires time.Time
+	misses  int
+}
+
+// passwordResets holds the codes waiting, by lowercased account.
+type passwordResets struct {
+	mutex   sync.Mutex
+	pending map[string]*passwordReset
+}
+
+func newPasswordResets() *passwordResets {
+	return &passwordResets{pending: make(map[string]*passwordReset)}
+}
+
+// Create makes a code for an account, replacing any it had.
+func (resets *passwordResets) Create(account string) passwordReset {
+	reset := &passwordReset{
+		Account: account,
+		Code:    rand.Text()[:RESET_CODE_LENGTH],
+		Expires: time.Now().Add(RESET_CODE_LIFETIME),
+	}
+	resets.mutex.Lock()
+	defer resets.mutex.Unlock()
+	resets.pending[strings.ToLower(account)] = reset
+	return *reset
+}
+
+// Redeem reports whether code is the account's, using it up if so. A code
+// is forgotten once it expires or has been guessed at RESET_ATTEMPTS times.
+func (resets *passwordResets) Redeem(account, code string) bool {
+	resets.mutex.Lock()
+	defer resets.mutex.Unlock()
+	key := strings.ToLower(account)
+	reset, ok := resets.pending[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(reset.Expires) {
+		delete(resets.pending, key)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(normalizeInviteCode(code)), []byte(reset.Code)) != 1 {
+		if reset.misses++; reset.misses >= RESET_ATTEMPTS {
+			delete(resets.pending, key)
+		}
+		return false
+	}
+	delete(resets.pending, key)
+	return true
+}
+
+// List returns the codes that haven't expired, by account.
+func (resets *passwordResets) List() []passwordReset {
+	resets.mutex.Lock()
+	defer resets.mutex.Unlock()
+	var list []passwordReset
+	for key, reset := range resets.pending {
+		if time.Now().After(reset.Expires) {
+			delete(resets.pending, key)
+			continue
+		}
+		list = append(list, *reset)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Account < list[j].Account })
+	return list
+}
+
+// SetPassword changes a registered account's password.
+func (store *AccountStore) SetPassword(name, password string) error {
+	if err := checkPasswordLength(password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if store.Provisioned(name) {
+		return fmt.Errorf("%s's password is set by the server's operator", name)
+	}
+	return store.update(name, func(account *Account) error {
+		if account.Hash == "" {
+			return fmt.Errorf("no account %s", name)
+		}
+		account.Hash = hash
+		return nil
+	})
+}
+
+// sendResetCode gets a reset code to the account's owner: by mail to a
+// verified address, or else through the admin console.
+func (server *ChatServer) sendResetCode(reset passwordReset) {
+	address, verified := server.accounts.Email(reset.Account)
+	if verified && server.config.Email.SMTP != "" {
+		text := fmt.Sprintf("Someone, hopefully you, asked to reset the password of %s on %s.\n\nTo set a new one, type this within %d minutes:\n\n/resetpassword %s %s <new password>\n\nIf it wasn't you, ignore this mail.",
+			reset.Account, server.config.StatusName, int(RESET_CODE_LIFETIME.Minutes()), reset.Account, reset.Code)
+		err := server.config.Email.send(address, "Reset your password", text)
+		if err == nil {
+			slog.Info("Password reset code mailed", "account", reset.Account)
+			return
+		}
+		slog.Error("Error mailing password reset code", "account", reset.Account, "err", err)
+	}
+	slog.Info("Password reset code waiting on the admin console", "account", reset.Account)
+	if server.console != nil {
+		server.console.Notice(fmt.Sprintf("password reset code for %s: %s (expires %s)",
+			reset.Account, reset.Code, reset.Expires.Local().Format("15:04")))
+	}
+}
+
+// handleResetPasswordCommand implements "/resetpassword <user>", which
+// sends a reset code, and "/resetpassword <user> <code> <new password>".
+func (server *ChatServer) handleResetPasswordCommand(client *Client, message string) {
+	_, args, _ := strings.Cut(message, " ")
+	user, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	code, password, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	password = strings.TrimSpace(password)
+	if !validName(user) || code != "" && password == "" {
+		client.messages <- "*** Usage: /resetpassword <user> [<code> <new password>] ***"
+		return
+	}
+
+	if code == "" {
+		if server.accounts.Exists(user) && !server.accounts.Provisioned(user) && server.email.allow(EMAIL_RESET, user) {
+			reset := server.resets.Create(user)
+			go server.sendResetCode(reset)
+		}
+		client.logger().Info("Password reset asked for", "account", user)
+		client.messages <- fmt.Sprintf("*** If %s is registered, a reset code is on its way to its email address, or to the server's administrators if it has none. Then: /resetpassword %s <code> <new password> ***", user, user)
+		return
+	}
+
+	if err := checkPasswordLength(password); err != nil {
+		client.messages <- fmt.Sprintf("*** %v ***", err)
+		return
+	}
+	if !server.resets.Redeem(user, code) {
+		client.logger().Warn("Wrong password reset code", "account", user)
+		server.auditClient(AUDIT_LOGIN_FAILED, client, user, "password reset code")
+		time.Sleep(LOGIN_FAILURE_DELAY)
+		client.messages <- "*** Wrong or expired reset code ***"
+		return
+	}
+	if err := server.accounts.SetPassword(user, password); err != nil {
+		client.messages <- fmt.Sprintf("*** %v ***", err)
+		return
+	}
+	client.logger().Info("Password reset", "account", user)
+	server.auditClient(AUDIT_PASSWORD_RESET, client, user, "")
+	client.messages <- fmt.Sprintf("*** Set a new password for %s: /login %s <password> ***", user, user)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Bracketed paste markers sent by terminals (xterm "paste mode")
+const (
+	PASTE_START = "\x1b[200~"
+	PASTE_END   = "\x1b[201~"
+
+	BRACKETED_PASTE_ON  = "\x1b[?2004h"
+	BRACKETED_PASTE_OFF = "\x1b[?2004l"
+
+	MAX_PASTE_LINES = 200
+)
+
+// pasteBuffer collects the lines of a multi-line paste. It is only touched
+// from the client's readPump.
+type pasteBuffer struct {
+	active    bool
+	bracketed bool
+	fenced    bool
+	lines     []string
+}
+
+// pasteLine feeds a raw input line through paste mode. It reports whether
+// the line was consumed, and returns the collected block once the paste is
+// closed, either by /endpaste, the terminal's end-of-paste marker, or the
+// closing ``` of a code block typed line by line.
+func (client *Client) pasteLine(line string) (string, bool) {
+	paste := &client.paste
+
+	if !paste.active {
+		switch {
+		case strings.TrimSpace(line) == "/paste":
+			paste.active = true
+			paste.lines = nil
+			client.messages <- "*** Paste mode: send your text, then /endpaste on its own line ***"
+			return "", true
+		case strings.HasPrefix(line, PASTE_START):
+			line = strings.TrimPrefix(line, PASTE_START)
+			if end := strings.Index(line, PASTE_END); end >= 0 {
+				return line[:end], true
+			}
+			paste.active = true
+			paste.bracketed = true
+			paste.lines = []string{line}
+			return "", true
+		case strings.HasPrefix(strings.TrimSpace(line), CODE_FENCE):
+			rest := strings.TrimPrefix(strings.TrimSpace(line), CODE_FENCE)
+			if strings.Contains(rest, CODE_FENCE) {
+				return "", false
+			}
+			paste.active = true
+			paste.fenced = true
+			paste.lines = []string{line}
+			return "", true
+		}
+		return "", false
+	}
+
+	if paste.fenced {
+		if strings.TrimSpace(line) == CODE_FENCE {
+			paste.lines = append(paste.lines, line)
+			return client.finishPaste(), true
+		}
+	} else if paste.bracketed {
+		if end := strings.Index(line, PASTE_END); end >= 0 {
+			paste.lines = append(paste.lines, line[:end])
+			return client.finishPaste(), true
+		}
+	} else if strings.TrimSpace(line) == "/endpaste" {
+		return client.finishPaste(), true
+	}
+
+	paste.lines = append(paste.lines, line)
+	if len(paste.lines) >= MAX_PASTE_LINES {
+		client.messages <- fmt.Sprintf("*** Paste cut off at %d lines ***", MAX_PASTE_LINES)
+		return client.finishPaste(), true
+	}
+	return "", true
+}
+
+func (client *Client) finishPaste() string {
+	lines := client.paste.lines
+	client.paste = pasteBuffer{}
+
+	// Drop blank lines around the block
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Presence. Users are online unless they say otherwise with /away, /busy
+// or /invisible; /back makes them online again. With --auto-away, users
+// who send nothing for that long are marked away until they next do.
+// Changes go to everyone on the server, as presence frames for JSON
+// clients. Invisible users are left out of /who and /whois, except for
+// admins, and everyone else is told they went offline.
+const (
+	PRESENCE_ONLINE    = "online"
+	PRESENCE_AWAY      = "away"
+	PRESENCE_BUSY      = "busy"
+	PRESENCE_INVISIBLE = "invisible"
+
+	// What invisible users appear as
+	PRESENCE_OFFLINE = "offline"
+
+	// Tag for presence changes: the tag's ID is the presence and the text
+	// the reason
+	TAG_PRESENCE = "presence"
+
+	// Reason given for users marked away by --auto-away, and the longest
+	// one users can give
+	AUTO_AWAY_REASON = "idle"
+	MAX_AWAY_REASON  = 100
+)
+
+// presence returns the client's presence and the reason for it.
+func (client *Client) presence() (string, string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.status == "" {
+		return PRESENCE_ONLINE, ""
+	}
+	return client.status, client.awayReason
+}
+
+// presenceFor is the client's presence as viewer sees it.
+func (client *Client) presenceFor(viewer *Client) (string, string) {
+	status, reason := client.presence()
+	if status == PRESENCE_INVISIBLE && viewer != client && !viewer.atLeast(ROLE_ADMIN) {
+		return PRESENCE_OFFLINE, ""
+	}
+	return status, reason
+}
+
+// describePresence shows a presence and its reason, like "away (lunch)".
+func describePresence(status, reason string) string {
+	if reason == "" {
+		return status
+	}
+	return fmt.Sprintf("%s (%s)", status, reason)
+}
+
+// presenceText describes a presence change for text clients.
+func presenceText(tag messageTag, reason string) string {
+	switch {
+	case tag.id == PRESENCE_ONLINE:
+		return fmt.Sprintf("*** %s is back ***", tag.from)
+	case tag.id == PRESENCE_OFFLINE:
+		return fmt.Sprintf("*** %s has gone offline ***", tag.from)
+	case reason != "":
+		return fmt.Sprintf("*** %s is %s: %s ***", tag.from, tag.id, reason)
+	}
+	return fmt.Sprintf("*** %s is %s ***", tag.from, tag.id)
+}
+
+// setPresence changes a client's presence and tells everyone, unless it
+// hasn't changed. auto says the change was made by --auto-away.
+func (server *ChatServer) setPresence(client *Client, status, reason string, auto bool) {
+	client.mutex.Lock()
+	previous := client.status
+	if previous == "" {
+		previous = PRESENCE_ONLINE
+	}
+	if previous == status && client.awayReason == reason {
+		client.mutex.Unlock()
+		return
+	}
+	client.status, client.awayReason, client.autoAway = status, reason, auto
+	client.mutex.Unlock()
+	client.logger().Info("Presence changed", "presence", status, "reason", reason)
+
+	// Others are only told an invisible user went offline
+	shown := status
+	if status == PRESENCE_INVISIBLE {
+		shown = PRESENCE_OFFLINE
+	}
+	server.notify("", tagMessage(messageTag{kind: TAG_PRESENCE, id: shown, from: client.name()}, reason))
+}
+
+// handlePresenceCommand implements "/away [reason]", "/busy [reason]",
+// "/invisible" and "/back".
+func (server *ChatServer) handlePresenceCommand(client *Client, message string) {
+	command, reason, _ := strings.Cut(message, " ")
+	reason = strings.TrimSpace(reason)
+	status := strings.TrimPrefix(command, "/")
+	if command == "/back" {
+		status = PRESENCE_ONLINE
+	}
+	if status == PRESENCE_ONLINE || status == PRESENCE_INVISIBLE {
+		reason = ""
+	}
+	if current, _ := client.presence(); current == status && status == PRESENCE_ONLINE {
+		client.messages <- "*** You aren't away ***"
+		return
+	}
+	if len(reason) > MAX_AWAY_REASON {
+		client.messages <- fmt.Sprintf("*** Keep the reason under %d characters ***", MAX_AWAY_REASON)
+		return
+	}
+	server.setPresence(client, status, reason, false)
+	if status == PRESENCE_INVISIBLE {
+		client.messages <- "*** You are invisible: others see you as offline ***"
+	}
+}
+
+// noticeActivity is called when a client sends something, and brings it
+// back if --auto-away marked it away.
+func (server *ChatServer) noticeActivity(client *Client) {
+	client.mutex.Lock()
+	auto := client.autoAway
+	client.mutex.Unlock()
+	if auto {
+		server.setPresence(client, PRESENCE_ONLINE, "", false)
+	}
+}
+
+// startAutoAway marks idle clients away, if --auto-away is set, until ctx
+// is cancelled.
+func (server *ChatServer) startAutoAway(ctx context.Context) {
+	after := server.config.AutoAway
+	if after <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(min(max(after/4, time.Second), time.Minute))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			server.mutex.RLock()
+			var idle []*Client
+			for client := range server.clients {
+				if status, _ := client.presence(); status == PRESENCE_ONLINE && client.idle() >= after {
+					idle = append(idle, client)
+				}
+			}
+			server.mutex.RUnlock()
+			for _, client := range idle {
+				server.setPresence(client, PRESENCE_AWAY, AUTO_AWAY_REASON, true)
+			}
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+package server
+
+// Delivery priorities, highest first. Each client has a queue per level and
+// writePump always empties the higher ones first, so when a client falls
+// behind, kick notices and announcements still reach it and room chatter is
+// what gets dropped.
+const (
+	PRIORITY_SYSTEM  = iota // server, admin and moderation notices
+	PRIORITY_DIRECT         // messages addressed to one user
+	PRIORITY_CHATTER        // room traffic: chat, joins, leaves, renames and user lists
+
+	// Capacity of the system and direct queues; chatter uses the client's
+	// main message queue
+	PRIORITY_QUEUE_SIZE = 64
+)
+
+// queue returns the client's channel for a priority level.
+func (client *Client) queue(priority int) chan string {
+	switch priority {
+	case PRIORITY_SYSTEM:
+		return client.urgent
+	case PRIORITY_DIRECT:
+		return client.direct
+	}
+	return client.messages
+}
+
+// deliver queues a message without blocking and reports whether there was
+// room for it.
+func (client *Client) deliver(message string, priority int) bool {
+	select {
+	case client.queue(priority) <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// next waits for the client's next message, taking the highest priority one
+// available. It reports false once the client has been closed and the
+// higher priority queues are empty.
+func (client *Client) next() (string, bool) {
+	select {
+	case message := <-client.urgent:
+		return message, true
+	default:
+	}
+
+	select {
+	case message := <-client.urgent:
+		return message, true
+	case message := <-client.direct:
+		return message, true
+	default:
+	}
+
+	select {
+	case message := <-client.urgent:
+		return message, true
+	case message := <-client.direct:
+		return message, true
+	case message, ok := <-client.messages:
+		return message, ok
+	}
+}
+
+// queued is the number of messages waiting for the client at all levels.
+func (client *Client) queued() int {
+	return len(client.urgent) + len(client.direct) + len(client.messages)
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol. Behind HAProxy or a load balancer every connection seems
+// to come from the proxy, so logs, bans and the per-address limit would all
+// see the one address. --proxy-protocol lists the proxies; connections from
+// them must start with a PROXY protocol header, version 1 (text) or 2
+// (binary), and the client address in it is used from then on. Connections
+// from anywhere else are taken as they are, so a client can't claim another
+// address by sending a header itself. It applies to --listen, --tls-listen
+// and the WebSocket port; the header comes before any TLS.
+const (
+	PROXY_HEADER_TIMEOUT = 5 * time.Second
+	PROXY_V1_MAX_LENGTH  = 107 // longest version 1 header, "\r\n" included
+)
+
+// Start of every version 2 header
+var PROXY_V2_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyList is the addresses allowed to send PROXY headers.
+type proxyList []*net.IPNet
+
+// parseProxies reads a comma-separated list of IP addresses and CIDR
+// ranges.
+func parseProxies(value string) (proxyList, error) {
+	var proxies proxyList
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", field)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", field)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// trusts reports whether a connection from addr is from one of the proxies.
+func (proxies proxyList) trusts(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxied wraps a listener so connections from the configured proxies
+// read their PROXY header, or returns it as it is if there are none.
+func (server *ChatServer) proxied(listener net.Listener) net.Listener {
+	// The list was checked when the configuration was loaded
+	proxies, _ := parseProxies(server.config.ProxyProtocol)
+	if len(proxies) == 0 {
+		return listener
+	}
+	return &proxyListener{listener, proxies}
+}
+
+// proxyListener hands out connections from its proxies as proxyConns.
+type proxyListener struct {
+	net.Listener
+	proxies proxyList
+}
+
+func (listener *proxyListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil || !listener.proxies.trusts(conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+// proxyConn is a connection from a proxy. Its header is read the first
+// time it is read from or asked for its address, which happens on the
+// goroutine serving it rather than the one accepting connections.
+type proxyConn struct {
+	net.Conn
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr // the client's, or the proxy's if the header has none
+	err    error
+}
+
+func (conn *proxyConn) header() error {
+	conn.once.Do(func() {
+		conn.reader = bufio.NewReader(conn.Conn)
+		conn.remote = conn.Conn.RemoteAddr()
+		conn.Conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+		remote, err := readProxyHeader(conn.reader)
+		conn.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			slog.Warn("Bad PROXY protocol header", "proxy", conn.remote.String(), "err", err)
+			conn.err = fmt.Errorf("PROXY protocol header: %v", err)
+			return
+		}
+		if remote != nil {
+			conn.remote = remote
+		}
+	})
+	return conn.err
+}
+
+func (conn *proxyConn) Read(p []byte) (int, error) {
+	if err := conn.header(); err != nil {
+		return 0, err
+	}
+	return conn.reader.Read(p)
+}
+
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	conn.header()
+	return conn.remote
+}
+
+// readProxyHeader reads a version 1 or 2 header and returns the client
+// address in it, or nil for headers that don't give one, like the
+// health checks proxies send for themselves.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	start, err := reader.Peek(len(PROXY_V2_SIGNATURE))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, PROXY_V2_SIGNATURE):
+		return readProxyV2(reader)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(reader)
+	}
+	return nil, errors.New("missing")
+}
+
+// readProxyV1 reads "PROXY TCP4|TCP6 <source> <destination> <source port>
+// <destination port>\r\n", or "PROXY UNKNOWN ...\r\n".
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil || len(line) > PROXY_V1_MAX_LENGTH || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("version 1 header isn't a line of at most 107 bytes")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed version 1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("bad source address %s port %s", fields[2], fields[4])
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); net.ParseIP(fields[3]) == nil || err != nil {
+		return nil, fmt.Errorf("bad destination address %s port %s", fields[3], fields[5])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header: the signature, the version and
+// command, the address family and protocol, the length of the rest, then
+// the addresses and any extensions, which are skipped.
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(PROXY_V2_SIGNATURE)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+
+	switch versionCommand & 0x0F {
+	case 0: // LOCAL: the proxy's own connection
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unknown command %d", versionCommand&0x0F)
+	}
+	switch family >> 4 {
+	case 1: // IPv4: source, destination, source port, destination port
+		if len(body) < 12 {
+			return nil, errors.New("short IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2: // IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// Unspecified or Unix addresses say nothing about the client
+	return nil, nil
+}
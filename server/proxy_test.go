@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a version 2 header with a version and command byte, an
+// address family byte and a body.
+func proxyV2(versionCommand, family byte, body []byte) []byte {
+	header := append([]byte{}, PROXY_V2_SIGNATURE...)
+	header = append(header, versionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+// proxyV2Addresses is the body of a version 2 header for a connection from
+// source to destination.
+func proxyV2Addresses(source, destination string, sourcePort, destinationPort uint16) []byte {
+	sourceIP, destinationIP := net.ParseIP(source), net.ParseIP(destination)
+	if ip := sourceIP.To4(); ip != nil {
+		sourceIP, destinationIP = ip, destinationIP.To4()
+	}
+	body := append(append([]byte{}, sourceIP...), destinationIP...)
+	body = binary.BigEndian.AppendUint16(body, sourcePort)
+	return binary.BigEndian.AppendUint16(body, destinationPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := proxyV2Addresses("203.0.113.7", "192.0.2.1", 51000, 6667)
+	ipv6 := proxyV2Addresses("2001:db8::7", "2001:db8::1", 51000, 6667)
+
+	tests := []struct {
+		name   string
+		in     []byte
+		remote string // "" if the header gives no address
+		fails  bool
+	}{
+		{
+			name:   "version 1 TCP4",
+			in:     []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 6667\r\n"),
+			remote: "203.0.113.7:51000",
+		},
+		{
+			name:   "version 1 TCP6",
+			in:     []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 6667\r\n"),
+			remote: "[2001:db8::7]:51000",
+		},
+		{
+			name: "version 1 UNKNOWN",
+			in:   []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name: "version 1 UNKNOWN with addresses",
+			in:   []byte("PROXY UNKNOWN 203.0.113.7 192.0.2.1 51000 6667\r\n"),
+		},
+		{
+			name:  "version 1 without CRLF",
+			in:    []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 6667\n"),
+			fails: true,
+		},
+		{
+			name:  "version 1 running into the data",
+			in:    []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 6667"),
+			fails: true,
+		},
+		{
+			name:  "version 1 too long",
+			in:    []byte("PROXY TCP6 " + strings.Repeat("f", PROXY_V1_MAX_LENGTH) + "\r\n"),
+			fails: true,
+		},
+		{
+			name:  "version 1 with a field missing",
+			in:    []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000\r\n"),
+			fails: true,
+		},
+		{
+			name:  "version 1 with an unknown protocol",
+			in:    []byte("PROXY UDP4 203.0.113.7 192.0.2.1 51000 6667\r\n"),
+			fails: true,
+		},
+		{
+			name:  "version 1 with a bad address",
+			in:    []byte("PROXY TCP4 203.0.113.300 192.0.2.1 51000 6667\r\n"),
+			fails: true,
+		},
+		{
+			name:  "version 1 with a bad destination",
+			in:    []byte("PROXY TCP4 203.0.113.7 192.0.2 51000 6667\r\n"),
+			fails: true,
+		},
+		{
+			name:  "version 1 with a bad port",
+			in:    []byte("PROXY TCP4 203.0.113.7 192.0.2.1 70000 6667\r\n"),
+			fails: true,
+		},
+		{
+			name:   "version 2 IPv4",
+			in:     proxyV2(0x21, 0x11, ipv4),
+			remote: "203.0.113.7:51000",
+		},
+		{
+			name:   "version 2 IPv6",
+			in:     proxyV2(0x21, 0x21, ipv6),
+			remote: "[2001:db8::7]:51000",
+		},
+		{
+			name:   "version 2 extensions are skipped",
+			in:     proxyV2(0x21, 0x11, append(append([]byte{}, ipv4...), 0x04, 0x00, 0x01, 0xAA)),
+			remote: "203.0.113.7:51000",
+		},
+		{
+			name: "version 2 LOCAL",
+			in:   proxyV2(0x20, 0x00, nil),
+		},
+		{
+			name: "version 2 unspecified family",
+			in:   proxyV2(0x21, 0x00, nil),
+		},
+		{
+			name: "version 2 Unix addresses",
+			in:   proxyV2(0x21, 0x31, make([]byte, 216)),
+		},
+		{
+			name:  "version 2 with another version",
+			in:    proxyV2(0x11, 0x11, ipv4),
+			fails: true,
+		},
+		{
+			name:  "version 2 with an unknown command",
+			in:    proxyV2(0x22, 0x11, ipv4),
+			fails: true,
+		},
+		{
+			name:  "version 2 with short IPv4 addresses",
+			in:    proxyV2(0x21, 0x11, ipv4[:8]),
+			fails: true,
+		},
+		{
+			name:  "version 2 with short IPv6 addresses",
+			in:    proxyV2(0x21, 0x21, ipv6[:20]),
+			fails: true,
+		},
+		{
+			name:  "version 2 cut short",
+			in:    proxyV2(0x21, 0x11, ipv4)[:20],
+			fails: true,
+		},
+		{
+			name:  "no header",
+			in:    []byte("Enter your username: alice\r\n"),
+			fails: true,
+		},
+		{
+			name:  "connection closed early",
+			in:    []byte("PROXY"),
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		// What follows the header is left for the client's session
+		reader := bufio.NewReader(bytes.NewReader(join(test.in, []byte("hello\r\n"))))
+		remote, err := readProxyHeader(reader)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: error %v, want failure %v", test.name, err, test.fails)
+			continue
+		}
+		if test.fails {
+			continue
+		}
+		got := ""
+		if remote != nil {
+			got = remote.String()
+		}
+		if got != test.remote {
+			t.Errorf("%s: remote %q, want %q", test.name, got, test.remote)
+		}
+		if rest, _ := io.ReadAll(reader); string(rest) != "hello\r\n" {
+			t.Errorf("%s: left %q after the header", test.name, rest)
+		}
+	}
+}
+
+func TestParseProxies(t *testing.T) {
+	tests := []struct {
+		value   string
+		trusted []string
+		refused []string
+		fails   bool
+	}{
+		{value: ""},
+		{value: "127.0.0.1", trusted: []string{"127.0.0.1"}, refused: []string{"127.0.0.2", "::1"}},
+		{value: "10.0.0.0/8, ::1", trusted: []string{"10.1.2.3", "::1"}, refused: []string{"11.0.0.1", "::2"}},
+		{value: "2001:db8::/32", trusted: []string{"2001:db8::7"}, refused: []string{"2001:db9::7", "203.0.113.7"}},
+		{value: "proxy.example", fails: true},
+		{value: "10.0.0.0/33", fails: true},
+		{value: "127.0.0.1,", trusted: []string{"127.0.0.1"}},
+	}
+	for _, test := range tests {
+		proxies, err := parseProxies(test.value)
+		if (err != nil) != test.fails {
+			t.Errorf("%q: error %v, want failure %v", test.value, err, test.fails)
+			continue
+		}
+		for _, ip := range test.trusted {
+			if !proxies.trusts(&net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}) {
+				t.Errorf("%q doesn't trust %s", test.value, ip)
+			}
+		}
+		for _, ip := range test.refused {
+			if proxies.trusts(&net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}) {
+				t.Errorf("%q trusts %s", test.value, ip)
+			}
+		}
+	}
+	proxies, _ := parseProxies("0.0.0.0/0")
+	if proxies.trusts(&net.UnixAddr{Name: "/tmp/chat.sock", Net: "unix"}) {
+		t.Errorf("trusts a Unix socket")
+	}
+}
+
+// TestProxyListener connects through a listener that trusts loopback, or
+// doesn't, and checks what the server then sees.
+func TestProxyListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies string
+		in      string
+		remote  string // "" for the connection's own address
+		data    string
+		fails   bool
+	}{
+		{
+			name:    "trusted proxy",
+			proxies: "127.0.0.0/8",
+			in:      "PROXY TCP4 203.0.113.7 192.0.2.1 51000 6667\r\nhello\r\n",
+			remote:  "203.0.113.7:51000",
+			data:    "hello\r\n",
+		},
+		{
+			name:    "trusted proxy's health check",
+			proxies: "127.0.0.0/8",
+			in:      "PROXY UNKNOWN\r\nhello\r\n",
+			data:    "hello\r\n",
+		},
+		{
+			name:    "trusted proxy without a header",
+			proxies: "127.0.0.0/8",
+			in:      "hello, I'm 203.0.113.7\r\n",
+			fails:   true,
+		},
+		{
+			name:    "trusted proxy with a malformed header",
+			proxies: "127.0.0.0/8",
+			in:      "PROXY TCP4 somewhere 192.0.2.1 51000 6667\r\nhello\r\n",
+			fails:   true,
+		},
+		{
+			name:    "untrusted source sending a header",
+			proxies: "10.0.0.0/8",
+			in:      "PROXY TCP4 203.0.113.7 192.0.2.1 51000 6667\r\nhello\r\n",
+			data:    "PROXY TCP4 203.0.113.7 192.0.2.1 51000 6667\r\nhello\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxies, err := parseProxies(test.proxies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := &proxyListener{inner, proxies}
+
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(client, test.in)
+		client.Close()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote := conn.RemoteAddr().String()
+		data, err := io.ReadAll(conn)
+		conn.Close()
+		listener.Close()
+
+		if (err != nil) != test.fails {
+			t.Errorf("%s: error %v, want failure %v", test.name, err, test.fails)
+		}
+		if test.remote == "" {
+			test.remote = client.LocalAddr().String()
+		}
+		if remote != test.remote {
+			t.Errorf("%s: remote %s, want %s", test.name, remote, test.remote)
+		}
+		if string(data) != test.data {
+			t.Errorf("%s: read %q, want %q", test.name, data, test.data)
+		}
+	}
+}
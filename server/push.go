@@ -0,0 +1,258 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Push notifications for registered users who are away. With --push-url
+// set, a private message left as mail for an account, or an @mention of it
+// in a room it could join, while nobody is logged in to it is POSTed to a
+// push gateway as a PushNotification listing the account's devices. The
+// gateway passes it on to FCM, APNs or the browser's push service,
+// whichever each device's platform is, so the server holds no credentials
+// for them. Deliveries go through a queue like webhooks' (under
+// PUSH_QUEUE_DIR, signed with --push-secret) and "chatd deadletters --dir
+// push-queue" shows the ones that failed. Apps register their device with
+// "/push add <platform> <token>", saved with the account; "/push off"
+// stops notifications without forgetting the devices.
+const (
+	PUSH_QUEUE_DIR   = "push-queue"
+	MAX_PUSH_DEVICES = 10
+	MAX_PUSH_TOKEN   = 4096
+	PUSH_PREVIEW     = 200 // characters of the message in a notification
+
+	// Kinds of notification
+	PUSH_DM      = "dm"
+	PUSH_MENTION = "mention"
+)
+
+// Platforms a device can be on
+var PUSH_PLATFORMS = map[string]bool{
+	"fcm":  true,
+	"apns": true,
+	"web":  true,
+}
+
+// PushOptions says where to send push notifications.
+type PushOptions struct {
+	URL    string
+	Secret string
+}
+
+func (options *PushOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.URL, "push-url", options.URL, "push gateway to POST notifications to for users who are away, e.g. https://push.example.com/notify (empty for none)")
+	flags.StringVar(&options.Secret, "push-secret", options.Secret, "key for signing push notifications with HMAC-SHA256 (empty for unsigned)")
+}
+
+func (options *PushOptions) validate() error {
+	if options.URL == "" {
+		return nil
+	}
+	location, err := url.Parse(options.URL)
+	if err != nil || (location.Scheme != "http" && location.Scheme != "https") || location.Host == "" {
+		return fmt.Errorf("push_url %q isn't an http or https URL", options.URL)
+	}
+	return nil
+}
+
+// PushDevice is a device registered for an account's notifications.
+type PushDevice struct {
+	Platform string    `json:"platform"`
+	Token    string    `json:"token"`
+	AddedAt  time.Time `json:"added_at"`
+}
+
+// PushSettings are an account's devices, and whether it has turned
+// notifications off.
+type PushSettings struct {
+	Devices []PushDevice `json:"devices,omitempty"`
+	Off     bool         `json:"off,omitempty"`
+}
+
+// PushNotification is what the push gateway is sent.
+type PushNotification struct {
+	Type    string       `json:"type"` // PUSH_DM or PUSH_MENTION
+	Account string       `json:"account"`
+	From    string       `json:"from"`
+	Room    string       `json:"room,omitempty"` // for mentions
+	Text    string       `json:"text"`
+	Time    time.Time    `json:"time"`
+	Devices []PushDevice `json:"devices"`
+}
+
+// pushAway queues a notification for an account if nobody is logged in to
+// it and it has devices to send it to.
+func (server *ChatServer) pushAway(kind, account, from, room, text string) {
+	if server.push == nil || len(server.findClients(account)) > 0 {
+		return
+	}
+	name, settings := server.accounts.Push(account)
+	if settings.Off || len(settings.Devices) == 0 {
+		return
+	}
+	if runes := []rune(text); len(runes) > PUSH_PREVIEW {
+		text = string(runes[:PUSH_PREVIEW-1]) + "…"
+	}
+	payload, err := json.Marshal(PushNotification{
+		Type:    kind,
+		Account: name,
+		From:    from,
+		Room:    room,
+		Text:    text,
+		Time:    time.Now(),
+		Devices: settings.Devices,
+	})
+	if err == nil {
+		err = server.push.Enqueue(server.config.Push.URL, payload)
+	}
+	if err != nil {
+		slog.Error("Error queueing push notification", "account", name, "err", err)
+		return
+	}
+	slog.Debug("Push notification queued", "type", kind, "account", name, "from", from)
+}
+
+// pushMentions notifies the accounts a chat message mentions, if they are
+// away and could read the room.
+func (server *ChatServer) pushMentions(client *Client, room, text string) {
+	if server.push == nil {
+		return
+	}
+	for _, name := range mentionedNames(text) {
+		if !strings.EqualFold(name, client.name()) && server.roomOpenTo(name, room) {
+			server.pushAway(PUSH_MENTION, name, client.name(), room, text)
+		}
+	}
+}
+
+// mentionedNames returns the names text mentions with @, once each and
+// lowercased, taking a name to run as far as mentions does.
+func mentionedNames(text string) []string {
+	var names []string
+	for _, field := range strings.Split(strings.ToLower(text), "@")[1:] {
+		end := strings.IndexFunc(field, func(r rune) bool {
+			return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-')
+		})
+		if end < 0 {
+			end = len(field)
+		}
+		if name := field[:end]; utf8.RuneCountInString(name) >= MIN_NAME_LENGTH && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// roomOpenTo reports whether an account could join a room without a
+// password, so telling it what was said there gives nothing away.
+func (server *ChatServer) roomOpenTo(account, room string) bool {
+	settings, ok := server.roomStore.Get(room)
+	key := strings.ToLower(account)
+	return !ok || (!settings.InviteOnly && !settings.hasPassword()) || settings.Owner == key || slices.Contains(settings.Invited, key)
+}
+
+// handlePushCommand implements "/push [on | off | add <platform> <token> |
+// del <number>]".
+func (server *ChatServer) handlePushCommand(client *Client, message string) {
+	const usage = "*** Usage: /push [on | off | add <fcm|apns|web> <token> | del <number>] ***"
+	if server.push == nil {
+		client.messages <- "*** This server doesn't send push notifications ***"
+		return
+	}
+	account := client.loggedInAs()
+	if account == "" {
+		client.messages <- "*** Devices are saved with your account: /register or /login first ***"
+		return
+	}
+	fields := strings.Fields(message)
+
+	switch {
+	case len(fields) == 1:
+		_, settings := server.accounts.Push(account)
+		state := "on"
+		if settings.Off {
+			state = "off (/push on to turn them back on)"
+		}
+		lines := []string{fmt.Sprintf("--- Push notifications for %s: %s ---", account, state)}
+		for i, device := range settings.Devices {
+			token := device.Token
+			if len(token) > 16 {
+				token = token[:16] + "..."
+			}
+			lines = append(lines, fmt.Sprintf("  %d. %s %s (added %s)", i+1, device.Platform, token, device.AddedAt.Local().Format("Jan 2 2006")))
+		}
+		if len(settings.Devices) == 0 {
+			lines = append(lines, "  (no devices; apps add theirs with /push add)")
+		}
+		client.messages <- strings.Join(lines, "\n")
+
+	case len(fields) == 2 && (fields[1] == "on" || fields[1] == "off"):
+		off := fields[1] == "off"
+		err := server.accounts.UpdatePush(account, func(settings *PushSettings) error {
+			settings.Off = off
+			return nil
+		})
+		if err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		client.logger().Info("Push notifications changed", "account", account, "off", off)
+		if off {
+			client.messages <- "*** Push notifications off; your devices are kept ***"
+		} else {
+			client.messages <- "*** Push notifications on: mentions and private messages reach your devices while you're away ***"
+		}
+
+	case len(fields) == 4 && fields[1] == "add":
+		platform, token := strings.ToLower(fields[2]), fields[3]
+		if !PUSH_PLATFORMS[platform] {
+			client.messages <- fmt.Sprintf("*** Unknown platform %q: use fcm, apns or web ***", fields[2])
+			return
+		}
+		if len(token) > MAX_PUSH_TOKEN {
+			client.messages <- fmt.Sprintf("*** Device tokens can be at most %d bytes ***", MAX_PUSH_TOKEN)
+			return
+		}
+		if err := server.accounts.AddPushDevice(account, PushDevice{Platform: platform, Token: token, AddedAt: time.Now()}); err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		client.logger().Info("Push device added", "account", account, "platform", platform)
+		client.messages <- fmt.Sprintf("*** Added your %s device; it's notified of mentions and private messages while you're away ***", platform)
+
+	case len(fields) == 3 && fields[1] == "del":
+		number, err := strconv.Atoi(fields[2])
+		if err != nil || number < 1 {
+			client.messages <- usage
+			return
+		}
+		var removed PushDevice
+		err = server.accounts.UpdatePush(account, func(settings *PushSettings) error {
+			if number > len(settings.Devices) {
+				return fmt.Errorf("no device %d; /push lists them", number)
+			}
+			removed = settings.Devices[number-1]
+			settings.Devices = slices.Delete(slices.Clone(settings.Devices), number-1, number)
+			return nil
+		})
+		if err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		client.logger().Info("Push device removed", "account", account, "platform", removed.Platform)
+		client.messages <- fmt.Sprintf("*** Removed device %d ***", number)
+
+	default:
+		client.messages <- usage
+	}
+}
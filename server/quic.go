@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"time"
+)
+
+// QUIC listener, experimental. Built in with -tags quic and served over UDP
+// on --quic-listen, with the certificate from --quic-cert and --quic-key
+// or else the TLS listener's; clients ask for the QUIC_ALPN protocol. Each connection opens one
+// bidirectional stream, which carries the chat protocol as a TCP
+// connection does: JSON clients send a hello frame first. A QUIC
+// connection survives its client changing address, as phones do moving
+// between networks, and a new one takes a single round trip.
+const (
+	QUIC_ALPN = "chat"
+
+	// How long a client has to open its stream, and how long a closed
+	// stream has to deliver what's left before the connection goes
+	QUIC_STREAM_TIMEOUT = 10 * time.Second
+	QUIC_CLOSE_TIMEOUT  = 5 * time.Second
+
+	// How often an idle connection is kept alive, well inside quic-go's
+	// 30 second idle timeout
+	QUIC_KEEPALIVE = 15 * time.Second
+)
+
+// serveQUIC serves chat over QUIC until ctx is cancelled. It is nil unless
+// the server was built with -tags quic.
+var serveQUIC func(ctx context.Context, server *ChatServer) error
+
+var errNoQUIC = errors.New("chatd was built without QUIC; rebuild with -tags quic")
+
+// startQUIC listens on --quic-listen.
+func (server *ChatServer) startQUIC(ctx context.Context) error {
+	if serveQUIC == nil {
+		return errNoQUIC
+	}
+	return serveQUIC(ctx, server)
+}
+
+// quicTLS returns the QUIC listener's TLS settings.
+func (config *Config) quicTLS() (*tls.Config, error) {
+	options := config.TLS
+	if config.QUICCert != "" || config.QUICKey != "" {
+		options = TLSOptions{CertFile: config.QUICCert, KeyFile: config.QUICKey, ClientAuth: "none"}
+	}
+	tlsConfig, err := options.config()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.NextProtos = []string{QUIC_ALPN}
+	return tlsConfig, nil
+}
@@ -0,0 +1,86 @@
+//go:build quic
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func init() {
+	serveQUIC = func(ctx context.Context, server *ChatServer) error {
+		tlsConfig, err := server.config.quicTLS()
+		if err != nil {
+			return fmt.Errorf("setting up TLS: %v", err)
+		}
+		listener, err := quic.ListenAddr(server.config.QUICListen, tlsConfig, &quic.Config{KeepAlivePeriod: QUIC_KEEPALIVE})
+		if err != nil {
+			return err
+		}
+		context.AfterFunc(ctx, func() { listener.Close() })
+		fmt.Printf("Listening on %s (QUIC, experimental)\n", listener.Addr())
+		go server.acceptQUIC(ctx, listener)
+		return nil
+	}
+}
+
+// acceptQUIC takes connections until ctx is cancelled, serving each one's
+// stream like a TCP connection.
+func (server *ChatServer) acceptQUIC(ctx context.Context, listener *quic.Listener) {
+	for {
+		connection, err := listener.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
+				return
+			}
+			slog.Error("Error accepting QUIC connection", "err", err)
+			continue
+		}
+		go func() {
+			streamCtx, cancel := context.WithTimeout(ctx, QUIC_STREAM_TIMEOUT)
+			stream, err := connection.AcceptStream(streamCtx)
+			cancel()
+			if err != nil {
+				connection.CloseWithError(0, "no stream opened")
+				return
+			}
+			conn := &quicConn{Stream: stream, connection: connection}
+			if server.admit(conn) {
+				server.handleClient(ctx, server.trackConn(conn))
+			}
+		}()
+	}
+}
+
+// quicConn is a QUIC connection's stream as a net.Conn.
+type quicConn struct {
+	*quic.Stream
+	connection *quic.Conn
+}
+
+func (conn *quicConn) LocalAddr() net.Addr  { return conn.connection.LocalAddr() }
+func (conn *quicConn) RemoteAddr() net.Addr { return conn.connection.RemoteAddr() }
+
+// passesBinary lets the stream carry CBOR frames.
+func (conn *quicConn) passesBinary() {}
+
+// Close ends the stream and, once the client has what was written or
+// QUIC_CLOSE_TIMEOUT has passed, the connection.
+func (conn *quicConn) Close() error {
+	conn.CancelRead(0)
+	err := conn.Stream.Close()
+	go func() {
+		select {
+		case <-conn.connection.Context().Done():
+		case <-time.After(QUIC_CLOSE_TIMEOUT):
+			conn.connection.CloseWithError(0, "")
+		}
+	}()
+	return err
+}
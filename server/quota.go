@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Inbound bandwidth quotas in KB per minute, by role (0 means unlimited).
+// Clients logged in to an account are users (or moderators or admins),
+// everyone else is a guest.
+var BANDWIDTH_QUOTAS = map[string]int{
+	ROLE_GUEST:     64,
+	ROLE_USER:      256,
+	ROLE_MODERATOR: 1024,
+	ROLE_ADMIN:     0,
+}
+
+const DEFAULT_ROLE = ROLE_GUEST
+
+// A client over its quota is slowed down to the quota rate. If it keeps
+// sending until it is this far behind, it is disconnected.
+const QUOTA_MAX_DEBT = time.Minute
+
+var errQuotaExceeded = errors.New("bandwidth quota exceeded")
+
+// quotaBucket is a token bucket holding up to a minute's worth of bytes.
+type quotaBucket struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	throttled time.Duration
+}
+
+func newQuotaBucket(kbPerMinute int) *quotaBucket {
+	if kbPerMinute <= 0 {
+		return nil
+	}
+	burst := float64(kbPerMinute * 1024)
+	return &quotaBucket{
+		rate:   burst / 60,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// take charges n bytes to the bucket and returns how long the reader should
+// wait to get back within its quota.
+func (bucket *quotaBucket) take(n int) time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	now := time.Now()
+	bucket.tokens = min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// throttle sleeps off any debt after reading n bytes, and fails once the
+// debt is more than QUOTA_MAX_DEBT.
+func (bucket *quotaBucket) throttle(n int) error {
+	if bucket == nil {
+		return nil
+	}
+	wait := bucket.take(n)
+	if wait > QUOTA_MAX_DEBT {
+		return errQuotaExceeded
+	}
+	if wait > 0 {
+		bucket.mutex.Lock()
+		bucket.throttled += wait
+		bucket.mutex.Unlock()
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+// throttledFor returns the total time spent throttled.
+func (bucket *quotaBucket) throttledFor() time.Duration {
+	if bucket == nil {
+		return 0
+	}
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	return bucket.throttled
+}
+
+// role returns the client's role, which sets its quota and what it may do.
+func (client *Client) role() string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.account == "" {
+		return DEFAULT_ROLE
+	}
+	return client.accountRole
+}
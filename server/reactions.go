@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Reactions. "/react <id> <emoji>" (or a react frame) adds the user's
+// reaction to a recent message, or takes it back if they already reacted
+// with that emoji, and the room is sent the message's new totals. Emotes
+// can be used as reactions by their :shortcode:. Text clients see message
+// IDs after "/ids on".
+const (
+	CHANGE_REACT = "react"
+
+	MAX_REACTION_LENGTH = 32 // bytes, after emotes are expanded
+)
+
+// reactionCount is how many users reacted to a message with one emoji.
+type reactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+}
+
+// reactionUpdate is queued, as JSON, as the text of a react tag.
+type reactionUpdate struct {
+	Author string          `json:"author"`
+	Emoji  string          `json:"emoji"`
+	Added  bool            `json:"added"`
+	Counts []reactionCount `json:"counts"`
+}
+
+// reactions holds who reacted to a message with what, keeping the emoji
+// in the order they were first used.
+type reactions struct {
+	order []string
+	users map[string]map[string]bool // emoji -> lowercased names
+}
+
+// toggle adds or removes name's reaction, reporting which.
+func (list *reactions) toggle(name, emoji string) bool {
+	if list.users == nil {
+		list.users = make(map[string]map[string]bool)
+	}
+	key := strings.ToLower(name)
+	users, seen := list.users[emoji]
+	if !seen {
+		users = make(map[string]bool)
+		list.users[emoji] = users
+		list.order = append(list.order, emoji)
+	}
+	if users[key] {
+		delete(users, key)
+		return false
+	}
+	users[key] = true
+	return true
+}
+
+// counts lists the emoji somebody still reacts with.
+func (list *reactions) counts() []reactionCount {
+	var counts []reactionCount
+	for _, emoji := range list.order {
+		if n := len(list.users[emoji]); n > 0 {
+			counts = append(counts, reactionCount{Emoji: emoji, Count: n})
+		}
+	}
+	return counts
+}
+
+// formatReactions shows totals as "👍 2, 🎉 1".
+func formatReactions(counts []reactionCount) string {
+	if len(counts) == 0 {
+		return "no reactions"
+	}
+	totals := make([]string, len(counts))
+	for i, count := range counts {
+		totals[i] = fmt.Sprintf("%s %d", count.Emoji, count.Count)
+	}
+	return strings.Join(totals, ", ")
+}
+
+// react toggles name's reaction to a recent message that hasn't been
+// deleted.
+func (recent *recentMessages) react(id, name, emoji string) (postedMessage, reactionUpdate, error) {
+	recent.mutex.Lock()
+	defer recent.mutex.Unlock()
+	message, ok := recent.byID[strings.ToUpper(id)]
+	if !ok || message.deleted {
+		return postedMessage{}, reactionUpdate{}, fmt.Errorf("there is no message %s", id)
+	}
+	added := message.reactions.toggle(name, emoji)
+	update := reactionUpdate{Author: message.from, Emoji: emoji, Added: added, Counts: message.reactions.counts()}
+	return *message, update, nil
+}
+
+// reactionText describes a react tag for text clients.
+func reactionText(tag messageTag, text string) string {
+	var update reactionUpdate
+	json.Unmarshal([]byte(text), &update)
+	verb := "reacted %s to"
+	if !update.Added {
+		verb = "took back their %s on"
+	}
+	return fmt.Sprintf("*** %s "+verb+" %s's message %s (%s) ***", tag.from, update.Emoji, update.Author, tag.id, formatReactions(update.Counts))
+}
+
+// handleReactCommand implements "/react <id> <emoji>".
+func (server *ChatServer) handleReactCommand(client *Client, message string) {
+	fields := strings.Fields(message)
+	if len(fields) != 3 {
+		client.messages <- "*** Usage: /react <id> <emoji> ***"
+		return
+	}
+	parts := []messagePart{{Text: fields[2]}}
+	server.emotes.Expand(parts)
+	emoji := parts[0].Text
+	if len(emoji) > MAX_REACTION_LENGTH || strings.IndexFunc(emoji, unicode.IsSpace) >= 0 {
+		client.messages <- "*** A reaction must be one short emoji or word ***"
+		return
+	}
+	if !server.allowMuted(client) || server.shadowed(client) {
+		return
+	}
+
+	reacted, update, err := server.recent.react(fields[1], client.name(), emoji)
+	if err != nil {
+		client.messages <- fmt.Sprintf("*** %v ***", err)
+		return
+	}
+	client.logger().Info("Reaction", "id", reacted.id, "room", reacted.room, "emoji", emoji, "added", update.Added)
+	server.export(server.record(ChatEvent{Type: EVENT_REACT, User: client.name(), Room: reacted.room, ID: reacted.id, Text: emoji}))
+	data, _ := json.Marshal(update)
+	server.send(reacted.room, tagMessage(messageTag{kind: CHANGE_REACT, id: reacted.id, from: client.name()}, string(data)), PRIORITY_CHATTER)
+}
+
+// handleIDsCommand implements "/ids on|off", which shows text clients the
+// IDs of messages so they can edit and react to them.
+func (client *Client) handleIDsCommand(message string) {
+	_, arg, _ := strings.Cut(message, " ")
+	switch strings.TrimSpace(arg) {
+	case "on":
+		client.mutex.Lock()
+		client.showIDs = true
+		client.mutex.Unlock()
+		client.messages <- "*** Message IDs on: they are shown in (parentheses) before each message ***"
+	case "off":
+		client.mutex.Lock()
+		client.showIDs = false
+		client.mutex.Unlock()
+		client.messages <- "*** Message IDs off ***"
+	default:
+		client.messages <- "*** Usage: /ids on|off ***"
+	}
+}
+
+// sortedReactions lists the totals in a history entry by emoji.
+func sortedReactions(totals map[string]int) []reactionCount {
+	var counts []reactionCount
+	for emoji, count := range totals {
+		counts = append(counts, reactionCount{Emoji: emoji, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Emoji < counts[j].Emoji })
+	return counts
+}
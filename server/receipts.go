@@ -0,0 +1,135 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Acknowledgments and read receipts, for JSON clients. A client can put a
+// ref of its own choosing on the chat, action and dm frames it sends; once
+// the server has accepted the message it answers with an ack frame holding
+// the ref and the message's ID. Private messages get a second ack when they
+// are written to the recipient's connection, and if the recipient's client
+// sends a read frame with the ID, the sender gets a read frame naming who
+// read it. Sending read frames is up to the recipient's client, so users
+// can turn receipts off there. Text clients neither get nor send any of
+// these. A ref also marks a message sent again after a reconnect; see
+// DEDUP_WINDOW.
+const (
+	// Queued as "RECEIPT <status> <id> <ref or name>" for JSON clients
+	RECEIPT_LINE = "RECEIPT"
+
+	RECEIPT_SENT      = "sent"
+	RECEIPT_DELIVERED = "delivered"
+	RECEIPT_READ      = "read"
+
+	// Tag for the recipient's copy of a private message
+	TAG_DIRECT = "direct"
+
+	// Private messages remembered for receipts
+	RECENT_DIRECT = 1024
+)
+
+// directMessage is a recently sent private message.
+type directMessage struct {
+	sender    *Client
+	to        string
+	delivered bool
+	read      bool
+}
+
+// receiptTracker remembers the last RECENT_DIRECT private messages by ID.
+type receiptTracker struct {
+	mutex    sync.Mutex
+	messages map[string]*directMessage
+	order    []string
+}
+
+func newReceiptTracker() *receiptTracker {
+	return &receiptTracker{messages: make(map[string]*directMessage)}
+}
+
+// add remembers a private message from sender to the user named to.
+func (tracker *receiptTracker) add(id string, sender *Client, to string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.messages[id] = &directMessage{sender: sender, to: to}
+	tracker.order = append(tracker.order, id)
+	if len(tracker.order) > RECENT_DIRECT {
+		delete(tracker.messages, tracker.order[0])
+		tracker.order = tracker.order[1:]
+	}
+}
+
+// mark records that a message has reached status for the first time, and
+// returns its sender. Only the recipient can mark a message.
+func (tracker *receiptTracker) mark(id string, by *Client, status string) (*Client, bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	message, ok := tracker.messages[strings.ToUpper(id)]
+	if !ok || !strings.EqualFold(message.to, by.name()) {
+		return nil, false
+	}
+	seen := &message.delivered
+	if status == RECEIPT_READ {
+		seen = &message.read
+	}
+	if *seen {
+		return nil, false
+	}
+	*seen = true
+	return message.sender, true
+}
+
+// receipt queues a receipt line for a JSON client.
+func receipt(client *Client, status, id, detail string) {
+	if client.json {
+		client.deliver(RECEIPT_LINE+" "+status+" "+id+" "+detail, PRIORITY_DIRECT)
+	}
+}
+
+// acknowledge tells a client the message it just sent was accepted, with
+// the ref from its frame, and remembers the ref to spot the message if it
+// is sent again.
+func (server *ChatServer) acknowledge(client *Client, id string) {
+	receipt(client, RECEIPT_SENT, id, client.ref)
+	server.dedup.add(client.name(), client.ref, id)
+}
+
+// delivered is called when a message has been written to client's
+// connection, and sends the delivery receipt if it was a private message.
+func (server *ChatServer) delivered(client *Client, message string) {
+	tag, _, ok := untagMessage(unframed(message))
+	if !ok || tag.kind != TAG_DIRECT {
+		return
+	}
+	if sender, ok := server.receipts.mark(tag.id, client, RECEIPT_DELIVERED); ok {
+		receipt(sender, RECEIPT_DELIVERED, tag.id, client.name())
+	}
+}
+
+// markRead handles a read frame: the client has shown the user a private
+// message, and its sender gets a read receipt.
+func (server *ChatServer) markRead(client *Client, id string) {
+	if sender, ok := server.receipts.mark(id, client, RECEIPT_READ); ok {
+		receipt(sender, RECEIPT_READ, strings.ToUpper(id), client.name())
+	}
+}
+
+// receiptFrame turns a receipt line into an ack or read frame.
+func receiptFrame(line string) protocol.Frame {
+	fields := strings.SplitN(line, " ", 4)
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	status, id, detail := fields[1], fields[2], fields[3]
+	switch status {
+	case RECEIPT_SENT:
+		return protocol.Frame{Type: protocol.FRAME_ACK, ID: id, Ref: detail, Body: status}
+	case RECEIPT_READ:
+		return protocol.Frame{Type: protocol.FRAME_READ, ID: id, From: detail}
+	}
+	return protocol.Frame{Type: protocol.FRAME_ACK, ID: id, From: detail, Body: status}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis backplane defaults
+const (
+	REDIS_PORT         = "6379"
+	REDIS_CHANNEL      = "chat"
+	REDIS_DIAL_TIMEOUT = 5 * time.Second
+)
+
+// redisBackplane shares messages through a Redis pub/sub channel. It keeps
+// two connections, since a subscribed connection can't publish, and
+// reconnects each when it drops.
+type redisBackplane struct {
+	address  string
+	password string
+	channel  string
+
+	out      chan LinkMessage
+	messages chan LinkMessage
+	done     chan struct{}
+	finished chan struct{}
+
+	mutex      sync.Mutex
+	subscriber net.Conn
+	closeOnce  sync.Once
+}
+
+func openRedisBackplane(address, password, channel string) *redisBackplane {
+	redis := &redisBackplane{
+		address:  address,
+		password: password,
+		channel:  channel,
+		out:      make(chan LinkMessage, CLUSTER_BUFFER),
+		messages: make(chan LinkMessage, CLUSTER_BUFFER),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go redis.publishLoop()
+	go redis.subscribeLoop()
+	return redis
+}
+
+func (redis *redisBackplane) Publish(message LinkMessage) {
+	select {
+	case redis.out <- message:
+	default:
+		slog.Warn("Backplane is backed up, dropping message", "type", message.Type)
+	}
+}
+
+func (redis *redisBackplane) Messages() <-chan LinkMessage {
+	return redis.messages
+}
+
+// Close stops both loops once what is waiting to be published has gone.
+func (redis *redisBackplane) Close() error {
+	redis.closeOnce.Do(func() {
+		close(redis.done)
+		redis.mutex.Lock()
+		if redis.subscriber != nil {
+			redis.subscriber.Close()
+		}
+		redis.mutex.Unlock()
+	})
+	<-redis.finished
+	return nil
+}
+
+// dial connects and authenticates.
+func (redis *redisBackplane) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", redis.address, REDIS_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	if redis.password != "" {
+		if _, err := redisCall(conn, reader, "AUTH", redis.password); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, reader, nil
+}
+
+// publishLoop sends queued messages, connecting when it needs to. Messages
+// that can't be sent are dropped.
+func (redis *redisBackplane) publishLoop() {
+	defer close(redis.finished)
+	var conn net.Conn
+	var reader *bufio.Reader
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	publish := func(message LinkMessage) {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return
+		}
+		if conn == nil {
+			if conn, reader, err = redis.dial(); err != nil {
+				slog.Warn("Error connecting to the backplane", "addr", redis.address, "err", err)
+				return
+			}
+		}
+		if _, err := redisCall(conn, reader, "PUBLISH", redis.channel, string(data)); err != nil {
+			slog.Warn("Error publishing to the backplane", "err", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+
+	for {
+		select {
+		case message := <-redis.out:
+			publish(message)
+		case <-redis.done:
+			for {
+				select {
+				case message := <-redis.out:
+					publish(message)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// subscribeLoop listens on the channel, reconnecting after LINK_RETRY when
+// the connection fails.
+func (redis *redisBackplane) subscribeLoop() {
+	for {
+		err := redis.subscribe()
+		select {
+		case <-redis.done:
+			return
+		default:
+		}
+		slog.Warn("Lost the backplane, retrying", "addr", redis.address, "err", err, "in", LINK_RETRY)
+		select {
+		case <-time.After(LINK_RETRY):
+		case <-redis.done:
+			return
+		}
+	}
+}
+
+func (redis *redisBackplane) subscribe() error {
+	conn, reader, err := redis.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	redis.mutex.Lock()
+	redis.subscriber = conn
+	redis.mutex.Unlock()
+	select {
+	case <-redis.done:
+		return nil
+	default:
+	}
+
+	if _, err := redisCall(conn, reader, "SUBSCRIBE", redis.channel); err != nil {
+		return err
+	}
+	slog.Info("Subscribed to the backplane", "addr", redis.address, "channel", redis.channel)
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return err
+		}
+		// Pushed messages are ["message", channel, payload]
+		fields, ok := reply.([]any)
+		if !ok || len(fields) != 3 || fields[0] != "message" {
+			continue
+		}
+		payload, _ := fields[2].(string)
+		var message LinkMessage
+		if err := json.Unmarshal([]byte(payload), &message); err != nil {
+			slog.Warn("Bad message on the backplane", "err", err)
+			continue
+		}
+		select {
+		case redis.messages <- message:
+		default:
+			slog.Warn("Backplane messages are backed up, dropping one", "type", message.Type)
+		}
+	}
+}
+
+// redisCall sends a command and reads its reply.
+func redisCall(conn net.Conn, reader *bufio.Reader, args ...string) (any, error) {
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	conn.SetDeadline(time.Now().Add(REDIS_DIAL_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, command.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(reader)
+}
+
+// readRedisReply reads one RESP value: a string, an integer, nil, or a
+// slice of those. Error replies are returned as errors.
+func readRedisReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch kind, rest := line[0], line[1:]; kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(rest)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(rest)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		values := make([]any, count)
+		for i := range values {
+			if values[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
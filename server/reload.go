@@ -0,0 +1,187 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Reloading. On SIGHUP, or a gRPC Rehash call, chatd calls Reload, which
+// reads the config file and flags again and applies the settings in
+// LIVE_SETTINGS to the running server; connections stay up. It also reads
+// --credentials-file and the ban list from storage again and kicks whoever
+// a new ban covers. Every change is logged, and changes to other settings
+// are logged as waiting for a restart.
+var LIVE_SETTINGS = []string{
+	"motd", "max-clients", "max-connections-per-ip", "message-rate",
+	"message-burst", "idle-timeout", "admins", "moderators",
+}
+
+// Settings whose values are left out of the log
+var SECRET_SETTINGS = []string{
+	"webhook-secret", "inbound-token", "feed-token", "admin-token",
+	"link-secret", "translate-api-key", "storage", "email-secret",
+}
+
+// liveSettings are the settings Reload changes. While the server runs
+// they are read with live, under the config's lock.
+type liveSettings struct {
+	MOTD          string
+	MaxClients    int
+	MaxPerAddress int
+	MessageRate   float64
+	MessageBurst  int
+	IdleTimeout   time.Duration
+	Admins        string
+	Moderators    string
+}
+
+// live returns the settings Reload can change.
+func (config *Config) live() liveSettings {
+	config.mutex.RLock()
+	defer config.mutex.RUnlock()
+	return liveSettings{
+		MOTD:          config.MOTD,
+		MaxClients:    config.MaxClients,
+		MaxPerAddress: config.MaxPerAddress,
+		MessageRate:   config.MessageRate,
+		MessageBurst:  config.MessageBurst,
+		IdleTimeout:   config.IdleTimeout,
+		Admins:        config.Admins,
+		Moderators:    config.Moderators,
+	}
+}
+
+// setLive changes the settings Reload can change.
+func (config *Config) setLive(settings liveSettings) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	config.MOTD = settings.MOTD
+	config.MaxClients = settings.MaxClients
+	config.MaxPerAddress = settings.MaxPerAddress
+	config.MessageRate = settings.MessageRate
+	config.MessageBurst = settings.MessageBurst
+	config.IdleTimeout = settings.IdleTimeout
+	config.Admins = settings.Admins
+	config.Moderators = settings.Moderators
+}
+
+// values returns every setting as its flag shows it, by flag name. Only
+// call it on a config nothing else is using: binding the flags writes to
+// the fields.
+func (config *Config) values() map[string]string {
+	values := make(map[string]string)
+	config.flagSet().VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+// Reload reads the configuration again from args, as the server was started
+// with, and applies what can change without a restart, then reloads the
+// bans. The running configuration is left alone if the new one is invalid.
+func (server *ChatServer) Reload(args []string) error {
+	config, err := LoadConfig(args)
+	if err != nil {
+		return fmt.Errorf("reloading configuration: %v", err)
+	}
+	values := config.values()
+
+	server.reloadMutex.Lock()
+	defer server.reloadMutex.Unlock()
+	changed := 0
+	for name, value := range values {
+		previous := server.loaded[name]
+		if value == previous {
+			continue
+		}
+		changed++
+		shown, was := value, previous
+		if slices.Contains(SECRET_SETTINGS, name) {
+			shown, was = "(hidden)", "(hidden)"
+		}
+		if slices.Contains(LIVE_SETTINGS, name) {
+			slog.Info("Setting changed", "setting", name, "from", was, "to", shown)
+		} else {
+			slog.Warn("Setting changed, takes effect on restart", "setting", name, "from", was, "to", shown)
+		}
+	}
+	server.config.setLive(config.live())
+	server.loaded = values
+	slog.Info("Configuration reloaded", "changed", changed)
+	server.audit(AuditEntry{Event: AUDIT_RELOAD, Detail: fmt.Sprintf("%d settings changed", changed)})
+
+	if err := server.accounts.LoadCredentials(server.config.CredentialsFile); err != nil {
+		return fmt.Errorf("reloading credentials: %v", err)
+	}
+	server.warnUnprovisioned()
+
+	return server.reloadBans()
+}
+
+// reloadBans reads the bans from storage again, for changes made to it
+// outside the server, and enforces the new ones.
+func (server *ChatServer) reloadBans() error {
+	before := make(map[string]bool)
+	for _, ban := range server.bans.List() {
+		before[banKey(ban.Target, ban.Address)] = true
+	}
+	if err := server.bans.Load(server.storage); err != nil {
+		return fmt.Errorf("reloading bans: %v", err)
+	}
+
+	added, kept := 0, 0
+	for _, ban := range server.bans.List() {
+		if before[banKey(ban.Target, ban.Address)] {
+			kept++
+			continue
+		}
+		added++
+		server.enforceBan(&ban, len(ROLE_RANKS))
+	}
+	slog.Info("Bans reloaded", "added", added, "removed", len(before)-kept)
+	return nil
+}
+
+// Rehash reloads the configuration from the command line the server's was
+// loaded from, as SIGHUP does.
+func (server *ChatServer) Rehash() error {
+	if server.config.args == nil {
+		return errors.New("the settings weren't loaded from a command line, so there's nothing to reload")
+	}
+	return server.Reload(server.config.args)
+}
+
+// setLimits changes --max-clients and --max-connections-per-ip until the
+// configuration is next reloaded. A negative value leaves that one alone.
+func (server *ChatServer) setLimits(maxClients, maxPerAddress int) (liveSettings, error) {
+	server.reloadMutex.Lock()
+	defer server.reloadMutex.Unlock()
+	live := server.config.live()
+	if maxClients >= 0 {
+		if maxClients < 1 {
+			return live, errors.New("max_clients must be at least 1")
+		}
+		live.MaxClients = maxClients
+	}
+	if maxPerAddress >= 0 {
+		live.MaxPerAddress = maxPerAddress
+	}
+	server.config.setLive(live)
+	slog.Info("Client limits changed", "max_clients", live.MaxClients, "max_connections_per_ip", live.MaxPerAddress)
+	return live, nil
+}
+
+// setMOTD changes the message of the day until the configuration is next
+// reloaded; "" removes it.
+func (server *ChatServer) setMOTD(text string) {
+	server.reloadMutex.Lock()
+	defer server.reloadMutex.Unlock()
+	live := server.config.live()
+	live.MOTD = text
+	server.config.setLive(live)
+	slog.Info("Message of the day changed", "motd", text)
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Session resume. With --resume-window set, every client is sent a session
+// token once it has logged in: JSON clients in a session frame, text
+// clients in a notice. If its connection drops, rather than the user
+// quitting or being kicked, nobody is told the user left; their name and
+// room are held for the window. A client that answers the first login
+// prompt with "/resume <token>" within the window is logged back in under
+// the same name, put back in the same room and sent the room's messages
+// from the gap, without a leave and a join for everyone else to see. When
+// the window passes the user leaves as usual. A token resumes one session;
+// each login gets a new one.
+const (
+	RESUME_COMMAND      = "/resume"
+	MAX_MISSED_MESSAGES = 100 // most messages sent to a client that resumes
+
+	// How a token is queued for a JSON client: "SESSION <token>"
+	SESSION_LINE = "SESSION"
+)
+
+// heldSession is where a dropped client was, kept for it to come back to.
+type heldSession struct {
+	client *Client // as it was when it dropped
+	room   string
+	since  time.Time
+	timer  *time.Timer
+}
+
+// heldSessions are the sessions waiting to be resumed, by token.
+type heldSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*heldSession
+}
+
+func newHeldSessions() *heldSessions {
+	return &heldSessions{sessions: make(map[string]*heldSession)}
+}
+
+func (held *heldSessions) add(token string, session *heldSession) {
+	held.mutex.Lock()
+	defer held.mutex.Unlock()
+	held.sessions[token] = session
+}
+
+// take removes the session with token and returns it, or nil if there is
+// none; whoever takes it first, a resuming client or the timer, has it.
+func (held *heldSessions) take(token string) *heldSession {
+	held.mutex.Lock()
+	defer held.mutex.Unlock()
+	session, ok := held.sessions[token]
+	if !ok {
+		return nil
+	}
+	delete(held.sessions, token)
+	session.timer.Stop()
+	return session
+}
+
+// issueToken gives a client a token to resume with, unless resuming is off.
+func (server *ChatServer) issueToken(client *Client) {
+	if server.config.ResumeWindow > 0 {
+		client.token = rand.Text()
+	}
+}
+
+// sendToken tells a client its token.
+func (server *ChatServer) sendToken(client *Client) {
+	switch {
+	case client.token == "":
+	case client.json:
+		client.deliver(SESSION_LINE+" "+client.token, PRIORITY_DIRECT)
+	default:
+		client.deliver(fmt.Sprintf("*** If you're disconnected, log in again within %s with %s %s to carry on where you left off ***", server.config.ResumeWindow, RESUME_COMMAND, client.token), PRIORITY_DIRECT)
+	}
+}
+
+// holds reports whether a client leaving should be held for it to resume:
+// it has a token and lost its connection, rather than quitting or being
+// disconnected by the server.
+func (server *ChatServer) holds(client *Client) bool {
+	return client.token != "" && client.lost && !client.kicked.Load() && !client.lagging.Load()
+}
+
+// hold keeps a dropped client's place until it resumes or the window
+// passes. Called from run, which has taken the client out of its room but
+// left its name claimed.
+func (server *ChatServer) hold(client *Client, room string) {
+	token := client.token
+	session := &heldSession{client: client, room: room, since: time.Now()}
+	session.timer = time.AfterFunc(server.config.ResumeWindow, func() {
+		select {
+		case server.control <- func() { server.expireSession(token) }:
+		case <-server.stopped:
+		}
+	})
+	server.held.add(token, session)
+	client.logger().Info("Connection lost, holding session", "room", room, "window", server.config.ResumeWindow)
+}
+
+// expireSession lets a held session go once its window has passed, if it
+// hasn't been resumed: the user leaves like anyone else.
+func (server *ChatServer) expireSession(token string) {
+	session := server.held.take(token)
+	if session == nil {
+		return
+	}
+	session.client.logger().Info("Session expired")
+	server.releaseName(session.client.name())
+	server.leave(session.client, session.room)
+}
+
+// resumeAnswer handles an answer to a login prompt that asks to resume a
+// session, reporting whether it was one. The session is nil if it can't
+// be resumed, and the client has been told.
+func (server *ChatServer) resumeAnswer(login *loginSession, answer string) (*heldSession, bool) {
+	token, ok := strings.CutPrefix(strings.TrimSpace(answer), RESUME_COMMAND+" ")
+	if !ok {
+		return nil, false
+	}
+	session := server.held.take(strings.TrimSpace(token))
+	if session == nil {
+		login.refuse("That session has ended. Log in again.")
+		return nil, true
+	}
+	// Banned while away, so it ends here
+	if ban := server.bans.CheckName(session.client.name()); ban != nil {
+		server.releaseName(session.client.name())
+		server.leave(session.client, session.room)
+		login.refuse(ban.describe())
+		return nil, true
+	}
+	return session, true
+}
+
+// restore carries over what a client had set for itself before it
+// dropped.
+func (client *Client) restore(previous *Client) {
+	previous.mutex.Lock()
+	defer previous.mutex.Unlock()
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.joinedAt = previous.joinedAt
+	client.aliases = previous.aliases
+	client.bell = previous.bell
+	client.showIDs = previous.showIDs
+	client.status = previous.status
+	client.awayReason = previous.awayReason
+	client.autoAway = previous.autoAway
+	client.language = previous.language
+	client.replyTo = previous.replyTo
+}
+
+// resume puts a client that has resumed a session back in its room and
+// sends it what was said there while it was away. Called from run in
+// place of the usual join. Sends wait until it is done, so nothing said in
+// the meantime is missed or comes out of order.
+func (server *ChatServer) resume(client *Client) {
+	session := client.resumed
+	client.resumed = nil
+	server.sendMutex.Lock()
+	defer server.sendMutex.Unlock()
+	server.mutex.Lock()
+	server.clients[client] = true
+	server.enterRoom(client, session.room)
+	server.mutex.Unlock()
+
+	var missed []HistoryEntry
+	if server.history != nil {
+		missed = server.history.Since(session.room, session.since, MAX_MISSED_MESSAGES)
+	}
+	client.logger().Info("Resumed session", "room", session.room, "away", time.Since(session.since).Round(time.Second), "missed", len(missed))
+	if len(missed) == 0 {
+		client.deliver(fmt.Sprintf("*** Welcome back, %s. You're in %s ***", client.name(), session.room), PRIORITY_CHATTER)
+		return
+	}
+	client.deliver(fmt.Sprintf("*** Welcome back, %s. What you missed in %s: ***", client.name(), session.room), PRIORITY_CHATTER)
+	for _, entry := range missed {
+		client.deliver(server.missedLine(entry), PRIORITY_CHATTER)
+	}
+}
+
+// missedLine shows a message from the history as it was sent.
+func (server *ChatServer) missedLine(entry HistoryEntry) string {
+	parts := parseMessage(entry.Text)
+	server.emotes.Expand(parts)
+	message := renderText(parts)
+	frame := protocol.Frame{Type: protocol.FRAME_CHAT, ID: entry.ID, From: entry.From, Room: entry.Room, Timestamp: entry.Time}
+	var line string
+	if entry.Action {
+		frame.Type, frame.Body = protocol.FRAME_ACTION, strings.Join(strings.Fields(message), " ")
+		line = fmt.Sprintf(ACTION_FORMAT, entry.From, frame.Body)
+	} else {
+		separator := " "
+		if strings.Contains(message, "\n") || hasCode(parts) {
+			separator = "\n"
+		}
+		frame.Body, frame.Parts = message, frameParts(parts)
+		line = fmt.Sprintf("[%s] %s:%s%s", entry.Time.Local().Format("15:04:05"), entry.From, separator, message)
+	}
+	if entry.ID == "" {
+		return withFrame(frame, line)
+	}
+	return withFrame(frame, tagMessage(messageTag{kind: TAG_MESSAGE, id: entry.ID, from: entry.From}, line))
+}
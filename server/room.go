@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Rooms. Every client is in exactly one room, starting in LOBBY. A room is
+// created by the first /join, which makes that user its owner, and removed
+// when its last member leaves.
+const LOBBY = "#lobby"
+
+var roomNamePattern = regexp.MustCompile(`^#[a-z0-9_-]{1,31}$`)
+
+type Room struct {
+	name      string
+	owner     string // lowercased name
+	createdAt time.Time
+	members   map[*Client]bool
+	mutes     map[string]time.Time // by lowercased name, from /roommute
+}
+
+// RoomInfo describes a room for /rooms and the status page.
+type RoomInfo struct {
+	Name       string    `json:"name"`
+	Members    int       `json:"members"`
+	CreatedAt  time.Time `json:"created_at"`
+	Owner      string    `json:"owner,omitempty"`
+	Node       string    `json:"node,omitempty"` // its home in a cluster, for the admin API
+	Password   bool      `json:"password,omitempty"`
+	InviteOnly bool      `json:"invite_only,omitempty"`
+	Topic      string    `json:"topic,omitempty"`
+}
+
+// normalizeRoomName lowercases a room name and adds the leading # if it is
+// missing, reporting whether the result is a valid name.
+func normalizeRoomName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "#") {
+		name = "#" + name
+	}
+	return name, roomNamePattern.MatchString(name)
+}
+
+// enterRoom moves the client into the named room, creating it if needed,
+// and returns the room it was in; the caller holds server.mutex.
+func (server *ChatServer) enterRoom(client *Client, name string) string {
+	previous := server.exitRoom(client)
+
+	room, ok := server.rooms[name]
+	if !ok {
+		room = &Room{
+			name:      name,
+			createdAt: time.Now(),
+			members:   make(map[*Client]bool),
+			mutes:     make(map[string]time.Time),
+		}
+		if settings, ok := server.roomStore.Get(name); ok {
+			room.owner = settings.Owner
+		} else if name != LOBBY {
+			room.owner = strings.ToLower(client.name())
+		}
+		server.rooms[name] = room
+		slog.Info("Room created", "room", name)
+	}
+	room.members[client] = true
+	client.room = name
+	return previous
+}
+
+// exitRoom takes the client out of its room, removing the room once it is
+// empty, and returns the room's name; the caller holds server.mutex.
+func (server *ChatServer) exitRoom(client *Client) string {
+	name := client.room
+	client.room = ""
+	if room, ok := server.rooms[name]; ok {
+		delete(room.members, client)
+		if len(room.members) == 0 {
+			delete(server.rooms, name)
+			slog.Info("Room removed", "room", name)
+		}
+	}
+	return name
+}
+
+// roomOf returns the room the client is in.
+func (server *ChatServer) roomOf(client *Client) string {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	return client.room
+}
+
+// roomMembers lists the names of a room's members.
+func (server *ChatServer) roomMembers(name string) []string {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	var users []string
+	if room, ok := server.rooms[name]; ok {
+		for client := range room.members {
+			users = append(users, client.name())
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// roomList describes the active rooms, sorted by name.
+func (server *ChatServer) roomList() []RoomInfo {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	rooms := make([]RoomInfo, 0, len(server.rooms))
+	for _, room := range server.rooms {
+		settings, _ := server.roomStore.Get(room.name)
+		rooms = append(rooms, RoomInfo{
+			Name:       room.name,
+			Members:    len(room.members),
+			CreatedAt:  room.createdAt,
+			Owner:      room.owner,
+			Password:   settings.hasPassword(),
+			InviteOnly: settings.InviteOnly,
+			Topic:      settings.Topic,
+		})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// switchRoom moves the client to another room and tells both rooms.
+func (server *ChatServer) switchRoom(client *Client, name string) {
+	server.mutex.Lock()
+	if client.room == name {
+		server.mutex.Unlock()
+		client.messages <- fmt.Sprintf("*** You are already in %s ***", name)
+		return
+	}
+	previous := server.enterRoom(client, name)
+	server.mutex.Unlock()
+
+	client.logger().Info("Changed rooms", "from", previous, "to", name)
+	server.notifyMembership(previous, membershipLine(protocol.EVENT_LEAVE, client.name(), previous))
+	server.notifyMembership(name, membershipLine(protocol.EVENT_JOIN, client.name(), name))
+	server.sendUserList(previous)
+	server.sendUserList(name)
+	server.sendTopic(client, name)
+}
+
+// handleRoomCommand implements "/join #room [password]", /leave and
+// /rooms.
+func (server *ChatServer) handleRoomCommand(client *Client, message string) {
+	command, arg, _ := strings.Cut(message, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch command {
+	case "/join":
+		if arg == "" {
+			client.messages <- "*** Usage: /join #room [password] ***"
+			return
+		}
+		arg, password, _ := strings.Cut(arg, " ")
+		name, ok := normalizeRoomName(arg)
+		if !ok {
+			client.messages <- "*** Room names are # followed by up to 31 of a-z, 0-9, _ and - ***"
+			return
+		}
+		if err := server.admitRoom(client, name, strings.TrimSpace(password)); err != nil {
+			client.logger().Info("Room join refused", "room", name, "err", err)
+			client.messages <- fmt.Sprintf("*** Can't join %s: %v ***", name, err)
+			return
+		}
+		server.switchRoom(client, name)
+
+	case "/leave":
+		if server.roomOf(client) == LOBBY {
+			client.messages <- "*** You are in the lobby; type 'exit' to quit ***"
+			return
+		}
+		server.switchRoom(client, LOBBY)
+
+	case "/rooms":
+		current := server.roomOf(client)
+		lines := []string{"--- Rooms ---"}
+		for _, room := range server.roomList() {
+			marker := " "
+			if room.Name == current {
+				marker = "*"
+			}
+			line := fmt.Sprintf("%s %s (%d)", marker, room.Name, room.Members)
+			if room.InviteOnly {
+				line += " invite-only"
+			} else if room.Password {
+				line += " password"
+			}
+			if room.Topic != "" {
+				line += " - " + room.Topic
+			}
+			lines = append(lines, line)
+		}
+		client.messages <- strings.Join(lines, "\n")
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Room passwords and invite-only rooms. Whoever creates a room owns it,
+// and the owner can give it a password with /roompass, make it invite-only
+// with /inviteonly and let people in with /invite, as can users its ACL
+// lets invite. Invited users don't need the password. Owners and admins can always join. The lobby is open
+// to everyone. Owners are known by name, so they should /register it.
+
+// roomOwner returns the lowercased name of a room's owner, or "" if it
+// has none.
+func (server *ChatServer) roomOwner(name string) string {
+	if settings, ok := server.roomStore.Get(name); ok && settings.Owner != "" {
+		return settings.Owner
+	}
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	if room, ok := server.rooms[name]; ok {
+		return room.owner
+	}
+	return ""
+}
+
+// ownsRoom reports whether client may change a room's settings.
+func (server *ChatServer) ownsRoom(client *Client, name string) bool {
+	return client.atLeast(ROLE_ADMIN) || server.roomOwner(name) == strings.ToLower(client.name())
+}
+
+// admitRoom checks whether client may join a room, with the password it
+// gave if any.
+func (server *ChatServer) admitRoom(client *Client, name, password string) error {
+	if server.config.Email.verifiedRoom(name) && !client.atLeast(ROLE_ADMIN) && !server.emailVerified(client) {
+		return fmt.Errorf("%s is for users with a verified email address: see /email", name)
+	}
+	settings, ok := server.roomStore.Get(name)
+	if !ok || server.ownsRoom(client, name) || slices.Contains(settings.Invited, strings.ToLower(client.name())) {
+		return nil
+	}
+	if !server.roomAllows(client, name, ACL_READ) {
+		return fmt.Errorf("%s's ACL doesn't let you in", name)
+	}
+	if settings.InviteOnly {
+		return fmt.Errorf("%s is invite-only; ask its owner to /invite you", name)
+	}
+	if !settings.hasPassword() {
+		return nil
+	}
+	if password == "" {
+		return fmt.Errorf("%s needs a password: /join %s <password>", name, name)
+	}
+	if !checkPassword(password, settings.Hash) {
+		return fmt.Errorf("wrong password for %s", name)
+	}
+	return nil
+}
+
+// ownedRoom returns the room client is in if it owns it, and otherwise
+// tells the client why not.
+func (server *ChatServer) ownedRoom(client *Client) (string, bool) {
+	name := server.roomOf(client)
+	switch {
+	case name == LOBBY:
+		client.messages <- "*** The lobby is open to everyone ***"
+		return "", false
+	case !server.ownsRoom(client, name):
+		client.messages <- fmt.Sprintf("*** Only the owner of %s can do that ***", name)
+		return "", false
+	}
+	return name, true
+}
+
+// updateRoom changes a room's settings for client, telling it if they
+// couldn't be saved.
+func (server *ChatServer) updateRoom(client *Client, name string, change func(*RoomSettings)) bool {
+	if err := server.roomStore.Update(name, server.roomOwner(name), change); err != nil {
+		client.logger().Error("Error saving room settings", "room", name, "err", err)
+		client.messages <- "*** Couldn't save the room's settings ***"
+		return false
+	}
+	return true
+}
+
+// handleRoomPasswordCommand implements "/roompass <password>|off".
+func (server *ChatServer) handleRoomPasswordCommand(client *Client, message string) {
+	_, password, _ := strings.Cut(message, " ")
+	password = strings.TrimSpace(password)
+	if password == "" || strings.ContainsAny(password, " \t") {
+		client.messages <- "*** Usage: /roompass <password>|off ***"
+		return
+	}
+	name, ok := server.ownedRoom(client)
+	if !ok {
+		return
+	}
+
+	if password == "off" {
+		if server.updateRoom(client, name, func(settings *RoomSettings) {
+			settings.Hash = ""
+		}) {
+			client.logger().Info("Room password removed", "room", name)
+			server.notify(name, fmt.Sprintf("*** %s removed the password from %s ***", client.name(), name))
+		}
+		return
+	}
+
+	if len(password) > MAX_PASSWORD_LENGTH {
+		client.messages <- fmt.Sprintf("*** Passwords can be at most %d bytes ***", MAX_PASSWORD_LENGTH)
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		client.messages <- fmt.Sprintf("*** %v ***", err)
+		return
+	}
+	if server.updateRoom(client, name, func(settings *RoomSettings) {
+		settings.Hash = hash
+	}) {
+		client.logger().Info("Room password set", "room", name)
+		server.notify(name, fmt.Sprintf("*** %s set a password on %s ***", client.name(), name))
+	}
+}
+
+// handleInviteOnlyCommand implements "/inviteonly on|off".
+func (server *ChatServer) handleInviteOnlyCommand(client *Client, message string) {
+	_, arg, _ := strings.Cut(message, " ")
+	arg = strings.TrimSpace(arg)
+	if arg != "on" && arg != "off" {
+		client.messages <- "*** Usage: /inviteonly on|off ***"
+		return
+	}
+	name, ok := server.ownedRoom(client)
+	if !ok {
+		return
+	}
+
+	on := arg == "on"
+	if !server.updateRoom(client, name, func(settings *RoomSettings) { settings.InviteOnly = on }) {
+		return
+	}
+	client.logger().Info("Room invite-only changed", "room", name, "invite_only", on)
+	if on {
+		server.notify(name, fmt.Sprintf("*** %s made %s invite-only ***", client.name(), name))
+	} else {
+		server.notify(name, fmt.Sprintf("*** %s opened %s to everyone ***", client.name(), name))
+	}
+}
+
+// handleInviteCommand implements "/invite <user>" and "/uninvite <user>".
+func (server *ChatServer) handleInviteCommand(client *Client, message string) {
+	fields := strings.Fields(message)
+	if len(fields) != 2 {
+		client.messages <- fmt.Sprintf("*** Usage: %s <user> ***", fields[0])
+		return
+	}
+	name, ok := server.permittedRoom(client, ACL_INVITE)
+	if !ok {
+		return
+	}
+
+	user := fields[1]
+	key := strings.ToLower(user)
+	if fields[0] == "/uninvite" {
+		settings, _ := server.roomStore.Get(name)
+		if !slices.Contains(settings.Invited, key) {
+			client.messages <- fmt.Sprintf("*** %s isn't invited to %s ***", user, name)
+			return
+		}
+		if server.updateRoom(client, name, func(settings *RoomSettings) {
+			settings.Invited = slices.DeleteFunc(settings.Invited, func(invited string) bool { return invited == key })
+		}) {
+			client.logger().Info("Room invite withdrawn", "room", name, "user", user)
+			client.messages <- fmt.Sprintf("*** %s is no longer invited to %s ***", user, name)
+		}
+		return
+	}
+
+	if !validName(user) {
+		client.messages <- fmt.Sprintf("*** %q isn't a valid name ***", user)
+		return
+	}
+	if !server.updateRoom(client, name, func(settings *RoomSettings) {
+		if !slices.Contains(settings.Invited, key) {
+			settings.Invited = append(settings.Invited, key)
+		}
+	}) {
+		return
+	}
+	client.logger().Info("Room invite", "room", name, "user", user)
+	client.messages <- fmt.Sprintf("*** Invited %s to %s ***", user, name)
+	for _, invited := range server.findClients(user) {
+		invited.deliver(fmt.Sprintf("*** %s invited you to %s: /join %s ***", client.name(), name, name), PRIORITY_DIRECT)
+	}
+}
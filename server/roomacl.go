@@ -0,0 +1,256 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Room access control lists. A room's owner and operators can give it an
+// ACL with /acl, each entry granting permissions to a user, to a role and
+// the roles above it ("@user" is everyone logged in) or to everyone
+// ("*"):
+//
+//	read      join the room and see what is said there
+//	write     chat and use /me there
+//	invite    /invite and /uninvite users
+//	moderate  /roomkick, /roommute and /roomunmute
+//
+// A room without an ACL lets everyone who gets in read and write. With
+// one, users have what its entries give them and nothing else, so
+// "/acl * read" and "/acl @moderator read,write", say, make a room
+// everyone can follow and only a panel posts in. Owners, operators,
+// moderators and admins keep what they always have, and owners and admins
+// can invite whatever the ACL says. Passwords and invite-only still apply
+// on top; an invite stands in for read. Users who lose read are sent back
+// to the lobby. The lobby can't have an ACL.
+const (
+	ACL_READ     = "read"
+	ACL_WRITE    = "write"
+	ACL_INVITE   = "invite"
+	ACL_MODERATE = "moderate"
+
+	ACL_EVERYONE = "*"
+	ACL_ROLE     = "@" // in front of a role
+	MAX_ACL      = 32  // entries a room may have
+)
+
+var ACL_PERMISSIONS = []string{ACL_READ, ACL_WRITE, ACL_INVITE, ACL_MODERATE}
+
+// ACLEntry grants permissions in a room to Who: a lowercased name, a role
+// after ACL_ROLE, or ACL_EVERYONE.
+type ACLEntry struct {
+	Who   string   `json:"who"`
+	Allow []string `json:"allow"`
+}
+
+// matches reports whether an entry is about a user with a role.
+func (entry ACLEntry) matches(key, role string) bool {
+	if grantee, ok := strings.CutPrefix(entry.Who, ACL_ROLE); ok {
+		return ROLE_RANKS[role] >= ROLE_RANKS[grantee]
+	}
+	return entry.Who == ACL_EVERYONE || entry.Who == key
+}
+
+func (entry ACLEntry) String() string {
+	return entry.Who + " " + strings.Join(entry.Allow, ",")
+}
+
+// aclAllows reports whether a room's ACL lets a user with a role do
+// something: anything reading and writing if there is no ACL.
+func (settings *RoomSettings) aclAllows(key, role, permission string) bool {
+	if len(settings.ACL) == 0 {
+		return permission == ACL_READ || permission == ACL_WRITE
+	}
+	for _, entry := range settings.ACL {
+		if entry.matches(key, role) && slices.Contains(entry.Allow, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// roomAllows reports whether client may do something in a room, by its
+// rank there or the room's ACL.
+func (server *ChatServer) roomAllows(client *Client, name, permission string) bool {
+	rank := server.roomRank(client, name)
+	switch {
+	case rank >= ROOM_OWNER:
+		return true
+	case rank >= ROOM_OP && permission != ACL_INVITE:
+		return true
+	}
+	settings, ok := server.roomStore.Get(name)
+	if !ok {
+		return permission == ACL_READ || permission == ACL_WRITE
+	}
+	return settings.aclAllows(strings.ToLower(client.name()), client.role(), permission)
+}
+
+// moderationRank is client's rank in a room when moderating it: that of
+// an operator if the room's ACL lets it moderate.
+func (server *ChatServer) moderationRank(client *Client, name string) int {
+	rank := server.roomRank(client, name)
+	if rank < ROOM_OP && server.roomAllows(client, name, ACL_MODERATE) {
+		return ROOM_OP
+	}
+	return rank
+}
+
+// permittedRoom returns the room client is in if it may do something
+// there, and otherwise tells the client why not.
+func (server *ChatServer) permittedRoom(client *Client, permission string) (string, bool) {
+	name := server.roomOf(client)
+	switch {
+	case name == LOBBY:
+		client.messages <- "*** The lobby is open to everyone ***"
+		return "", false
+	case !server.roomAllows(client, name, permission):
+		client.messages <- fmt.Sprintf("*** You don't have %s permission in %s ***", permission, name)
+		return "", false
+	}
+	return name, true
+}
+
+// parseACLGrantee checks who an ACL entry is for, returning it as the
+// entry keeps it.
+func parseACLGrantee(who string) (string, error) {
+	who = strings.ToLower(who)
+	if role, ok := strings.CutPrefix(who, ACL_ROLE); ok {
+		if _, known := ROLE_RANKS[role]; !known {
+			return "", fmt.Errorf("there is no role %q (use guest, user, moderator or admin)", role)
+		}
+		return who, nil
+	}
+	if who != ACL_EVERYONE && !validName(who) {
+		return "", fmt.Errorf("%q isn't a name, %s<role> or %s", who, ACL_ROLE, ACL_EVERYONE)
+	}
+	return who, nil
+}
+
+// parseACLPermissions reads a comma-separated list of permissions.
+func parseACLPermissions(list string) ([]string, error) {
+	var allow []string
+	for _, permission := range strings.Split(strings.ToLower(list), ",") {
+		if !slices.Contains(ACL_PERMISSIONS, permission) {
+			return nil, fmt.Errorf("there is no permission %q (use %s)", permission, strings.Join(ACL_PERMISSIONS, ", "))
+		}
+		if !slices.Contains(allow, permission) {
+			allow = append(allow, permission)
+		}
+	}
+	return allow, nil
+}
+
+// handleACLCommand implements "/acl" to show the ACL of the client's room,
+// "/acl <who> <permission,...>" to set an entry, "/acl <who> off" to remove
+// one and "/acl clear" to remove them all, for the room's owner and
+// operators.
+func (server *ChatServer) handleACLCommand(client *Client, message string) {
+	fields := strings.Fields(message)
+	name := server.roomOf(client)
+	if len(fields) == 1 {
+		settings, _ := server.roomStore.Get(name)
+		if len(settings.ACL) == 0 {
+			client.messages <- fmt.Sprintf("*** %s has no ACL: everyone who gets in can read and write ***", name)
+			return
+		}
+		entries := make([]string, len(settings.ACL))
+		for i, entry := range settings.ACL {
+			entries[i] = entry.String()
+		}
+		client.messages <- fmt.Sprintf("*** ACL of %s: %s ***", name, strings.Join(entries, "; "))
+		return
+	}
+	if !(len(fields) == 2 && fields[1] == "clear") && len(fields) != 3 {
+		client.messages <- "*** Usage: /acl [<who> <permission,...>|<who> off|clear] ***"
+		return
+	}
+	if name == LOBBY {
+		client.messages <- "*** The lobby is open to everyone ***"
+		return
+	}
+	if server.roomRank(client, name) < ROOM_OP {
+		client.messages <- fmt.Sprintf("*** Only the owner and operators of %s can do that ***", name)
+		return
+	}
+
+	var change func(*RoomSettings)
+	var notice string
+	switch {
+	case len(fields) == 2:
+		change = func(settings *RoomSettings) { settings.ACL = nil }
+		notice = fmt.Sprintf("*** %s removed the ACL of %s; everyone can read and write ***", client.name(), name)
+	case strings.ToLower(fields[2]) == "off":
+		who, err := parseACLGrantee(fields[1])
+		if err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		settings, _ := server.roomStore.Get(name)
+		if !slices.ContainsFunc(settings.ACL, func(entry ACLEntry) bool { return entry.Who == who }) {
+			client.messages <- fmt.Sprintf("*** %s has no ACL entry for %s ***", name, who)
+			return
+		}
+		change = func(settings *RoomSettings) {
+			settings.ACL = slices.DeleteFunc(settings.ACL, func(entry ACLEntry) bool { return entry.Who == who })
+		}
+		notice = fmt.Sprintf("*** %s removed %s from the ACL of %s ***", client.name(), who, name)
+	default:
+		who, err := parseACLGrantee(fields[1])
+		if err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		allow, err := parseACLPermissions(fields[2])
+		if err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		entry := ACLEntry{Who: who, Allow: allow}
+		settings, _ := server.roomStore.Get(name)
+		i := slices.IndexFunc(settings.ACL, func(entry ACLEntry) bool { return entry.Who == who })
+		if i < 0 && len(settings.ACL) >= MAX_ACL {
+			client.messages <- fmt.Sprintf("*** A room can have at most %d ACL entries ***", MAX_ACL)
+			return
+		}
+		change = func(settings *RoomSettings) {
+			if i := slices.IndexFunc(settings.ACL, func(entry ACLEntry) bool { return entry.Who == who }); i >= 0 {
+				settings.ACL[i] = entry
+			} else {
+				settings.ACL = append(settings.ACL, entry)
+			}
+		}
+		notice = fmt.Sprintf("*** %s set the ACL of %s: %s ***", client.name(), name, entry)
+	}
+
+	if !server.updateRoom(client, name, change) {
+		return
+	}
+	client.logger().Info("Room ACL changed", "room", name, "acl", strings.Join(fields[1:], " "))
+	server.notify(name, notice)
+	server.enforceACL(name)
+}
+
+// enforceACL sends the members of a room who may no longer read it back
+// to the lobby.
+func (server *ChatServer) enforceACL(name string) {
+	server.mutex.RLock()
+	var members []*Client
+	if room, ok := server.rooms[name]; ok {
+		for member := range room.members {
+			members = append(members, member)
+		}
+	}
+	server.mutex.RUnlock()
+
+	settings, _ := server.roomStore.Get(name)
+	for _, member := range members {
+		key := strings.ToLower(member.name())
+		if server.roomAllows(member, name, ACL_READ) || slices.Contains(settings.Invited, key) {
+			continue
+		}
+		member.deliver(fmt.Sprintf("*** You no longer have access to %s ***", name), PRIORITY_SYSTEM)
+		server.switchRoom(member, LOBBY)
+	}
+}
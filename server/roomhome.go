@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strings"
+)
+
+// Room homes. In a cluster every room has a home node, chosen by
+// rendezvous hashing over the nodes that are up, so each node works out
+// the same home without a coordinator, and a node joining or dying moves
+// only the rooms whose home it becomes or was. Settings changed on any
+// node are published to the others, newest winning. When the membership
+// changes, each node publishes the settings of the rooms whose home it
+// now is, and of those whose home moved: a node that joins catches up, and
+// the rooms of a node that died are taken over by, and resynced from, the
+// survivors.
+
+// rendezvousHome picks a room's home from nodes: the one whose hash with
+// the room's name is highest.
+func rendezvousHome(room string, nodes []string) string {
+	var home string
+	var best uint64
+	for _, node := range nodes {
+		hash := fnv.New64a()
+		hash.Write([]byte(node + "\n" + room))
+		if weight := hash.Sum64(); home == "" || weight > best || (weight == best && node < home) {
+			home, best = node, weight
+		}
+	}
+	return home
+}
+
+// roomHome returns the node a room's home is, as far as this node knows;
+// without a cluster, that is this node.
+func (server *ChatServer) roomHome(name string) string {
+	return rendezvousHome(name, append(server.cluster.Nodes(), server.config.Node))
+}
+
+// publishRoom sends a room's settings to the other nodes, or tells them it
+// was closed if settings is nil.
+func (server *ChatServer) publishRoom(name string, settings *RoomSettings) {
+	server.backplane.Publish(LinkMessage{Type: CLUSTER_ROOM, Server: server.config.Node, Room: name, Settings: settings})
+}
+
+// applyRoom takes a room's settings from another node, moving this node's
+// users out of it if it was closed.
+func (server *ChatServer) applyRoom(name string, settings *RoomSettings) {
+	name, ok := normalizeRoomName(name)
+	if !ok || (name == LOBBY && settings == nil) {
+		return
+	}
+	if settings != nil {
+		settings.Name = name
+		settings.Owner = strings.ToLower(settings.Owner)
+	}
+	previous, _ := server.roomStore.Get(name)
+	changed, err := server.roomStore.Apply(name, settings)
+	if err != nil {
+		slog.Error("Error saving room settings from the cluster", "room", name, "err", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	if settings == nil {
+		slog.Info("Room closed on another node", "room", name)
+		server.emptyRoom(name, fmt.Sprintf("*** %s was closed; you are back in %s ***", name, LOBBY))
+		return
+	}
+	server.mutex.Lock()
+	if room, ok := server.rooms[name]; ok && settings.Owner != "" {
+		room.owner = settings.Owner
+	}
+	server.mutex.Unlock()
+	if settings.Topic != previous.Topic {
+		if settings.Topic == "" {
+			server.notify(name, fmt.Sprintf("*** %s cleared the topic of %s ***", settings.TopicBy, name))
+		} else {
+			server.notify(name, fmt.Sprintf("*** %s changed the topic of %s to: %s ***", settings.TopicBy, name, settings.Topic))
+		}
+	}
+}
+
+// rebalanceRooms works out every room's home again after the cluster's
+// membership changed, and publishes the settings of the rooms whose home
+// this node is or which have a new home.
+func (server *ChatServer) rebalanceRooms() {
+	nodes := append(server.cluster.Nodes(), server.config.Node)
+	server.cluster.mutex.Lock()
+	previous := server.cluster.balanced
+	server.cluster.balanced = nodes
+	server.cluster.mutex.Unlock()
+
+	rooms := server.roomStore.List()
+	homed, taken := 0, 0
+	for _, settings := range rooms {
+		home, was := rendezvousHome(settings.Name, nodes), rendezvousHome(settings.Name, previous)
+		switch {
+		case home == server.config.Node:
+			homed++
+			if was != "" && was != home {
+				taken++
+				slog.Info("Took over room", "room", settings.Name, "from", was)
+			}
+		case was == home:
+			continue
+		}
+		// A new home may not have the room yet, so it is sent by whoever had it
+		server.publishRoom(settings.Name, &settings)
+	}
+	slog.Info("Rebalanced rooms", "nodes", len(nodes), "rooms", len(rooms), "homed_here", homed, "taken_over", taken)
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Room operators. A room's owner can make other users its operators with
+// /op, take that back with /deop and hand the room to someone else with
+// /transfer. Owners and operators can send users out of the room with
+// /roomkick and stop them talking there with /roommute; neither reaches
+// beyond the room. These sit on top of the server-wide roles: admins can
+// do anything in any room, and moderators act as operators everywhere.
+const (
+	ROOM_MEMBER = iota
+	ROOM_OP
+	ROOM_OWNER
+	ROOM_ADMIN
+)
+
+// roomRank returns what client may do in a room.
+func (server *ChatServer) roomRank(client *Client, name string) int {
+	key := strings.ToLower(client.name())
+	settings, _ := server.roomStore.Get(name)
+	switch {
+	case client.atLeast(ROLE_ADMIN):
+		return ROOM_ADMIN
+	case name != LOBBY && server.roomOwner(name) == key:
+		return ROOM_OWNER
+	case client.atLeast(ROLE_MODERATOR) || slices.Contains(settings.Ops, key):
+		return ROOM_OP
+	}
+	return ROOM_MEMBER
+}
+
+// roomMutedFor returns how much longer the client is muted in its room,
+// or 0.
+func (server *ChatServer) roomMutedFor(client *Client) time.Duration {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	room, ok := server.rooms[client.room]
+	if !ok {
+		return 0
+	}
+	return max(0, time.Until(room.mutes[strings.ToLower(client.name())]))
+}
+
+// roomMember finds an online user in a room whom client outranks there,
+// telling the client if there isn't one.
+func (server *ChatServer) roomMember(client *Client, room, name string) *Client {
+	peers := server.findClients(name)
+	if len(peers) == 0 || server.roomOf(peers[0]) != room {
+		client.messages <- fmt.Sprintf("*** %s isn't in %s ***", name, room)
+		return nil
+	}
+	if server.moderationRank(peers[0], room) >= server.moderationRank(client, room) {
+		client.messages <- fmt.Sprintf("*** You can't moderate %s in %s ***", peers[0].name(), room)
+		return nil
+	}
+	return peers[0]
+}
+
+// handleOpCommand implements "/op [user]", "/deop <user>" and "/transfer
+// <user>", for the owner of the room the client is in.
+func (server *ChatServer) handleOpCommand(client *Client, message string) {
+	fields := strings.Fields(message)
+	command := fields[0]
+	if command == "/op" && len(fields) == 1 {
+		server.listOps(client)
+		return
+	}
+	if len(fields) != 2 {
+		client.messages <- fmt.Sprintf("*** Usage: %s <user> ***", command)
+		return
+	}
+	name, ok := server.ownedRoom(client)
+	if !ok {
+		return
+	}
+	user := fields[1]
+	key := strings.ToLower(user)
+	settings, _ := server.roomStore.Get(name)
+	owner := server.roomOwner(name)
+
+	switch command {
+	case "/op":
+		if !validName(user) {
+			client.messages <- fmt.Sprintf("*** %q isn't a valid name ***", user)
+			return
+		}
+		if key == owner || slices.Contains(settings.Ops, key) {
+			client.messages <- fmt.Sprintf("*** %s can already moderate %s ***", user, name)
+			return
+		}
+		if !server.updateRoom(client, name, func(settings *RoomSettings) {
+			settings.Ops = append(settings.Ops, key)
+		}) {
+			return
+		}
+		client.logger().Info("Room op added", "room", name, "user", user)
+		server.notify(name, fmt.Sprintf("*** %s made %s an operator of %s ***", client.name(), user, name))
+
+	case "/deop":
+		if !slices.Contains(settings.Ops, key) {
+			client.messages <- fmt.Sprintf("*** %s isn't an operator of %s ***", user, name)
+			return
+		}
+		if !server.updateRoom(client, name, func(settings *RoomSettings) {
+			settings.Ops = slices.DeleteFunc(settings.Ops, func(op string) bool { return op == key })
+		}) {
+			return
+		}
+		client.logger().Info("Room op removed", "room", name, "user", user)
+		server.notify(name, fmt.Sprintf("*** %s is no longer an operator of %s ***", user, name))
+
+	case "/transfer":
+		peers := server.findClients(user)
+		if len(peers) == 0 {
+			client.messages <- fmt.Sprintf("*** %s is not online ***", user)
+			return
+		}
+		user = peers[0].name()
+		if key == owner {
+			client.messages <- fmt.Sprintf("*** %s already owns %s ***", user, name)
+			return
+		}
+		// The previous owner stays on as an operator
+		if !server.updateRoom(client, name, func(settings *RoomSettings) {
+			settings.Ops = slices.DeleteFunc(settings.Ops, func(op string) bool { return op == key })
+			if owner != "" {
+				settings.Ops = append(settings.Ops, owner)
+			}
+			settings.Owner = key
+		}) {
+			return
+		}
+		server.mutex.Lock()
+		if room, ok := server.rooms[name]; ok {
+			room.owner = key
+		}
+		server.mutex.Unlock()
+		client.logger().Info("Room transferred", "room", name, "from", owner, "to", user)
+		server.notify(name, fmt.Sprintf("*** %s gave %s to %s ***", client.name(), name, user))
+	}
+}
+
+// listOps shows who owns the client's room and who its operators are.
+func (server *ChatServer) listOps(client *Client) {
+	name := server.roomOf(client)
+	owner := server.roomOwner(name)
+	if owner == "" {
+		client.messages <- fmt.Sprintf("*** %s has no owner; moderators look after it ***", name)
+		return
+	}
+	settings, _ := server.roomStore.Get(name)
+	ops := "none"
+	if len(settings.Ops) > 0 {
+		ops = strings.Join(settings.Ops, ", ")
+	}
+	client.messages <- fmt.Sprintf("*** %s is owned by %s; operators: %s ***", name, owner, ops)
+}
+
+// handleRoomModerationCommand implements "/roomkick <user> [reason]",
+// "/roommute <user> <duration>" and "/roomunmute <user>", for the owner and
+// operators of the room the client is in.
+func (server *ChatServer) handleRoomModerationCommand(client *Client, message string) {
+	command, args, _ := strings.Cut(message, " ")
+	fields := strings.Fields(args)
+	name := server.roomOf(client)
+	if name == LOBBY && !client.atLeast(ROLE_MODERATOR) {
+		client.messages <- "*** Only moderators look after the lobby ***"
+		return
+	}
+	if server.moderationRank(client, name) < ROOM_OP {
+		client.messages <- fmt.Sprintf("*** Only the owner and operators of %s can do that ***", name)
+		return
+	}
+
+	switch command {
+	case "/roomkick":
+		if len(fields) < 1 {
+			client.messages <- "*** Usage: /roomkick <user> [reason] ***"
+			return
+		}
+		if name == LOBBY {
+			client.messages <- "*** Users can't be sent out of the lobby; use /kick to disconnect them ***"
+			return
+		}
+		peer := server.roomMember(client, name, fields[0])
+		if peer == nil {
+			return
+		}
+		reason := strings.Join(fields[1:], " ")
+		notice := fmt.Sprintf("*** %s was sent out of %s by %s ***", peer.name(), name, client.name())
+		if reason != "" {
+			notice = fmt.Sprintf("*** %s was sent out of %s by %s: %s ***", peer.name(), name, client.name(), reason)
+		}
+		client.logger().Info("Room kick", "room", name, "target", peer.name(), "reason", reason)
+		server.notify(name, notice)
+		server.switchRoom(peer, LOBBY)
+
+	case "/roommute":
+		if len(fields) != 2 {
+			client.messages <- "*** Usage: /roommute <user> <duration> ***"
+			return
+		}
+		duration, err := time.ParseDuration(fields[1])
+		if err != nil || duration <= 0 {
+			client.messages <- "*** Durations look like 30s, 10m or 2h ***"
+			return
+		}
+		peer := server.roomMember(client, name, fields[0])
+		if peer == nil {
+			return
+		}
+		server.mutex.Lock()
+		if room, ok := server.rooms[name]; ok {
+			room.mutes[strings.ToLower(peer.name())] = time.Now().Add(duration)
+		}
+		server.mutex.Unlock()
+		client.logger().Info("Room mute", "room", name, "target", peer.name(), "for", duration)
+		server.notify(name, fmt.Sprintf("*** %s was muted in %s for %s by %s ***", peer.name(), name, duration, client.name()))
+
+	case "/roomunmute":
+		if len(fields) != 1 {
+			client.messages <- "*** Usage: /roomunmute <user> ***"
+			return
+		}
+		key := strings.ToLower(fields[0])
+		muted := false
+		server.mutex.Lock()
+		if room, ok := server.rooms[name]; ok {
+			_, muted = room.mutes[key]
+			delete(room.mutes, key)
+		}
+		server.mutex.Unlock()
+		if !muted {
+			client.messages <- fmt.Sprintf("*** %s isn't muted in %s ***", fields[0], name)
+			return
+		}
+		client.logger().Info("Room unmute", "room", name, "target", fields[0])
+		server.notify(name, fmt.Sprintf("*** %s can talk in %s again ***", fields[0], name))
+	}
+}
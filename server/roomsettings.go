@@ -0,0 +1,175 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// RoomSettings is what is kept about a room between runs. A room has
+// settings once its owner changes one, and keeps them, and its owner,
+// after it empties.
+type RoomSettings struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+	Owner     string    `json:"owner,omitempty"` // lowercased name
+
+	Hash string `json:"hash,omitempty"` // of the password, as for accounts
+
+	InviteOnly bool     `json:"invite_only,omitempty"`
+	Invited    []string `json:"invited,omitempty"` // lowercased names
+	Ops        []string `json:"ops,omitempty"`     // lowercased names
+
+	Topic   string    `json:"topic,omitempty"`
+	TopicBy string    `json:"topic_by,omitempty"`
+	TopicAt time.Time `json:"topic_at,omitzero"`
+
+	Filters []FilterRule `json:"filters,omitempty"`
+	ACL     []ACLEntry   `json:"acl,omitempty"`
+}
+
+// hasPassword reports whether the room needs a password.
+func (settings *RoomSettings) hasPassword() bool {
+	return settings.Hash != ""
+}
+
+// RoomStore holds the rooms' settings by name, saved so they survive a
+// restart.
+type RoomStore struct {
+	mutex   sync.Mutex
+	storage Storage
+	rooms   map[string]*RoomSettings
+
+	// Called with each change made here, settings nil for a deletion
+	changed []func(name string, settings *RoomSettings)
+}
+
+func NewRoomStore() *RoomStore {
+	return &RoomStore{storage: newMemoryStorage(), rooms: make(map[string]*RoomSettings)}
+}
+
+// Load reads the settings from storage, where changes are saved from then
+// on.
+func (store *RoomStore) Load(storage Storage) error {
+	rooms, err := storage.LoadRooms()
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.storage, store.rooms = storage, rooms
+	return nil
+}
+
+// Get returns a copy of a room's settings, if it has any.
+func (store *RoomStore) Get(name string) (RoomSettings, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	settings, ok := store.rooms[name]
+	if !ok {
+		return RoomSettings{}, false
+	}
+	copied := *settings
+	copied.Invited, copied.Ops = slices.Clone(settings.Invited), slices.Clone(settings.Ops)
+	copied.Filters, copied.ACL = slices.Clone(settings.Filters), slices.Clone(settings.ACL)
+	return copied, true
+}
+
+// Update changes a room's settings, starting them with owner if it has
+// none, and saves them.
+func (store *RoomStore) Update(name, owner string, change func(*RoomSettings)) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	settings := &RoomSettings{Name: name, CreatedAt: time.Now(), Owner: owner}
+	if current, ok := store.rooms[name]; ok {
+		copied := *current
+		copied.Invited, copied.Ops = slices.Clone(current.Invited), slices.Clone(current.Ops)
+		copied.Filters = slices.Clone(current.Filters)
+		settings = &copied
+	}
+	change(settings)
+	settings.UpdatedAt = time.Now()
+	if err := store.storage.SaveRoom(settings); err != nil {
+		return err
+	}
+	store.rooms[name] = settings
+	for _, changed := range store.changed {
+		copied := *settings
+		changed(name, &copied)
+	}
+	return nil
+}
+
+// OnChange arranges for changed to be called, along with anything already
+// arranged, with each change made with Update or Delete, but not with
+// Apply.
+func (store *RoomStore) OnChange(changed func(name string, settings *RoomSettings)) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.changed = append(store.changed, changed)
+}
+
+// Apply saves settings made elsewhere, replacing the room's unless they
+// are older, or forgets the room if settings is nil. It reports whether
+// anything changed.
+func (store *RoomStore) Apply(name string, settings *RoomSettings) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	current, ok := store.rooms[name]
+	if settings == nil {
+		if !ok {
+			return false, nil
+		}
+		if err := store.storage.DeleteRoom(name); err != nil {
+			return false, err
+		}
+		delete(store.rooms, name)
+		return true, nil
+	}
+	if ok && !settings.UpdatedAt.After(current.UpdatedAt) {
+		return false, nil
+	}
+	if err := store.storage.SaveRoom(settings); err != nil {
+		return false, err
+	}
+	store.rooms[name] = settings
+	return true, nil
+}
+
+// List returns copies of every room's settings, sorted by name.
+func (store *RoomStore) List() []RoomSettings {
+	store.mutex.Lock()
+	names := make([]string, 0, len(store.rooms))
+	for name := range store.rooms {
+		names = append(names, name)
+	}
+	store.mutex.Unlock()
+
+	slices.Sort(names)
+	rooms := make([]RoomSettings, 0, len(names))
+	for _, name := range names {
+		if settings, ok := store.Get(name); ok {
+			rooms = append(rooms, settings)
+		}
+	}
+	return rooms
+}
+
+// Delete forgets a room's settings, reporting whether it had any.
+func (store *RoomStore) Delete(name string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.rooms[name]; !ok {
+		return false, nil
+	}
+	if err := store.storage.DeleteRoom(name); err != nil {
+		return false, err
+	}
+	delete(store.rooms, name)
+	for _, changed := range store.changed {
+		changed(name, nil)
+	}
+	return true, nil
+}
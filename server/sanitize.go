@@ -0,0 +1,29 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Text from clients is cleaned before anyone else sees it, so nobody can
+// send escape sequences to other people's terminals. Lines that aren't
+// valid UTF-8 are refused; ANSI escape sequences and other control
+// characters are removed, except tabs and the newlines of multi-line
+// messages.
+
+// escapePattern matches terminal escape sequences: CSI (ESC [ parameters
+// final), the string commands OSC, DCS, SOS, PM and APC (ended by BEL or
+// ST, or by the end of the line), and the two- and three-byte escapes.
+var escapePattern = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|[\]PX^_][^\x07\x1b]*(?:\x07|\x1b\\)?|[ -/]*[0-~])`)
+
+// sanitizeText removes escape sequences and control characters.
+func sanitizeText(text string) string {
+	text = escapePattern.ReplaceAllString(text, "")
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, text)
+}
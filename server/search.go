@@ -0,0 +1,294 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Search over the history. The server indexes the history when it starts,
+// and every message after that, by the words in it; "/search" and GET
+// /admin/search find the messages containing all the words given, newest
+// first, a page at a time. Edits are searched by their new text and
+// deleted messages are left out. The index keeps the messages in memory.
+const (
+	SEARCH_PAGE_SIZE     = 10
+	MAX_SEARCH_PAGE_SIZE = 100
+	MAX_SEARCH_WORDS     = 8
+)
+
+// SearchQuery says which messages to find. Words must all appear, in any
+// case; the other fields are optional.
+type SearchQuery struct {
+	Words    []string
+	Room     string
+	From     string
+	Since    time.Time
+	Until    time.Time
+	Page     int // from 1
+	PageSize int
+}
+
+// SearchResults is one page of the messages a search found.
+type SearchResults struct {
+	Total   int            `json:"total"`
+	Page    int            `json:"page"`
+	Pages   int            `json:"pages"`
+	Matches []HistoryEntry `json:"matches"`
+}
+
+// searchWords splits text into lowercased words, each once.
+func searchWords(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]bool)
+	words := fields[:0]
+	for _, word := range fields {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// historyIndex maps words to the messages containing them.
+type historyIndex struct {
+	messages []HistoryEntry
+	byID     map[string]int
+	words    map[string][]int // word -> positions in messages
+}
+
+func newHistoryIndex() *historyIndex {
+	return &historyIndex{byID: make(map[string]int), words: make(map[string][]int)}
+}
+
+// add indexes a history entry, applying it to the message it changes if it
+// is an edit or deletion.
+func (index *historyIndex) add(entry HistoryEntry) {
+	i, known := index.byID[entry.ID]
+	switch {
+	case entry.Change == "":
+		i = len(index.messages)
+		index.messages = append(index.messages, entry)
+		if entry.ID != "" {
+			index.byID[entry.ID] = i
+		}
+	case !known:
+		return
+	case entry.Change == CHANGE_EDIT:
+		index.messages[i].Text = entry.Text
+		index.messages[i].Change = CHANGE_EDIT
+	case entry.Change == CHANGE_DELETE:
+		index.messages[i].Change = CHANGE_DELETE
+		return
+	default:
+		return
+	}
+	for _, word := range searchWords(index.messages[i].Text) {
+		postings := index.words[word]
+		if len(postings) == 0 || postings[len(postings)-1] != i {
+			index.words[word] = append(postings, i)
+		}
+	}
+}
+
+// search finds a page of matches. Words left in the index by edits are
+// checked against the current text.
+func (index *historyIndex) search(query SearchQuery) SearchResults {
+	var candidates []int
+	for n, word := range query.Words {
+		if postings := index.words[word]; n == 0 || len(postings) < len(candidates) {
+			candidates = postings
+		}
+	}
+
+	var matches []HistoryEntry
+	seen := make(map[int]bool)
+	for _, i := range candidates {
+		message := index.messages[i]
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		if message.Change == CHANGE_DELETE ||
+			(query.Room != "" && message.room() != query.Room) ||
+			(query.From != "" && !strings.EqualFold(message.From, query.From)) ||
+			(!query.Since.IsZero() && message.Time.Before(query.Since)) ||
+			(!query.Until.IsZero() && !message.Time.Before(query.Until)) {
+			continue
+		}
+		words := make(map[string]bool)
+		for _, word := range searchWords(message.Text) {
+			words[word] = true
+		}
+		all := true
+		for _, word := range query.Words {
+			all = all && words[word]
+		}
+		if all {
+			matches = append(matches, message)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Time.After(matches[j].Time) })
+
+	results := SearchResults{Total: len(matches), Page: query.Page}
+	results.Pages = (len(matches) + query.PageSize - 1) / query.PageSize
+	start := min((query.Page-1)*query.PageSize, len(matches))
+	results.Matches = matches[start:min(start+query.PageSize, len(matches))]
+	return results
+}
+
+// BuildIndex reads the history from the event log into the search index;
+// events applied from then on are indexed as they come.
+func (history *HistoryLog) BuildIndex() error {
+	index := newHistoryIndex()
+	err := history.log.ReadEvents(0, 0, func(event ChatEvent) {
+		if entry, ok := historyEntry(event); ok {
+			index.add(entry)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	history.index = index
+	return nil
+}
+
+// Search finds messages in the history. The history must have been
+// indexed.
+func (history *HistoryLog) Search(query SearchQuery) SearchResults {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if history.index == nil {
+		return SearchResults{Page: query.Page}
+	}
+	return history.index.search(query)
+}
+
+// Since returns the last limit messages in a room after a time, oldest
+// first. The history must have been indexed.
+func (history *HistoryLog) Since(room string, since time.Time, limit int) []HistoryEntry {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if history.index == nil {
+		return nil
+	}
+	var messages []HistoryEntry
+	for _, message := range history.index.messages {
+		if message.Change != CHANGE_DELETE && message.room() == room && message.Time.After(since) {
+			messages = append(messages, message)
+		}
+	}
+	// Imported logs are appended after live messages, so sort by time
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Time.Before(messages[j].Time) })
+	return messages[max(len(messages)-limit, 0):]
+}
+
+// parseSearch builds a query from the words to find and the values of the
+// options, which may be empty.
+func parseSearch(text, room, from, since, until, page, pageSize string) (SearchQuery, error) {
+	query := SearchQuery{Words: searchWords(text), From: from, Page: 1, PageSize: SEARCH_PAGE_SIZE}
+	var err error
+	switch {
+	case len(query.Words) == 0:
+		return query, errors.New("give some words to search for")
+	case len(query.Words) > MAX_SEARCH_WORDS:
+		return query, fmt.Errorf("search for at most %d words", MAX_SEARCH_WORDS)
+	}
+	if room != "" {
+		var ok bool
+		if query.Room, ok = normalizeRoomName(room); !ok {
+			return query, fmt.Errorf("invalid room name %q", room)
+		}
+	}
+	if since != "" {
+		if query.Since, err = parseDate(since); err != nil {
+			return query, err
+		}
+	}
+	if until != "" {
+		if query.Until, err = parseDate(until); err != nil {
+			return query, err
+		}
+	}
+	if page != "" {
+		if query.Page, err = strconv.Atoi(page); err != nil || query.Page < 1 {
+			return query, fmt.Errorf("page must be a positive number")
+		}
+	}
+	if pageSize != "" {
+		if query.PageSize, err = strconv.Atoi(pageSize); err != nil || query.PageSize < 1 || query.PageSize > MAX_SEARCH_PAGE_SIZE {
+			return query, fmt.Errorf("page size must be 1-%d", MAX_SEARCH_PAGE_SIZE)
+		}
+	}
+	return query, nil
+}
+
+// searchQueryFrom reads a query from the parameters of a search request:
+// q, room, from, since, until, page and per_page.
+func searchQueryFrom(values url.Values) (SearchQuery, error) {
+	return parseSearch(values.Get("q"), values.Get("room"), values.Get("from"), values.Get("since"), values.Get("until"), values.Get("page"), values.Get("per_page"))
+}
+
+// handleSearchCommand implements "/search <words> [#room] [from:user]
+// [since:date] [until:date] [page:n]".
+func (server *ChatServer) handleSearchCommand(client *Client, message string) {
+	_, args, _ := strings.Cut(message, " ")
+	var words []string
+	var room, from, since, until, page string
+	for _, field := range strings.Fields(args) {
+		key, value, _ := strings.Cut(field, ":")
+		switch {
+		case strings.HasPrefix(field, "#"):
+			room = field
+		case key == "from" && value != "":
+			from = value
+		case key == "since" && value != "":
+			since = value
+		case key == "until" && value != "":
+			until = value
+		case key == "page" && value != "":
+			page = value
+		default:
+			words = append(words, field)
+		}
+	}
+	query, err := parseSearch(strings.Join(words, " "), room, from, since, until, page, "")
+	if err != nil {
+		client.messages <- fmt.Sprintf("*** %v. Usage: /search <words> [#room] [from:user] [since:YYYY-MM-DD] [until:YYYY-MM-DD] [page:n] ***", err)
+		return
+	}
+
+	results := server.history.Search(query)
+	if results.Total == 0 {
+		client.messages <- "*** No messages found ***"
+		return
+	}
+	if len(results.Matches) == 0 {
+		client.messages <- fmt.Sprintf("*** There are only %d pages ***", results.Pages)
+		return
+	}
+	lines := []string{fmt.Sprintf("--- Search results: %d, page %d of %d ---", results.Total, results.Page, results.Pages)}
+	for _, entry := range results.Matches {
+		when := entry.Time.Local().Format("2006-01-02 15:04")
+		if entry.Action {
+			lines = append(lines, fmt.Sprintf("  [%s] %s "+ACTION_FORMAT, when, entry.room(), entry.From, entry.Text))
+		} else {
+			lines = append(lines, fmt.Sprintf("  [%s] %s %s: %s", when, entry.room(), entry.From, entry.Text))
+		}
+	}
+	if results.Page < results.Pages {
+		lines = append(lines, fmt.Sprintf("Add page:%d for more", results.Page+1))
+	}
+	client.messages <- strings.Join(lines, "\n")
+}
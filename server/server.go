@@ -0,0 +1,1114 @@
+// Package server implements the chat server: line-based chat over telnet,
+// TCP, TLS and WebSockets, with rooms, accounts, moderation and the admin
+// interfaces. Create one with NewChatServer, call Open, then Serve or
+// ListenAndServe.
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Defaults for the listen address and client limit, see Config
+const (
+	PORT        = ":8888"
+	MAX_CLIENTS = 50
+	WRAP_WIDTH  = 80
+)
+
+type Client struct {
+	conn     net.Conn
+	input    *lineReader
+	json     bool // JSON framing, chosen at login
+	binary   bool // with the frames in CBOR rather than JSON
+	joinedAt time.Time
+	messages chan string
+
+	// When the client's name was first seen, as of login, for the new-user
+	// restrictions
+	firstSeen time.Time
+
+	// Token for resuming the session, the held session it resumed until
+	// run has put it back, and whether its connection was lost rather than
+	// closed on purpose, set by readPump
+	token   string
+	resumed *heldSession
+	lost    bool
+
+	// Room the client is in, guarded by the server's mutex
+	room string
+
+	// Higher priority queues for notices and direct messages, the number
+	// of chat messages dropped because the client fell behind, and whether
+	// it is being disconnected for falling behind or was kicked
+	urgent  chan string
+	direct  chan string
+	dropped atomic.Int64
+	lagging atomic.Bool
+	kicked  atomic.Bool
+	
+	// Connection statistics for the inspector
+	meter      *meteredConn
+	lastActive atomic.Int64
+	readState  atomic.Int32
+	writeState atomic.Int32
+	keepalive  keepaliveState
+
+	// Multi-line paste in progress, personal command aliases, when the
+	// client last chatted or said it was typing, its flood protection,
+	// what it recently sent for the spam checks and the ref of the frame
+	// being handled, owned by readPump
+	paste      pasteBuffer
+	aliases    map[string]string
+	lastChat   time.Time
+	lastTyping time.Time
+	flood      floodState
+	spam       spamState
+	ref        string
+
+	// The client's name, which /nick changes, per-client settings, changed
+	// by the client's own commands, its presence, who last sent the client
+	// a private message, and the account it logged in to with the role that
+	// gives it; read the name with name()
+	mutex       sync.Mutex
+	username    string
+	newline     string
+	wrapWidth   int
+	bell        bool
+	color       bool
+	showIDs     bool
+	status      string
+	awayReason  string
+	autoAway    bool
+	language    string
+	replyTo     string
+	account     string
+	accountRole string
+}
+
+type ChatServer struct {
+	config     *Config
+	clients    map[*Client]bool
+	names      map[string]bool
+	mutes      map[string]time.Time
+	rooms      map[string]*Room
+	register   chan *Client
+	unregister chan *Client
+	control    chan func()
+	mutex      sync.RWMutex
+	sendMutex  sync.Mutex
+	emotes     *EmoteRegistry
+	invites    *InviteRegistry
+	accounts   *AccountStore
+	bans       *BanList
+	shadowBans *ShadowBanList
+	filter     *contentFilter
+	spamChecks []SpamCheck
+	mail       *MailStore
+	roomStore  *RoomStore
+	storage    Storage
+	activity   *ActivityTracker
+	digest     *DailyDigest
+	email      *emailSender
+	resets     *passwordResets
+	twoFactor  *twoFactor
+	history    *HistoryLog
+	events     *EventLog
+	links      *LinkManager
+	backplane  Backplane
+	cluster    *clusterPresence
+	translator *Translator
+	push       *DeliveryQueue // nil unless push notifications are on
+	console    *ConsoleServer // nil unless the admin console is on
+	exporters  []EventExporter
+	auditLog   *auditLog // nil unless the audit log is on
+	logs       *logTail  // recent log lines, for the admin API
+	feed       *feedHub  // nil unless the feed is on
+	recent     *recentMessages
+	receipts   *receiptTracker
+	dedup      *dedupCache
+	held       *heldSessions
+	files      *FileStore // nil unless file sharing is on
+	commands   *CommandRegistry
+	formats    *messageFormats // nil for the built-in formats
+	
+	// This server's name if it is a tenant, and its tenants by name if it
+	// has any
+	tenant  string
+	tenants map[string]*tenantServer
+	
+	// The settings as of startup or the last Reload, by flag name
+	reloadMutex sync.Mutex
+	loaded      map[string]string
+
+	startedAt    time.Time
+	messageCount atomic.Int64
+	metrics      serverMetrics
+	
+	// Closed when run returns; pumps counts the running writePumps
+	stopped chan struct{}
+	pumps   sync.WaitGroup
+	
+	// Every open connection, logged in or not
+	connMutex   sync.Mutex
+	connections map[*meteredConn]*Client
+	traffic     trafficTotals
+	egress      *EgressLimiter
+}
+
+func NewChatServer(config *Config) *ChatServer {
+	server := &ChatServer{
+		config:      config,
+		clients:     make(map[*Client]bool),
+		names:       make(map[string]bool),
+		mutes:       make(map[string]time.Time),
+		rooms:       make(map[string]*Room),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		control:     make(chan func()),
+		emotes:      NewEmoteRegistry(),
+		invites:     NewInviteRegistry(),
+		accounts:    NewAccountStore(),
+		bans:        NewBanList(),
+		shadowBans:  NewShadowBanList(),
+		filter:      newContentFilter(nil),
+		mail:        NewMailStore(),
+		roomStore:   NewRoomStore(),
+		activity:    NewActivityTracker(),
+		digest:      NewDailyDigest(),
+		email:       newEmailSender(config.Email.Secret),
+		resets:      newPasswordResets(),
+		twoFactor:   newTwoFactor(),
+		backplane:   localBackplane{},
+		cluster:     newClusterPresence(),
+		recent:      newRecentMessages(),
+		receipts:    newReceiptTracker(),
+		dedup:       newDedupCache(),
+		held:        newHeldSessions(),
+		logs:        newLogTail(),
+		startedAt:   time.Now(),
+		stopped:     make(chan struct{}),
+		connections: make(map[*meteredConn]*Client),
+		egress:      NewEgressLimiter(config.EgressKBPerSec),
+		loaded:      config.values(),
+	}
+	server.commands = server.builtinCommands()
+	return server
+}
+
+// run adds and removes clients, one at a time, until the server shuts down.
+// Admin API operations come in on the control channel and run here too, so
+// they see the tables between one join or leave and the next.
+//
+// Locking: server.mutex guards the client, name, room and mute tables and
+// each client's room. Messages are delivered by send, from any goroutine,
+// without blocking and without run's help, so run never waits on itself.
+// A client's messages channel is closed only by run (or shutdown), under
+// the write lock and once the client is out of the tables.
+func (server *ChatServer) run(ctx context.Context) {
+	defer close(server.stopped)
+	
+	for {
+		select {
+		case <-ctx.Done():
+			server.shutdown()
+			return
+		
+		case client := <-server.register:
+			if client.resumed != nil {
+				server.resume(client)
+				continue
+			}
+			server.mutex.Lock()
+			server.clients[client] = true
+			server.enterRoom(client, LOBBY)
+			server.mutex.Unlock()
+			server.activity.Joined(client)
+			server.exportEvent(EVENT_JOIN, client, "")
+			server.relay(LINK_JOIN, "", client.name(), "")
+			
+			// Send welcome message
+			joinMsg := membershipLine(protocol.EVENT_JOIN, client.name(), "")
+			client.logger().Info("Joined")
+			server.notifyMembership("", joinMsg)
+			
+			// Send user list
+			server.sendUserList(LOBBY)
+
+		case client := <-server.unregister:
+			// A client that only lost its connection keeps its name
+			// while it may resume
+			hold := server.holds(client)
+			server.mutex.Lock()
+			room := client.room
+			if _, ok := server.clients[client]; ok {
+				server.exitRoom(client)
+				delete(server.clients, client)
+				if !hold {
+					delete(server.names, strings.ToLower(client.name()))
+				}
+				// writePump closes the connection once it has sent
+				// what is left, such as the reason for leaving
+				close(client.messages)
+			}
+			server.mutex.Unlock()
+			if hold {
+				server.hold(client, room)
+				continue
+			}
+			server.leave(client, room)
+		
+		case operation := <-server.control:
+			operation()
+		}
+	}
+}
+
+// leave tells everyone a client has left, after run has taken it out of
+// room.
+func (server *ChatServer) leave(client *Client, room string) {
+	server.activity.Left(client)
+	server.exportEvent(EVENT_LEAVE, client, "")
+	server.relay(LINK_LEAVE, "", client.name(), "")
+	
+	// Send leave message
+	leaveMsg := membershipLine(protocol.EVENT_LEAVE, client.name(), "")
+	client.logger().Info("Left")
+	server.notifyMembership("", leaveMsg)
+	
+	// Send updated user list
+	server.sendUserList(room)
+}
+
+// send delivers text to the members of room, or to everyone when room is
+// empty. Chatter for a client that has fallen behind is handled by the
+// backpressure policy, which only blocks under BACKPRESSURE_BLOCK, and a
+// client that can't even take a notice is disconnected. Sends are
+// serialized so that everyone sees messages in the same order. The caller
+// must not hold server.mutex.
+func (server *ChatServer) send(room, text string, priority int) {
+	server.sendMutex.Lock()
+	defer server.sendMutex.Unlock()
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	
+	members := server.clients
+	if room != "" {
+		r, ok := server.rooms[room]
+		if !ok {
+			return
+		}
+		members = r.members
+	}
+	
+	var deadline time.Time
+	for client := range members {
+		if client.deliver(text, priority) {
+			continue
+		}
+		if priority == PRIORITY_CHATTER {
+			server.backpressure(client, text, &deadline)
+			continue
+		}
+		// Client can't even keep up with notices. Closing the connection
+		// ends its readPump, which unregisters it.
+		if client.lagging.CompareAndSwap(false, true) {
+			server.metrics.droppedClients.Add(1)
+			client.logger().Warn("Client can't keep up with notices, disconnecting")
+			client.conn.Close()
+		}
+	}
+}
+
+// notify sends a system notice to the members of room, or to everyone.
+func (server *ChatServer) notify(room, text string) {
+	server.send(room, text, PRIORITY_SYSTEM)
+}
+
+// userNames lists the names of the local clients.
+func (server *ChatServer) userNames() []string {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	
+	var users []string
+	for client := range server.clients {
+		users = append(users, client.name())
+	}
+	return users
+}
+
+// sendUserList tells a room who is in it. Users on linked servers and
+// other cluster nodes are shown in the lobby.
+func (server *ChatServer) sendUserList(room string) {
+	users := server.roomMembers(room)
+	if room == LOBBY {
+		users = append(users, server.cluster.Users()...)
+	}
+	if room == LOBBY && server.links != nil {
+		users = append(users, server.links.RemoteUsers()...)
+	}
+	
+	if len(users) > 0 && !server.crowded(room) {
+		userList := fmt.Sprintf("*** Users in %s: %s ***", room, strings.Join(users, ", "))
+		server.send(room, userList, PRIORITY_CHATTER)
+	}
+}
+
+func (server *ChatServer) handleClient(ctx context.Context, conn net.Conn) {
+	server.serveClient(ctx, conn, newLineReader(conn, server.config.MaxMessageBytes))
+}
+
+// serveClient logs a client in and serves it, reading from input, which
+// may hold what was read before another server handed the connection on.
+func (server *ChatServer) serveClient(ctx context.Context, conn net.Conn, input *lineReader) {
+	// Once the client is registered, writePump closes the connection after
+	// sending what is left
+	registered := false
+	defer func() {
+		if !registered {
+			conn.Close()
+		}
+	}()
+	logger := slog.With("remote", conn.RemoteAddr().String())
+	
+	input.limit = server.config.MaxMessageBytes
+	login := &loginSession{conn: conn, input: input}
+	if server.config.LoginTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(server.config.LoginTimeout))
+	}
+	
+	// Invite-only servers ask for a code first; it is used up once the
+	// client is actually let in. Either prompt can be answered with a
+	// token to resume a session instead.
+	var invite string
+	var held *heldSession
+	var resuming bool
+	for server.config.InviteOnly && held == nil && invite == "" {
+		login.ask("Invite code: ")
+		code, err := login.read(false)
+		if err != nil {
+			logger.Info("Error reading invite code", "err", err)
+			return
+		}
+		if held, resuming = server.resumeAnswer(login, code); resuming {
+			continue
+		}
+		if tenant, ok := server.tenantAnswer(login, code); ok {
+			if tenant != nil {
+				registered = true
+				tenant.handOff(ctx, conn, input)
+				return
+			}
+			continue
+		}
+		if !server.invites.Valid(code) {
+			login.refuse("Invalid invite code.")
+			return
+		}
+		invite = code
+	}
+	
+	// Get username, asking again until we get a free one. SSH users have
+	// answered already with the name they connected as, and the key they
+	// proved stands in for the password of an account it's saved with.
+	var name, account string
+	var sshUser, sshKey string
+	if session, ok := sshSessionOf(conn); ok {
+		sshUser, sshKey = session.sshIdentity()
+	}
+	for held == nil {
+		line := sshUser
+		if sshUser != "" {
+			sshUser = ""
+		} else {
+			login.ask("Enter your username: ")
+			var err error
+			if line, err = login.read(false); err != nil {
+				logger.Info("Error reading username", "err", err)
+				return
+			}
+		}
+		if held, resuming = server.resumeAnswer(login, line); resuming {
+			continue
+		}
+		if tenant, ok := server.tenantAnswer(login, line); ok {
+			if tenant != nil {
+				registered = true
+				tenant.handOff(ctx, conn, input)
+				return
+			}
+			continue
+		}
+		
+		name = strings.TrimSpace(line)
+		if !validName(name) {
+			login.refuse("Username must be " + NAME_RULE + ".")
+			continue
+		}
+		if ban := server.bans.CheckName(name); ban != nil {
+			logger.Warn("Banned user tried to log in", "user", name)
+			server.audit(AuditEntry{Event: AUDIT_REFUSED, Remote: conn.RemoteAddr().String(), Target: name, Detail: "banned name"})
+			login.refuse(ban.describe())
+			return
+		}
+		
+		// Registered names need their password
+		if keyed, err := server.accounts.VerifyKey(name, sshKey); err == nil {
+			account, name = keyed, keyed
+		} else if server.accounts.Exists(name) {
+			login.ask("Password: ")
+			password, err := login.read(true)
+			if err != nil {
+				logger.Info("Error reading password", "user", name, "err", err)
+				return
+			}
+			if account, err = server.accounts.Verify(name, password); err != nil {
+				logger.Warn("Failed login", "account", name)
+				server.audit(AuditEntry{Event: AUDIT_LOGIN_FAILED, Remote: conn.RemoteAddr().String(), Target: name})
+				time.Sleep(LOGIN_FAILURE_DELAY)
+				login.refuse("Wrong password.")
+				return
+			}
+			name = account
+		}
+		
+		// Accounts with two-factor login on need the code too
+		if account != "" && server.accounts.TOTP(account) != "" && !server.askTOTP(login, account, logger) {
+			return
+		}
+		
+		if server.claimName(name) {
+			break
+		}
+		login.refuse(fmt.Sprintf("%s is already in use. Pick another name.", name))
+		account = ""
+	}
+	// A resumed session keeps its claim on the name
+	if held != nil {
+		name, account = held.client.name(), held.client.loggedInAs()
+	}
+	conn.SetReadDeadline(time.Time{})
+	
+	// Telnet clients edit lines locally; ask for linemode and their
+	// window size if they negotiate
+	if tc, ok := conn.(*telnetConn); ok && !login.json {
+		tc.requestLineMode()
+		tc.requestWindowSize()
+	}
+	
+	// Create client
+	client := &Client{
+		conn:      conn,
+		input:     input,
+		username:  name,
+		joinedAt:  time.Now(),
+		firstSeen: server.activity.FirstSeen(name),
+		newline:   defaultNewline(conn),
+		json:      login.json,
+		binary:    login.binary,
+		color:     slices.Contains(login.capabilities, protocol.CAPABILITY_COLOR),
+		keepalive: keepaliveState{
+			done: make(chan struct{}),
+		},
+		messages: make(chan string, 256),
+		urgent:   make(chan string, PRIORITY_QUEUE_SIZE),
+		direct:   make(chan string, PRIORITY_QUEUE_SIZE),
+		resumed:  held,
+	}
+	server.issueToken(client)
+	if held != nil {
+		client.restore(held.client)
+	}
+	
+	if account != "" {
+		server.setAccount(client, account)
+		if held != nil {
+			server.auditClient(AUDIT_LOGIN, client, account, "resumed session")
+		} else {
+			server.auditClient(AUDIT_LOGIN, client, account, "")
+		}
+	}
+	
+	// Check max clients; a resumed session already had its place
+	server.mutex.RLock()
+	clientCount := len(server.clients)
+	server.mutex.RUnlock()
+	
+	if held == nil && clientCount >= server.config.live().MaxClients {
+		login.refuse("Server is full. Try again later.")
+		server.releaseName(name)
+		return
+	}
+	
+	if invite != "" {
+		if err := server.invites.Redeem(invite); err != nil {
+			login.refuse("Invalid invite code.")
+			server.releaseName(name)
+			return
+		}
+		client.logger().Info("Joined with invite", "code", normalizeInviteCode(invite))
+	}
+	
+	// Register client, unless the server has started shutting down
+	server.attachClient(client)
+	select {
+	case server.register <- client:
+	case <-ctx.Done():
+		server.releaseName(name)
+		return
+	}
+	
+	// Start writing (and pinging) on goroutines of their own. Room traffic
+	// can fill the client's queue as soon as it is registered, so this
+	// comes before anything else is queued for it.
+	registered = true
+	server.pumps.Add(1)
+	go func() {
+		defer server.pumps.Done()
+		server.writePump(client)
+	}()
+	go server.keepalive(ctx, client)
+	
+	// Send welcome message to client; run has already welcomed back
+	// one that resumed
+	if held == nil {
+		welcomeMsg := fmt.Sprintf("=== Welcome to Go Chat Server ===\nYour username: %s\nType /help for commands, 'exit' to quit\n===================================\n\n", name)
+		client.messages <- welcomeMsg
+	}
+	server.sendCommands(client)
+	server.sendToken(client)
+	if held == nil {
+		server.sendMOTD(client)
+		server.sendTopic(client, LOBBY)
+		if account != "" {
+			server.deliverMail(client, account)
+		}
+	}
+	
+	// Read on this goroutine until the client leaves
+	server.readPump(ctx, client)
+}
+
+func (server *ChatServer) readPump(ctx context.Context, client *Client) {
+	defer func() {
+		client.readState.Store(PUMP_EXITED)
+		close(client.keepalive.done)
+		select {
+		case server.unregister <- client:
+		case <-server.stopped:
+		}
+	}()
+	
+	// Stop reading when the server shuts down
+	stop := context.AfterFunc(ctx, func() { client.conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	
+	for {
+		client.readState.Store(PUMP_READING)
+		client.conn.SetReadDeadline(server.readDeadline(client))
+		if ctx.Err() != nil {
+			break
+		}
+		line, err := client.input.ReadLine()
+		if errors.Is(err, errLineTooLong) {
+			client.messages <- fmt.Sprintf("*** Message too long (the limit is %d bytes) ***", server.config.MaxMessageBytes)
+			continue
+		}
+		if errors.Is(err, protocol.ErrFrameTooLong) {
+			client.logger().Info("Disconnected for an overlong frame")
+			client.deliver(fmt.Sprintf("*** Frame too long (the limit is %d bytes); disconnecting ***", server.config.MaxMessageBytes), PRIORITY_SYSTEM)
+			break
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() == nil {
+			client.logger().Info("Disconnected due to inactivity")
+			client.deliver("*** Disconnected due to inactivity ***", PRIORITY_SYSTEM)
+			break
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				client.logger().Info("Error reading from client", "err", err)
+				client.lost = true
+			}
+			break
+		}
+		if client.json {
+			if protocol.IsTyping(line) {
+				server.sendTyping(client)
+				continue
+			}
+			frame, decoded, err := decodeFrame(line)
+			if err != nil {
+				client.messages <- fmt.Sprintf("*** %v ***", err)
+				continue
+			}
+			if frame.Type == protocol.FRAME_READ {
+				server.markRead(client, frame.ID)
+				continue
+			}
+			// A message sent again after a reconnect only gets its ack again
+			if id, ok := server.dedup.lookup(client.name(), frame.Ref); ok {
+				client.logger().Debug("Dropped retransmitted message", "ref", frame.Ref, "id", id)
+				receipt(client, RECEIPT_SENT, id, frame.Ref)
+				continue
+			}
+			line, client.ref = decoded, frame.Ref
+		}
+		if protocol.IsPong(line) {
+			client.keepalive.answersPings.Store(true)
+			continue
+		}
+		if !utf8.ValidString(line) {
+			client.messages <- "*** Messages must be UTF-8 text ***"
+			continue
+		}
+		client.readState.Store(PUMP_HANDLING)
+		client.touch()
+		server.noticeActivity(client)
+		server.metrics.linesIn.Add(1)
+		
+		// Pasted blocks keep their indentation and go out as one message
+		if block, ok := client.pasteLine(line); ok {
+			block = sanitizeText(block)
+			if strings.TrimSpace(block) == "" {
+				continue
+			}
+			if drop, kicked := server.checkFlood(client); kicked {
+				break
+			} else if !drop && server.allowChat(client, block) {
+				server.sendChat(client, block)
+			}
+			continue
+		}
+		
+		message := client.resolveAlias(strings.TrimSpace(sanitizeText(line)))
+		
+		if message == "exit" {
+			break
+		}
+		
+		// Flood protection covers commands as well as chat
+		if message != "" {
+			if drop, kicked := server.checkFlood(client); kicked {
+				break
+			} else if drop {
+				continue
+			}
+		}
+		
+		if server.commands.Dispatch(client, message) {
+			continue
+		}
+		
+		// Anything else is chat, with "//" escaping a leading slash
+		message = strings.TrimPrefix(message, "/")
+		
+		if len(message) > 0 && server.allowChat(client, message) {
+			server.sendChat(client, message)
+		}
+	}
+}
+
+// sendChat formats a message from client and broadcasts it to the client's
+// room. Multi-line
+// messages and code blocks start on the line after the sender's name.
+func (server *ChatServer) sendChat(client *Client, text string) {
+	room := server.roomOf(client)
+	if !server.checkSpam(client, room, text) {
+		return
+	}
+	text, ok := server.filterChat(client, room, text)
+	if !ok {
+		return
+	}
+	parts := parseMessage(text)
+	server.emotes.Expand(parts)
+	message := renderText(parts)
+	
+	// Add timestamp and format message
+	now := time.Now()
+	timestamp := now.Format("15:04:05")
+	separator := " "
+	if strings.Contains(message, "\n") || hasCode(parts) {
+		separator = "\n"
+	}
+	formattedMsg := fmt.Sprintf("[%s] %s:%s%s", timestamp, client.name(), separator, message)
+	
+	tag := server.newMessage(client, client.name(), room, message, false)
+	server.recordChat(client, room, tag.id, text, message, false)
+	frame := protocol.Frame{Type: protocol.FRAME_CHAT, ID: tag.id, From: client.name(), Room: room, Body: message, Timestamp: now, Parts: frameParts(parts)}
+	server.sendFrom(client, room, withFrame(frame, tagMessage(tag, formattedMsg)), PRIORITY_CHATTER)
+	server.acknowledge(client, tag.id)
+	if server.translator != nil && !hasCode(parts) && !server.shadowed(client) {
+		server.translator.queue(func() { server.translateChat(client, room, now, message) })
+	}
+}
+
+// recordChat does the bookkeeping for a chat message or action: logs,
+// statistics, exported events, linked servers, push notifications and
+// history. text is what the client typed and message what is shown.
+// Messages from shadow-banned clients are only logged.
+func (server *ChatServer) recordChat(client *Client, room, id, text, message string, action bool) {
+	kind, eventType, linkType := "Chat", EVENT_MESSAGE, LINK_MESSAGE
+	if action {
+		kind, eventType, linkType = "Action", EVENT_ACTION, LINK_ACTION
+	}
+	
+	if server.shadowed(client) {
+		client.logger().Info(kind, "room", room, "text", message, "shadow_banned", true)
+		return
+	}
+	client.logger().Info(kind, "room", room, "text", message)
+	server.activity.Message(client)
+	server.digest.Record(client.name())
+	server.messageCount.Add(1)
+	// The event log keeps what was typed, and exporters get what is shown
+	event := server.record(ChatEvent{Type: eventType, User: client.name(), Room: room, ID: id, Text: text})
+	event.Text, event.Remote = message, client.conn.RemoteAddr().String()
+	server.export(event)
+	server.relay(linkType, room, client.name(), message)
+	server.pushMentions(client, room, text)
+}
+
+func (server *ChatServer) writePump(client *Client) {
+	defer client.conn.Close()
+	defer client.writeState.Store(PUMP_EXITED)
+	
+	// Messages already queued go out in the same write, except over
+	// WebSocket, where each is a message of its own
+	limit := WRITE_BATCH_BYTES
+	if _, ok := client.conn.(*wsConn); ok {
+		limit = 0
+	}
+	var batch []string
+	for {
+		client.writeState.Store(PUMP_WAITING)
+		message, ok := client.next()
+		if !ok {
+			return
+		}
+		
+		client.writeState.Store(PUMP_WRITING)
+		if server.config.WriteTimeout > 0 {
+			client.conn.SetWriteDeadline(time.Now().Add(server.config.WriteTimeout))
+		}
+		buffer := writeBuffers.Get().(*bytes.Buffer)
+		batch = batch[:0]
+		for {
+			if client.binary {
+				buffer.Write(protocol.EncodeCBOR(client.colorFrame(server.frameFor(client, message))))
+			} else if client.json {
+				buffer.Write(protocol.Encode(client.colorFrame(server.frameFor(client, message))))
+			} else {
+				buffer.Write(client.encodeOutput(server.textFor(client, message)))
+			}
+			batch = append(batch, message)
+			if buffer.Len() >= limit || client.queued() == 0 {
+				break
+			}
+			if message, ok = client.next(); !ok {
+				break
+			}
+		}
+		_, err := client.conn.Write(buffer.Bytes())
+		putWriteBuffer(buffer)
+		if err != nil {
+			client.logger().Info("Error writing to client", "err", err)
+			
+			// Keep emptying the queues until the client is removed, so
+			// nothing blocks sending to it
+			client.conn.Close()
+			for {
+				if _, ok := client.next(); !ok {
+					return
+				}
+			}
+		}
+		server.metrics.delivered.Add(int64(len(batch)))
+		for _, message := range batch {
+			server.delivered(client, message)
+		}
+	}
+}
+
+// Open loads everything the server keeps on disk and opens its logs, queues
+// and console socket. Call it once, before Serve. The configured logger
+// becomes the default slog logger, which the log package also writes to.
+func (server *ChatServer) Open() error {
+	// Tenants log to the main server's log
+	if server.tenant == "" {
+		logger, err := server.config.Log.logger(server.logs)
+		if err != nil {
+			return fmt.Errorf("opening log: %v", err)
+		}
+		slog.SetDefault(logger)
+	}
+	var err error
+	if server.auditLog, err = server.config.Audit.open(); err != nil {
+		return fmt.Errorf("opening audit log: %v", err)
+	}
+	
+	formats, err := server.config.Formats.compile()
+	if err != nil {
+		return fmt.Errorf("message formats: %v", err)
+	}
+	server.formats = formats
+	filters, err := server.config.Filter.load()
+	if err != nil {
+		return fmt.Errorf("loading filter: %v", err)
+	}
+	server.filter = newContentFilter(filters)
+	if server.spamChecks, err = server.config.Spam.chain(); err != nil {
+		return fmt.Errorf("spam checks: %v", err)
+	}
+	storage, err := openStorage(server.config.Storage, server.config.StoragePool)
+	if err != nil {
+		return fmt.Errorf("opening storage: %v", err)
+	}
+	server.storage = storage
+	if err := server.accounts.Load(storage); err != nil {
+		return fmt.Errorf("loading accounts: %v", err)
+	}
+	if err := server.accounts.LoadCredentials(server.config.CredentialsFile); err != nil {
+		return fmt.Errorf("loading credentials: %v", err)
+	}
+	server.warnUnprovisioned()
+	if err := server.bans.Load(storage); err != nil {
+		return fmt.Errorf("loading bans: %v", err)
+	}
+	if err := server.invites.Load(storage); err != nil {
+		return fmt.Errorf("loading invites: %v", err)
+	}
+	if err := server.mail.Load(storage); err != nil {
+		return fmt.Errorf("loading mail: %v", err)
+	}
+	if err := server.roomStore.Load(storage); err != nil {
+		return fmt.Errorf("loading rooms: %v", err)
+	}
+	if err := server.activity.Load(storage); err != nil {
+		return fmt.Errorf("loading activity: %v", err)
+	}
+	if err := server.emotes.Load(storage); err != nil {
+		return fmt.Errorf("loading emotes: %v", err)
+	}
+	go server.activity.saveLoop()
+	
+	server.history = NewHistoryLog(storage)
+	if err := server.history.BuildIndex(); err != nil {
+		return fmt.Errorf("indexing history: %v", err)
+	}
+	server.events = NewEventLog(storage, server.history)
+	server.roomStore.OnChange(server.recordRoom)
+	
+	if server.config.Translate.URL != "" {
+		server.translator = NewTranslator(server.config.Translate.URL, server.config.Translate.APIKey)
+	}
+	
+	if server.config.EventsFile != "" {
+		exporter, err := NewFileExporter(server.config.EventsFile)
+		if err != nil {
+			return fmt.Errorf("opening %s: %v", server.config.EventsFile, err)
+		}
+		server.exporters = append(server.exporters, exporter)
+	}
+	
+	if server.config.Kafka.Brokers != "" {
+		exporter, err := NewKafkaExporter(server.config.Kafka)
+		if err != nil {
+			return fmt.Errorf("kafka: %v", err)
+		}
+		server.exporters = append(server.exporters, exporter)
+	}
+	
+	if len(server.config.Webhooks) > 0 {
+		queue, err := OpenDeliveryQueue(WEBHOOK_QUEUE_DIR, server.config.WebhookSecret)
+		if err != nil {
+			return fmt.Errorf("opening webhook queue: %v", err)
+		}
+		for _, hook := range server.config.Webhooks {
+			server.exporters = append(server.exporters, NewWebhookExporter(hook, queue))
+		}
+	}
+	
+	if server.config.Push.URL != "" {
+		if server.push, err = OpenDeliveryQueue(PUSH_QUEUE_DIR, server.config.Push.Secret); err != nil {
+			return fmt.Errorf("opening push queue: %v", err)
+		}
+	}
+	
+	if server.config.FeedListen != "" {
+		server.feed = newFeedHub()
+		server.exporters = append(server.exporters, server.feed)
+	}
+	
+	// Admin console
+	if server.config.ConsoleSocket != "" {
+		console := NewConsoleServer(server)
+		if err := console.Listen(server.config.ConsoleSocket); err != nil {
+			return fmt.Errorf("opening console socket: %v", err)
+		}
+		server.exporters = append(server.exporters, console)
+		server.console = console
+	}
+	
+	for _, spec := range server.config.Bots {
+		if err := server.startBot(spec); err != nil {
+			return err
+		}
+	}
+	return server.openTenants()
+}
+
+// startServices starts the HTTP listeners, including the inbound webhook,
+// file sharing and email verification, server links and cluster backplane.
+func (server *ChatServer) startServices(ctx context.Context) error {
+	// Admin API, public status page and metrics, on one listener for
+	// those that share a port
+	listeners := make(map[string]*http.ServeMux)
+	mount := func(port, pattern string, handler http.Handler) {
+		if listeners[port] == nil {
+			listeners[port] = http.NewServeMux()
+		}
+		listeners[port].Handle(pattern, handler)
+	}
+	if server.config.AdminListen != "" {
+		mount(server.config.AdminListen, "/admin/", server.adminHandler())
+	}
+	if server.config.StatusListen != "" {
+		mount(server.config.StatusListen, "/", server.statusHandler())
+	}
+	if server.config.MetricsListen != "" {
+		mount(server.config.MetricsListen, "/metrics", server.metricsHandler())
+	}
+	if server.config.InboundListen != "" {
+		if !server.claimName(server.config.InboundName) {
+			return fmt.Errorf("inbound name %q is taken by a bot", server.config.InboundName)
+		}
+		mount(server.config.InboundListen, "/hooks/", server.inboundHandler())
+	}
+	if server.config.FilesListen != "" {
+		server.startFiles(ctx.Done())
+		mount(server.config.FilesListen, "/files/", server.filesHandler())
+	}
+	if server.config.FeedListen != "" {
+		mount(server.config.FeedListen, "/feed", server.feedHandler())
+	}
+	if server.config.Email.Listen != "" {
+		mount(server.config.Email.Listen, "/verify", server.verifyHandler())
+	}
+	for port, mux := range listeners {
+		go serveHTTP(ctx, port, mux, nil)
+	}
+	// WebSocket listener for browsers
+	if server.config.WebSocketListen != "" {
+		go serveHTTP(ctx, server.config.WebSocketListen, server.websocketHandler(ctx), server.proxied)
+	}
+	if server.config.GRPCListen != "" {
+		if err := server.startGRPC(ctx); err != nil {
+			return fmt.Errorf("starting gRPC API: %v", err)
+		}
+	}
+	if server.config.QUICListen != "" {
+		if err := server.startQUIC(ctx); err != nil {
+			return fmt.Errorf("starting QUIC listener: %v", err)
+		}
+	}
+	if server.config.SSHListen != "" {
+		if err := server.startSSH(ctx); err != nil {
+			return fmt.Errorf("starting SSH listener: %v", err)
+		}
+	}
+	
+	// Link to other servers
+	if server.config.Link.Secret != "" {
+		server.links = NewLinkManager(server)
+		if server.config.Link.Listen != "" {
+			if err := server.links.Listen(server.config.Link.Listen); err != nil {
+				return fmt.Errorf("starting link listener: %v", err)
+			}
+		}
+		for _, peer := range server.config.Link.peers() {
+			go server.links.Connect(peer, 0)
+		}
+	}
+	return server.startBackplane(ctx)
+}
+
+// Serve accepts chat connections on the listeners until ctx is cancelled,
+// then shuts down: clients are told, their queues are flushed and every
+// connection is closed before it returns. Serve closes the listeners.
+func (server *ChatServer) Serve(ctx context.Context, listeners ...net.Listener) error {
+	closeAll := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	defer closeAll()
+	if err := server.startServices(ctx); err != nil {
+		return err
+	}
+	
+	// Start server
+	go server.run(ctx)
+	tenants := server.serveTenants(ctx)
+	go server.digestLoop()
+	server.startAnnouncements(ctx)
+	server.startAutoAway(ctx)
+	
+	context.AfterFunc(ctx, closeAll)
+	var accepting sync.WaitGroup
+	for _, listener := range listeners {
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			server.accept(ctx, listener)
+		}()
+	}
+	accepting.Wait()
+	// A tenant may have no listeners of its own
+	<-ctx.Done()
+	
+	slog.Info("Shutting down server")
+	server.drain()
+	server.activity.Save()
+	if server.storage != nil {
+		if err := server.storage.Close(); err != nil {
+			slog.Error("Error closing storage", "err", err)
+		}
+	}
+	tenants.Wait()
+	return nil
+}
+
+// ListenAndServe opens the configured listeners (TCP, TLS and a Unix
+// socket) and calls Serve.
+func (server *ChatServer) ListenAndServe(ctx context.Context) error {
+	listeners, err := server.listen()
+	if err != nil {
+		return err
+	}
+	
+	fmt.Printf("=== GO CHAT SERVER STARTED ===\n")
+	served := make([]net.Listener, len(listeners))
+	for i, listener := range listeners {
+		fmt.Printf("Listening on %s (%s)\n", listener.Addr(), listener.scheme)
+		served[i] = listener
+	}
+	fmt.Printf("Waiting for connections...\n")
+	fmt.Printf("Press Ctrl+C to stop\n\n")
+	
+	return server.Serve(ctx, served...)
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shadow bans, for spammers who come back under a new name whenever they
+// are banned. A shadow-banned user's chat, actions, private messages and
+// edits are shown back to them, and acked, as if they had gone out, but
+// nobody else gets them and they stay out of the history, exported events
+// and linked servers; their typing and reactions are dropped. Admins
+// shadow-ban a name, an address or a range of addresses with "/shadowban
+// <user|ip|cidr> [duration] [reason]". Like mutes, shadow bans aren't
+// saved: they last until they run out, are lifted with /unshadowban, or
+// the server restarts. A shadow-banned name that changes with /nick stays
+// shadow-banned.
+
+// ShadowBanList holds the shadow bans, by the same keys as bans.
+type ShadowBanList struct {
+	mutex sync.Mutex
+	bans  map[string]*Ban
+}
+
+func NewShadowBanList() *ShadowBanList {
+	return &ShadowBanList{bans: make(map[string]*Ban)}
+}
+
+// Add shadow-bans a target, replacing any earlier shadow ban on it.
+func (list *ShadowBanList) Add(ban Ban) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	ban.CreatedAt = time.Now()
+	list.bans[banKey(ban.Target, ban.Address)] = &ban
+}
+
+// Remove lifts a shadow ban, reporting whether there was one.
+func (list *ShadowBanList) Remove(target string) bool {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	key := banKey(addressTarget(target))
+	if _, ok := list.bans[key]; !ok {
+		return false
+	}
+	delete(list.bans, key)
+	return true
+}
+
+// Covers returns the shadow ban on a name or on the address it connects
+// from, if there is one still in force.
+func (list *ShadowBanList) Covers(name, host string) *Ban {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	var found *Ban
+	for key, ban := range list.bans {
+		matches := strings.EqualFold(ban.Target, name)
+		if ban.Address {
+			matches = ban.covers(host)
+		}
+		if !matches {
+			continue
+		}
+		if ban.expired() {
+			delete(list.bans, key)
+			continue
+		}
+		found = ban
+	}
+	return found
+}
+
+// rename moves a shadow ban on a name to the name it has changed to.
+func (list *ShadowBanList) rename(old, name string) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	ban, ok := list.bans[banKey(old, false)]
+	if !ok {
+		return
+	}
+	delete(list.bans, banKey(old, false))
+	ban.Target = name
+	list.bans[banKey(name, false)] = ban
+}
+
+// List returns the shadow bans in force, newest first.
+func (list *ShadowBanList) List() []Ban {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	bans := make([]Ban, 0, len(list.bans))
+	for key, ban := range list.bans {
+		if ban.expired() {
+			delete(list.bans, key)
+			continue
+		}
+		bans = append(bans, *ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].CreatedAt.After(bans[j].CreatedAt) })
+	return bans
+}
+
+// shadowed reports whether the client is shadow-banned.
+func (server *ChatServer) shadowed(client *Client) bool {
+	return server.shadowBans.Covers(client.name(), remoteHost(client.conn)) != nil
+}
+
+// sendFrom is send for a message from sender: a shadow-banned sender's
+// messages go to the sender alone.
+func (server *ChatServer) sendFrom(sender *Client, room, text string, priority int) {
+	if server.shadowed(sender) {
+		sender.deliver(text, priority)
+		return
+	}
+	server.send(room, text, priority)
+}
+
+// handleShadowBanCommand implements "/shadowban [<user|ip|cidr> [duration]
+// [reason]]", which lists the shadow bans without arguments, and
+// "/unshadowban <user|ip|cidr>". The command registry keeps them to
+// admins.
+func (server *ChatServer) handleShadowBanCommand(client *Client, message string) {
+	command, args, _ := strings.Cut(message, " ")
+	fields := strings.Fields(args)
+
+	switch {
+	case command == "/unshadowban":
+		if len(fields) != 1 {
+			client.messages <- "*** Usage: /unshadowban <user|ip|cidr> ***"
+			return
+		}
+		if !server.shadowBans.Remove(fields[0]) {
+			client.messages <- fmt.Sprintf("*** %s isn't shadow-banned ***", fields[0])
+			return
+		}
+		client.logger().Info("Lifted shadow ban", "target", fields[0])
+		client.messages <- fmt.Sprintf("*** Lifted the shadow ban on %s ***", fields[0])
+
+	case len(fields) == 0:
+		bans := server.shadowBans.List()
+		if len(bans) == 0 {
+			client.messages <- "*** Nobody is shadow-banned ***"
+			return
+		}
+		lines := []string{"--- Shadow bans ---"}
+		for _, ban := range bans {
+			line := fmt.Sprintf("  %s by %s", ban.Target, ban.By)
+			if !ban.Until.IsZero() {
+				line += fmt.Sprintf(", %s left", time.Until(ban.Until).Round(time.Second))
+			}
+			if ban.Reason != "" {
+				line += fmt.Sprintf(" (%s)", ban.Reason)
+			}
+			lines = append(lines, line)
+		}
+		client.messages <- strings.Join(lines, "\n")
+
+	default:
+		ban := parseBan(fields, client.name())
+		if !ban.Address && !server.canModerate(client, ban.Target) {
+			return
+		}
+		server.shadowBans.Add(ban)
+		client.logger().Info("Shadow-banned", "target", ban.Target, "until", ban.Until, "reason", ban.Reason)
+		client.messages <- fmt.Sprintf("*** Shadow-banned %s; they won't be told ***", ban.Target)
+	}
+}
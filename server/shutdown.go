@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// On SIGINT or SIGTERM the server stops accepting connections, tells
+// everyone, and gives clients this long to be sent what is queued for them
+// before the remaining connections are closed.
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
+const SHUTDOWN_NOTICE = "*** Server shutting down ***"
+
+// shutdown takes over from run's loop once the server is stopping. Every
+// readPump stops reading when the context is cancelled and unregisters its
+// client; closing the client's queue then lets its writePump send what is
+// left and exit.
+func (server *ChatServer) shutdown() {
+	server.mutex.RLock()
+	for client := range server.clients {
+		client.deliver(SHUTDOWN_NOTICE, PRIORITY_SYSTEM)
+	}
+	server.mutex.RUnlock()
+
+	deadline := time.After(SHUTDOWN_TIMEOUT)
+	for {
+		server.mutex.RLock()
+		remaining := len(server.clients)
+		server.mutex.RUnlock()
+		if remaining == 0 {
+			return
+		}
+
+		select {
+		case client := <-server.unregister:
+			server.mutex.Lock()
+			if _, ok := server.clients[client]; ok {
+				server.exitRoom(client)
+				delete(server.clients, client)
+				delete(server.names, strings.ToLower(client.name()))
+				close(client.messages)
+			}
+			server.mutex.Unlock()
+			server.activity.Left(client)
+			server.exportEvent(EVENT_LEAVE, client, "")
+
+		case <-deadline:
+			slog.Warn("Gave up waiting for clients", "remaining", remaining)
+			return
+		}
+	}
+}
+
+// drain waits for run to finish shutting down and for the writePumps to
+// flush, then closes whatever connections are still open.
+func (server *ChatServer) drain() {
+	flushed := make(chan struct{})
+	go func() {
+		<-server.stopped
+		server.pumps.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+	case <-time.After(SHUTDOWN_TIMEOUT):
+		slog.Warn("Timed out flushing clients")
+	}
+
+	server.connMutex.Lock()
+	open := make([]net.Conn, 0, len(server.connections))
+	for meter := range server.connections {
+		open = append(open, meter)
+	}
+	server.connMutex.Unlock()
+	for _, conn := range open {
+		conn.Close()
+	}
+}
+
+// serveHTTP serves handler on addr until the context is cancelled, on
+// the listener wrap returns if it isn't nil. Connections that have been
+// hijacked, like WebSockets, are left open.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler, wrap func(net.Listener) net.Listener) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if wrap != nil {
+		listener = wrap(listener)
+	}
+	httpServer := &http.Server{Handler: handler}
+	context.AfterFunc(ctx, func() { httpServer.Close() })
+	if err := httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
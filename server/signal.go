@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// WebRTC signaling; see the protocol package for the message format.
+
+// handleSignalCommand implements "/rtc <type> <user> [payload]", which sends
+// one signaling message straight to another user.
+func (server *ChatServer) handleSignalCommand(client *Client, message string) {
+	fields := strings.SplitN(message, " ", 4)
+	if len(fields) < 3 || !protocol.RTC_TYPES[fields[1]] {
+		client.messages <- "*** Usage: /rtc offer|answer|ice|bye <user> [payload] ***"
+		return
+	}
+	kind, target, payload := fields[1], fields[2], ""
+	if len(fields) == 4 {
+		payload = strings.TrimSpace(fields[3])
+	}
+
+	if payload == "" && kind != protocol.RTC_BYE {
+		client.messages <- fmt.Sprintf("*** /rtc %s needs a payload ***", kind)
+		return
+	}
+	if len(payload) > protocol.MAX_RTC_PAYLOAD {
+		client.messages <- fmt.Sprintf("*** Signaling payloads are limited to %d bytes ***", protocol.MAX_RTC_PAYLOAD)
+		return
+	}
+	if kind == protocol.RTC_OFFER && !server.allowDirect(client, target) {
+		return
+	}
+	if strings.EqualFold(target, client.name()) {
+		client.messages <- "*** You can't signal yourself ***"
+		return
+	}
+
+	peers := server.findClients(target)
+	if len(peers) == 0 {
+		client.messages <- fmt.Sprintf("*** %s is not online here ***", target)
+		return
+	}
+
+	signal := strings.TrimSpace(fmt.Sprintf("%s %s %s %s", protocol.RTC_PREFIX, kind, client.name(), payload))
+	for _, peer := range peers {
+		if !peer.deliver(signal, PRIORITY_DIRECT) {
+			client.messages <- fmt.Sprintf("*** %s is too far behind to take signals right now ***", peer.name())
+		}
+	}
+}
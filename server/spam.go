@@ -0,0 +1,242 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Spam detection, on top of the message rate. Chat and actions go through
+// a chain of spam checks, named in --spam-checks and run in that order;
+// the first to object stops the message, and tells the sender why. The
+// built-in checks catch the same message sent over and over ("repeat"),
+// shouting ("caps") and posting link after link ("links"). Programs that
+// embed the server can add their own with RegisterSpamCheck. Each message
+// stopped is a strike: the first gets a warning, the second a mute for
+// --spam-mute and the third a kick. Strikes are forgotten once a sender
+// goes SPAM_STRIKE_RESET without one. Moderators and admins aren't checked.
+const (
+	SPAM_WINDOW       = time.Minute // how far back checks look
+	SPAM_RECENT       = 20          // most recent messages kept per client
+	SPAM_STRIKE_RESET = 10 * time.Minute
+
+	SPAM_REPEATS      = 3  // sends of the same message within the window
+	SPAM_CAPS_LETTERS = 15 // fewest letters for a message to count as shouting
+	SPAM_CAPS_PERCENT = 80 // share of those letters in capitals
+	SPAM_LINKS        = 5  // links within the window
+)
+
+// SpamMessage is a chat message or action as spam checks see it.
+type SpamMessage struct {
+	From string
+	Room string
+	Text string
+	Time time.Time
+}
+
+// SpamCheck looks for one kind of spam.
+type SpamCheck interface {
+	// Check returns why message looks like spam, or "" if it doesn't.
+	// recent is what the same client sent in the last SPAM_WINDOW and
+	// wasn't stopped, oldest first. Checks are called from many
+	// goroutines at once.
+	Check(message SpamMessage, recent []SpamMessage) string
+}
+
+// SpamCheckFunc lets an ordinary function be a SpamCheck.
+type SpamCheckFunc func(message SpamMessage, recent []SpamMessage) string
+
+func (check SpamCheckFunc) Check(message SpamMessage, recent []SpamMessage) string {
+	return check(message, recent)
+}
+
+var (
+	spamMutex  sync.Mutex
+	spamChecks = make(map[string]SpamCheck)
+)
+
+// RegisterSpamCheck makes a spam check available to --spam-checks. It
+// panics if the name is already registered.
+func RegisterSpamCheck(name string, check SpamCheck) {
+	spamMutex.Lock()
+	defer spamMutex.Unlock()
+	if _, ok := spamChecks[name]; ok {
+		panic("server: spam check " + name + " registered twice")
+	}
+	spamChecks[name] = check
+}
+
+func spamCheck(name string) (SpamCheck, bool) {
+	spamMutex.Lock()
+	defer spamMutex.Unlock()
+	check, ok := spamChecks[name]
+	return check, ok
+}
+
+// spamCheckNames lists the registered spam checks.
+func spamCheckNames() []string {
+	spamMutex.Lock()
+	defer spamMutex.Unlock()
+	names := make([]string, 0, len(spamChecks))
+	for name := range spamChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterSpamCheck("repeat", SpamCheckFunc(checkRepeats))
+	RegisterSpamCheck("caps", SpamCheckFunc(checkCaps))
+	RegisterSpamCheck("links", SpamCheckFunc(checkLinks))
+}
+
+// checkRepeats objects to the same text, give or take case and spacing,
+// being sent SPAM_REPEATS times within the window.
+func checkRepeats(message SpamMessage, recent []SpamMessage) string {
+	text := strings.Join(strings.Fields(message.Text), " ")
+	repeats := 1
+	for _, earlier := range recent {
+		if strings.EqualFold(strings.Join(strings.Fields(earlier.Text), " "), text) {
+			repeats++
+		}
+	}
+	if repeats >= SPAM_REPEATS {
+		return "you've sent that several times already"
+	}
+	return ""
+}
+
+// checkCaps objects to messages mostly in capitals.
+func checkCaps(message SpamMessage, recent []SpamMessage) string {
+	letters, upper := 0, 0
+	for _, r := range message.Text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters >= SPAM_CAPS_LETTERS && upper*100 >= letters*SPAM_CAPS_PERCENT {
+		return "please don't shout"
+	}
+	return ""
+}
+
+// checkLinks objects to more than SPAM_LINKS links within the window.
+func checkLinks(message SpamMessage, recent []SpamMessage) string {
+	links := len(linkPattern.FindAllStringIndex(message.Text, -1))
+	if links == 0 {
+		return ""
+	}
+	for _, earlier := range recent {
+		links += len(linkPattern.FindAllStringIndex(earlier.Text, -1))
+	}
+	if links > SPAM_LINKS {
+		return "that's too many links"
+	}
+	return ""
+}
+
+// SpamOptions picks the spam checks and the penalties.
+type SpamOptions struct {
+	Checks  string
+	MuteFor time.Duration
+}
+
+func (options *SpamOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.Checks, "spam-checks", options.Checks, "comma-separated spam checks to run, in order: "+strings.Join(spamCheckNames(), ", ")+" or ones the program registers (empty for none)")
+	flags.DurationVar(&options.MuteFor, "spam-mute", options.MuteFor, "how long a second spam strike mutes for")
+}
+
+func (options *SpamOptions) validate() error {
+	if _, err := options.chain(); err != nil {
+		return err
+	}
+	if options.MuteFor <= 0 {
+		return fmt.Errorf("spam_mute must be positive")
+	}
+	return nil
+}
+
+// chain returns the checks named in Checks, in order.
+func (options *SpamOptions) chain() ([]SpamCheck, error) {
+	var checks []SpamCheck
+	for _, name := range strings.Split(options.Checks, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		check, ok := spamCheck(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown spam check %q (have %s)", name, strings.Join(spamCheckNames(), ", "))
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// spamState is what a client recently sent and its spam strikes, owned
+// by readPump.
+type spamState struct {
+	recent     []SpamMessage
+	strikes    int
+	lastStrike time.Time
+}
+
+// checkSpam runs a message client is sending to room through the spam
+// checks, reporting whether it may be sent. If not, the client gets its
+// strike.
+func (server *ChatServer) checkSpam(client *Client, room, text string) bool {
+	if len(server.spamChecks) == 0 || client.atLeast(ROLE_MODERATOR) {
+		return true
+	}
+	spam := &client.spam
+	now := time.Now()
+	spam.recent = slices.DeleteFunc(spam.recent, func(earlier SpamMessage) bool {
+		return now.Sub(earlier.Time) > SPAM_WINDOW
+	})
+
+	message := SpamMessage{From: client.name(), Room: room, Text: text, Time: now}
+	for _, check := range server.spamChecks {
+		if reason := check.Check(message, spam.recent); reason != "" {
+			server.spamStrike(client, reason)
+			return false
+		}
+	}
+	if len(spam.recent) == SPAM_RECENT {
+		spam.recent = spam.recent[1:]
+	}
+	spam.recent = append(spam.recent, message)
+	return true
+}
+
+// spamStrike warns, mutes or kicks a client whose message was stopped as
+// spam, depending on how many strikes it has.
+func (server *ChatServer) spamStrike(client *Client, reason string) {
+	spam := &client.spam
+	now := time.Now()
+	if now.Sub(spam.lastStrike) > SPAM_STRIKE_RESET {
+		spam.strikes = 0
+	}
+	spam.strikes++
+	spam.lastStrike = now
+	client.logger().Info("Stopped spam", "reason", reason, "strikes", spam.strikes)
+
+	switch spam.strikes {
+	case 1:
+		client.messages <- fmt.Sprintf("*** Your message wasn't sent: %s. Next time you'll be muted ***", reason)
+	case 2:
+		duration := server.config.Spam.MuteFor
+		server.mute(client.name(), "the server", reason, duration)
+		client.messages <- fmt.Sprintf("*** Your message wasn't sent: %s. You are muted for %s, and next time you'll be kicked ***", reason, duration)
+	default:
+		server.kick(client.name(), "the server", "spamming")
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Chat over SSH. Built in with -tags ssh and served on --ssh-listen, so
+// "ssh -p 2222 alice@chat.example.com" lands alice straight in the chat;
+// the name she connects as answers the username prompt. A terminal gets
+// the server's echo and line editing, as a telnet client in char mode
+// does, and Ctrl-C or Ctrl-D leaves. An SSH key saved with an account
+// stands in for its password: /register over SSH saves the key it was
+// done with, and /sshkey lists, adds and removes them. Any key, or none,
+// gets in, but only as a guest until it's saved with an account. The
+// host key is kept in --ssh-host-key, and made there if it's missing.
+const (
+	MAX_SSH_KEYS = 10
+
+	// Bytes that end an SSH terminal session: Ctrl-C and Ctrl-D
+	SSH_INTERRUPT = 0x03
+	SSH_EOF       = 0x04
+)
+
+// serveSSH serves chat over SSH until ctx is cancelled. It is nil unless
+// the server was built with -tags ssh.
+var serveSSH func(ctx context.Context, server *ChatServer) error
+
+var errNoSSH = errors.New("chatd was built without SSH; rebuild with -tags ssh")
+
+// startSSH listens on --ssh-listen.
+func (server *ChatServer) startSSH(ctx context.Context) error {
+	if serveSSH == nil {
+		return errNoSSH
+	}
+	return serveSSH(ctx, server)
+}
+
+// sshSession is the server's end of an SSH session.
+type sshSession interface {
+	// sshIdentity returns the name the user connected as and the key it
+	// proved, in authorized_keys form, or "" if it used none
+	sshIdentity() (user, key string)
+
+	// terminal reports whether the user asked for a terminal, and so
+	// needs the server to echo, and its width in columns
+	terminal() bool
+	terminalWidth() int
+}
+
+// sshSessionOf returns the SSH session conn is the server's end of,
+// looking under the meter trackConn puts around it.
+func sshSessionOf(conn net.Conn) (sshSession, bool) {
+	if meter, ok := conn.(*meteredConn); ok {
+		conn = meter.Conn
+	}
+	session, ok := conn.(sshSession)
+	return session, ok
+}
+
+// sshKeyFingerprint returns the SHA256 fingerprint of a key in
+// authorized_keys form, as ssh-keygen -l shows it.
+func sshKeyFingerprint(key string) string {
+	parsed, _, _, _, err := gossh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "(unreadable key)"
+	}
+	return gossh.FingerprintSHA256(parsed)
+}
+
+// handleSSHKeyCommand implements "/sshkey [add [<public key>] | del
+// <fingerprint>]". Without a key, add saves the one this SSH session was
+// opened with.
+func (server *ChatServer) handleSSHKeyCommand(client *Client, message string) {
+	const usage = "*** Usage: /sshkey [add [<public key>] | del <fingerprint>] ***"
+	account := client.loggedInAs()
+	if account == "" {
+		client.messages <- "*** SSH keys are saved with your account: /register or /login first ***"
+		return
+	}
+	fields := strings.Fields(message)
+
+	switch {
+	case len(fields) == 1:
+		keys := server.accounts.SSHKeys(account)
+		lines := []string{"--- SSH keys for " + account + " ---"}
+		for _, key := range keys {
+			kind, _, _ := strings.Cut(key, " ")
+			lines = append(lines, fmt.Sprintf("  %s %s", sshKeyFingerprint(key), kind))
+		}
+		if len(keys) == 0 {
+			lines = append(lines, "  (none; /sshkey add saves one)")
+		}
+		client.messages <- strings.Join(lines, "\n")
+
+	case fields[1] == "add":
+		var key string
+		if len(fields) > 2 {
+			parsed, _, _, _, err := gossh.ParseAuthorizedKey([]byte(strings.Join(fields[2:], " ")))
+			if err != nil {
+				client.messages <- fmt.Sprintf("*** That isn't a public key: %v ***", err)
+				return
+			}
+			key = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(parsed)))
+		} else if session, ok := sshSessionOf(client.conn); ok {
+			_, key = session.sshIdentity()
+		}
+		if key == "" {
+			client.messages <- "*** Give the public key to add, like /sshkey add ssh-ed25519 AAAA... ***"
+			return
+		}
+		if err := server.accounts.AddSSHKey(account, key); err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		client.logger().Info("SSH key added", "account", account, "fingerprint", sshKeyFingerprint(key))
+		client.messages <- fmt.Sprintf("*** %s can now log in as %s over SSH ***", sshKeyFingerprint(key), account)
+
+	case fields[1] == "del" && len(fields) == 3:
+		removed, err := server.accounts.RemoveSSHKey(account, func(key string) bool {
+			return sshKeyFingerprint(key) == fields[2]
+		})
+		if err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		if removed == 0 {
+			client.messages <- fmt.Sprintf("*** No key %s on %s ***", fields[2], account)
+			return
+		}
+		client.logger().Info("SSH key removed", "account", account, "fingerprint", fields[2])
+		client.messages <- fmt.Sprintf("*** Removed %s ***", fields[2])
+
+	default:
+		client.messages <- usage
+	}
+}
@@ -0,0 +1,165 @@
+//go:build ssh
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func init() {
+	serveSSH = func(ctx context.Context, server *ChatServer) error {
+		signer, err := loadSSHHostKey(server.config.SSHHostKey)
+		if err != nil {
+			return fmt.Errorf("host key: %v", err)
+		}
+		sshServer := &ssh.Server{
+			Handler: func(session ssh.Session) { server.serveSSHSession(ctx, session) },
+
+			// Any key, or none, gets in; a key is only an identity once
+			// it's saved with an account
+			PublicKeyHandler: func(ssh.Context, ssh.PublicKey) bool { return true },
+			KeyboardInteractiveHandler: func(ssh.Context, gossh.KeyboardInteractiveChallenge) bool {
+				return true
+			},
+		}
+		sshServer.AddHostKey(signer)
+
+		listener, err := net.Listen("tcp", server.config.SSHListen)
+		if err != nil {
+			return err
+		}
+		// Sessions are left to end with their clients as the server shuts
+		// down, so they get its goodbye
+		context.AfterFunc(ctx, func() { listener.Close() })
+		fmt.Printf("Listening on %s (SSH)\n", listener.Addr())
+		go func() {
+			if err := sshServer.Serve(server.proxied(listener)); err != nil && ctx.Err() == nil {
+				slog.Error("SSH listener stopped", "err", err)
+			}
+		}()
+		return nil
+	}
+}
+
+// loadSSHHostKey reads the host key at path, making an Ed25519 one there
+// if there's none.
+func loadSSHHostKey(path string) (gossh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := gossh.MarshalPrivateKey(private, "chatd host key")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		slog.Info("Made SSH host key", "file", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return gossh.ParsePrivateKey(data)
+}
+
+// serveSSHSession connects an SSH session to the hub. As with gRPC streams
+// the session is copied to and from one end of a pipe while handleClient
+// serves the other end like a TCP connection.
+func (server *ChatServer) serveSSHSession(ctx context.Context, session ssh.Session) {
+	key := ""
+	if session.PublicKey() != nil {
+		key = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(session.PublicKey())))
+	}
+	pty, windows, isTerminal := session.Pty()
+	serverEnd, clientEnd := net.Pipe()
+	conn := &sshConn{Conn: serverEnd, remote: session.RemoteAddr(), user: session.User(), key: key, isTerminal: isTerminal}
+	conn.width.Store(int64(pty.Window.Width))
+	if isTerminal {
+		go func() {
+			for window := range windows {
+				conn.width.Store(int64(window.Width))
+			}
+		}()
+	}
+	slog.Debug("New SSH session", "remote", conn.remote.String(), "user", conn.user)
+
+	// What the server writes goes to the session until it closes its end
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		io.Copy(session, clientEnd)
+	}()
+
+	// What the user types goes to the server; on a terminal Ctrl-C and
+	// Ctrl-D hang up
+	go func() {
+		defer clientEnd.Close()
+		buffer := make([]byte, 4096)
+		for {
+			n, err := session.Read(buffer)
+			input := buffer[:n]
+			if isTerminal {
+				if end := bytes.IndexAny(input, string([]byte{SSH_INTERRUPT, SSH_EOF})); end >= 0 {
+					input, err = input[:end], io.EOF
+				}
+			}
+			if len(input) > 0 {
+				if _, err := clientEnd.Write(input); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	if server.admit(conn) {
+		server.handleClient(ctx, server.trackConn(conn))
+	}
+	<-written
+}
+
+// sshConn is the server's end of an SSH session's pipe.
+type sshConn struct {
+	net.Conn
+	remote     net.Addr
+	user, key  string
+	isTerminal bool
+	width      atomic.Int64
+}
+
+func (conn *sshConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *sshConn) sshIdentity() (string, string) {
+	return conn.user, conn.key
+}
+
+func (conn *sshConn) terminal() bool {
+	return conn.isTerminal
+}
+
+func (conn *sshConn) terminalWidth() int {
+	return int(conn.width.Load())
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Public status page, so people can check the server is up before they
+// connect, on --status-listen. It may share the admin API's address, in
+// which case one listener serves both.
+
+// ServerStatus is the public view of the server, without user names.
+type ServerStatus struct {
+	Name       string     `json:"name"`
+	StartedAt  time.Time  `json:"started_at"`
+	Uptime     string     `json:"uptime"`
+	Online     int        `json:"online"`
+	Address    string     `json:"address"`
+	InviteOnly bool       `json:"invite_only"`
+	Rooms      []RoomInfo `json:"rooms"`
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+code { background: #eee; padding: 0.2em 0.4em; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<p>Up for {{.Uptime}}, {{.Online}} online.</p>
+{{if .Rooms}}<h2>Rooms</h2>
+<ul>
+{{range .Rooms}}<li>{{.Name}} ({{.Members}})</li>
+{{end}}</ul>
+{{end}}<h2>Connecting</h2>
+<p><code>telnet {{.Host}} {{.Port}}</code> or <code>nc {{.Host}} {{.Port}}</code></p>
+{{if .InviteOnly}}<p>This server is invite-only; you will be asked for an invite code.</p>{{end}}
+</body>
+</html>
+`))
+
+// status describes the server for the status page; host is the name the
+// page was requested under, used when --status-address isn't set.
+func (server *ChatServer) status(host string) ServerStatus {
+	server.mutex.RLock()
+	online := len(server.clients)
+	server.mutex.RUnlock()
+
+	address := server.config.StatusAddress
+	if address == "" {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		_, port, _ := net.SplitHostPort(server.config.Listen)
+		address = net.JoinHostPort(host, port)
+	}
+
+	return ServerStatus{
+		Name:       server.config.StatusName,
+		StartedAt:  server.startedAt,
+		Uptime:     time.Since(server.startedAt).Round(time.Second).String(),
+		Online:     online,
+		Address:    address,
+		InviteOnly: server.config.InviteOnly,
+		Rooms:      server.roomList(),
+	}
+}
+
+// statusHandler serves the status page:
+//
+//	GET /             human-readable status
+//	GET /status.json  the same as JSON
+func (server *ChatServer) statusHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		status := server.status(r.Host)
+		host, port, _ := net.SplitHostPort(status.Address)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := statusTemplate.Execute(w, struct {
+			ServerStatus
+			Host, Port string
+		}{status, host, port})
+		if err != nil {
+			slog.Error("Error rendering status page", "err", err)
+		}
+	})
+
+	mux.HandleFunc("GET /status.json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, server.status(r.Host))
+	})
+
+	return mux
+}
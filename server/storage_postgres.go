@@ -0,0 +1,6 @@
+//go:build postgres
+
+package server
+
+// The PostgreSQL driver for --storage postgres://...
+import _ "github.com/jackc/pgx/v5/stdlib"
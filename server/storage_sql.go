@@ -0,0 +1,599 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connections to an SQL --storage that have been idle this long are closed.
+const SQL_IDLE_TIMEOUT = 5 * time.Minute
+
+// sqlDialect is what differs between the SQL databases a sqlStorage can
+// use.
+type sqlDialect struct {
+	name   string
+	driver string // database/sql driver, registered by a build tag
+
+	// numbered placeholders ($1, $2, ...) rather than ?
+	numbered bool
+
+	// column type for an autoincrementing key
+	serial string
+
+	// SQLite allows one writer at a time, so it gets a single connection
+	// rather than writes failing as busy
+	oneConnection bool
+}
+
+var (
+	sqliteDialect   = sqlDialect{name: "sqlite", driver: "sqlite", serial: "INTEGER PRIMARY KEY AUTOINCREMENT", oneConnection: true}
+	postgresDialect = sqlDialect{name: "postgres", driver: "pgx", numbered: true, serial: "BIGSERIAL PRIMARY KEY"}
+)
+
+// sqlMigrations bring a database's tables up to date: the database is at
+// version n once the first n have been applied, which schema_migrations
+// records. %[1]s is the dialect's serial type. Add new migrations at the
+// end and never change old ones. Times are Unix nanoseconds, 0 for none.
+var sqlMigrations = []string{
+	// 1: the tables
+	`CREATE TABLE IF NOT EXISTS accounts (
+		key        TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		hash       TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS bans (
+		key        TEXT PRIMARY KEY,
+		target     TEXT NOT NULL,
+		address    BOOLEAN NOT NULL,
+		until      BIGINT NOT NULL,
+		reason     TEXT NOT NULL,
+		banned_by  TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS mail (
+		id        %[1]s,
+		mailbox   TEXT NOT NULL,
+		sender    TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		text      TEXT NOT NULL,
+		sent_at   BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS mail_mailbox ON mail (mailbox);
+	CREATE TABLE IF NOT EXISTS messages (
+		seq         %[1]s,
+		time        BIGINT NOT NULL,
+		room        TEXT NOT NULL,
+		sender      TEXT NOT NULL,
+		text        TEXT NOT NULL,
+		action      BOOLEAN NOT NULL,
+		message_id  TEXT NOT NULL,
+		change_type TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS rooms (
+		name     TEXT PRIMARY KEY,
+		settings TEXT NOT NULL
+	)`,
+
+	// 2: command aliases saved with accounts, as a JSON object
+	`ALTER TABLE accounts ADD COLUMN aliases TEXT NOT NULL DEFAULT '{}'`,
+
+	// 3: SSH keys saved with accounts, as a JSON array
+	`ALTER TABLE accounts ADD COLUMN ssh_keys TEXT NOT NULL DEFAULT '[]'`,
+
+	// 4: push notification devices and opt-out saved with accounts, as a
+	// JSON object
+	`ALTER TABLE accounts ADD COLUMN push TEXT NOT NULL DEFAULT '{}'`,
+
+	// 5: activity statistics, invite codes and emotes, which were kept in
+	// files of their own whatever the storage
+	`CREATE TABLE IF NOT EXISTS activity (
+		key        TEXT PRIMARY KEY,
+		messages   BIGINT NOT NULL,
+		first_seen BIGINT NOT NULL,
+		last_seen  BIGINT NOT NULL,
+		online     BIGINT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS invites (
+		code       TEXT PRIMARY KEY,
+		max_uses   INTEGER NOT NULL,
+		uses       INTEGER NOT NULL,
+		created_at BIGINT NOT NULL,
+		note       TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS emotes (
+		name  TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+
+	// 6: the event log, which the history became part of. data is the
+	// whole event as JSON, '{}' for those that were messages.
+	`CREATE TABLE IF NOT EXISTS events (
+		seq        %[1]s,
+		time       BIGINT NOT NULL,
+		type       TEXT NOT NULL,
+		user_name  TEXT NOT NULL,
+		room       TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		text       TEXT NOT NULL,
+		data       TEXT NOT NULL
+	);
+	INSERT INTO events (time, type, user_name, room, message_id, text, data)
+		SELECT time, CASE WHEN change_type <> '' THEN change_type WHEN action THEN 'action' ELSE 'message' END,
+			sender, room, message_id, text, '{}'
+		FROM messages ORDER BY seq;
+	DROP TABLE messages`,
+
+	// 7: email addresses saved with accounts, and whether they are
+	// verified
+	`ALTER TABLE accounts ADD COLUMN email TEXT NOT NULL DEFAULT '';
+	ALTER TABLE accounts ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE`,
+
+	// 8: two-factor login secrets saved with accounts
+	`ALTER TABLE accounts ADD COLUMN totp TEXT NOT NULL DEFAULT ''`,
+}
+
+// sqlStorage keeps the records in an SQL database. Queries are prepared
+// the first time they are used and kept until Close.
+type sqlStorage struct {
+	db      *sql.DB
+	dialect sqlDialect
+
+	mutex      sync.Mutex
+	statements map[string]*sql.Stmt
+}
+
+// openSQLStorage connects to a database, keeping at most pool connections
+// open, and applies any migrations it is missing.
+func openSQLStorage(dialect sqlDialect, source string, pool int) (*sqlStorage, error) {
+	if !slices.Contains(sql.Drivers(), dialect.driver) {
+		return nil, fmt.Errorf("built without %s; build with -tags %s", dialect.name, dialect.name)
+	}
+	db, err := sql.Open(dialect.driver, source)
+	if err != nil {
+		return nil, err
+	}
+	if dialect.oneConnection {
+		pool = 1
+	}
+	db.SetMaxOpenConns(pool)
+	db.SetMaxIdleConns(pool)
+	db.SetConnMaxIdleTime(SQL_IDLE_TIMEOUT)
+
+	store := &sqlStorage{db: db, dialect: dialect, statements: make(map[string]*sql.Stmt)}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating: %v", err)
+	}
+	return store, nil
+}
+
+// migrate applies the migrations the database hasn't had, each in a
+// transaction of its own.
+func (store *sqlStorage) migrate() error {
+	if _, err := store.db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL)"); err != nil {
+		return err
+	}
+	var version int
+	if err := store.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqlMigrations) {
+		return fmt.Errorf("the database is at version %d, newer than this server knows (%d)", version, len(sqlMigrations))
+	}
+
+	for version < len(sqlMigrations) {
+		migration := strings.ReplaceAll(sqlMigrations[version], "%[1]s", store.dialect.serial)
+		version++
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range strings.Split(migration, ";") {
+			if strings.TrimSpace(statement) == "" {
+				continue
+			}
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("version %d: %v", version, err)
+			}
+		}
+		if _, err := tx.Exec(store.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), version, time.Now().UnixNano()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("version %d: %v", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("version %d: %v", version, err)
+		}
+		slog.Info("Migrated storage", "storage", store.dialect.name, "version", version)
+	}
+	return nil
+}
+
+// rebind rewrites a query's ? placeholders for the dialect.
+func (store *sqlStorage) rebind(query string) string {
+	if !store.dialect.numbered {
+		return query
+	}
+	var rebound strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(r)
+	}
+	return rebound.String()
+}
+
+// prepare returns the prepared statement for a query, preparing it the
+// first time.
+func (store *sqlStorage) prepare(query string) (*sql.Stmt, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if statement, ok := store.statements[query]; ok {
+		return statement, nil
+	}
+	statement, err := store.db.Prepare(store.rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	store.statements[query] = statement
+	return statement, nil
+}
+
+func (store *sqlStorage) exec(query string, args ...any) error {
+	statement, err := store.prepare(query)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(args...)
+	return err
+}
+
+func (store *sqlStorage) query(query string, args ...any) (*sql.Rows, error) {
+	statement, err := store.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return statement.Query(args...)
+}
+
+// unixNano and fromUnixNano store times, keeping the zero time as 0.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func (store *sqlStorage) LoadAccounts() (map[string]*Account, error) {
+	rows, err := store.query("SELECT key, name, hash, created_at, aliases, ssh_keys, push, email, email_verified, totp FROM accounts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make(map[string]*Account)
+	for rows.Next() {
+		var key, aliases, sshKeys, push string
+		var created int64
+		account := &Account{}
+		if err := rows.Scan(&key, &account.Name, &account.Hash, &created, &aliases, &sshKeys, &push, &account.Email, &account.EmailVerified, &account.TOTP); err != nil {
+			return nil, err
+		}
+		account.CreatedAt = fromUnixNano(created)
+		if err := json.Unmarshal([]byte(aliases), &account.Aliases); err != nil {
+			return nil, fmt.Errorf("aliases of %s: %v", key, err)
+		}
+		if err := json.Unmarshal([]byte(sshKeys), &account.SSHKeys); err != nil {
+			return nil, fmt.Errorf("SSH keys of %s: %v", key, err)
+		}
+		if err := json.Unmarshal([]byte(push), &account.Push); err != nil {
+			return nil, fmt.Errorf("push settings of %s: %v", key, err)
+		}
+		accounts[key] = account
+	}
+	return accounts, rows.Err()
+}
+
+func (store *sqlStorage) SaveAccount(key string, account *Account) error {
+	aliases, err := json.Marshal(account.Aliases)
+	if err != nil {
+		return err
+	}
+	if account.Aliases == nil {
+		aliases = []byte("{}")
+	}
+	sshKeys, err := json.Marshal(account.SSHKeys)
+	if err != nil {
+		return err
+	}
+	if account.SSHKeys == nil {
+		sshKeys = []byte("[]")
+	}
+	push, err := json.Marshal(account.Push)
+	if err != nil {
+		return err
+	}
+	return store.exec(`INSERT INTO accounts (key, name, hash, created_at, aliases, ssh_keys, push, email, email_verified, totp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET name = excluded.name, hash = excluded.hash, created_at = excluded.created_at,
+		aliases = excluded.aliases, ssh_keys = excluded.ssh_keys, push = excluded.push,
+		email = excluded.email, email_verified = excluded.email_verified, totp = excluded.totp`,
+		key, account.Name, account.Hash, unixNano(account.CreatedAt), string(aliases), string(sshKeys), string(push),
+		account.Email, account.EmailVerified, account.TOTP)
+}
+
+func (store *sqlStorage) LoadBans() (map[string]*Ban, error) {
+	rows, err := store.query("SELECT key, target, address, until, reason, banned_by, created_at FROM bans")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := make(map[string]*Ban)
+	for rows.Next() {
+		var key string
+		var until, created int64
+		ban := &Ban{}
+		if err := rows.Scan(&key, &ban.Target, &ban.Address, &until, &ban.Reason, &ban.By, &created); err != nil {
+			return nil, err
+		}
+		ban.Until, ban.CreatedAt = fromUnixNano(until), fromUnixNano(created)
+		bans[key] = ban
+	}
+	return bans, rows.Err()
+}
+
+func (store *sqlStorage) SaveBan(key string, ban *Ban) error {
+	return store.exec(`INSERT INTO bans (key, target, address, until, reason, banned_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET target = excluded.target, address = excluded.address, until = excluded.until,
+		reason = excluded.reason, banned_by = excluded.banned_by, created_at = excluded.created_at`,
+		key, ban.Target, ban.Address, unixNano(ban.Until), ban.Reason, ban.By, unixNano(ban.CreatedAt))
+}
+
+func (store *sqlStorage) DeleteBan(key string) error {
+	return store.exec("DELETE FROM bans WHERE key = ?", key)
+}
+
+func (store *sqlStorage) LoadMail() (map[string][]Mail, error) {
+	rows, err := store.query("SELECT mailbox, sender, recipient, text, sent_at FROM mail ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	boxes := make(map[string][]Mail)
+	for rows.Next() {
+		var key string
+		var sent int64
+		var mail Mail
+		if err := rows.Scan(&key, &mail.From, &mail.To, &mail.Text, &sent); err != nil {
+			return nil, err
+		}
+		mail.SentAt = fromUnixNano(sent)
+		boxes[key] = append(boxes[key], mail)
+	}
+	return boxes, rows.Err()
+}
+
+func (store *sqlStorage) AddMail(key string, mail Mail) error {
+	return store.exec("INSERT INTO mail (mailbox, sender, recipient, text, sent_at) VALUES (?, ?, ?, ?, ?)",
+		key, mail.From, mail.To, mail.Text, unixNano(mail.SentAt))
+}
+
+func (store *sqlStorage) DeleteMail(key string) error {
+	return store.exec("DELETE FROM mail WHERE mailbox = ?", key)
+}
+
+func (store *sqlStorage) AppendEvent(event *ChatEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	statement, err := store.prepare("INSERT INTO events (time, type, user_name, room, message_id, text, data) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING seq")
+	if err != nil {
+		return err
+	}
+	return statement.QueryRow(unixNano(event.Time), event.Type, event.User, event.Room, event.ID, event.Text, string(data)).Scan(&event.Seq)
+}
+
+func (store *sqlStorage) ReadEvents(after int64, limit int, each func(ChatEvent)) error {
+	query := "SELECT seq, time, type, user_name, room, message_id, text, data FROM events WHERE seq > ? ORDER BY seq"
+	args := []any{after}
+	if limit > 0 {
+		query, args = query+" LIMIT ?", append(args, limit)
+	}
+	rows, err := store.query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var when int64
+		var data string
+		var event ChatEvent
+		var columns ChatEvent
+		if err := rows.Scan(&columns.Seq, &when, &columns.Type, &columns.User, &columns.Room, &columns.ID, &columns.Text, &data); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("event %d: %v", columns.Seq, err)
+		}
+		event.Seq, event.Type, event.User, event.Room, event.ID, event.Text = columns.Seq, columns.Type, columns.User, columns.Room, columns.ID, columns.Text
+		event.Time = fromUnixNano(when)
+		if event.Version == 0 {
+			event.Version = EVENTS_VERSION
+		}
+		each(event)
+	}
+	return rows.Err()
+}
+
+func (store *sqlStorage) LoadRooms() (map[string]*RoomSettings, error) {
+	rows, err := store.query("SELECT name, settings FROM rooms")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[string]*RoomSettings)
+	for rows.Next() {
+		var name, data string
+		if err := rows.Scan(&name, &data); err != nil {
+			return nil, err
+		}
+		room := &RoomSettings{}
+		if err := json.Unmarshal([]byte(data), room); err != nil {
+			return nil, fmt.Errorf("room %s: %v", name, err)
+		}
+		room.Name = name
+		rooms[name] = room
+	}
+	return rooms, rows.Err()
+}
+
+// SaveRoom keeps the settings as JSON, so adding one needs no new column.
+func (store *sqlStorage) SaveRoom(room *RoomSettings) error {
+	data, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+	return store.exec("INSERT INTO rooms (name, settings) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET settings = excluded.settings",
+		room.Name, string(data))
+}
+
+func (store *sqlStorage) DeleteRoom(name string) error {
+	return store.exec("DELETE FROM rooms WHERE name = ?", name)
+}
+
+func (store *sqlStorage) LoadActivity() (map[string]*UserActivity, error) {
+	rows, err := store.query("SELECT key, messages, first_seen, last_seen, online FROM activity")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[string]*UserActivity)
+	for rows.Next() {
+		var key string
+		var first, last, online int64
+		activity := &UserActivity{}
+		if err := rows.Scan(&key, &activity.Messages, &first, &last, &online); err != nil {
+			return nil, err
+		}
+		activity.FirstSeen, activity.LastSeen = fromUnixNano(first), fromUnixNano(last)
+		activity.Online = time.Duration(online)
+		users[key] = activity
+	}
+	return users, rows.Err()
+}
+
+// SaveActivity saves the users in one transaction, since a save covers
+// everyone active since the last.
+func (store *sqlStorage) SaveActivity(users map[string]*UserActivity) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	statement, err := tx.Prepare(store.rebind(`INSERT INTO activity (key, messages, first_seen, last_seen, online) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET messages = excluded.messages, first_seen = excluded.first_seen,
+		last_seen = excluded.last_seen, online = excluded.online`))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer statement.Close()
+	for key, activity := range users {
+		if _, err := statement.Exec(key, activity.Messages, unixNano(activity.FirstSeen), unixNano(activity.LastSeen), int64(activity.Online)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *sqlStorage) LoadInvites() (map[string]*Invite, error) {
+	rows, err := store.query("SELECT code, max_uses, uses, created_at, note FROM invites")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make(map[string]*Invite)
+	for rows.Next() {
+		var created int64
+		invite := &Invite{}
+		if err := rows.Scan(&invite.Code, &invite.MaxUses, &invite.Uses, &created, &invite.Note); err != nil {
+			return nil, err
+		}
+		invite.CreatedAt = fromUnixNano(created)
+		invites[invite.Code] = invite
+	}
+	return invites, rows.Err()
+}
+
+func (store *sqlStorage) SaveInvite(invite *Invite) error {
+	return store.exec(`INSERT INTO invites (code, max_uses, uses, created_at, note) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (code) DO UPDATE SET max_uses = excluded.max_uses, uses = excluded.uses,
+		created_at = excluded.created_at, note = excluded.note`,
+		invite.Code, invite.MaxUses, invite.Uses, unixNano(invite.CreatedAt), invite.Note)
+}
+
+func (store *sqlStorage) DeleteInvite(code string) error {
+	return store.exec("DELETE FROM invites WHERE code = ?", code)
+}
+
+func (store *sqlStorage) LoadEmotes() (map[string]string, error) {
+	rows, err := store.query("SELECT name, value FROM emotes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emotes := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		emotes[name] = value
+	}
+	return emotes, rows.Err()
+}
+
+func (store *sqlStorage) SaveEmote(name, value string) error {
+	return store.exec("INSERT INTO emotes (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value",
+		name, value)
+}
+
+func (store *sqlStorage) DeleteEmote(name string) error {
+	return store.exec("DELETE FROM emotes WHERE name = ?", name)
+}
+
+func (store *sqlStorage) Close() error {
+	store.mutex.Lock()
+	for _, statement := range store.statements {
+		statement.Close()
+	}
+	store.statements = nil
+	store.mutex.Unlock()
+	return store.db.Close()
+}
@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package server
+
+// The SQLite driver for --storage sqlite:<path>, which is pure Go.
+import _ "modernc.org/sqlite"
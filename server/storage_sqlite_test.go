@@ -0,0 +1,175 @@
+//go:build sqlite
+
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storageDump is everything a storage loads, as JSON-comparable values.
+func storageDump(t *testing.T, storage Storage) map[string]any {
+	t.Helper()
+	accounts, err := storage.LoadAccounts()
+	must(t, err)
+	bans, err := storage.LoadBans()
+	must(t, err)
+	mail, err := storage.LoadMail()
+	must(t, err)
+	rooms, err := storage.LoadRooms()
+	must(t, err)
+	activity, err := storage.LoadActivity()
+	must(t, err)
+	invites, err := storage.LoadInvites()
+	must(t, err)
+	emotes, err := storage.LoadEmotes()
+	must(t, err)
+	return map[string]any{
+		"accounts": accounts,
+		"bans":     bans,
+		"mail":     mail,
+		"events":   readAllEvents(t, storage, 0, 0),
+		"rooms":    rooms,
+		"activity": activity,
+		"invites":  invites,
+		"emotes":   emotes,
+	}
+}
+
+// schemaVersion is the version schema_migrations records.
+func schemaVersion(t *testing.T, store *sqlStorage) int {
+	t.Helper()
+	var version int
+	must(t, store.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version))
+	return version
+}
+
+// TestSQLiteStorage runs the round trip against a new database, then
+// checks that it all comes back after reopening it.
+func TestSQLiteStorage(t *testing.T) {
+	spec := STORAGE_SQLITE + filepath.Join(t.TempDir(), "chat.db")
+	storage, err := openStorage(spec, 4)
+	must(t, err)
+	testStorageRoundTrip(t, storage)
+	before := storageDump(t, storage)
+	must(t, storage.Close())
+
+	storage, err = openStorage(spec, 4)
+	must(t, err)
+	defer storage.Close()
+	sameJSON(t, "after reopening", storageDump(t, storage), before)
+
+	// New events carry on from the last one kept
+	event := &ChatEvent{Version: EVENTS_VERSION, Type: "message", Time: storageTime(time.Hour), User: "bob", Room: LOBBY, Text: "back"}
+	must(t, storage.AppendEvent(event))
+	if want := int64(len(before["events"].([]ChatEvent)) + 1); event.Seq != want {
+		t.Errorf("event after reopening numbered %d, want %d", event.Seq, want)
+	}
+}
+
+// TestSQLiteMigrations brings databases left at every older version up to
+// date, checking that what was in them survives and that the newer
+// columns get their defaults.
+func TestSQLiteMigrations(t *testing.T) {
+	all := sqlMigrations
+	defer func() { sqlMigrations = all }()
+	created := storageTime(0)
+
+	for from := range len(all) {
+		path := filepath.Join(t.TempDir(), "chat.db")
+
+		// A database as a server from before the later migrations left it
+		sqlMigrations = all[:from]
+		old, err := openSQLStorage(sqliteDialect, path, 1)
+		must(t, err)
+		if got := schemaVersion(t, old); got != from {
+			t.Fatalf("from %d: database at version %d", from, got)
+		}
+		if from >= 1 {
+			_, err := old.db.Exec("INSERT INTO accounts (key, name, hash, created_at) VALUES (?, ?, ?, ?)",
+				"alice", "Alice", "$2a$10$hash", created.UnixNano())
+			must(t, err)
+			_, err = old.db.Exec("INSERT INTO rooms (name, settings) VALUES (?, ?)", "dev", `{"name":"dev","topic":"Go"}`)
+			must(t, err)
+		}
+		if from >= 1 && from < 6 {
+			_, err := old.db.Exec(`INSERT INTO messages (time, room, sender, text, action, message_id, change_type)
+				VALUES (?, ?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?, ?)`,
+				created.UnixNano(), LOBBY, "alice", "hello", false, "m1", "",
+				created.UnixNano()+1, LOBBY, "alice", "waves", true, "m2", "",
+				created.UnixNano()+2, LOBBY, "alice", "hi", false, "m1", "edit")
+			must(t, err)
+		}
+		must(t, old.Close())
+
+		sqlMigrations = all
+		store, err := openSQLStorage(sqliteDialect, path, 1)
+		must(t, err)
+		if got := schemaVersion(t, store); got != len(all) {
+			t.Errorf("from %d: migrated to version %d, want %d", from, got, len(all))
+		}
+
+		accounts, err := store.LoadAccounts()
+		must(t, err)
+		rooms, err := store.LoadRooms()
+		must(t, err)
+		events := readAllEvents(t, store, 0, 0)
+		if from == 0 {
+			sameJSON(t, "new database", accounts, map[string]*Account{})
+		} else {
+			sameJSON(t, "migrated accounts", accounts, map[string]*Account{
+				"alice": {Name: "Alice", Hash: "$2a$10$hash", CreatedAt: created},
+			})
+			sameJSON(t, "migrated rooms", rooms, map[string]*RoomSettings{"dev": {Name: "dev", Topic: "Go"}})
+		}
+		if from >= 1 && from < 6 {
+			sameJSON(t, "history moved to the event log", events, []ChatEvent{
+				{Version: EVENTS_VERSION, Seq: 1, Type: "message", Time: created, User: "alice", Room: LOBBY, ID: "m1", Text: "hello"},
+				{Version: EVENTS_VERSION, Seq: 2, Type: "action", Time: created.Add(1), User: "alice", Room: LOBBY, ID: "m2", Text: "waves"},
+				{Version: EVENTS_VERSION, Seq: 3, Type: "edit", Time: created.Add(2), User: "alice", Room: LOBBY, ID: "m1", Text: "hi"},
+			})
+		} else if len(events) != 0 {
+			t.Errorf("from %d: %d events, want none", from, len(events))
+		}
+
+		// The newer columns work once migrated
+		account := accounts["alice"]
+		if account == nil {
+			account = &Account{Name: "Alice", CreatedAt: created}
+		}
+		account.Email, account.EmailVerified, account.TOTP = "alice@example.com", true, "JBSWY3DPEHPK3PXP"
+		must(t, store.SaveAccount("alice", account))
+		must(t, store.Close())
+
+		// Opening it again changes nothing
+		store, err = openSQLStorage(sqliteDialect, path, 1)
+		must(t, err)
+		var applied int
+		must(t, store.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied))
+		if applied != len(all) {
+			t.Errorf("from %d: %d migrations recorded, want %d", from, applied, len(all))
+		}
+		accounts, err = store.LoadAccounts()
+		must(t, err)
+		sameJSON(t, "account saved after migrating", accounts, map[string]*Account{"alice": account})
+		must(t, store.Close())
+	}
+}
+
+// TestSQLiteNewerDatabase checks that a database from a newer server is
+// left alone.
+func TestSQLiteNewerDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+	store, err := openSQLStorage(sqliteDialect, path, 1)
+	must(t, err)
+	_, err = store.db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", len(sqlMigrations)+1, time.Now().UnixNano())
+	must(t, err)
+	must(t, store.Close())
+
+	_, err = openSQLStorage(sqliteDialect, path, 1)
+	if err == nil || !strings.Contains(err.Error(), "newer than this server knows") {
+		t.Fatalf("opened a newer database: %v", err)
+	}
+}
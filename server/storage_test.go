@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// storageTime is a time as the SQL storages give it back: whole
+// nanoseconds in the local time zone, with no monotonic reading.
+func storageTime(offset time.Duration) time.Time {
+	return time.Unix(0, time.Date(2026, 3, 14, 15, 9, 26, 535897932, time.UTC).Add(offset).UnixNano())
+}
+
+// sameJSON fails the test if got and want don't encode the same, which
+// compares times as instants and treats nil and empty alike as the
+// records' JSON does.
+func sameJSON(t *testing.T, what string, got, want any) {
+	t.Helper()
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("%s:\n got %s\nwant %s", what, gotJSON, wantJSON)
+	}
+}
+
+// must fails the test on an error from a storage.
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readAllEvents returns the events in a storage after seq, at most limit
+// of them if limit is set.
+func readAllEvents(t *testing.T, storage Storage, after int64, limit int) []ChatEvent {
+	t.Helper()
+	var events []ChatEvent
+	must(t, storage.ReadEvents(after, limit, func(event ChatEvent) {
+		events = append(events, event)
+	}))
+	return events
+}
+
+// testStorageRoundTrip saves, changes and deletes records of every kind
+// in an empty storage, checking that it loads what was last saved.
+func testStorageRoundTrip(t *testing.T, storage Storage) {
+	// Accounts, saved again when they change
+	alice := &Account{
+		Name:          "Alice",
+		Hash:          "$2a$10$hash",
+		CreatedAt:     storageTime(0),
+		Aliases:       map[string]string{"/j": "/join"},
+		SSHKeys:       []string{"ssh-ed25519 AAAA alice@laptop"},
+		Push:          PushSettings{Devices: []PushDevice{{Platform: "ios", Token: "token", AddedAt: storageTime(time.Minute)}}},
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		TOTP:          "JBSWY3DPEHPK3PXP",
+	}
+	bob := &Account{Name: "bob", Hash: "$2a$10$other", CreatedAt: storageTime(time.Hour)}
+	must(t, storage.SaveAccount("alice", alice))
+	must(t, storage.SaveAccount("bob", bob))
+	bob.Email, bob.Aliases = "bob@example.com", map[string]string{"/w": "/who"}
+	must(t, storage.SaveAccount("bob", bob))
+	accounts, err := storage.LoadAccounts()
+	must(t, err)
+	sameJSON(t, "accounts", accounts, map[string]*Account{"alice": alice, "bob": bob})
+
+	// Bans, by name and by address
+	byName := &Ban{Target: "mallory", By: "alice", Reason: "spam", CreatedAt: storageTime(0)}
+	byAddress := &Ban{Target: "203.0.113.7", Address: true, Until: storageTime(24 * time.Hour), By: "alice", CreatedAt: storageTime(0)}
+	must(t, storage.SaveBan("mallory", byName))
+	must(t, storage.SaveBan("203.0.113.7", byAddress))
+	byName.Reason = "more spam"
+	must(t, storage.SaveBan("mallory", byName))
+	bans, err := storage.LoadBans()
+	must(t, err)
+	sameJSON(t, "bans", bans, map[string]*Ban{"mallory": byName, "203.0.113.7": byAddress})
+	must(t, storage.DeleteBan("203.0.113.7"))
+	bans, err = storage.LoadBans()
+	must(t, err)
+	sameJSON(t, "bans after a delete", bans, map[string]*Ban{"mallory": byName})
+
+	// Mailboxes keep their order
+	first := Mail{From: "alice", To: "bob", Text: "first", SentAt: storageTime(0)}
+	second := Mail{From: "carol", To: "bob", Text: "second", SentAt: storageTime(time.Minute)}
+	other := Mail{From: "bob", To: "alice", Text: "other", SentAt: storageTime(time.Second)}
+	must(t, storage.AddMail("bob", first))
+	must(t, storage.AddMail("alice", other))
+	must(t, storage.AddMail("bob", second))
+	mail, err := storage.LoadMail()
+	must(t, err)
+	sameJSON(t, "mail", mail, map[string][]Mail{"bob": {first, second}, "alice": {other}})
+	must(t, storage.DeleteMail("bob"))
+	mail, err = storage.LoadMail()
+	must(t, err)
+	sameJSON(t, "mail after a delete", mail, map[string][]Mail{"alice": {other}})
+
+	// Events are numbered from 1 in the order they are appended
+	events := []ChatEvent{
+		{Version: EVENTS_VERSION, Type: "message", Time: storageTime(0), User: "alice", Room: LOBBY, ID: "m1", Text: "hello"},
+		{Version: EVENTS_VERSION, Type: "ban", Time: storageTime(time.Second), User: "mallory", By: "alice", Until: storageTime(time.Hour), Text: "spam"},
+		{Version: EVENTS_VERSION, Type: "room", Time: storageTime(2 * time.Second), User: "alice", Room: "dev", Settings: &RoomSettings{Name: "dev", Topic: "Go"}},
+	}
+	for i := range events {
+		must(t, storage.AppendEvent(&events[i]))
+		if events[i].Seq != int64(i+1) {
+			t.Errorf("event %d numbered %d", i+1, events[i].Seq)
+		}
+	}
+	sameJSON(t, "events", readAllEvents(t, storage, 0, 0), events)
+	sameJSON(t, "events after 1, at most 1", readAllEvents(t, storage, 1, 1), events[1:2])
+	sameJSON(t, "events after the last", readAllEvents(t, storage, 3, 0), []ChatEvent(nil))
+
+	// Rooms, with their settings kept whole
+	dev := &RoomSettings{
+		Name:       "dev",
+		CreatedAt:  storageTime(0),
+		Owner:      "alice",
+		InviteOnly: true,
+		Invited:    []string{"bob"},
+		Ops:        []string{"carol"},
+		Topic:      "Go",
+		TopicBy:    "alice",
+		TopicAt:    storageTime(time.Minute),
+		ACL:        []ACLEntry{{Who: ACL_EVERYONE, Allow: []string{ACL_READ}}, {Who: "@moderator", Allow: []string{ACL_READ, ACL_WRITE}}},
+	}
+	games := &RoomSettings{Name: "games", CreatedAt: storageTime(0)}
+	must(t, storage.SaveRoom(dev))
+	must(t, storage.SaveRoom(games))
+	dev.Topic, dev.UpdatedAt = "Go and Rust", storageTime(time.Hour)
+	must(t, storage.SaveRoom(dev))
+	rooms, err := storage.LoadRooms()
+	must(t, err)
+	sameJSON(t, "rooms", rooms, map[string]*RoomSettings{"dev": dev, "games": games})
+	must(t, storage.DeleteRoom("games"))
+	rooms, err = storage.LoadRooms()
+	must(t, err)
+	sameJSON(t, "rooms after a delete", rooms, map[string]*RoomSettings{"dev": dev})
+
+	// Activity saves leave the users they don't mention alone
+	active := &UserActivity{Messages: 3, FirstSeen: storageTime(0), LastSeen: storageTime(time.Hour), Online: 90 * time.Minute}
+	idle := &UserActivity{Messages: 1, FirstSeen: storageTime(0), LastSeen: storageTime(0)}
+	must(t, storage.SaveActivity(map[string]*UserActivity{"alice": active, "bob": idle}))
+	active.Messages, active.LastSeen = 4, storageTime(2*time.Hour)
+	must(t, storage.SaveActivity(map[string]*UserActivity{"alice": active}))
+	activity, err := storage.LoadActivity()
+	must(t, err)
+	sameJSON(t, "activity", activity, map[string]*UserActivity{"alice": active, "bob": idle})
+
+	// Invites, used and deleted
+	invite := &Invite{Code: "ABCDEFGHJK", MaxUses: 2, CreatedAt: storageTime(0), Note: "for bob"}
+	spare := &Invite{Code: "MNPQRSTVWX", MaxUses: 1, CreatedAt: storageTime(0)}
+	must(t, storage.SaveInvite(invite))
+	must(t, storage.SaveInvite(spare))
+	invite.Uses = 1
+	must(t, storage.SaveInvite(invite))
+	must(t, storage.DeleteInvite(spare.Code))
+	invites, err := storage.LoadInvites()
+	must(t, err)
+	sameJSON(t, "invites", invites, map[string]*Invite{invite.Code: invite})
+
+	// Emotes, replaced and deleted
+	must(t, storage.SaveEmote("shrug", `¯\_(ツ)_/¯`))
+	must(t, storage.SaveEmote("wave", "o/"))
+	must(t, storage.SaveEmote("wave", "\\o/"))
+	must(t, storage.SaveEmote("gone", "x"))
+	must(t, storage.DeleteEmote("gone"))
+	emotes, err := storage.LoadEmotes()
+	must(t, err)
+	sameJSON(t, "emotes", emotes, map[string]string{"shrug": `¯\_(ツ)_/¯`, "wave": "\\o/"})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorageRoundTrip(t, newMemoryStorage())
+}
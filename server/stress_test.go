@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Clients in the stress test, and how long any stage of it may take before
+// the server counts as stuck
+const (
+	STRESS_CLIENTS = 1000
+	STRESS_ROOMS   = 20
+	STRESS_TIMEOUT = 3 * time.Minute
+)
+
+// TestStress logs STRESS_CLIENTS clients in at once. Each turns its bell
+// on, joins a room, mentions someone there, asks for its activity, maybe
+// changes its name, and goes back to the lobby, while half of them never
+// read a byte. The server must get through all of it, still answer a new
+// client, and forget every client once they hang up. Run it with -race.
+func TestStress(t *testing.T) {
+	clients := STRESS_CLIENTS
+	if testing.Short() {
+		clients = 100
+	}
+	t.Chdir(t.TempDir())
+
+	config := DefaultConfig()
+	config.MaxClients = clients + 10
+	config.MessageRate = 0
+	config.Storage = STORAGE_MEMORY
+	config.Log.Level = "error"
+	server := NewChatServer(config)
+	if err := server.Open(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx, listener) }()
+
+	// Every client runs its script; readers also wait for the reply to the
+	// last line, so once they're done the server has dealt with them
+	conns := make([]net.Conn, clients)
+	errs := make(chan error, clients)
+	var scripts sync.WaitGroup
+	for i := range clients {
+		scripts.Add(1)
+		go func() {
+			defer scripts.Done()
+			conn, err := stressClient(address, i, clients, i%2 == 0)
+			conns[i] = conn
+			if err != nil {
+				errs <- fmt.Errorf("user%d: %v", i, err)
+			}
+		}()
+	}
+	if !waitFor(&scripts, STRESS_TIMEOUT) {
+		t.Fatalf("clients still running their scripts after %s", STRESS_TIMEOUT)
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	// A newcomer still gets in while the rest are connected
+	probe, err := stressClient(address, clients, clients, true)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	probe.Close()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	deadline := time.Now().Add(STRESS_TIMEOUT)
+	for {
+		server.mutex.Lock()
+		left := len(server.clients)
+		server.mutex.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients still registered %s after hanging up", left, STRESS_TIMEOUT)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(STRESS_TIMEOUT):
+		t.Fatalf("Serve still running %s after shutdown", STRESS_TIMEOUT)
+	}
+}
+
+// stressClient connects as user<i> and sends its script, returning the
+// open connection. A reader drains everything it's sent and waits for the
+// reply to the script's last line; otherwise nothing is ever read.
+func stressClient(address string, i, clients int, reads bool) (net.Conn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("user%d", i)
+	script := []string{
+		name,
+		"/bell on",
+		fmt.Sprintf("/join #room%d", i%STRESS_ROOMS),
+		fmt.Sprintf("hello @user%d", (i+STRESS_ROOMS)%clients),
+		"/activity",
+		"/rooms",
+	}
+	if i%10 == 0 {
+		script = append(script, fmt.Sprintf("/nick %s-x", name))
+	}
+	script = append(script, "/leave", "/bell off")
+
+	conn.SetDeadline(time.Now().Add(STRESS_TIMEOUT))
+	if _, err := io.WriteString(conn, strings.Join(script, "\n")+"\n"); err != nil {
+		return conn, err
+	}
+	if !reads {
+		return conn, nil
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), "*** Bell off ***") {
+			go io.Copy(io.Discard, conn)
+			return conn, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return conn, err
+	}
+	return conn, io.ErrUnexpectedEOF
+}
+
+// waitFor waits for group, reporting false if it takes longer than timeout.
+func waitFor(group *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Socket activation. When systemd starts chatd from a .socket unit it
+// passes the listening sockets in as file descriptors from
+// SD_LISTEN_FDS_START on, with LISTEN_FDS saying how many, LISTEN_PID
+// which process they are for and LISTEN_FDNAMES what each is called
+// (FileDescriptorName= in the unit). The server uses them in place of the
+// listeners it would open itself: a Unix socket for --socket, one named
+// SOCKET_NAME_TLS for --tls-listen, and any other TCP socket for --listen.
+// Because systemd keeps the sockets open, connections made while the
+// server restarts wait for the new one instead of being refused.
+const (
+	SD_LISTEN_FDS_START = 3
+
+	SOCKET_NAME_TLS = "tls"
+)
+
+// inheritedListener is a listener systemd passed in, with its name.
+type inheritedListener struct {
+	name     string
+	listener net.Listener
+}
+
+// inheritedListeners are the sockets systemd passed in that haven't been
+// used yet.
+type inheritedListeners []inheritedListener
+
+// systemdListeners returns the sockets systemd passed in, or none if the
+// server wasn't socket-activated. The variables are cleared so that
+// programs the server starts don't think the sockets are theirs.
+func systemdListeners() (inheritedListeners, error) {
+	pid, count := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid == "" || count == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("bad LISTEN_FDS %q", count)
+	}
+
+	var inherited inheritedListeners
+	for i := range n {
+		file := os.NewFile(uintptr(SD_LISTEN_FDS_START+i), "systemd socket")
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			inherited.close()
+			return nil, fmt.Errorf("systemd socket %d: %v", SD_LISTEN_FDS_START+i, err)
+		}
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		inherited = append(inherited, inheritedListener{name, listener})
+	}
+	return inherited, nil
+}
+
+// take removes and returns the first listener match accepts, or nil.
+func (inherited *inheritedListeners) take(match func(name, network string) bool) net.Listener {
+	for i, candidate := range *inherited {
+		if match(candidate.name, candidate.listener.Addr().Network()) {
+			*inherited = append((*inherited)[:i], (*inherited)[i+1:]...)
+			return candidate.listener
+		}
+	}
+	return nil
+}
+
+// close closes the listeners left over.
+func (inherited inheritedListeners) close() {
+	for _, candidate := range inherited {
+		candidate.listener.Close()
+	}
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Telnet protocol bytes (RFC 854) and the options we care about.
+const (
+	TELNET_SE   = 240
+	TELNET_NOP  = 241
+	TELNET_AYT  = 246
+	TELNET_SB   = 250
+	TELNET_WILL = 251
+	TELNET_WONT = 252
+	TELNET_DO   = 253
+	TELNET_DONT = 254
+	TELNET_IAC  = 255
+
+	TELOPT_ECHO     = 1
+	TELOPT_SGA      = 3
+	TELOPT_NAWS     = 31
+	TELOPT_LINEMODE = 34
+
+	LINEMODE_MODE = 1
+	MODE_EDIT     = 1
+
+	// Longest subnegotiation we keep; NAWS needs 5 bytes. Anything longer
+	// is dropped, so a peer can't make us buffer without end.
+	TELNET_MAX_SUBNEG = 64
+)
+
+// Parser states for telnetConn.Read
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSubneg
+	telnetSubnegIAC
+)
+
+// telnetConn wraps a raw connection and strips telnet IAC sequences from
+// the input stream, answering option negotiation as it goes. Clients that
+// never send IAC (nc, scripts) pass through untouched, and we never start
+// negotiating until the peer has shown it speaks telnet, so they don't see
+// stray control bytes.
+type telnetConn struct {
+	net.Conn
+
+	writeMutex sync.Mutex
+	state      int
+	verb       byte
+	subneg     []byte
+	overlong   bool // the current subnegotiation passed TELNET_MAX_SUBNEG
+	isTelnet   bool
+
+	mutex   sync.Mutex
+	local   map[byte]bool // options enabled on our side (WILL)
+	remote  map[byte]bool // options enabled on the peer's side (DO)
+	pending map[byte]bool // requests we sent and are waiting on
+	width   int           // terminal width reported via NAWS, 0 if unknown
+
+	binary atomic.Bool // passing bytes through untouched, for CBOR frames
+}
+
+func newTelnetConn(conn net.Conn) *telnetConn {
+	return &telnetConn{
+		Conn:    conn,
+		local:   make(map[byte]bool),
+		remote:  make(map[byte]bool),
+		pending: make(map[byte]bool),
+	}
+}
+
+// Options we are willing to enable on our side, and ask the peer to enable.
+func (t *telnetConn) supportsLocal(opt byte) bool {
+	return opt == TELOPT_ECHO || opt == TELOPT_SGA
+}
+
+func (t *telnetConn) supportsRemote(opt byte) bool {
+	return opt == TELOPT_NAWS || opt == TELOPT_LINEMODE || opt == TELOPT_SGA
+}
+
+func (t *telnetConn) Read(p []byte) (int, error) {
+	if t.binary.Load() {
+		return t.Conn.Read(p)
+	}
+	buf := make([]byte, len(p))
+	for {
+		n, err := t.Conn.Read(buf)
+		out := 0
+		for _, b := range buf[:n] {
+			if t.feed(b) {
+				p[out] = b
+				out++
+			}
+		}
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+// feed runs one input byte through the parser and reports whether it is
+// plain data that should be passed on to the reader.
+func (t *telnetConn) feed(b byte) bool {
+	switch t.state {
+	case telnetData:
+		if b == TELNET_IAC {
+			if !t.isTelnet {
+				t.mutex.Lock()
+				t.isTelnet = true
+				t.mutex.Unlock()
+			}
+			t.state = telnetCommand
+			return false
+		}
+		return true
+
+	case telnetCommand:
+		switch b {
+		case TELNET_IAC:
+			// Escaped 0xFF
+			t.state = telnetData
+			return true
+		case TELNET_WILL, TELNET_WONT, TELNET_DO, TELNET_DONT:
+			t.verb = b
+			t.state = telnetOption
+		case TELNET_SB:
+			t.subneg = t.subneg[:0]
+			t.overlong = false
+			t.state = telnetSubneg
+		case TELNET_AYT:
+			t.Write([]byte("[yes]\r\n"))
+			t.state = telnetData
+		default:
+			t.state = telnetData
+		}
+
+	case telnetOption:
+		t.negotiate(t.verb, b)
+		t.state = telnetData
+
+	case telnetSubneg:
+		if b == TELNET_IAC {
+			t.state = telnetSubnegIAC
+		} else {
+			t.appendSubneg(b)
+		}
+
+	case telnetSubnegIAC:
+		switch b {
+		case TELNET_SE:
+			if !t.overlong {
+				t.subnegotiation(t.subneg)
+			}
+			t.state = telnetData
+		case TELNET_IAC:
+			t.appendSubneg(b)
+			t.state = telnetSubneg
+		default:
+			t.state = telnetSubneg
+		}
+	}
+	return false
+}
+
+// appendSubneg adds a byte to the subnegotiation being read, unless it
+// has grown too long to be one we understand, in which case the rest of it
+// is skipped and it is dropped at IAC SE.
+func (t *telnetConn) appendSubneg(b byte) {
+	if len(t.subneg) >= TELNET_MAX_SUBNEG {
+		t.overlong = true
+		return
+	}
+	t.subneg = append(t.subneg, b)
+}
+
+// negotiate answers a WILL/WONT/DO/DONT from the peer. Replies are only sent
+// when the option state actually changes, which keeps both ends from looping.
+func (t *telnetConn) negotiate(verb, opt byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	switch verb {
+	case TELNET_WILL:
+		if t.remote[opt] {
+			return
+		}
+		if !t.supportsRemote(opt) {
+			t.sendCommand(TELNET_DONT, opt)
+			return
+		}
+		t.remote[opt] = true
+		if !t.pending[opt] {
+			t.sendCommand(TELNET_DO, opt)
+		}
+		delete(t.pending, opt)
+		if opt == TELOPT_LINEMODE {
+			// Let the client do its own line editing
+			t.send([]byte{TELNET_IAC, TELNET_SB, TELOPT_LINEMODE, LINEMODE_MODE, MODE_EDIT, TELNET_IAC, TELNET_SE})
+		}
+
+	case TELNET_WONT:
+		delete(t.pending, opt)
+		if t.remote[opt] {
+			delete(t.remote, opt)
+			t.sendCommand(TELNET_DONT, opt)
+		}
+
+	case TELNET_DO:
+		if t.local[opt] {
+			return
+		}
+		if !t.supportsLocal(opt) {
+			t.sendCommand(TELNET_WONT, opt)
+			return
+		}
+		t.local[opt] = true
+		if !t.pending[opt] {
+			t.sendCommand(TELNET_WILL, opt)
+		}
+		delete(t.pending, opt)
+
+	case TELNET_DONT:
+		delete(t.pending, opt)
+		if t.local[opt] {
+			delete(t.local, opt)
+			t.sendCommand(TELNET_WONT, opt)
+		}
+	}
+}
+
+func (t *telnetConn) subnegotiation(data []byte) {
+	// NAWS: option, width (16 bits), height (16 bits). LINEMODE replies
+	// are accepted and dropped.
+	if len(data) == 5 && data[0] == TELOPT_NAWS {
+		t.mutex.Lock()
+		t.width = int(data[1])<<8 | int(data[2])
+		t.mutex.Unlock()
+	}
+}
+
+// terminalWidth returns the width the client reported, or 0 if it hasn't.
+func (t *telnetConn) terminalWidth() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.width
+}
+
+// requestLocal asks to enable or disable one of our own options (WILL/WONT).
+func (t *telnetConn) requestLocal(opt byte, enable bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.isTelnet || t.local[opt] == enable {
+		return
+	}
+	if enable {
+		t.pending[opt] = true
+		t.sendCommand(TELNET_WILL, opt)
+	} else {
+		delete(t.local, opt)
+		t.sendCommand(TELNET_WONT, opt)
+	}
+}
+
+// requestRemote asks the peer to enable or disable an option (DO/DONT).
+func (t *telnetConn) requestRemote(opt byte, enable bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.isTelnet || t.remote[opt] == enable {
+		return
+	}
+	if enable {
+		t.pending[opt] = true
+		t.sendCommand(TELNET_DO, opt)
+	} else {
+		delete(t.remote, opt)
+		t.sendCommand(TELNET_DONT, opt)
+	}
+}
+
+// speaksTelnet reports whether the peer has sent any telnet commands.
+func (t *telnetConn) speaksTelnet() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.isTelnet
+}
+
+// passBinary stops parsing and escaping IAC, for a client that has
+// switched to binary frames. Only one that never spoke telnet can.
+func (t *telnetConn) passBinary() {
+	t.binary.Store(true)
+}
+
+// localEnabled reports whether the peer has agreed to one of our options.
+func (t *telnetConn) localEnabled(opt byte) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.local[opt]
+}
+
+// requestEcho switches server-side echo on or off for telnet clients.
+func (t *telnetConn) requestEcho(enable bool) {
+	t.requestLocal(TELOPT_ECHO, enable)
+}
+
+// requestLineMode asks the client to edit lines locally and send them whole.
+func (t *telnetConn) requestLineMode() {
+	t.requestRemote(TELOPT_LINEMODE, true)
+}
+
+// requestWindowSize asks the client to report its terminal size.
+func (t *telnetConn) requestWindowSize() {
+	t.requestRemote(TELOPT_NAWS, true)
+}
+
+func (t *telnetConn) sendCommand(verb, opt byte) {
+	t.send([]byte{TELNET_IAC, verb, opt})
+}
+
+func (t *telnetConn) send(b []byte) {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	t.Conn.Write(b)
+}
+
+// Write escapes literal 0xFF bytes so they aren't taken as IAC, unless
+// binary frames are passing through.
+func (t *telnetConn) Write(p []byte) (int, error) {
+	out := p
+	for i, b := range p {
+		if b == TELNET_IAC && !t.binary.Load() {
+			out = make([]byte, 0, len(p)+8)
+			out = append(out, p[:i]...)
+			for _, b := range p[i:] {
+				if b == TELNET_IAC {
+					out = append(out, TELNET_IAC)
+				}
+				out = append(out, b)
+			}
+			break
+		}
+	}
+
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	if _, err := t.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
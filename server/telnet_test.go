@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// scriptedConn is a net.Conn that reads from in, at most chunk bytes at a
+// time if chunk is set, and records what is written to it.
+type scriptedConn struct {
+	net.Conn
+	in      []byte
+	chunk   int
+	written bytes.Buffer
+}
+
+func (conn *scriptedConn) Read(p []byte) (int, error) {
+	if len(conn.in) == 0 {
+		return 0, io.EOF
+	}
+	n := min(len(p), len(conn.in))
+	if conn.chunk > 0 {
+		n = min(n, conn.chunk)
+	}
+	copy(p, conn.in[:n])
+	conn.in = conn.in[n:]
+	return n, nil
+}
+
+func (conn *scriptedConn) Write(p []byte) (int, error) {
+	return conn.written.Write(p)
+}
+
+func (conn *scriptedConn) SetWriteDeadline(time.Time) error { return nil }
+func (conn *scriptedConn) Close() error                     { return nil }
+
+func iac(b ...byte) []byte {
+	return append([]byte{TELNET_IAC}, b...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestTelnetRead(t *testing.T) {
+	overlong := join(iac(TELNET_SB, TELOPT_NAWS), bytes.Repeat([]byte{1}, TELNET_MAX_SUBNEG+10), iac(TELNET_SE))
+
+	tests := []struct {
+		name   string
+		in     []byte
+		data   string // what the reader gets
+		reply  []byte // what the server answers
+		width  int
+		telnet bool
+	}{
+		{
+			name: "plain text passes through",
+			in:   []byte("hello\r\n"),
+			data: "hello\r\n",
+		},
+		{
+			name:   "escaped IAC is a data byte",
+			in:     join([]byte("a"), iac(TELNET_IAC), []byte("b")),
+			data:   "a\xffb",
+			telnet: true,
+		},
+		{
+			name:   "NOP is dropped",
+			in:     join([]byte("a"), iac(TELNET_NOP), []byte("b")),
+			data:   "ab",
+			telnet: true,
+		},
+		{
+			name:   "AYT is answered",
+			in:     iac(TELNET_AYT),
+			reply:  []byte("[yes]\r\n"),
+			telnet: true,
+		},
+		{
+			name:   "WILL of a supported option",
+			in:     join(iac(TELNET_WILL, TELOPT_NAWS), []byte("x")),
+			data:   "x",
+			reply:  iac(TELNET_DO, TELOPT_NAWS),
+			telnet: true,
+		},
+		{
+			name:   "WILL of an unsupported option",
+			in:     iac(TELNET_WILL, 24),
+			reply:  iac(TELNET_DONT, 24),
+			telnet: true,
+		},
+		{
+			name:   "repeated WILL is answered once",
+			in:     join(iac(TELNET_WILL, TELOPT_NAWS), iac(TELNET_WILL, TELOPT_NAWS)),
+			reply:  iac(TELNET_DO, TELOPT_NAWS),
+			telnet: true,
+		},
+		{
+			name:   "WILL LINEMODE sets edit mode",
+			in:     iac(TELNET_WILL, TELOPT_LINEMODE),
+			reply:  join(iac(TELNET_DO, TELOPT_LINEMODE), iac(TELNET_SB, TELOPT_LINEMODE, LINEMODE_MODE, MODE_EDIT), iac(TELNET_SE)),
+			telnet: true,
+		},
+		{
+			name:   "DO of a supported option",
+			in:     iac(TELNET_DO, TELOPT_ECHO),
+			reply:  iac(TELNET_WILL, TELOPT_ECHO),
+			telnet: true,
+		},
+		{
+			name:   "DO of an unsupported option",
+			in:     iac(TELNET_DO, 0),
+			reply:  iac(TELNET_WONT, 0),
+			telnet: true,
+		},
+		{
+			name:   "WONT of an option that was never on",
+			in:     iac(TELNET_WONT, TELOPT_NAWS),
+			telnet: true,
+		},
+		{
+			name:   "DONT turns an option off",
+			in:     join(iac(TELNET_DO, TELOPT_SGA), iac(TELNET_DONT, TELOPT_SGA)),
+			reply:  join(iac(TELNET_WILL, TELOPT_SGA), iac(TELNET_WONT, TELOPT_SGA)),
+			telnet: true,
+		},
+		{
+			name:   "NAWS sets the width",
+			in:     join(iac(TELNET_SB, TELOPT_NAWS, 0, 100, 0, 40), iac(TELNET_SE), []byte("x")),
+			data:   "x",
+			width:  100,
+			telnet: true,
+		},
+		{
+			name:   "NAWS with an escaped 255",
+			in:     join(iac(TELNET_SB, TELOPT_NAWS, 0), iac(TELNET_IAC, 0, 40), iac(TELNET_SE)),
+			width:  255,
+			telnet: true,
+		},
+		{
+			name:   "NAWS of the wrong length is ignored",
+			in:     join(iac(TELNET_SB, TELOPT_NAWS, 0, 100, 0), iac(TELNET_SE)),
+			telnet: true,
+		},
+		{
+			name:   "overlong subnegotiation is dropped",
+			in:     join(overlong, []byte("x")),
+			data:   "x",
+			telnet: true,
+		},
+		{
+			name:   "other commands inside a subnegotiation are skipped",
+			in:     join(iac(TELNET_SB, TELOPT_NAWS, 0, 80), iac(TELNET_NOP), []byte{0, 24}, iac(TELNET_SE)),
+			width:  80,
+			telnet: true,
+		},
+	}
+
+	for _, test := range tests {
+		// Whole, and a byte at a time, so the parser's state has to carry
+		// across reads
+		for _, chunk := range []int{0, 1} {
+			conn := &scriptedConn{in: test.in, chunk: chunk}
+			telnet := newTelnetConn(conn)
+			data, err := io.ReadAll(telnet)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if string(data) != test.data {
+				t.Errorf("%s (chunk %d): read %q, want %q", test.name, chunk, data, test.data)
+			}
+			if !bytes.Equal(conn.written.Bytes(), test.reply) {
+				t.Errorf("%s (chunk %d): replied %v, want %v", test.name, chunk, conn.written.Bytes(), test.reply)
+			}
+			if width := telnet.terminalWidth(); width != test.width {
+				t.Errorf("%s (chunk %d): width %d, want %d", test.name, chunk, width, test.width)
+			}
+			if speaks := telnet.speaksTelnet(); speaks != test.telnet {
+				t.Errorf("%s (chunk %d): speaks telnet %v, want %v", test.name, chunk, speaks, test.telnet)
+			}
+		}
+	}
+}
+
+func TestTelnetWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		out    []byte
+		binary bool
+		want   []byte
+	}{
+		{"plain text", []byte("hi\r\n"), false, []byte("hi\r\n")},
+		{"0xFF is escaped", []byte("a\xffb\xff"), false, []byte("a\xff\xffb\xff\xff")},
+		{"binary frames pass untouched", []byte("a\xffb"), true, []byte("a\xffb")},
+	}
+	for _, test := range tests {
+		conn := &scriptedConn{}
+		telnet := newTelnetConn(conn)
+		if test.binary {
+			telnet.passBinary()
+		}
+		n, err := telnet.Write(test.out)
+		if err != nil || n != len(test.out) {
+			t.Errorf("%s: wrote %d, %v; want %d, nil", test.name, n, err, len(test.out))
+		}
+		if !bytes.Equal(conn.written.Bytes(), test.want) {
+			t.Errorf("%s: sent %q, want %q", test.name, conn.written.Bytes(), test.want)
+		}
+	}
+}
+
+// TestTelnetQuiet checks that nothing is negotiated with a client that
+// hasn't sent any telnet commands, and that it is once one has.
+func TestTelnetQuiet(t *testing.T) {
+	conn := &scriptedConn{in: []byte("plain\n")}
+	telnet := newTelnetConn(conn)
+	io.ReadAll(telnet)
+	telnet.requestWindowSize()
+	telnet.requestEcho(true)
+	if conn.written.Len() != 0 {
+		t.Fatalf("negotiated with a plain client: %v", conn.written.Bytes())
+	}
+
+	conn.in = iac(TELNET_NOP)
+	io.ReadAll(telnet)
+	telnet.requestWindowSize()
+	if want := iac(TELNET_DO, TELOPT_NAWS); !bytes.Equal(conn.written.Bytes(), want) {
+		t.Fatalf("sent %v, want %v", conn.written.Bytes(), want)
+	}
+}
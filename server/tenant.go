@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tenants. One chatd can host several communities, each a ChatServer of
+// its own with separate rooms, accounts, bans and settings. Every --tenant
+// (or "tenant" line in the config file) adds one:
+//
+//	tenant = "gophers /etc/chat/gophers.conf chat.gophers.example"
+//
+// that is, a name, a config file in the main one's format, and any number
+// of TLS server names. The file's settings override the built-in
+// defaults, not the main server's. A tenant is reached
+//
+//   - on its own listen address, if its file sets listen;
+//   - on the main server's TLS listener, by one of its server names (SNI),
+//     with its own certificate if its file sets tls_cert and tls_key;
+//   - on any of the main server's listeners, by answering the first prompt
+//     with "/tenant <name>".
+//
+// Tenants log to the main server's log. Their storage must be memory or a
+// database of their own, since the files storage uses fixed names in the
+// working directory, and for the same reason they can't have webhooks or
+// push notifications.
+const TENANT_COMMAND = "/tenant"
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Tenant is one community hosted alongside the main server.
+type Tenant struct {
+	Name      string
+	File      string
+	Hostnames []string // TLS server names, lowercased
+}
+
+// tenantList collects the --tenant flags; it is a flag.Value, so every
+// "tenant" line in the config file adds one.
+type tenantList []Tenant
+
+func (list *tenantList) String() string {
+	if list == nil {
+		return ""
+	}
+	specs := make([]string, len(*list))
+	for i, tenant := range *list {
+		specs[i] = strings.Join(append([]string{tenant.Name, tenant.File}, tenant.Hostnames...), " ")
+	}
+	return strings.Join(specs, "; ")
+}
+
+func (list *tenantList) Set(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return fmt.Errorf("want \"<name> <config file> [server names...]\", not %q", value)
+	}
+	tenant := Tenant{Name: strings.ToLower(fields[0]), File: fields[1]}
+	if !tenantNamePattern.MatchString(tenant.Name) {
+		return fmt.Errorf("tenant names are 1-32 of a-z, 0-9, _ and -, not %q", fields[0])
+	}
+	for _, hostname := range fields[2:] {
+		tenant.Hostnames = append(tenant.Hostnames, strings.ToLower(hostname))
+	}
+	for _, other := range *list {
+		if other.Name == tenant.Name {
+			return fmt.Errorf("there are two tenants called %s", tenant.Name)
+		}
+		for _, hostname := range tenant.Hostnames {
+			if slices.Contains(other.Hostnames, hostname) {
+				return fmt.Errorf("%s is a server name of both %s and %s", hostname, other.Name, tenant.Name)
+			}
+		}
+	}
+	*list = append(*list, tenant)
+	return nil
+}
+
+// tenantServer is a tenant while the main server runs.
+type tenantServer struct {
+	*ChatServer
+	hostnames   []string
+	certificate *tls.Certificate // nil to use the main server's
+}
+
+// loadTenantConfig reads a tenant's config file over the defaults.
+func loadTenantConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	config.File, config.tenant = path, true
+	// Tenants only listen where their file says
+	config.Listen, config.ConsoleSocket = "", ""
+	if err := config.loadFile(path); err != nil {
+		return nil, err
+	}
+	if err := config.readAdminToken(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(config.Tenants) > 0:
+		return nil, errors.New("a tenant can't have tenants")
+	case config.Storage == STORAGE_FILES:
+		return nil, errors.New("storage must be memory or a database of the tenant's own")
+	case len(config.Webhooks) > 0 || config.Push.URL != "":
+		return nil, errors.New("tenants can't have webhooks or push notifications")
+	}
+	return config, config.validate()
+}
+
+// openTenants reads the tenants' settings and opens them.
+func (server *ChatServer) openTenants() error {
+	if len(server.config.Tenants) == 0 {
+		return nil
+	}
+	server.tenants = make(map[string]*tenantServer)
+	storages := map[string]string{server.config.Storage: "the main server"}
+	named := false
+	for _, spec := range server.config.Tenants {
+		config, err := loadTenantConfig(spec.File)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %v", spec.Name, err)
+		}
+		if config.Storage != STORAGE_MEMORY {
+			if other, taken := storages[config.Storage]; taken {
+				return fmt.Errorf("tenant %s: its storage is %s's too", spec.Name, other)
+			}
+			storages[config.Storage] = spec.Name
+		}
+
+		tenant := &tenantServer{ChatServer: NewChatServer(config), hostnames: spec.Hostnames}
+		tenant.tenant = spec.Name
+		if config.TLS.enabled() {
+			tlsConfig, err := config.TLS.config()
+			if err != nil {
+				return fmt.Errorf("tenant %s: setting up TLS: %v", spec.Name, err)
+			}
+			tenant.certificate = &tlsConfig.Certificates[0]
+		}
+		if err := tenant.Open(); err != nil {
+			return fmt.Errorf("tenant %s: %v", spec.Name, err)
+		}
+		server.tenants[spec.Name] = tenant
+		named = named || len(spec.Hostnames) > 0
+		slog.Info("Opened tenant", "tenant", spec.Name, "listen", config.Listen, "hostnames", strings.Join(spec.Hostnames, ","))
+	}
+	if named && !server.config.TLS.enabled() {
+		slog.Warn("Tenants' server names need TLS on the main server")
+	}
+	return nil
+}
+
+// serveTenants serves each tenant, on its own listeners if it has any,
+// until ctx is cancelled. Wait on the result for them to shut down.
+func (server *ChatServer) serveTenants(ctx context.Context) *sync.WaitGroup {
+	var serving sync.WaitGroup
+	for name, tenant := range server.tenants {
+		serving.Go(func() {
+			var listeners []net.Listener
+			if tenant.config.Listen != "" {
+				opened, err := tenant.listen()
+				if err != nil {
+					slog.Error("Tenant can't listen", "tenant", name, "err", err)
+				}
+				for _, listener := range opened {
+					slog.Info("Tenant listening", "tenant", name, "addr", listener.Addr().String(), "scheme", listener.scheme)
+					listeners = append(listeners, listener)
+				}
+			}
+			if err := tenant.Serve(ctx, listeners...); err != nil {
+				slog.Error("Tenant stopped", "tenant", name, "err", err)
+			}
+		})
+	}
+	return &serving
+}
+
+// tenantByHost returns the tenant with a TLS server name, if there is one.
+func (server *ChatServer) tenantByHost(hostname string) *tenantServer {
+	hostname = strings.ToLower(hostname)
+	for _, tenant := range server.tenants {
+		if hostname != "" && slices.Contains(tenant.hostnames, hostname) {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// tenantCertificate is the main server's tls.Config.GetCertificate: it
+// picks a tenant's certificate by server name, or leaves the choice to the
+// main server's.
+func (server *ChatServer) tenantCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if tenant := server.tenantByHost(hello.ServerName); tenant != nil {
+		return tenant.certificate, nil
+	}
+	return nil, nil
+}
+
+// route finishes a TLS handshake and returns the server the client's
+// server name picks: a tenant's, or this one. It closes the connection and
+// returns nil if the handshake fails.
+func (server *ChatServer) route(conn *tls.Conn) *ChatServer {
+	if server.config.LoginTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(server.config.LoginTimeout))
+	}
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		slog.Debug("TLS handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return nil
+	}
+	if tenant := server.tenantByHost(conn.ConnectionState().ServerName); tenant != nil {
+		return tenant.ChatServer
+	}
+	return server
+}
+
+// tenantAnswer picks out "/tenant <name>" at a login prompt and returns
+// the tenant it names, telling the client if there is no such tenant.
+func (server *ChatServer) tenantAnswer(login *loginSession, answer string) (*ChatServer, bool) {
+	name, ok := strings.CutPrefix(strings.TrimSpace(answer), TENANT_COMMAND+" ")
+	if !ok || server.tenants == nil {
+		return nil, false
+	}
+	tenant, ok := server.tenants[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		login.refuse("There is no community by that name here.")
+		return nil, true
+	}
+	return tenant.ChatServer, true
+}
+
+// handOff takes over a connection from the main server, with what it has
+// read so far, and logs the client in afresh.
+func (server *ChatServer) handOff(ctx context.Context, conn net.Conn, input *lineReader) {
+	slog.Info("Handed over to tenant", "remote", conn.RemoteAddr().String(), "tenant", server.tenant)
+	if server.admit(conn) {
+		server.serveClient(ctx, conn, input)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Client certificate modes for --tls-client-auth
+var TLS_CLIENT_AUTH_MODES = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// TLSOptions configures TLS on the chat listener. It is off unless a
+// certificate and key are given, and then replaces plain TCP on --listen
+// unless it is given an address of its own.
+type TLSOptions struct {
+	Listen     string
+	CertFile   string
+	KeyFile    string
+	ClientCA   string
+	ClientAuth string
+}
+
+// defaultTLSOptions takes the TLS settings from the CHAT_TLS_* environment
+// variables.
+func defaultTLSOptions() TLSOptions {
+	return TLSOptions{
+		Listen:     os.Getenv("CHAT_TLS_LISTEN"),
+		CertFile:   os.Getenv("CHAT_TLS_CERT"),
+		KeyFile:    os.Getenv("CHAT_TLS_KEY"),
+		ClientCA:   os.Getenv("CHAT_TLS_CLIENT_CA"),
+		ClientAuth: envOr("CHAT_TLS_CLIENT_AUTH", "none"),
+	}
+}
+
+// register adds the TLS flags, using the current settings as the defaults
+// so the config file's survive the flags being parsed over them.
+func (options *TLSOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.Listen, "tls-listen", options.Listen, "address for TLS, keeping plain TCP on --listen (default $CHAT_TLS_LISTEN, or TLS on --listen)")
+	flags.StringVar(&options.CertFile, "tls-cert", options.CertFile, "TLS certificate file (PEM); enables TLS (default $CHAT_TLS_CERT)")
+	flags.StringVar(&options.KeyFile, "tls-key", options.KeyFile, "TLS private key file (PEM) (default $CHAT_TLS_KEY)")
+	flags.StringVar(&options.ClientCA, "tls-client-ca", options.ClientCA, "CA certificates (PEM) client certificates must chain to (default $CHAT_TLS_CLIENT_CA)")
+	flags.StringVar(&options.ClientAuth, "tls-client-auth", options.ClientAuth, "client certificates: none, request or require (default $CHAT_TLS_CLIENT_AUTH)")
+}
+
+func (options *TLSOptions) enabled() bool {
+	return options.CertFile != "" || options.KeyFile != ""
+}
+
+// config loads the certificates and builds the server's TLS configuration.
+func (options *TLSOptions) config() (*tls.Config, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, fmt.Errorf("both a certificate and a key are needed")
+	}
+	clientAuth, ok := TLS_CLIENT_AUTH_MODES[options.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client auth mode %q (use none, request or require)", options.ClientAuth)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   clientAuth,
+	}
+
+	if clientAuth != tls.NoClientCert {
+		if options.ClientCA == "" {
+			return nil, fmt.Errorf("client certificate verification needs a CA file")
+		}
+		data, err := os.ReadFile(options.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", options.ClientCA)
+		}
+	}
+	return config, nil
+}
+
+// envOr returns the environment variable, or fallback if it is unset.
+func envOr(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
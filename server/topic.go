@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Room topics. "/topic" shows the topic of the room you are in and
+// "/topic <text>" sets it, for the room's owner, operators and moderators;
+// "/topic off" clears it. Users see the topic when they join, and /rooms lists it.
+// Topics are kept with the room's settings.
+const MAX_TOPIC_LENGTH = 200
+
+// describeTopic shows a room's topic and who set it, or "" if it has none.
+func describeTopic(name string, settings RoomSettings) string {
+	if settings.Topic == "" {
+		return ""
+	}
+	return fmt.Sprintf("*** Topic for %s: %s (set by %s, %s) ***", name, settings.Topic, settings.TopicBy, settings.TopicAt.Local().Format("Jan 2 15:04"))
+}
+
+// sendTopic tells a client the topic of a room it joined, if there is one.
+func (server *ChatServer) sendTopic(client *Client, name string) {
+	settings, _ := server.roomStore.Get(name)
+	if topic := describeTopic(name, settings); topic != "" {
+		client.messages <- topic
+	}
+}
+
+// handleTopicCommand implements "/topic [text|off]".
+func (server *ChatServer) handleTopicCommand(client *Client, message string) {
+	_, text, _ := strings.Cut(message, " ")
+	text = strings.TrimSpace(text)
+	name := server.roomOf(client)
+	if text == "" {
+		settings, _ := server.roomStore.Get(name)
+		if topic := describeTopic(name, settings); topic != "" {
+			client.messages <- topic
+		} else {
+			client.messages <- fmt.Sprintf("*** %s has no topic ***", name)
+		}
+		return
+	}
+
+	if server.roomRank(client, name) < ROOM_OP {
+		if name == LOBBY {
+			client.messages <- "*** Only moderators can set the lobby's topic ***"
+		} else {
+			client.messages <- fmt.Sprintf("*** Only the owner and operators of %s can set its topic ***", name)
+		}
+		return
+	}
+	if len(text) > MAX_TOPIC_LENGTH {
+		client.messages <- fmt.Sprintf("*** Keep the topic under %d characters ***", MAX_TOPIC_LENGTH)
+		return
+	}
+	if text == "off" {
+		text = ""
+	}
+	if !server.updateRoom(client, name, func(settings *RoomSettings) {
+		settings.Topic, settings.TopicBy, settings.TopicAt = text, client.name(), time.Now()
+	}) {
+		return
+	}
+
+	client.logger().Info("Topic changed", "room", name, "topic", text)
+	if text == "" {
+		server.notify(name, fmt.Sprintf("*** %s cleared the topic of %s ***", client.name(), name))
+	} else {
+		server.notify(name, fmt.Sprintf("*** %s changed the topic of %s to: %s ***", client.name(), name, text))
+	}
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Two-factor login with time-based one-time passwords (RFC 6238), as
+// authenticator apps make them. "/2fa enable" gives a logged-in user a new
+// secret as an otpauth:// URL, which apps take typed in or as a QR code,
+// and "/2fa confirm <code>" turns it on once the app shows the right code.
+// From then on logging in to the account, with a password or an SSH key,
+// also takes the code the app shows: at the "Code:" prompt, or after the
+// password in /login. "/2fa disable <code>" turns it off, and the console's
+// "reset2fa" does for users who lost their device. A code is good for
+// the TOTP_PERIOD it was made in and the ones either side, once.
+//
+// The roles in --require-2fa, usually moderator and admin, only count once
+// an account has two-factor login on: until then it has the role below.
+const (
+	TOTP_PERIOD      = 30 * time.Second
+	TOTP_DIGITS      = 6
+	TOTP_SECRET_SIZE = 20 // bytes, as for HMAC-SHA1
+	TOTP_SKEW        = 1  // periods either side a code is still good for
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the code for a secret in a period.
+func totpCode(secret []byte, period int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(period))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for range TOTP_DIGITS {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulus)
+}
+
+// totpPeriod returns the period a code is for if it is good at now, and
+// whether it is.
+func totpPeriod(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if err != nil || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	current := now.Unix() / int64(TOTP_PERIOD/time.Second)
+	for period := current - TOTP_SKEW; period <= current+TOTP_SKEW; period++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, period)), []byte(code)) == 1 {
+			return period, true
+		}
+	}
+	return 0, false
+}
+
+// totpURL is the otpauth:// URL authenticator apps read a secret from.
+func totpURL(issuer, account, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	values.Set("period", fmt.Sprint(int(TOTP_PERIOD/time.Second)))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// twoFactor holds the secrets users have asked for but not confirmed, and
+// the last period a code was used in per account, so no code works twice.
+type twoFactor struct {
+	mutex   sync.Mutex
+	pending map[string]string // by lowercased account
+	used    map[string]int64
+}
+
+func newTwoFactor() *twoFactor {
+	return &twoFactor{pending: make(map[string]string), used: make(map[string]int64)}
+}
+
+// check reports whether code is good for secret now and hasn't been used
+// for the account, using it up if so.
+func (factor *twoFactor) check(account, secret, code string) bool {
+	period, ok := totpPeriod(secret, code, time.Now())
+	if !ok {
+		return false
+	}
+	factor.mutex.Lock()
+	defer factor.mutex.Unlock()
+	key := strings.ToLower(account)
+	if period <= factor.used[key] {
+		return false
+	}
+	factor.used[key] = period
+	return true
+}
+
+// TOTP returns an account's two-factor secret, "" if it has none.
+func (store *AccountStore) TOTP(name string) string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if account, ok := store.accounts[strings.ToLower(name)]; ok {
+		return account.TOTP
+	}
+	return ""
+}
+
+// SetTOTP turns two-factor login on for an account with a secret, or off
+// with "".
+func (store *AccountStore) SetTOTP(name, secret string) error {
+	return store.update(name, func(account *Account) error {
+		account.TOTP = secret
+		return nil
+	})
+}
+
+// checkTOTP reports whether code is good for an account with two-factor
+// login on.
+func (server *ChatServer) checkTOTP(account, code string) bool {
+	secret := server.accounts.TOTP(account)
+	return secret != "" && server.twoFactor.check(account, secret, code)
+}
+
+// askTOTP asks a client logging in to an account with two-factor login on
+// for its code, reporting whether it gave a good one. It tells the client
+// and logs if not.
+func (server *ChatServer) askTOTP(login *loginSession, account string, logger *slog.Logger) bool {
+	login.ask("Code: ")
+	code, err := login.read(true)
+	if err != nil {
+		logger.Info("Error reading two-factor code", "user", account, "err", err)
+		return false
+	}
+	if !server.checkTOTP(account, code) {
+		logger.Warn("Failed two-factor login", "account", account)
+		server.audit(AuditEntry{Event: AUDIT_LOGIN_FAILED, Remote: login.conn.RemoteAddr().String(), Target: account, Detail: "two-factor code"})
+		time.Sleep(LOGIN_FAILURE_DELAY)
+		login.refuse("Wrong code.")
+		return false
+	}
+	return true
+}
+
+// twoFactorRole returns the role an account gets, taking it down a rank
+// at a time while it is one of --require-2fa and the account doesn't have
+// two-factor login on.
+func (server *ChatServer) twoFactorRole(account, role string) string {
+	required := splitNames(server.config.Require2FA)
+	if len(required) == 0 || server.accounts.TOTP(account) != "" {
+		return role
+	}
+	for slices.Contains(required, role) {
+		role = roleBelow(role)
+	}
+	return role
+}
+
+// handle2FACommand implements "/2fa" to show whether two-factor login is
+// on, "/2fa enable" to get a secret, "/2fa confirm <code>" to turn it on
+// and "/2fa disable <code>" to turn it off.
+func (server *ChatServer) handle2FACommand(client *Client, message string) {
+	fields := strings.Fields(message)
+	account := client.loggedInAs()
+	if account == "" {
+		client.messages <- "*** Two-factor login is for registered users: /register or /login first ***"
+		return
+	}
+	secret := server.accounts.TOTP(account)
+	key := strings.ToLower(account)
+
+	switch {
+	case len(fields) == 1:
+		if secret == "" {
+			client.messages <- "*** Two-factor login is off: /2fa enable to turn it on ***"
+		} else {
+			client.messages <- "*** Two-factor login is on: logging in takes a code from your app ***"
+		}
+
+	case fields[1] == "enable" && len(fields) == 2:
+		if secret != "" {
+			client.messages <- "*** Two-factor login is already on; /2fa disable <code> first to change the secret ***"
+			return
+		}
+		raw := make([]byte, TOTP_SECRET_SIZE)
+		rand.Read(raw)
+		pending := totpEncoding.EncodeToString(raw)
+		server.twoFactor.mutex.Lock()
+		server.twoFactor.pending[key] = pending
+		server.twoFactor.mutex.Unlock()
+		client.logger().Info("Two-factor secret issued")
+		client.messages <- strings.Join([]string{
+			"*** Add this to your authenticator app, as a link or a QR code made from it (/wrap off keeps it on one line): ***",
+			totpURL(server.config.StatusName, account, pending),
+			fmt.Sprintf("*** Or type in the secret %s. Then: /2fa confirm <code> ***", pending),
+		}, "\n")
+
+	case fields[1] == "confirm" && len(fields) == 3:
+		server.twoFactor.mutex.Lock()
+		pending := server.twoFactor.pending[key]
+		server.twoFactor.mutex.Unlock()
+		if pending == "" {
+			client.messages <- "*** Nothing to confirm: /2fa enable first ***"
+			return
+		}
+		if !server.twoFactor.check(account, pending, fields[2]) {
+			client.messages <- "*** Wrong code; check your device's clock and try the next one ***"
+			return
+		}
+		if err := server.accounts.SetTOTP(account, pending); err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		server.twoFactor.mutex.Lock()
+		delete(server.twoFactor.pending, key)
+		server.twoFactor.mutex.Unlock()
+		client.logger().Info("Two-factor login turned on")
+		server.auditClient(AUDIT_2FA, client, account, "on")
+		client.messages <- "*** Two-factor login is on: logging in now takes a code from your app ***"
+		server.refreshRole(account)
+
+	case fields[1] == "disable" && len(fields) == 3:
+		if secret == "" {
+			client.messages <- "*** Two-factor login is already off ***"
+			return
+		}
+		if !server.checkTOTP(account, fields[2]) {
+			time.Sleep(LOGIN_FAILURE_DELAY)
+			client.messages <- "*** Wrong code ***"
+			return
+		}
+		if err := server.accounts.SetTOTP(account, ""); err != nil {
+			client.messages <- fmt.Sprintf("*** %v ***", err)
+			return
+		}
+		client.logger().Info("Two-factor login turned off")
+		server.auditClient(AUDIT_2FA, client, account, "off")
+		client.messages <- "*** Two-factor login is off ***"
+		server.refreshRole(account)
+
+	default:
+		client.messages <- "*** Usage: /2fa [enable|confirm <code>|disable <code>] ***"
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/leavedtrait/chat/protocol"
+)
+
+// Machine translation through a LibreTranslate-compatible API. Off unless
+// --translate-url is set; users then pick a language with /lang and get a
+// translation under each chat message, or ask for one with /translate.
+// Translations are made by TRANSLATE_WORKERS goroutines, so a slow
+// provider never holds up the chat; a message that finds
+// TRANSLATE_QUEUE others waiting goes untranslated.
+const (
+	TRANSLATE_TIMEOUT = 10 * time.Second
+	TRANSLATE_WORKERS = 4
+	TRANSLATE_QUEUE   = 256
+)
+
+// TranslateOptions says where to send messages for translation.
+type TranslateOptions struct {
+	URL    string
+	APIKey string
+}
+
+func (options *TranslateOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&options.URL, "translate-url", options.URL, "LibreTranslate-compatible API to translate messages with, e.g. http://localhost:5000/translate (empty for none)")
+	flags.StringVar(&options.APIKey, "translate-api-key", options.APIKey, "API key for --translate-url")
+}
+
+// Language codes as the API takes them: "de", "pt-BR", "zh-Hans"
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z]{2,4})?$`)
+
+type Translator struct {
+	url    string
+	apiKey string
+	client *http.Client
+	jobs   chan func()
+}
+
+// NewTranslator starts the workers that run queued translations.
+func NewTranslator(url, apiKey string) *Translator {
+	translator := &Translator{
+		url:    url,
+		apiKey: apiKey,
+		client: &http.Client{Timeout: TRANSLATE_TIMEOUT},
+		jobs:   make(chan func(), TRANSLATE_QUEUE),
+	}
+	for range TRANSLATE_WORKERS {
+		go func() {
+			for job := range translator.jobs {
+				job()
+			}
+		}()
+	}
+	return translator
+}
+
+// queue hands job to the workers, reporting whether there was room for it.
+func (translator *Translator) queue(job func()) bool {
+	select {
+	case translator.jobs <- job:
+		return true
+	default:
+		slog.Warn("Translation queue is full, dropping translation")
+		return false
+	}
+}
+
+// Translate translates text into the target language, letting the provider
+// detect the source language. What comes back is sanitized like anything
+// else bound for terminals.
+func (translator *Translator) Translate(text, target string) (string, error) {
+	body, err := json.Marshal(map[string]string{
+		"q":       text,
+		"source":  "auto",
+		"target":  target,
+		"format":  "text",
+		"api_key": translator.apiKey,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	response, err := translator.client.Post(translator.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var result struct {
+		TranslatedText string `json:"translatedText"`
+		Error          string `json:"error"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("%s: %v", response.Status, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", response.Status, result.Error)
+	}
+	return strings.TrimSpace(sanitizeText(result.TranslatedText)), nil
+}
+
+// handleLangCommand implements "/lang <code>|off".
+func (server *ChatServer) handleLangCommand(client *Client, message string) {
+	if server.translator == nil {
+		client.messages <- "*** Translation is not enabled on this server ***"
+		return
+	}
+
+	arg := strings.TrimSpace(strings.TrimPrefix(message, "/lang"))
+	switch {
+	case arg == "off":
+		client.mutex.Lock()
+		client.language = ""
+		client.mutex.Unlock()
+		client.messages <- "*** Translation off ***"
+	case languagePattern.MatchString(arg):
+		client.mutex.Lock()
+		client.language = arg
+		client.mutex.Unlock()
+		client.messages <- fmt.Sprintf("*** Chat will be translated to %s ***", arg)
+	default:
+		client.messages <- "*** Usage: /lang <language code, e.g. de>|off ***"
+	}
+}
+
+// translateChat translates a chat message once for each language the other
+// clients in the room asked for and sends each of them the result. It runs
+// on a translation worker.
+func (server *ChatServer) translateChat(sender *Client, room string, sent time.Time, message string) {
+	readers := make(map[string][]*Client)
+	server.mutex.RLock()
+	for client := range server.clients {
+		client.mutex.Lock()
+		language := client.language
+		client.mutex.Unlock()
+		if language != "" && client != sender && client.room == room {
+			readers[language] = append(readers[language], client)
+		}
+	}
+	server.mutex.RUnlock()
+
+	for language, clients := range readers {
+		translated, err := server.translator.Translate(message, language)
+		if err != nil {
+			slog.Warn("Error translating", "language", language, "err", err)
+			continue
+		}
+		if translated == "" || translated == strings.TrimSpace(message) {
+			// Already in the reader's language
+			continue
+		}
+		line := fmt.Sprintf("[%s] %s (%s): %s", sent.Format("15:04:05"), sender.name(), language, translated)
+		line = withFrame(protocol.Frame{Type: protocol.FRAME_CHAT, From: sender.name(), Room: room, Body: translated, Timestamp: sent}, line)
+		server.mutex.RLock()
+		for _, client := range clients {
+			// Skip anyone who left while we were waiting
+			if server.clients[client] && client.room == room {
+				client.deliver(line, PRIORITY_CHATTER)
+			}
+		}
+		server.mutex.RUnlock()
+	}
+}
+
+// handleTranslateCommand implements "/translate <id> [code]", which
+// translates a recent message in the client's room into the language
+// given, or the one the client picked with /lang.
+func (server *ChatServer) handleTranslateCommand(client *Client, message string) {
+	if server.translator == nil {
+		client.messages <- "*** Translation is not enabled on this server ***"
+		return
+	}
+	fields := strings.Fields(message)
+	client.mutex.Lock()
+	language := client.language
+	client.mutex.Unlock()
+	if len(fields) == 3 {
+		language = fields[2]
+	}
+	if len(fields) < 2 || len(fields) > 3 || !languagePattern.MatchString(language) {
+		client.messages <- "*** Usage: /translate <id> [language code, e.g. de] ***"
+		return
+	}
+
+	posted, ok := server.recent.get(fields[1])
+	if !ok || posted.room != server.roomOf(client) {
+		client.messages <- fmt.Sprintf("*** There is no message %s ***", fields[1])
+		return
+	}
+	queued := server.translator.queue(func() {
+		line := "*** The message couldn't be translated ***"
+		translated, err := server.translator.Translate(posted.text, language)
+		if err != nil || translated == "" {
+			slog.Warn("Error translating", "language", language, "err", err)
+		} else {
+			line = fmt.Sprintf("[%s] %s (%s): %s", posted.sentAt.Format("15:04:05"), posted.from, language, translated)
+			frame := protocol.Frame{Type: protocol.FRAME_CHAT, From: posted.from, Room: posted.room, Body: translated, Timestamp: posted.sentAt}
+			line = withFrame(frame, line)
+		}
+		// The client may have left while we were waiting
+		server.mutex.RLock()
+		if server.clients[client] {
+			client.deliver(line, PRIORITY_DIRECT)
+		}
+		server.mutex.RUnlock()
+	})
+	if !queued {
+		client.messages <- "*** Translation is busy; try again shortly ***"
+	}
+}
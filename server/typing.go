@@ -0,0 +1,36 @@
+package server
+
+import "time"
+
+// Typing indicators. JSON clients send a typing frame while their user is
+// typing and the server passes it on to the other JSON clients in the room;
+// text clients never see them. They aren't logged, stored, relayed to other
+// servers or counted against flood protection, so to keep them from
+// flooding the hub only one per client per TYPING_INTERVAL goes out.
+const (
+	TYPING_INTERVAL = 3 * time.Second
+
+	// How a typing notice is queued for a client: "TYPING <name>"
+	TYPING_LINE = "TYPING"
+)
+
+// sendTyping tells the rest of client's room that its user is typing,
+// unless it did so less than TYPING_INTERVAL ago or is muted or
+// shadow-banned. Called from readPump.
+func (server *ChatServer) sendTyping(client *Client) {
+	if time.Since(client.lastTyping) < TYPING_INTERVAL || server.mutedFor(client) > 0 || server.shadowed(client) {
+		return
+	}
+	client.lastTyping = time.Now()
+
+	notice := TYPING_LINE + " " + client.name()
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	for other := range server.clients {
+		if other == client || !other.json || other.room != client.room {
+			continue
+		}
+		// Stale by the time a lagging client would see it, so just drop it
+		other.deliver(notice, PRIORITY_CHATTER)
+	}
+}
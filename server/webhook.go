@@ -0,0 +1,398 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbound webhooks. Each "webhook" line in the config file, or --webhook
+// flag, names a URL and optionally the events it wants:
+//
+//	webhook = "https://hooks.example.com/chat"
+//	webhook = "https://audit.example.com/in join,leave,ban"
+//
+// Matching events are POSTed to it as JSON. With --webhook-secret set, each
+// POST carries X-Chat-Signature: sha256=<hex HMAC-SHA256 of the body>.
+// Deliveries are queued on disk under WEBHOOK_QUEUE_DIR so they survive
+// restarts, retried with exponential backoff, and moved to the dead-letter
+// directory after WEBHOOK_MAX_ATTEMPTS failures.
+const (
+	WEBHOOK_QUEUE_DIR    = "webhook-queue"
+	WEBHOOK_MAX_ATTEMPTS = 8
+	WEBHOOK_BACKOFF      = 2 * time.Second
+	WEBHOOK_MAX_BACKOFF  = 10 * time.Minute
+	WEBHOOK_TIMEOUT      = 10 * time.Second
+
+	WEBHOOK_SIGNATURE_HEADER = "X-Chat-Signature"
+)
+
+// Webhook is one configured webhook. A nil Events means every event.
+type Webhook struct {
+	URL    string
+	Events map[string]bool
+}
+
+// webhookList collects the --webhook flags; it is a flag.Value, so every
+// "webhook" line in the config file adds one.
+type webhookList []Webhook
+
+func (list *webhookList) String() string {
+	if list == nil {
+		return ""
+	}
+	lines := make([]string, len(*list))
+	for i, hook := range *list {
+		lines[i] = hook.URL
+		if hook.Events != nil {
+			events := make([]string, 0, len(hook.Events))
+			for event := range hook.Events {
+				events = append(events, event)
+			}
+			sort.Strings(events)
+			lines[i] += " " + strings.Join(events, ",")
+		}
+	}
+	return strings.Join(lines, "; ")
+}
+
+func (list *webhookList) Set(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("webhook %q should be a URL and optionally a list of events", value)
+	}
+	location, err := url.Parse(fields[0])
+	if err != nil || (location.Scheme != "http" && location.Scheme != "https") || location.Host == "" {
+		return fmt.Errorf("webhook %q isn't an http or https URL", fields[0])
+	}
+
+	hook := Webhook{URL: fields[0]}
+	if len(fields) == 2 {
+		hook.Events = make(map[string]bool)
+		for _, event := range strings.Split(fields[1], ",") {
+			if !EVENT_TYPES[event] {
+				return fmt.Errorf("unknown webhook event %q (use %s)", event, eventTypeNames())
+			}
+			hook.Events[event] = true
+		}
+	}
+	*list = append(*list, hook)
+	return nil
+}
+
+// Delivery is one queued POST, stored as a JSON file.
+type Delivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// DeliveryQueue delivers payloads in the background. Pending deliveries live
+// in dir/pending and failed ones in dir/dead.
+type DeliveryQueue struct {
+	dir    string
+	secret string
+	client *http.Client
+	wake   chan struct{}
+
+	mutex   sync.Mutex
+	pending map[string]*Delivery
+	seq     int
+}
+
+// OpenDeliveryQueue opens the queue in dir. Deliveries are signed with
+// secret, unless it is empty; it isn't stored with them, so changing it
+// applies to the ones still waiting.
+func OpenDeliveryQueue(dir, secret string) (*DeliveryQueue, error) {
+	for _, sub := range []string{"pending", "dead"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	queue := &DeliveryQueue{
+		dir:     dir,
+		secret:  secret,
+		client:  &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		wake:    make(chan struct{}, 1),
+		pending: make(map[string]*Delivery),
+	}
+
+	// Pick up whatever was left over from the last run
+	deliveries, err := readDeliveries(filepath.Join(dir, "pending"))
+	if err != nil {
+		return nil, err
+	}
+	for _, delivery := range deliveries {
+		queue.pending[delivery.ID] = delivery
+	}
+	if len(deliveries) > 0 {
+		slog.Info("Resuming queued webhook deliveries", "count", len(deliveries))
+	}
+
+	go queue.run()
+	return queue, nil
+}
+
+func readDeliveries(dir string) ([]*Delivery, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var deliveries []*Delivery
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		delivery := &Delivery{}
+		if err := json.Unmarshal(data, delivery); err != nil {
+			slog.Warn("Skipping unreadable delivery", "file", file, "err", err)
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (queue *DeliveryQueue) path(state, id string) string {
+	return filepath.Join(queue.dir, state, id+".json")
+}
+
+func (queue *DeliveryQueue) write(state string, delivery *Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	tmp := queue.path(state, delivery.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, queue.path(state, delivery.ID))
+}
+
+// Enqueue stores a delivery and returns without waiting for it.
+func (queue *DeliveryQueue) Enqueue(url string, payload []byte) error {
+	queue.mutex.Lock()
+	queue.seq++
+	delivery := &Delivery{
+		// Sortable, so deliveries go out roughly in order
+		ID:          fmt.Sprintf("%d-%06d", time.Now().UnixNano(), queue.seq),
+		URL:         url,
+		Payload:     payload,
+		NextAttempt: time.Now(),
+	}
+	err := queue.write("pending", delivery)
+	if err == nil {
+		queue.pending[delivery.ID] = delivery
+	}
+	queue.mutex.Unlock()
+
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// due returns the deliveries whose time has come, oldest first, and how
+// long until the next one after them.
+func (queue *DeliveryQueue) due() ([]*Delivery, time.Duration) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	now := time.Now()
+	wait := time.Hour
+	var ready []*Delivery
+	for _, delivery := range queue.pending {
+		if until := delivery.NextAttempt.Sub(now); until > 0 {
+			wait = min(wait, until)
+		} else {
+			ready = append(ready, delivery)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].ID < ready[j].ID })
+	return ready, wait
+}
+
+func (queue *DeliveryQueue) run() {
+	for {
+		ready, wait := queue.due()
+		for _, delivery := range ready {
+			queue.attempt(delivery)
+		}
+		if len(ready) > 0 {
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-queue.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (queue *DeliveryQueue) attempt(delivery *Delivery) {
+	err := queue.post(delivery)
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if err == nil {
+		delete(queue.pending, delivery.ID)
+		os.Remove(queue.path("pending", delivery.ID))
+		return
+	}
+
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= WEBHOOK_MAX_ATTEMPTS {
+		slog.Error("Webhook delivery failed, moving to dead letters", "id", delivery.ID, "attempts", delivery.Attempts, "err", err)
+		delete(queue.pending, delivery.ID)
+		if err := queue.write("dead", delivery); err != nil {
+			slog.Error("Error saving dead letter", "id", delivery.ID, "err", err)
+		}
+		os.Remove(queue.path("pending", delivery.ID))
+		return
+	}
+
+	delivery.NextAttempt = time.Now().Add(backoff(delivery.Attempts))
+	slog.Warn("Webhook delivery failed, retrying", "id", delivery.ID, "attempt", delivery.Attempts, "next", delivery.NextAttempt, "err", err)
+	if err := queue.write("pending", delivery); err != nil {
+		slog.Error("Error saving delivery", "id", delivery.ID, "err", err)
+	}
+}
+
+// backoff doubles the wait with every attempt, with some jitter so a burst
+// of failures doesn't retry in lockstep.
+func backoff(attempts int) time.Duration {
+	wait := WEBHOOK_BACKOFF << (attempts - 1)
+	if wait <= 0 || wait > WEBHOOK_MAX_BACKOFF {
+		wait = WEBHOOK_MAX_BACKOFF
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func (queue *DeliveryQueue) post(delivery *Delivery) error {
+	request, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Chat-Delivery", delivery.ID)
+	if queue.secret != "" {
+		request.Header.Set(WEBHOOK_SIGNATURE_HEADER, signPayload(queue.secret, delivery.Payload))
+	}
+
+	response, err := queue.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New(response.Status)
+	}
+	return nil
+}
+
+// signPayload returns the signature header value for a payload:
+// "sha256=" and the hex HMAC-SHA256 of it under secret.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookExporter queues the events a webhook wants for delivery to it.
+type webhookExporter struct {
+	hook  Webhook
+	queue *DeliveryQueue
+}
+
+func NewWebhookExporter(hook Webhook, queue *DeliveryQueue) EventExporter {
+	return &webhookExporter{hook: hook, queue: queue}
+}
+
+func (exporter *webhookExporter) Export(event ChatEvent) {
+	if exporter.hook.Events != nil && !exporter.hook.Events[event.Type] {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err == nil {
+		err = exporter.queue.Enqueue(exporter.hook.URL, payload)
+	}
+	if err != nil {
+		slog.Error("Error queueing webhook", "err", err)
+	}
+}
+
+// RunDeadLettersCommand implements "chat deadletters", which lists failed
+// webhook deliveries and can put them back in the queue.
+func RunDeadLettersCommand(args []string) int {
+	flags := flag.NewFlagSet("deadletters", flag.ContinueOnError)
+	dir := flags.String("dir", WEBHOOK_QUEUE_DIR, "webhook queue directory")
+	retry := flags.Bool("retry", false, "move dead letters back to the queue (restart the server to resend)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	deadDir := filepath.Join(*dir, "dead")
+	deliveries, err := readDeliveries(deadDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(deliveries) == 0 {
+		fmt.Println("No dead letters")
+		return 0
+	}
+
+	for _, delivery := range deliveries {
+		payload := strings.TrimSpace(string(delivery.Payload))
+		if len(payload) > 80 {
+			payload = payload[:77] + "..."
+		}
+		fmt.Printf("%s  %s  %d attempts  %s\n    %s\n", delivery.ID, delivery.URL, delivery.Attempts, delivery.LastError, payload)
+
+		if *retry {
+			delivery.Attempts = 0
+			delivery.LastError = ""
+			delivery.NextAttempt = time.Now()
+			data, err := json.Marshal(delivery)
+			if err == nil {
+				err = os.WriteFile(filepath.Join(*dir, "pending", delivery.ID+".json"), data, 0644)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			os.Remove(filepath.Join(deadDir, delivery.ID+".json"))
+		}
+	}
+	if *retry {
+		fmt.Printf("Requeued %d deliveries\n", len(deliveries))
+	}
+	return 0
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket listener for browsers (RFC 6455). Each text message from the
+// browser is one line of input and each line of output is one message, so
+// WebSocket clients go through the same login, pumps and broadcast loop as
+// telnet ones. Off unless --websocket-listen is set.
+const (
+	WEBSOCKET_PATH = "/chat"
+
+	// Largest message we accept from a browser
+	WEBSOCKET_MAX_MESSAGE = 64 * 1024
+
+	// How long a close handshake may take
+	WEBSOCKET_CLOSE_TIMEOUT = 5 * time.Second
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes
+const (
+	WS_CONTINUATION = 0x0
+	WS_TEXT         = 0x1
+	WS_BINARY       = 0x2
+	WS_CLOSE        = 0x8
+	WS_PING         = 0x9
+	WS_PONG         = 0xA
+)
+
+// Close status codes
+const (
+	WS_CLOSE_NORMAL   = 1000
+	WS_CLOSE_PROTOCOL = 1002
+	WS_CLOSE_TOO_BIG  = 1009
+)
+
+var errWebSocketProtocol = errors.New("websocket protocol error")
+
+// wsConn turns a WebSocket into a stream of lines. Reads return message
+// payloads, each ended with a newline; writes are sent as text messages.
+type wsConn struct {
+	net.Conn
+
+	reader  *bufio.Reader
+	pending []byte // rest of the current message, not yet read
+	message []byte // fragments of a message still arriving
+
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+}
+
+func newWebSocketConn(conn net.Conn) *wsConn {
+	return &wsConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		message, err := ws.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if !strings.HasSuffix(string(message), "\n") {
+			message = append(message, '\n')
+		}
+		ws.pending = message
+	}
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+// readMessage returns the next complete data message, answering pings and
+// close frames on the way.
+func (ws *wsConn) readMessage() ([]byte, error) {
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case WS_PING:
+			ws.writeFrame(WS_PONG, payload)
+		case WS_PONG:
+		case WS_CLOSE:
+			ws.closeWith(WS_CLOSE_NORMAL)
+			return nil, io.EOF
+
+		case WS_TEXT, WS_BINARY, WS_CONTINUATION:
+			if (opcode == WS_CONTINUATION) != (ws.message != nil) {
+				ws.closeWith(WS_CLOSE_PROTOCOL)
+				return nil, errWebSocketProtocol
+			}
+			if len(ws.message)+len(payload) > WEBSOCKET_MAX_MESSAGE {
+				ws.closeWith(WS_CLOSE_TOO_BIG)
+				return nil, errWebSocketProtocol
+			}
+			ws.message = append(ws.message, payload...)
+			if fin {
+				message := ws.message
+				ws.message = nil
+				return message, nil
+			}
+
+		default:
+			ws.closeWith(WS_CLOSE_PROTOCOL)
+			return nil, errWebSocketProtocol
+		}
+	}
+}
+
+// readFrame reads and unmasks one frame. Browsers must mask what they send.
+func (ws *wsConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	if header[0]&0x70 != 0 || !masked {
+		ws.closeWith(WS_CLOSE_PROTOCOL)
+		return false, 0, nil, errWebSocketProtocol
+	}
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > WEBSOCKET_MAX_MESSAGE {
+		ws.closeWith(WS_CLOSE_TOO_BIG)
+		return false, 0, nil, errWebSocketProtocol
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	_, err := ws.Conn.Write(append(header, payload...))
+	return err
+}
+
+// Write sends p as one text message, without the trailing newline.
+func (ws *wsConn) Write(p []byte) (int, error) {
+	text := strings.TrimSuffix(string(p), "\n")
+	if err := ws.writeFrame(WS_TEXT, []byte(text)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// closeWith sends a close frame with a status code and closes the
+// connection.
+func (ws *wsConn) closeWith(code uint16) {
+	ws.closeOnce.Do(func() {
+		ws.Conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_CLOSE_TIMEOUT))
+		ws.writeFrame(WS_CLOSE, binary.BigEndian.AppendUint16(nil, code))
+		ws.Conn.Close()
+	})
+}
+
+func (ws *wsConn) Close() error {
+	ws.closeWith(WS_CLOSE_NORMAL)
+	return nil
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept answer to a key.
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// websocketHandler upgrades requests on WEBSOCKET_PATH and hands the
+// connections to handleClient. Anything else gets a minimal browser client.
+func (server *ChatServer) websocketHandler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET "+WEBSOCKET_PATH, func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if !headerContains(r.Header, "Connection", "upgrade") ||
+			!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+			http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+			return
+		}
+
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if reason := server.refusal(host); reason != "" {
+				slog.Info("Refused connection", "remote", r.RemoteAddr, "reason", reason)
+				http.Error(w, reason, http.StatusForbidden)
+				return
+			}
+		}
+
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "can't upgrade this connection", http.StatusInternalServerError)
+			return
+		}
+		conn, buffered, err := hijacker.Hijack()
+		if err != nil {
+			slog.Warn("Error upgrading WebSocket", "err", err)
+			return
+		}
+		if buffered.Reader.Buffered() > 0 {
+			// The client sent frames before we accepted
+			conn.Close()
+			return
+		}
+
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+		if err := buffered.Flush(); err != nil {
+			conn.Close()
+			return
+		}
+
+		slog.Debug("New WebSocket connection", "remote", conn.RemoteAddr().String())
+		server.handleClient(ctx, newWebSocketConn(server.trackConn(conn)))
+	})
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, websocketPage)
+	})
+
+	return mux
+}
+
+// headerContains reports whether a comma-separated header has token in it.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Browser client served next to the WebSocket endpoint
+const websocketPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Chat</title>
+<style>
+body { font-family: monospace; margin: 0; display: flex; flex-direction: column; height: 100vh; }
+#log { flex: 1; overflow-y: auto; margin: 0; padding: 0.5em; white-space: pre-wrap; }
+#input { font: inherit; padding: 0.5em; border: 0; border-top: 1px solid #ccc; }
+</style>
+</head>
+<body>
+<pre id="log"></pre>
+<input id="input" autofocus autocomplete="off">
+<script>
+const log = document.getElementById("log");
+const input = document.getElementById("input");
+const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+const socket = new WebSocket(scheme + location.host + "` + WEBSOCKET_PATH + `");
+function show(text) {
+	log.textContent += text + "\n";
+	log.scrollTop = log.scrollHeight;
+}
+socket.onmessage = event => show(event.data);
+socket.onclose = () => show("*** Disconnected ***");
+input.addEventListener("keydown", event => {
+	if (event.key === "Enter") {
+		socket.send(input.value);
+		input.value = "";
+	}
+});
+</script>
+</body>
+</html>
+`
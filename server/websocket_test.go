@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// wsFrame builds a frame as a browser sends it, masked unless mask is nil.
+func wsFrame(fin bool, opcode byte, payload []byte, mask []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+var wsMask = []byte{0x37, 0xfa, 0x21, 0x3d}
+
+// wsText is a whole masked text message.
+func wsText(text string) []byte {
+	return wsFrame(true, WS_TEXT, []byte(text), wsMask)
+}
+
+// wsClose is the close frame the server sends with a status code.
+func wsClose(code uint16) []byte {
+	return wsFrame(true, WS_CLOSE, binary.BigEndian.AppendUint16(nil, code), nil)
+}
+
+func TestWebSocketRead(t *testing.T) {
+	big := strings.Repeat("x", WEBSOCKET_MAX_MESSAGE)
+	half := []byte(big[:WEBSOCKET_MAX_MESSAGE/2])
+
+	tests := []struct {
+		name  string
+		in    []byte
+		data  string // what the reader gets
+		reply []byte // what the server answers
+		fails bool
+	}{
+		{
+			name: "a text message is a line",
+			in:   wsText("hello"),
+			data: "hello\n",
+		},
+		{
+			name: "a trailing newline isn't doubled",
+			in:   wsText("hello\n"),
+			data: "hello\n",
+		},
+		{
+			name: "messages in a row",
+			in:   join(wsText("one"), wsText("two")),
+			data: "one\ntwo\n",
+		},
+		{
+			name: "binary messages are read as text",
+			in:   wsFrame(true, WS_BINARY, []byte("bin"), wsMask),
+			data: "bin\n",
+		},
+		{
+			name: "16-bit length",
+			in:   wsText(strings.Repeat("y", 300)),
+			data: strings.Repeat("y", 300) + "\n",
+		},
+		{
+			name: "64-bit length up to the limit",
+			in:   wsText(big),
+			data: big + "\n",
+		},
+		{
+			name:  "unmasked frames are refused",
+			in:    wsFrame(true, WS_TEXT, []byte("hello"), nil),
+			reply: wsClose(WS_CLOSE_PROTOCOL),
+			fails: true,
+		},
+		{
+			name:  "reserved bits are refused",
+			in:    append([]byte{0x80 | 0x40 | WS_TEXT}, wsText("hello")[1:]...),
+			reply: wsClose(WS_CLOSE_PROTOCOL),
+			fails: true,
+		},
+		{
+			name:  "unknown opcodes are refused",
+			in:    wsFrame(true, 0x3, []byte("hello"), wsMask),
+			reply: wsClose(WS_CLOSE_PROTOCOL),
+			fails: true,
+		},
+		{
+			name: "fragments make one message",
+			in: join(
+				wsFrame(false, WS_TEXT, []byte("hel"), wsMask),
+				wsFrame(false, WS_CONTINUATION, []byte("lo "), wsMask),
+				wsFrame(true, WS_CONTINUATION, []byte("there"), wsMask),
+			),
+			data: "hello there\n",
+		},
+		{
+			name: "pings between fragments are answered",
+			in: join(
+				wsFrame(false, WS_TEXT, []byte("hel"), wsMask),
+				wsFrame(true, WS_PING, []byte("p"), wsMask),
+				wsFrame(true, WS_CONTINUATION, []byte("lo"), wsMask),
+			),
+			data:  "hello\n",
+			reply: wsFrame(true, WS_PONG, []byte("p"), nil),
+		},
+		{
+			name: "pongs are ignored",
+			in:   join(wsFrame(true, WS_PONG, nil, wsMask), wsText("x")),
+			data: "x\n",
+		},
+		{
+			name:  "continuation without a message is refused",
+			in:    wsFrame(true, WS_CONTINUATION, []byte("lo"), wsMask),
+			reply: wsClose(WS_CLOSE_PROTOCOL),
+			fails: true,
+		},
+		{
+			name:  "a new message inside a fragmented one is refused",
+			in:    join(wsFrame(false, WS_TEXT, []byte("hel"), wsMask), wsText("lo")),
+			reply: wsClose(WS_CLOSE_PROTOCOL),
+			fails: true,
+		},
+		{
+			name:  "a frame over the limit is refused",
+			in:    wsText(big + "x"),
+			reply: wsClose(WS_CLOSE_TOO_BIG),
+			fails: true,
+		},
+		{
+			name: "fragments over the limit are refused",
+			in: join(
+				wsFrame(false, WS_TEXT, half, wsMask),
+				wsFrame(false, WS_CONTINUATION, half, wsMask),
+				wsFrame(true, WS_CONTINUATION, []byte("x"), wsMask),
+			),
+			reply: wsClose(WS_CLOSE_TOO_BIG),
+			fails: true,
+		},
+		{
+			name:  "close is answered and ends the stream",
+			in:    join(wsText("bye"), wsFrame(true, WS_CLOSE, nil, wsMask), wsText("after")),
+			data:  "bye\n",
+			reply: wsClose(WS_CLOSE_NORMAL),
+		},
+	}
+
+	for _, test := range tests {
+		// Whole, and a byte at a time, so frames have to be put together
+		// across reads
+		for _, chunk := range []int{0, 1} {
+			conn := &scriptedConn{in: test.in, chunk: chunk}
+			data, err := io.ReadAll(newWebSocketConn(conn))
+			if (err != nil) != test.fails {
+				t.Errorf("%s (chunk %d): error %v, want failure %v", test.name, chunk, err, test.fails)
+			}
+			if string(data) != test.data {
+				t.Errorf("%s (chunk %d): read %.40q, want %.40q", test.name, chunk, data, test.data)
+			}
+			if !bytes.Equal(conn.written.Bytes(), test.reply) {
+				t.Errorf("%s (chunk %d): replied %v, want %v", test.name, chunk, conn.written.Bytes(), test.reply)
+			}
+		}
+	}
+}
+
+func TestWebSocketWrite(t *testing.T) {
+	long := strings.Repeat("z", 200)
+	huge := strings.Repeat("z", 70000)
+	tests := []struct {
+		name string
+		out  string
+		want []byte
+	}{
+		{"a line is one text frame", "hi\n", wsFrame(true, WS_TEXT, []byte("hi"), nil)},
+		{"without a newline", "hi", wsFrame(true, WS_TEXT, []byte("hi"), nil)},
+		{"16-bit length", long, wsFrame(true, WS_TEXT, []byte(long), nil)},
+		{"64-bit length", huge, wsFrame(true, WS_TEXT, []byte(huge), nil)},
+	}
+	for _, test := range tests {
+		conn := &scriptedConn{}
+		n, err := newWebSocketConn(conn).Write([]byte(test.out))
+		if err != nil || n != len(test.out) {
+			t.Errorf("%s: wrote %d, %v; want %d, nil", test.name, n, err, len(test.out))
+		}
+		if !bytes.Equal(conn.written.Bytes(), test.want) {
+			t.Errorf("%s: sent %.40v, want %.40v", test.name, conn.written.Bytes(), test.want)
+		}
+	}
+}
+
+// TestWebSocketAccept checks the key in RFC 6455's example.
+func TestWebSocketAccept(t *testing.T) {
+	if accept := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("accept %q", accept)
+	}
+}
+
+// TestWebSocketHandshake upgrades a connection and logs in over it, after
+// checking that requests which aren't proper upgrades are turned away.
+func TestWebSocketHandshake(t *testing.T) {
+	t.Chdir(t.TempDir())
+	config := DefaultConfig()
+	config.Storage = STORAGE_MEMORY
+	config.Log.Level = "error"
+	server := NewChatServer(config)
+	if err := server.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx)
+	handler := server.websocketHandler(ctx)
+
+	refused := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"no upgrade", map[string]string{"Sec-WebSocket-Key": "a2V5", "Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+		{"no key", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+		{"old version", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Key": "a2V5", "Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+	}
+	for _, test := range refused {
+		request := httptest.NewRequest("GET", WEBSOCKET_PATH, nil)
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+
+	web := httptest.NewServer(handler)
+	defer web.Close()
+	conn, err := net.Dial("tcp", web.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET "+WEBSOCKET_PATH+" HTTP/1.1\r\n"+
+		"Host: chat.example\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %s", response.Status)
+	}
+	if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("accept %q", accept)
+	}
+
+	// The server's frames come unmasked, one per line
+	next := func() string {
+		var header [2]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			t.Fatal(err)
+		}
+		if header[0] != 0x80|WS_TEXT || header[1]&0x80 != 0 {
+			t.Fatalf("frame header %x", header)
+		}
+		length := int(header[1])
+		if length == 126 {
+			var extended [2]byte
+			io.ReadFull(reader, extended[:])
+			length = int(binary.BigEndian.Uint16(extended[:]))
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			t.Fatal(err)
+		}
+		return string(payload)
+	}
+	expect := func(want string) {
+		for {
+			if text := next(); strings.Contains(text, want) {
+				return
+			}
+		}
+	}
+	expect("Enter your username:")
+	conn.Write(wsText("webuser"))
+	expect("webuser")
+}
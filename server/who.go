@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// handleWhoCommand implements "/who [#room]", which lists who is online
+// with their room, how long they have been idle and whether they are away
+// or busy.
+func (server *ChatServer) handleWhoCommand(client *Client, message string) {
+	_, filter, _ := strings.Cut(message, " ")
+	filter = strings.TrimSpace(filter)
+	if filter != "" {
+		room, ok := normalizeRoomName(filter)
+		if !ok {
+			client.messages <- "*** Usage: /who [#room] ***"
+			return
+		}
+		filter = room
+	}
+
+	var rows []string
+	server.mutex.RLock()
+	for peer := range server.clients {
+		status, reason := peer.presenceFor(client)
+		if status == PRESENCE_OFFLINE || (filter != "" && peer.room != filter) {
+			continue
+		}
+		row := fmt.Sprintf("  %-20s %-16s idle %s", peer.name(), peer.room, peer.idle().Round(time.Second))
+		if status != PRESENCE_ONLINE {
+			row += ", " + describePresence(status, reason)
+		}
+		rows = append(rows, row)
+	}
+	server.mutex.RUnlock()
+	sort.Slice(rows, func(i, j int) bool { return strings.ToLower(rows[i]) < strings.ToLower(rows[j]) })
+
+	title := "--- Who's online ---"
+	if filter != "" {
+		title = fmt.Sprintf("--- Who's in %s ---", filter)
+	}
+	lines := append([]string{title}, rows...)
+	lines = append(lines, fmt.Sprintf("%d online", len(rows)))
+	client.messages <- strings.Join(lines, "\n")
+}
+
+// handleWhoisCommand implements "/whois <user>": when they joined, how long
+// they have been idle, their room, presence and role. Admins also see where they
+// are connecting from.
+func (server *ChatServer) handleWhoisCommand(client *Client, message string) {
+	fields := strings.Fields(message)
+	if len(fields) != 2 {
+		client.messages <- "*** Usage: /whois <user> ***"
+		return
+	}
+	peers := server.findClients(fields[1])
+	if len(peers) > 0 {
+		if status, _ := peers[0].presenceFor(client); status == PRESENCE_OFFLINE {
+			peers = nil
+		}
+	}
+	if len(peers) == 0 {
+		client.messages <- fmt.Sprintf("*** %s is not online ***", fields[1])
+		return
+	}
+	peer := peers[0]
+
+	lines := []string{
+		fmt.Sprintf("--- %s ---", peer.name()),
+		fmt.Sprintf("Joined:  %s (%s ago)", peer.joinedAt.Format("2006-01-02 15:04:05"), time.Since(peer.joinedAt).Round(time.Second)),
+		fmt.Sprintf("Idle:    %s", peer.idle().Round(time.Second)),
+		fmt.Sprintf("Room:    %s", server.roomOf(peer)),
+		fmt.Sprintf("Status:  %s", describePresence(peer.presenceFor(client))),
+		fmt.Sprintf("Role:    %s", peer.role()),
+	}
+	peer.mutex.Lock()
+	if peer.account != "" {
+		lines = append(lines, fmt.Sprintf("Account: %s", peer.account))
+	}
+	peer.mutex.Unlock()
+	if client.atLeast(ROLE_ADMIN) {
+		lines = append(lines, fmt.Sprintf("Host:    %s", remoteHost(peer.conn)))
+	}
+	client.messages <- strings.Join(lines, "\n")
+}
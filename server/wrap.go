@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Wrap width settings. WRAP_AUTO follows the size the terminal reports
+// (falling back to WRAP_WIDTH, or no wrapping for browsers, which wrap
+// for themselves); WRAP_OFF sends lines as they are.
+const (
+	WRAP_AUTO = 0
+	WRAP_OFF  = -1
+
+	MIN_WRAP_WIDTH = 20
+	MAX_WRAP_WIDTH = 1000
+
+	// Prefix marking lines that continue a wrapped one
+	WRAP_MARKER = "  ... "
+)
+
+func parseWrapWidth(arg string) (int, bool) {
+	switch arg {
+	case "auto":
+		return WRAP_AUTO, true
+	case "off":
+		return WRAP_OFF, true
+	}
+	width, err := strconv.Atoi(arg)
+	if err != nil || width < MIN_WRAP_WIDTH || width > MAX_WRAP_WIDTH {
+		return 0, false
+	}
+	return width, true
+}
+
+// handleWrapCommand implements "/wrap <width>|auto|off".
+func (client *Client) handleWrapCommand(message string) {
+	_, arg, _ := strings.Cut(message, " ")
+	arg = strings.TrimSpace(arg)
+	width, ok := parseWrapWidth(arg)
+	if !ok {
+		client.messages <- fmt.Sprintf("*** Usage: /wrap <%d-%d>|auto|off ***", MIN_WRAP_WIDTH, MAX_WRAP_WIDTH)
+		return
+	}
+	client.mutex.Lock()
+	client.wrapWidth = width
+	client.mutex.Unlock()
+	client.messages <- fmt.Sprintf("*** Wrap width set to %s ***", arg)
+}
+
+// effectiveWrapWidth resolves the client's setting to a column count, or 0
+// when wrapping is off.
+func (client *Client) effectiveWrapWidth() int {
+	client.mutex.Lock()
+	width := client.wrapWidth
+	client.mutex.Unlock()
+
+	switch width {
+	case WRAP_OFF:
+		return 0
+	case WRAP_AUTO:
+		if _, ok := client.conn.(*wsConn); ok {
+			return 0
+		}
+		if tc, ok := client.conn.(*telnetConn); ok {
+			if w := tc.terminalWidth(); w >= MIN_WRAP_WIDTH {
+				return w
+			}
+		}
+		if session, ok := sshSessionOf(client.conn); ok {
+			if w := session.terminalWidth(); w >= MIN_WRAP_WIDTH {
+				return w
+			}
+		}
+		return WRAP_WIDTH
+	}
+	return width
+}
+
+// wrapText breaks every line of text longer than width columns, preferring
+// to break at spaces, and marks the continuation lines.
+func wrapText(text string, width int) string {
+	if width <= 0 {
+		return text
+	}
+
+	lines := strings.Split(text, "\n")
+	var out []string
+	for _, line := range lines {
+		out = append(out, wrapLine(line, width)...)
+	}
+	return strings.Join(out, "\n")
+}
+
+func wrapLine(line string, width int) []string {
+	var chunks []string
+	limit := width
+	length := visibleLength(line)
+	for length > limit {
+		// Find the byte offset of the rune at the limit; colors take up
+		// no room
+		cut := visibleOffset(line, limit)
+
+		if space := strings.LastIndexByte(line[:cut], ' '); space > 0 {
+			chunks = append(chunks, line[:space])
+			length -= visibleLength(line[:space+1])
+			line = line[space+1:]
+		} else {
+			chunks = append(chunks, line[:cut])
+			length -= limit
+			line = line[cut:]
+		}
+
+		if len(chunks) == 1 {
+			limit = width - utf8.RuneCountInString(WRAP_MARKER)
+		}
+	}
+	chunks = append(chunks, line)
+
+	for i := 1; i < len(chunks); i++ {
+		chunks[i] = WRAP_MARKER + chunks[i]
+	}
+	return chunks
+}